@@ -62,6 +62,34 @@ import (
 type Backend interface {
 	backend.Backend
 	local() // at the moment, no local specific info, so just use a marker function.
+
+	// Apply performs the provided type of update on a locally hosted stack, streaming the engine events to the
+	// given channel.
+	Apply(ctx context.Context, kind apitype.UpdateKind, stack backend.Stack,
+		op backend.UpdateOperation, opts backend.ApplierOptions,
+		events chan<- engine.Event) (*deploy.Plan, engine.ResourceChanges, result.Result)
+
+	// Upgrade migrates a bucket in the legacy layout to the project layout, where every project has its own
+	// namespace of stack names.
+	Upgrade(ctx context.Context) error
+	// Downgrade migrates a bucket in the project layout back to the legacy layout, and keeps it there.
+	Downgrade(ctx context.Context) error
+
+	// GetStackLocks returns the locks held on a stack, including the expired ones.
+	GetStackLocks(ctx context.Context, stackRef backend.StackReference) ([]StackLock, error)
+	// CancelCurrentUpdate breaks the locks held on a stack, so it can be updated again after a crash.
+	CancelCurrentUpdate(ctx context.Context, stackRef backend.StackReference) error
+
+	// CollectGarbage removes the history entries and backups of a stack, or of all stacks if it is nil, that the
+	// retention policy doesn't keep.
+	CollectGarbage(ctx context.Context, stackRef backend.StackReference, policy RetentionPolicy,
+		dryRun bool) (GarbageStats, error)
+
+	// AddStackToPolicyGroup makes a stack a member of a policy group, whose policy packs are then enforced on its
+	// updates instead of the ones of the default policy group.
+	AddStackToPolicyGroup(ctx context.Context, policyGroup string, stackRef backend.StackReference) error
+	// RemoveStackFromPolicyGroup returns a stack of a policy group to the default policy group.
+	RemoveStackFromPolicyGroup(ctx context.Context, policyGroup string, stackRef backend.StackReference) error
 }
 
 type localBackend struct {
@@ -77,20 +105,53 @@ type localBackend struct {
 	mutex  sync.Mutex
 
 	lockID string
+
+	// leases renew the locks held by this backend, by lock path.
+	leases     map[string]*lease
+	leaseMutex sync.Mutex
+
+	// layout is the version of the layout of the bucket's stacks.
+	layout int
+	// recordLayout is whether the layout of the bucket, which is empty, must be recorded with its first stack.
+	recordLayout bool
+
+	// gzip is whether checkpoints are compressed when they are saved.
+	gzip bool
+	// retention is the policy applied to the history and backups of stacks after their updates.
+	retention RetentionPolicy
+
+	// currentProject is the project of the current workspace, if any. Stack names without a project refer to
+	// its stacks.
+	currentProject *workspace.Project
 }
 
 type localBackendReference struct {
-	name tokens.QName
+	name    tokens.QName
+	project tokens.PackageName // the stack's project, empty in the legacy layout.
+	b       *localBackend
 }
 
 func (r localBackendReference) String() string {
-	return string(r.name)
+	// If the project is the current one, we can elide it.
+	if r.project == "" || (r.b.currentProject != nil && r.project == r.b.currentProject.Name) {
+		return string(r.name)
+	}
+	return fmt.Sprintf("%s/%s", r.project, r.name)
 }
 
 func (r localBackendReference) Name() tokens.QName {
 	return r.name
 }
 
+// qualifiedName is the name of the stack within the bucket, which is "<project>/<stack>" in the project layout. The
+// stack's files are stored under this path.
+func (r localBackendReference) qualifiedName() tokens.QName {
+	if r.project == "" {
+		return r.name
+	}
+	return tokens.QName(fmt.Sprintf("%s/%s", r.project, r.name))
+}
+
 func IsFileStateBackendURL(urlstr string) bool {
 	u, err := url.Parse(urlstr)
 	if err != nil {
@@ -151,13 +212,31 @@ func New(d diag.Sink, originalURL string) (Backend, error) {
 		return nil, err
 	}
 
-	return &localBackend{
-		d:           d,
-		originalURL: originalURL,
-		url:         u,
-		bucket:      &wrappedBucket{bucket: bucket},
-		lockID:      lockID.String(),
-	}, nil
+	retention, err := RetentionPolicyFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	// When parsing and stringifying stack references, we take the current project (if present) into account.
+	currentProject, err := workspace.DetectProject()
+	if err != nil || currentProject.Name == "" {
+		currentProject = nil
+	}
+
+	b := &localBackend{
+		d:              d,
+		originalURL:    originalURL,
+		url:            u,
+		bucket:         &wrappedBucket{bucket: bucket},
+		lockID:         lockID.String(),
+		currentProject: currentProject,
+		gzip:           cmdutil.IsTruthy(os.Getenv(GzipEnvVar)),
+		retention:      retention,
+	}
+	if err = b.initLayout(context.TODO()); err != nil {
+		return nil, err
+	}
+	return b, nil
 }
 
 // massageBlobPath takes the path the user provided and converts it to an appropriate form go-cloud
@@ -205,11 +284,16 @@ func massageBlobPath(path string) (string, error) {
 	return FilePathPrefix + path, nil
 }
 
+// Login opens a bucket and stores it as the current backend. Unlike New, it migrates buckets that predate the project
+// layout to it, which is undone with Downgrade.
 func Login(d diag.Sink, url string) (Backend, error) {
 	be, err := New(d, url)
 	if err != nil {
 		return nil, err
 	}
+	if err = be.(*localBackend).upgradeOnLogin(context.TODO()); err != nil {
+		d.Warningf(diag.Message("", "not migrating the backend to project-scoped stacks: %v"), err)
+	}
 	return be, workspace.StoreAccount(be.URL(), workspace.Account{}, true)
 }
 
@@ -232,49 +316,102 @@ func (b *localBackend) StateDir() string {
 	return workspace.BookkeepingDir
 }
 
-func (b *localBackend) GetPolicyPack(ctx context.Context, policyPack string,
-	d diag.Sink) (backend.PolicyPack, error) {
-
-	return nil, fmt.Errorf("File state backend does not support resource policy")
-}
-
-func (b *localBackend) ListPolicyGroups(ctx context.Context, orgName string, _ backend.ContinuationToken) (
-	apitype.ListPolicyGroupsResponse, backend.ContinuationToken, error) {
-	return apitype.ListPolicyGroupsResponse{}, nil, fmt.Errorf("File state backend does not support resource policy")
-}
-
-func (b *localBackend) ListPolicyPacks(ctx context.Context, orgName string, _ backend.ContinuationToken) (
-	apitype.ListPolicyPacksResponse, backend.ContinuationToken, error) {
-	return apitype.ListPolicyPacksResponse{}, nil, fmt.Errorf("File state backend does not support resource policy")
-}
-
 // SupportsOrganizations tells whether a user can belong to multiple organizations in this backend.
 func (b *localBackend) SupportsOrganizations() bool {
 	return false
 }
 
+// localOrganization is the organization of fully qualified stack names. Local stacks don't belong to any
+// organization, so it is the only one accepted.
+const localOrganization = "organization"
+
+// parseStackName splits a stack name into its project and name. In the project layout, stack names may be qualified
+// as "<project>/<stack>" or "organization/<project>/<stack>"; the project is "" if omitted.
+func (b *localBackend) parseStackName(s string) (tokens.PackageName, string, error) {
+	if !b.projectScoped() {
+		if strings.Contains(s, "/") {
+			return "", "", errors.New("stack names may not contain slashes in the legacy layout of this backend; " +
+				"upgrade it to the project layout to use project-scoped stack names")
+		}
+		return "", s, nil
+	}
+
+	split := strings.Split(s, "/")
+	switch len(split) {
+	case 1:
+		return "", split[0], nil
+	case 2:
+		return tokens.PackageName(split[0]), split[1], nil
+	case 3:
+		if split[0] != localOrganization {
+			return "", "", fmt.Errorf("local stacks don't belong to organization '%s'; "+
+				"qualify them as %s/<project>/<stack> or <project>/<stack>", split[0], localOrganization)
+		}
+		return tokens.PackageName(split[1]), split[2], nil
+	default:
+		return "", "", fmt.Errorf("could not parse stack name '%s'", s)
+	}
+}
+
 func (b *localBackend) ParseStackReference(stackRefName string) (backend.StackReference, error) {
-	return localBackendReference{name: tokens.QName(stackRefName)}, nil
+	project, name, err := b.parseStackName(stackRefName)
+	if err != nil {
+		return nil, err
+	}
+
+	// If the provided stack name didn't include the project, infer it from the local environment.
+	if project == "" && b.projectScoped() {
+		if b.currentProject == nil {
+			return nil, fmt.Errorf("no current project found; pass the fully qualified stack name (<project>/%s)", name)
+		}
+		project = b.currentProject.Name
+	}
+
+	return localBackendReference{name: tokens.QName(name), project: project, b: b}, nil
 }
 
 // ValidateStackName verifies the stack name is valid for the local backend. We use the same rules as the
 // httpstate backend.
 func (b *localBackend) ValidateStackName(stackName string) error {
-	if strings.Contains(stackName, "/") {
-		return errors.New("stack names may not contain slashes")
+	project, name, err := b.parseStackName(stackName)
+	if err != nil {
+		return err
+	}
+
+	if project != "" {
+		if err = workspace.ValidateProjectName(string(project)); err != nil {
+			return err
+		}
 	}
 
 	validNameRegex := regexp.MustCompile("^[A-Za-z0-9_.-]{1,100}$")
-	if !validNameRegex.MatchString(stackName) {
+	if !validNameRegex.MatchString(name) {
 		return errors.New("stack names may only contain alphanumeric, hyphens, underscores, or periods")
 	}
 
 	return nil
 }
 
+// getReference converts a stack reference to the local stack reference it must be.
+func (b *localBackend) getReference(stackRef backend.StackReference) (localBackendReference, error) {
+	ref, ok := stackRef.(localBackendReference)
+	if !ok {
+		return localBackendReference{}, fmt.Errorf("bad stack reference type %T", stackRef)
+	}
+	return ref, nil
+}
+
 func (b *localBackend) DoesProjectExist(ctx context.Context, projectName string) (bool, error) {
-	// Local backends don't really have multiple projects, so just return false here.
-	return false, nil
+	// The legacy layout doesn't keep track of projects, so just return false there.
+	if !b.projectScoped() {
+		return false, nil
+	}
+
+	stacks, err := b.getProjectStacks(tokens.PackageName(projectName))
+	if err != nil {
+		return false, err
+	}
+	return len(stacks) > 0, nil
 }
 
 func (b *localBackend) CreateStack(ctx context.Context, stackRef backend.StackReference,
@@ -288,28 +425,42 @@ func (b *localBackend) CreateStack(ctx context.Context, stackRef backend.StackRe
 
 	contract.Requiref(opts == nil, "opts", "local stacks do not support any options")
 
-	stackName := stackRef.Name()
-	if stackName == "" {
+	ref, err := b.getReference(stackRef)
+	if err != nil {
+		return nil, err
+	}
+	if ref.name == "" {
 		return nil, errors.New("invalid empty stack name")
 	}
 
-	if _, _, err := b.getStack(stackName); err == nil {
-		return nil, &backend.StackAlreadyExistsError{StackName: string(stackName)}
+	if _, _, err := b.getStack(ref); err == nil {
+		return nil, &backend.StackAlreadyExistsError{StackName: ref.String()}
 	}
 
 	tags, err := backend.GetEnvironmentTagsForCurrentStack()
 	if err != nil {
 		return nil, fmt.Errorf("getting stack tags: %w", err)
 	}
-	if err = validation.ValidateStackProperties(string(stackName), tags); err != nil {
+	if ref.project != "" {
+		tags[apitype.ProjectNameTag] = string(ref.project)
+	}
+	if err = validation.ValidateStackProperties(string(ref.name), tags); err != nil {
 		return nil, fmt.Errorf("validating stack properties: %w", err)
 	}
 
-	file, err := b.saveStack(stackName, nil, nil)
+	if err = b.ensureLayoutRecorded(ctx); err != nil {
+		return nil, err
+	}
+
+	file, err := b.saveStack(ref, nil, nil)
 	if err != nil {
 		return nil, err
 	}
 
+	if err = b.saveStackMetadata(ref, &stackMetadata{Tags: tags}); err != nil {
+		return nil, err
+	}
+
 	stack := newStack(stackRef, file, nil, b)
 	fmt.Printf("Created stack '%s'\n", stack.Ref())
 
@@ -317,8 +468,11 @@ func (b *localBackend) CreateStack(ctx context.Context, stackRef backend.StackRe
 }
 
 func (b *localBackend) GetStack(ctx context.Context, stackRef backend.StackReference) (backend.Stack, error) {
-	stackName := stackRef.Name()
-	snapshot, path, err := b.getStack(stackName)
+	ref, err := b.getReference(stackRef)
+	if err != nil {
+		return nil, err
+	}
+	snapshot, path, err := b.getStack(ref)
 
 	switch {
 	case gcerrors.Code(err) == gcerrors.NotFound:
@@ -331,26 +485,28 @@ func (b *localBackend) GetStack(ctx context.Context, stackRef backend.StackRefer
 }
 
 func (b *localBackend) ListStacks(
-	ctx context.Context, _ backend.ListStacksFilter, _ backend.ContinuationToken) (
+	ctx context.Context, filter backend.ListStacksFilter, _ backend.ContinuationToken) (
 	[]backend.StackSummary, backend.ContinuationToken, error) {
 	stacks, err := b.getLocalStacks()
 	if err != nil {
 		return nil, nil, err
 	}
 
-	// Note that the provided stack filter is not honored, since fields like
-	// organizations and tags aren't persisted in the local backend.
+	// Note that the organization filter is not honored, since local stacks don't belong to organizations.
 	var results []backend.StackSummary
-	for _, stackName := range stacks {
-		chk, err := b.getCheckpoint(stackName)
+	for _, ref := range stacks {
+		meta, err := b.getStackMetadata(ref)
 		if err != nil {
 			return nil, nil, err
 		}
-		stackRef, err := b.ParseStackReference(string(stackName))
+		if !matchesStackFilter(filter, ref, meta.Tags) {
+			continue
+		}
+		chk, err := b.getCheckpoint(ref)
 		if err != nil {
 			return nil, nil, err
 		}
-		results = append(results, newLocalStackSummary(stackRef, chk))
+		results = append(results, newLocalStackSummary(ref, chk, meta.Tags))
 	}
 
 	return results, nil, nil
@@ -364,8 +520,11 @@ func (b *localBackend) RemoveStack(ctx context.Context, stack backend.Stack, for
 	}
 	defer b.Unlock(ctx, stack.Ref())
 
-	stackName := stack.Ref().Name()
-	snapshot, _, err := b.getStack(stackName)
+	ref, err := b.getReference(stack.Ref())
+	if err != nil {
+		return false, err
+	}
+	snapshot, _, err := b.getStack(ref)
 	if err != nil {
 		return false, err
 	}
@@ -375,7 +534,18 @@ func (b *localBackend) RemoveStack(ctx context.Context, stack backend.Stack, for
 		return true, errors.New("refusing to remove stack because it still contains resources")
 	}
 
-	return false, b.removeStack(stackName)
+	if err = b.removeStack(ref); err != nil {
+		return false, err
+	}
+
+	// Drop the stack from its policy group, so that a new stack of the same name starts in the default one.
+	name := ref.qualifiedName().String()
+	return false, b.renamePolicyGroupStacks(ctx, func(s string) string {
+		if s == name {
+			return ""
+		}
+		return s
+	})
 }
 
 func (b *localBackend) RenameStack(ctx context.Context, stack backend.Stack,
@@ -388,45 +558,72 @@ func (b *localBackend) RenameStack(ctx context.Context, stack backend.Stack,
 	defer b.Unlock(ctx, stack.Ref())
 
 	// Get the current state from the stack to be renamed.
-	stackName := stack.Ref().Name()
-	snap, _, err := b.getStack(stackName)
+	oldRef, err := b.getReference(stack.Ref())
+	if err != nil {
+		return nil, err
+	}
+	snap, _, err := b.getStack(oldRef)
 	if err != nil {
 		return nil, err
 	}
 
-	// Ensure the new stack name is valid.
-	newRef, err := b.ParseStackReference(string(newName))
+	// Ensure the new stack name is valid. A qualified name also moves the stack to another project.
+	parsedRef, err := b.ParseStackReference(string(newName))
+	if err != nil {
+		return nil, err
+	}
+	newRef, err := b.getReference(parsedRef)
 	if err != nil {
 		return nil, err
 	}
 
 	// Ensure the destination stack does not already exist.
-	hasExisting, err := b.bucket.Exists(ctx, b.stackPath(newName))
+	hasExisting, err := b.bucket.Exists(ctx, b.stackPath(newRef))
 	if err != nil {
 		return nil, err
 	}
 	if hasExisting {
-		return nil, fmt.Errorf("a stack named %s already exists", newName)
+		return nil, fmt.Errorf("a stack named %s already exists", newRef)
 	}
 
-	// If we have a snapshot, we need to rename the URNs inside it to use the new stack name.
+	// If we have a snapshot, we need to rename the URNs inside it to use the new stack and project names.
 	if snap != nil {
-		if err = edit.RenameStack(snap, newName, ""); err != nil {
+		var newProject tokens.PackageName
+		if newRef.project != oldRef.project {
+			newProject = newRef.project
+		}
+		if err = edit.RenameStack(snap, newRef.name, newProject); err != nil {
 			return nil, err
 		}
 	}
 
 	// Now save the snapshot with a new name (we pass nil to re-use the existing secrets manager from the snapshot).
-	if _, err = b.saveStack(newName, snap, nil); err != nil {
+	if _, err = b.saveStack(newRef, snap, nil); err != nil {
+		return nil, err
+	}
+
+	// Carry the stack's tags over to its new name.
+	if err = b.renameStackMetadata(oldRef, newRef); err != nil {
+		return nil, err
+	}
+
+	// Keep the stack in its policy group.
+	oldQName, newQName := oldRef.qualifiedName().String(), newRef.qualifiedName().String()
+	if err = b.renamePolicyGroupStacks(ctx, func(s string) string {
+		if s == oldQName {
+			return newQName
+		}
+		return s
+	}); err != nil {
 		return nil, err
 	}
 
 	// To remove the old stack, just make a backup of the file and don't write out anything new.
-	file := b.stackPath(stackName)
+	file := b.stackPath(oldRef)
 	backupTarget(b.bucket, file)
 
 	// And rename the histoy folder as well.
-	if err = b.renameHistory(stackName, newName); err != nil {
+	if err = b.renameHistory(oldRef, newRef); err != nil {
 		return nil, err
 	}
 	return newRef, err
@@ -496,6 +693,15 @@ func (b *localBackend) Watch(ctx context.Context, stack backend.Stack,
 	return backend.Watch(ctx, b, stack, op, b.apply, paths)
 }
 
+// Apply performs the provided type of update on a locally hosted stack, streaming the engine events to the
+// given channel.
+func (b *localBackend) Apply(
+	ctx context.Context, kind apitype.UpdateKind, stack backend.Stack,
+	op backend.UpdateOperation, opts backend.ApplierOptions,
+	events chan<- engine.Event) (*deploy.Plan, engine.ResourceChanges, result.Result) {
+	return b.apply(ctx, kind, stack, op, opts, events)
+}
+
 // apply actually performs the provided type of update on a locally hosted stack.
 func (b *localBackend) apply(
 	ctx context.Context, kind apitype.UpdateKind, stack backend.Stack,
@@ -503,7 +709,10 @@ func (b *localBackend) apply(
 	events chan<- engine.Event) (*deploy.Plan, engine.ResourceChanges, result.Result) {
 
 	stackRef := stack.Ref()
-	stackName := stackRef.Name()
+	ref, err := b.getReference(stackRef)
+	if err != nil {
+		return nil, nil, result.FromError(err)
+	}
 	actionLabel := backend.ActionLabel(kind, opts.DryRun)
 
 	if !(op.Opts.Display.JSONDisplay || op.Opts.Display.Type == display.DisplayWatch) {
@@ -521,8 +730,25 @@ func (b *localBackend) apply(
 		defer b.Unlock(ctx, stack.Ref())
 	}
 
+	// Pick up any changes of the project and vcs tags, as the service does when an update starts.
+	if !opts.DryRun {
+		if err := b.updateEnvironmentTags(ref); err != nil {
+			return nil, nil, result.FromError(fmt.Errorf("updating stack tags: %w", err))
+		}
+	}
+
+	// Enforce the policy packs of the stack's policy group, as the service does. Refreshes only read the state of the
+	// stack's resources, which policies don't apply to, so they don't install and run any policy pack.
+	if kind != apitype.RefreshUpdate {
+		requiredPolicies, err := b.getRequiredPolicies(ctx, ref)
+		if err != nil {
+			return nil, nil, result.FromError(err)
+		}
+		op.Opts.Engine.RequiredPolicies = append(op.Opts.Engine.RequiredPolicies, requiredPolicies...)
+	}
+
 	// Start the update.
-	update, err := b.newUpdate(stackName, op)
+	update, err := b.newUpdate(ref, op)
 	if err != nil {
 		return nil, nil, result.FromError(err)
 	}
@@ -531,7 +757,7 @@ func (b *localBackend) apply(
 	displayEvents := make(chan engine.Event)
 	displayDone := make(chan bool)
 	go display.ShowEvents(
-		strings.ToLower(actionLabel), kind, stackName, op.Proj.Name,
+		strings.ToLower(actionLabel), kind, ref.name, op.Proj.Name,
 		displayEvents, displayDone, op.Opts.Display, opts.DryRun)
 
 	// Create a separate event channel for engine events that we'll pipe to both listening streams.
@@ -554,10 +780,12 @@ func (b *localBackend) apply(
 	}()
 
 	// Create the management machinery.
-	persister := b.newSnapshotPersister(stackName, op.SecretsManager)
+	persister := b.newSnapshotPersister(ref, op.SecretsManager)
 	manager := backend.NewSnapshotManager(persister, update.GetTarget().Snapshot)
+	cancelContext, releaseCancel := b.cancelOnLostLock(ref, scope.Context())
+	defer releaseCancel()
 	engineCtx := &engine.Context{
-		Cancel:          scope.Context(),
+		Cancel:          cancelContext,
 		Events:          engineEvents,
 		SnapshotManager: manager,
 		BackendClient:   backend.NewBackendClient(b),
@@ -616,8 +844,8 @@ func (b *localBackend) apply(
 	var saveErr error
 	var backupErr error
 	if !opts.DryRun {
-		saveErr = b.addToHistory(stackName, info)
-		backupErr = b.backupStack(stackName)
+		saveErr = b.addToHistory(ref, info)
+		backupErr = b.backupStack(ref)
 	}
 
 	if updateRes != nil {
@@ -634,6 +862,11 @@ func (b *localBackend) apply(
 		return plan, changes, result.FromError(fmt.Errorf("saving backup: %w", backupErr))
 	}
 
+	// Drop the history and backups that are no longer retained, now that this update's are saved.
+	if !opts.DryRun {
+		b.collectStackGarbage(ctx, ref)
+	}
+
 	// Make sure to print a link to the stack's checkpoint before exiting.
 	if !op.Opts.Display.SuppressPermalink && opts.ShowLink && !op.Opts.Display.JSONDisplay {
 		// Note we get a real signed link for aws/azure/gcp links.  But no such option exists for
@@ -641,10 +874,10 @@ func (b *localBackend) apply(
 		var link string
 		if strings.HasPrefix(b.url, FilePathPrefix) {
 			u, _ := url.Parse(b.url)
-			u.Path = filepath.ToSlash(path.Join(u.Path, b.stackPath(stackName)))
+			u.Path = filepath.ToSlash(path.Join(u.Path, b.stackPath(ref)))
 			link = u.String()
 		} else {
-			link, err = b.bucket.SignedURL(context.TODO(), b.stackPath(stackName), nil)
+			link, err = b.bucket.SignedURL(context.TODO(), b.stackPath(ref), nil)
 			if err != nil {
 				// set link to be empty to when there is an error to hide use of Permalinks
 				link = ""
@@ -682,8 +915,11 @@ func (b *localBackend) GetHistory(
 	stackRef backend.StackReference,
 	pageSize int,
 	page int) ([]backend.UpdateInfo, error) {
-	stackName := stackRef.Name()
-	updates, err := b.getHistory(stackName, pageSize, page)
+	ref, err := b.getReference(stackRef)
+	if err != nil {
+		return nil, err
+	}
+	updates, err := b.getHistory(ref, pageSize, page)
 	if err != nil {
 		return nil, err
 	}
@@ -693,8 +929,11 @@ func (b *localBackend) GetHistory(
 func (b *localBackend) GetLogs(ctx context.Context, stack backend.Stack, cfg backend.StackConfiguration,
 	query operations.LogQuery) ([]operations.LogEntry, error) {
 
-	stackName := stack.Ref().Name()
-	target, err := b.getTarget(stackName, cfg.Config, cfg.Decrypter)
+	ref, err := b.getReference(stack.Ref())
+	if err != nil {
+		return nil, err
+	}
+	target, err := b.getTarget(ref, cfg.Config, cfg.Decrypter)
 	if err != nil {
 		return nil, err
 	}
@@ -728,8 +967,11 @@ func GetLogsForTarget(target *deploy.Target, query operations.LogQuery) ([]opera
 func (b *localBackend) ExportDeployment(ctx context.Context,
 	stk backend.Stack) (*apitype.UntypedDeployment, error) {
 
-	stackName := stk.Ref().Name()
-	snap, _, err := b.getStack(stackName)
+	ref, err := b.getReference(stk.Ref())
+	if err != nil {
+		return nil, err
+	}
+	snap, _, err := b.getStack(ref)
 	if err != nil {
 		return nil, err
 	}
@@ -763,8 +1005,11 @@ func (b *localBackend) ImportDeployment(ctx context.Context, stk backend.Stack,
 	}
 	defer b.Unlock(ctx, stk.Ref())
 
-	stackName := stk.Ref().Name()
-	_, _, err = b.getStack(stackName)
+	ref, err := b.getReference(stk.Ref())
+	if err != nil {
+		return err
+	}
+	_, _, err = b.getStack(ref)
 	if err != nil {
 		return err
 	}
@@ -774,7 +1019,7 @@ func (b *localBackend) ImportDeployment(ctx context.Context, stk backend.Stack,
 		return err
 	}
 
-	_, err = b.saveStack(stackName, snap, snap.SecretsManager)
+	_, err = b.saveStack(ref, snap, snap.SecretsManager)
 	return err
 }
 
@@ -794,13 +1039,46 @@ func (b *localBackend) CurrentUser() (string, error) {
 	return user.Username, nil
 }
 
-func (b *localBackend) getLocalStacks() ([]tokens.QName, error) {
-	var stacks []tokens.QName
+func (b *localBackend) getLocalStacks() ([]localBackendReference, error) {
+	// In the legacy layout, all the stacks are in the stack directory.
+	if !b.projectScoped() {
+		return b.listStacks(b.stacksDirectory(), "")
+	}
 
-	// Read the stack directory.
-	path := b.stackPath("")
+	// Otherwise, read the project directories.
+	files, err := listBucket(b.bucket, b.stacksDirectory())
+	if err != nil {
+		return nil, fmt.Errorf("error listing projects: %w", err)
+	}
+
+	var stacks []localBackendReference
+	for _, file := range files {
+		// Ignore files, such as the checkpoints of the legacy layout.
+		if !file.IsDir {
+			continue
+		}
+
+		projectStacks, err := b.getProjectStacks(tokens.PackageName(path.Base(file.Key)))
+		if err != nil {
+			return nil, err
+		}
+		stacks = append(stacks, projectStacks...)
+	}
+
+	return stacks, nil
+}
+
+// getProjectStacks returns the stacks of a project in the project layout.
+func (b *localBackend) getProjectStacks(project tokens.PackageName) ([]localBackendReference, error) {
+	return b.listStacks(filepath.Join(b.stacksDirectory(), string(project)), project)
+}
+
+// listStacks returns the stacks whose checkpoints are in the given directory.
+func (b *localBackend) listStacks(dir string, project tokens.PackageName) ([]localBackendReference, error) {
+	var stacks []localBackendReference
+	seen := make(map[tokens.QName]bool)
 
-	files, err := listBucket(b.bucket, path)
+	files, err := listBucket(b.bucket, dir)
 	if err != nil {
 		return nil, fmt.Errorf("error listing stacks: %w", err)
 	}
@@ -812,16 +1090,20 @@ func (b *localBackend) getLocalStacks() ([]tokens.QName, error) {
 		}
 
 		// Skip files without valid extensions (e.g., *.bak files).
-		stackfn := objectName(file)
+		stackfn := strings.TrimSuffix(objectName(file), gzipExt)
 		ext := filepath.Ext(stackfn)
 		if _, has := encoding.Marshalers[ext]; !has {
 			continue
 		}
 
-		// Read in this stack's information.
+		// Read in this stack's information. A stack being compressed, or not, may briefly have two checkpoints.
 		name := tokens.QName(stackfn[:len(stackfn)-len(ext)])
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
 
-		stacks = append(stacks, name)
+		stacks = append(stacks, localBackendReference{name: name, project: project, b: b})
 	}
 
 	return stacks, nil
@@ -831,14 +1113,44 @@ func (b *localBackend) getLocalStacks() ([]tokens.QName, error) {
 func (b *localBackend) GetStackTags(ctx context.Context,
 	stack backend.Stack) (map[apitype.StackTagName]string, error) {
 
-	// The local backend does not currently persist tags.
-	return nil, errors.New("stack tags not supported in --local mode")
+	ref, err := b.getReference(stack.Ref())
+	if err != nil {
+		return nil, err
+	}
+	meta, err := b.getStackMetadata(ref)
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[apitype.StackTagName]string, len(meta.Tags))
+	for k, v := range meta.Tags {
+		tags[k] = v
+	}
+	return tags, nil
 }
 
 // UpdateStackTags updates the stacks's tags, replacing all existing tags.
 func (b *localBackend) UpdateStackTags(ctx context.Context,
 	stack backend.Stack, tags map[apitype.StackTagName]string) error {
 
-	// The local backend does not currently persist tags.
-	return errors.New("stack tags not supported in --local mode")
+	if err := validation.ValidateStackTags(tags); err != nil {
+		return fmt.Errorf("validating stack tags: %w", err)
+	}
+
+	ref, err := b.getReference(stack.Ref())
+	if err != nil {
+		return err
+	}
+
+	err = b.Lock(ctx, stack.Ref())
+	if err != nil {
+		return err
+	}
+	defer b.Unlock(ctx, stack.Ref())
+
+	meta, err := b.getStackMetadata(ref)
+	if err != nil {
+		return err
+	}
+	meta.Tags = tags
+	return b.saveStackMetadata(ref, meta)
 }
@@ -135,7 +135,7 @@ func TestListStacksWithMultiplePassphrases(t *testing.T) {
 	ctx := context.Background()
 
 	// Create stack "a" and import a checkpoint with a secret
-	aStackRef, err := b.ParseStackReference("a")
+	aStackRef, err := b.ParseStackReference("proj/a")
 	assert.NoError(t, err)
 	aStack, err := b.CreateStack(ctx, aStackRef, nil)
 	assert.NoError(t, err)
@@ -154,7 +154,7 @@ func TestListStacksWithMultiplePassphrases(t *testing.T) {
 	assert.NoError(t, err)
 
 	// Create stack "b" and import a checkpoint with a secret
-	bStackRef, err := b.ParseStackReference("b")
+	bStackRef, err := b.ParseStackReference("proj/b")
 	assert.NoError(t, err)
 	bStack, err := b.CreateStack(ctx, bStackRef, nil)
 	assert.NoError(t, err)
@@ -197,10 +197,87 @@ func TestDrillError(t *testing.T) {
 	ctx := context.Background()
 
 	// Get a non-existent stack and expect a nil error because it won't be found.
-	stackRef, err := b.ParseStackReference("dev")
+	stackRef, err := b.ParseStackReference("proj/dev")
 	if err != nil {
 		t.Fatalf("unexpected error %v when parsing stack reference", err)
 	}
 	_, err = b.GetStack(ctx, stackRef)
 	assert.Nil(t, err)
 }
+
+func TestStackTags(t *testing.T) {
+	// Login to a temp dir filestate backend
+	tmpDir, err := ioutil.TempDir("", "filestatebackend")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	b, err := New(cmdutil.Diag(), "file://"+filepath.ToSlash(tmpDir))
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	// Create a tagged stack "a" and an untagged stack "b"
+	aStackRef, err := b.ParseStackReference("proj/a")
+	assert.NoError(t, err)
+	aStack, err := b.CreateStack(ctx, aStackRef, nil)
+	assert.NoError(t, err)
+	err = b.UpdateStackTags(ctx, aStack, map[apitype.StackTagName]string{
+		apitype.ProjectNameTag: "proj",
+		"team":                 "infra",
+	})
+	assert.NoError(t, err)
+	bStackRef, err := b.ParseStackReference("other/b")
+	assert.NoError(t, err)
+	_, err = b.CreateStack(ctx, bStackRef, nil)
+	assert.NoError(t, err)
+
+	tags, err := b.GetStackTags(ctx, aStack)
+	assert.NoError(t, err)
+	assert.Equal(t, map[apitype.StackTagName]string{apitype.ProjectNameTag: "proj", "team": "infra"}, tags)
+
+	// Filter the stacks by tag
+	tagName, tagValue := "team", "infra"
+	stacks, _, err := b.ListStacks(ctx, backend.ListStacksFilter{TagName: &tagName, TagValue: &tagValue}, nil)
+	assert.NoError(t, err)
+	if assert.Len(t, stacks, 1) {
+		assert.Equal(t, "proj/a", stacks[0].Name().String())
+		summary, ok := stacks[0].(StackSummary)
+		assert.True(t, ok)
+		assert.Equal(t, "infra", summary.Tags()["team"])
+	}
+	tagValue = "web"
+	stacks, _, err = b.ListStacks(ctx, backend.ListStacksFilter{TagName: &tagName, TagValue: &tagValue}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, stacks, 0)
+
+	// Filter the stacks by project
+	project := "other"
+	stacks, _, err = b.ListStacks(ctx, backend.ListStacksFilter{Project: &project}, nil)
+	assert.NoError(t, err)
+	if assert.Len(t, stacks, 1) {
+		assert.Equal(t, "other/b", stacks[0].Name().String())
+	}
+
+	// The tags survive a rename and an import
+	renamedRef, err := b.RenameStack(ctx, aStack, "proj/c")
+	assert.NoError(t, err)
+	renamed, err := b.GetStack(ctx, renamedRef)
+	assert.NoError(t, err)
+	deployment, err := makeUntypedDeployment("c", "abc123",
+		"v1:4iF78gb0nF0=:v1:Co6IbTWYs/UdrjgY:FSrAWOFZnj9ealCUDdJL7LrUKXX9BA==")
+	assert.NoError(t, err)
+	err = os.Setenv("PULUMI_CONFIG_PASSPHRASE", "abc123")
+	assert.NoError(t, err)
+	defer os.Unsetenv("PULUMI_CONFIG_PASSPHRASE")
+	err = b.ImportDeployment(ctx, renamed, deployment)
+	assert.NoError(t, err)
+	tags, err = b.GetStackTags(ctx, renamed)
+	assert.NoError(t, err)
+	assert.Equal(t, "infra", tags["team"])
+	_, err = os.Stat(filepath.Join(tmpDir, ".pulumi", "stacks", "proj", "a"+stackMetadataExt))
+	assert.True(t, os.IsNotExist(err))
+
+	// Removing the stack removes its tags
+	_, err = b.RemoveStack(ctx, renamed, true)
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(tmpDir, ".pulumi", "stacks", "proj", "c"+stackMetadataExt))
+	assert.True(t, os.IsNotExist(err))
+}
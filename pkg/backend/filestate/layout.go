@@ -0,0 +1,320 @@
+// Copyright 2016-2022, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"gocloud.dev/gcerrors"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/cmdutil"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
+)
+
+// LegacyLayoutEnvVar creates new buckets in the legacy layout, so that older versions of the CLI can still use them.
+const LegacyLayoutEnvVar = "PULUMI_FILESTATE_LEGACY_LAYOUT"
+
+// The layouts of the stacks of a bucket.
+const (
+	// legacyLayout stores stacks as .pulumi/stacks/<stack>.json, so all the projects share the stack names.
+	legacyLayout = 0
+	// projectLayout stores stacks as .pulumi/stacks/<project>/<stack>.json.
+	projectLayout = 1
+)
+
+// bucketLayout is the content of the file recording the layout of a bucket.
+type bucketLayout struct {
+	Version int `json:"version"`
+}
+
+func (b *localBackend) layoutPath() string {
+	return filepath.Join(b.StateDir(), "layout.json")
+}
+
+// projectScoped returns whether the stack names of the bucket are scoped by project.
+func (b *localBackend) projectScoped() bool {
+	return b.layout >= projectLayout
+}
+
+// initLayout loads the layout of the bucket. Buckets that don't record their layout yet keep the legacy layout until
+// they are logged into or upgraded, as opening a bucket must not move the stacks of other users and tools around. Empty
+// buckets are in the project layout, unless LegacyLayoutEnvVar is set, which they record when their first stack is
+// created.
+func (b *localBackend) initLayout(ctx context.Context) error {
+	byts, err := b.bucket.ReadAll(ctx, b.layoutPath())
+	switch {
+	case err == nil:
+		var layout bucketLayout
+		if err = json.Unmarshal(byts, &layout); err != nil {
+			return fmt.Errorf("unmarshalling bucket layout: %w", err)
+		}
+		if layout.Version > projectLayout {
+			return fmt.Errorf("the bucket layout version %d is newer than this version of the CLI supports; "+
+				"please upgrade it", layout.Version)
+		}
+		b.layout = layout.Version
+		return nil
+	case gcerrors.Code(err) != gcerrors.NotFound:
+		return fmt.Errorf("reading bucket layout: %w", err)
+	}
+
+	b.layout = legacyLayout
+	stacks, err := b.getLocalStacks()
+	if err != nil {
+		return err
+	}
+	if len(stacks) == 0 {
+		if !cmdutil.IsTruthy(os.Getenv(LegacyLayoutEnvVar)) {
+			b.layout = projectLayout
+		}
+		b.recordLayout = true
+	}
+	return nil
+}
+
+// ensureLayoutRecorded records the layout of an empty bucket, before its first stack is created.
+func (b *localBackend) ensureLayoutRecorded(ctx context.Context) error {
+	if !b.recordLayout {
+		return nil
+	}
+	if err := b.writeLayout(ctx, b.layout); err != nil {
+		return err
+	}
+	b.recordLayout = false
+	return nil
+}
+
+func (b *localBackend) writeLayout(ctx context.Context, version int) error {
+	byts, err := json.Marshal(bucketLayout{Version: version})
+	if err != nil {
+		return fmt.Errorf("marshalling bucket layout: %w", err)
+	}
+	if err = b.bucket.WriteAll(ctx, b.layoutPath(), byts, nil); err != nil {
+		return fmt.Errorf("writing bucket layout: %w", err)
+	}
+	return nil
+}
+
+// upgradeOnLogin upgrades a bucket that doesn't record its layout yet, so that buckets are migrated when logging into
+// them. Buckets that record the legacy layout, such as downgraded ones, are left as they are, and so are all buckets
+// when LegacyLayoutEnvVar is set.
+func (b *localBackend) upgradeOnLogin(ctx context.Context) error {
+	if b.projectScoped() || b.recordLayout || cmdutil.IsTruthy(os.Getenv(LegacyLayoutEnvVar)) {
+		return nil
+	}
+	recorded, err := b.bucket.Exists(ctx, b.layoutPath())
+	if err != nil || recorded {
+		return err
+	}
+	return b.Upgrade(ctx)
+}
+
+// Upgrade moves every stack of a bucket in the legacy layout under the directory of its project. The project of a
+// stack is its project tag or else the project of the resources in its checkpoint, so stacks that were neither tagged
+// nor updated must be tagged first.
+func (b *localBackend) Upgrade(ctx context.Context) error {
+	if b.projectScoped() {
+		return b.ensureLayoutRecorded(ctx)
+	}
+
+	stacks, err := b.getLocalStacks()
+	if err != nil {
+		return err
+	}
+
+	// Find the project of every stack before moving any of them.
+	var unknown []string
+	targets := make([]localBackendReference, 0, len(stacks))
+	for _, ref := range stacks {
+		project, err := b.legacyStackProject(ref)
+		if err != nil {
+			return err
+		}
+		if project == "" {
+			unknown = append(unknown, string(ref.name))
+			continue
+		}
+		targets = append(targets, localBackendReference{name: ref.name, project: project, b: b})
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("the project of stack(s) %s is unknown; set it with `pulumi stack tag set %s <project>`",
+			strings.Join(unknown, ", "), apitype.ProjectNameTag)
+	}
+
+	return b.migrate(ctx, stacks, targets, projectLayout)
+}
+
+// Downgrade moves the stacks of a bucket in the project layout back to the legacy layout, which the bucket then keeps
+// until it is upgraded again. Stack names must be unique across projects for that.
+func (b *localBackend) Downgrade(ctx context.Context) error {
+	if !b.projectScoped() {
+		if err := b.writeLayout(ctx, legacyLayout); err != nil {
+			return err
+		}
+		b.recordLayout = false
+		return nil
+	}
+
+	stacks, err := b.getLocalStacks()
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[tokens.QName]localBackendReference)
+	targets := make([]localBackendReference, 0, len(stacks))
+	for _, ref := range stacks {
+		if other, has := seen[ref.name]; has {
+			return fmt.Errorf("stacks %s and %s have the same name; rename one of them first",
+				other.qualifiedName(), ref.qualifiedName())
+		}
+		seen[ref.name] = ref
+		targets = append(targets, localBackendReference{name: ref.name, b: b})
+	}
+
+	return b.migrate(ctx, stacks, targets, legacyLayout)
+}
+
+// legacyStackProject returns the project of a stack of the legacy layout, or "" if it can't be told.
+func (b *localBackend) legacyStackProject(ref localBackendReference) (tokens.PackageName, error) {
+	meta, err := b.getStackMetadata(ref)
+	if err != nil {
+		return "", err
+	}
+	if project := meta.Tags[apitype.ProjectNameTag]; project != "" {
+		return tokens.PackageName(project), nil
+	}
+
+	chk, err := b.getCheckpoint(ref)
+	if err != nil {
+		return "", fmt.Errorf("reading checkpoint of stack %s: %w", ref.name, err)
+	}
+	if chk.Latest != nil && len(chk.Latest.Resources) > 0 {
+		return chk.Latest.Resources[0].URN.Project(), nil
+	}
+	return "", nil
+}
+
+// migrate moves stacks to their references in another layout. The files of the stacks are copied before the new
+// layout is recorded and only removed afterwards, so an interrupted migration leaves the bucket usable in its
+// previous layout and can simply be run again.
+func (b *localBackend) migrate(ctx context.Context, from, to []localBackendReference, layout int) error {
+	contract.Assert(len(from) == len(to))
+
+	// Don't move stacks from under the feet of running updates.
+	for _, ref := range from {
+		if err := b.checkForLock(ctx, ref); err != nil {
+			return err
+		}
+	}
+
+	var moved []string
+	for i := range from {
+		moves, err := b.stackFileMoves(from[i], to[i])
+		if err != nil {
+			return err
+		}
+		for src, dst := range moves {
+			if err = b.bucket.Copy(ctx, dst, src, nil); err != nil {
+				return fmt.Errorf("copying %s to %s: %w", src, dst, err)
+			}
+			moved = append(moved, src)
+		}
+	}
+
+	// The policy groups refer to stacks by their names in the layout.
+	names := make(map[string]string, len(from))
+	for i := range from {
+		names[from[i].qualifiedName().String()] = to[i].qualifiedName().String()
+	}
+	if err := b.renamePolicyGroupStacks(ctx, func(s string) string {
+		if name, has := names[s]; has {
+			return name
+		}
+		return s
+	}); err != nil {
+		return err
+	}
+
+	if err := b.writeLayout(ctx, layout); err != nil {
+		return err
+	}
+	b.layout = layout
+	b.recordLayout = false
+
+	for _, src := range moved {
+		if err := b.bucket.Delete(ctx, src); err != nil {
+			logging.V(5).Infof("error deleting migrated object: %v (%v) skipping", src, err)
+		}
+	}
+	return nil
+}
+
+// stackFileMoves maps the files of a stack, which are its checkpoint and the copies of it (such as its .bak files),
+// metadata, history and backups, to their paths for another reference to the stack.
+func (b *localBackend) stackFileMoves(from, to localBackendReference) (map[string]string, error) {
+	src := b.stackPath(from)
+	dst := b.checkpointPath(to, strings.HasSuffix(src, gzipExt))
+	moves := map[string]string{src: dst}
+
+	copies, err := b.checkpointCopies(path.Dir(filepath.ToSlash(src)))
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range copies[strings.TrimSuffix(path.Base(filepath.ToSlash(src)), gzipExt)] {
+		for _, key := range entry.keys {
+			moves[key] = path.Join(path.Dir(filepath.ToSlash(dst)), path.Base(key))
+		}
+	}
+
+	hasMetadata, err := b.bucket.Exists(context.TODO(), b.stackMetadataPath(from))
+	if err != nil {
+		return nil, err
+	}
+	if hasMetadata {
+		moves[b.stackMetadataPath(from)] = b.stackMetadataPath(to)
+	}
+
+	dirs := [][2]string{
+		{b.historyDirectory(from), b.historyDirectory(to)},
+		{b.backupDirectory(from), b.backupDirectory(to)},
+	}
+	for _, dir := range dirs {
+		files, err := listBucket(b.bucket, dir[0])
+		if err != nil {
+			if gcerrors.Code(err) == gcerrors.NotFound {
+				continue
+			}
+			return nil, err
+		}
+		for _, file := range files {
+			// Directories hold the files of other stacks, such as the ones of a project named like this stack.
+			if file.IsDir {
+				continue
+			}
+			moves[file.Key] = path.Join(filepath.ToSlash(dir[1]), objectName(file))
+		}
+	}
+
+	return moves, nil
+}
@@ -0,0 +1,254 @@
+package filestate
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/cmdutil"
+)
+
+func newTestBackend(t *testing.T, dir string) *localBackend {
+	b, err := New(cmdutil.Diag(), "file://"+filepath.ToSlash(dir))
+	if err != nil {
+		t.Fatalf("Initializing new filestate backend: %v", err)
+	}
+	return b.(*localBackend)
+}
+
+func createTestStack(t *testing.T, b *localBackend, name string) backend.Stack {
+	ref, err := b.ParseStackReference(name)
+	assert.NoError(t, err)
+	stack, err := b.CreateStack(context.Background(), ref, nil)
+	assert.NoError(t, err)
+	return stack
+}
+
+func listTestStacks(t *testing.T, b *localBackend) []string {
+	summaries, _, err := b.ListStacks(context.Background(), backend.ListStacksFilter{}, nil)
+	assert.NoError(t, err)
+	var names []string
+	for _, summary := range summaries {
+		names = append(names, summary.Name().String())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestProjectStackNames(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "filestatebackend")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	t.Setenv("PROJECT_NAME", "")
+	b := newTestBackend(t, tmpDir)
+	assert.True(t, b.projectScoped())
+
+	// Stack names need a project without a current one.
+	_, err = b.ParseStackReference("dev")
+	assert.Error(t, err)
+	_, err = b.ParseStackReference("acme/proj/dev")
+	assert.Error(t, err)
+	assert.Error(t, b.ValidateStackName("proj/dev/extra/parts"))
+	assert.NoError(t, b.ValidateStackName("organization/proj/dev"))
+
+	// Two projects may have a stack of the same name.
+	createTestStack(t, b, "proj/dev")
+	createTestStack(t, b, "organization/other/dev")
+	assert.Equal(t, []string{"other/dev", "proj/dev"}, listTestStacks(t, b))
+	assert.FileExists(t, filepath.Join(tmpDir, ".pulumi", "stacks", "proj", "dev.json"))
+	assert.FileExists(t, filepath.Join(tmpDir, ".pulumi", "stacks", "other", "dev.json"))
+
+	exists, err := b.DoesProjectExist(context.Background(), "proj")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	exists, err = b.DoesProjectExist(context.Background(), "missing")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	// The project of the current workspace is the default one, and is elided.
+	t.Setenv("PROJECT_NAME", "proj")
+	b = newTestBackend(t, tmpDir)
+	ref, err := b.ParseStackReference("dev")
+	assert.NoError(t, err)
+	assert.Equal(t, "dev", ref.String())
+	assert.Equal(t, tokens.PackageName("proj"), ref.(localBackendReference).project)
+	assert.Equal(t, []string{"dev", "other/dev"}, listTestStacks(t, b))
+}
+
+func TestUpgradeLegacyLayout(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "filestatebackend")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	t.Setenv("PROJECT_NAME", "")
+	ctx := context.Background()
+
+	// Create a bucket in the legacy layout with a stack of each way to tell its project.
+	t.Setenv(LegacyLayoutEnvVar, "true")
+	b := newTestBackend(t, tmpDir)
+	assert.False(t, b.projectScoped())
+	_, err = b.ParseStackReference("proj/a")
+	assert.Error(t, err)
+
+	aStack := createTestStack(t, b, "a")
+	deployment, err := makeUntypedDeployment("a", "abc123",
+		"v1:4iF78gb0nF0=:v1:Co6IbTWYs/UdrjgY:FSrAWOFZnj9ealCUDdJL7LrUKXX9BA==")
+	assert.NoError(t, err)
+	t.Setenv("PULUMI_CONFIG_PASSPHRASE", "abc123")
+	assert.NoError(t, b.ImportDeployment(ctx, aStack, deployment))
+	aRef, err := b.getReference(aStack.Ref())
+	assert.NoError(t, err)
+	assert.NoError(t, b.addToHistory(aRef, backend.UpdateInfo{Kind: apitype.UpdateUpdate}))
+
+	bStack := createTestStack(t, b, "b")
+	assert.NoError(t, b.UpdateStackTags(ctx, bStack, map[apitype.StackTagName]string{
+		apitype.ProjectNameTag: "other",
+	}))
+
+	// The project of a stack that was neither updated nor tagged is unknown, so the bucket stays as it is.
+	cStack := createTestStack(t, b, "c")
+	t.Setenv(LegacyLayoutEnvVar, "")
+	b = newTestBackend(t, tmpDir)
+	assert.False(t, b.projectScoped())
+	assert.Error(t, b.Upgrade(ctx))
+	assert.False(t, b.projectScoped())
+	assert.Equal(t, []string{"a", "b", "c"}, listTestStacks(t, b))
+
+	// Once it is tagged, the bucket can be upgraded, but opening it doesn't do so.
+	assert.NoError(t, b.UpdateStackTags(ctx, cStack, map[apitype.StackTagName]string{
+		apitype.ProjectNameTag: "proj",
+	}))
+	b = newTestBackend(t, tmpDir)
+	assert.False(t, b.projectScoped())
+	assert.FileExists(t, filepath.Join(tmpDir, ".pulumi", "stacks", "a.json"))
+	assert.NoError(t, b.Upgrade(ctx))
+	b = newTestBackend(t, tmpDir)
+	assert.True(t, b.projectScoped())
+	assert.Equal(t, []string{"other/b", "proj/a", "proj/c"}, listTestStacks(t, b))
+	assert.NoFileExists(t, filepath.Join(tmpDir, ".pulumi", "stacks", "a.json"))
+	assert.NoFileExists(t, filepath.Join(tmpDir, ".pulumi", "stacks", "b.meta"))
+
+	ref, err := b.ParseStackReference("proj/a")
+	assert.NoError(t, err)
+	history, err := b.GetHistory(ctx, ref, 0, 0)
+	assert.NoError(t, err)
+	assert.Len(t, history, 1)
+	stack, err := b.GetStack(ctx, ref)
+	assert.NoError(t, err)
+	if assert.NotNil(t, stack) {
+		snap, err := stack.Snapshot(ctx)
+		assert.NoError(t, err)
+		assert.Len(t, snap.Resources, 1)
+	}
+
+	// Downgrading moves the stacks back, and keeps the bucket in the legacy layout.
+	assert.NoError(t, b.Downgrade(ctx))
+	b = newTestBackend(t, tmpDir)
+	assert.False(t, b.projectScoped())
+	assert.Equal(t, []string{"a", "b", "c"}, listTestStacks(t, b))
+	ref, err = b.ParseStackReference("a")
+	assert.NoError(t, err)
+	history, err = b.GetHistory(ctx, ref, 0, 0)
+	assert.NoError(t, err)
+	assert.Len(t, history, 1)
+	tags, err := b.GetStackTags(ctx, bStack)
+	assert.NoError(t, err)
+	assert.Equal(t, "other", tags[apitype.ProjectNameTag])
+}
+
+func TestLoginUpgradesLegacyLayout(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "filestatebackend")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	t.Setenv("PROJECT_NAME", "")
+	t.Setenv("PULUMI_HOME", t.TempDir())
+	ctx := context.Background()
+	url := "file://" + filepath.ToSlash(tmpDir)
+	stacksDir := filepath.Join(tmpDir, ".pulumi", "stacks")
+
+	t.Setenv(LegacyLayoutEnvVar, "true")
+	b := newTestBackend(t, tmpDir)
+	stack := createTestStack(t, b, "dev")
+	assert.NoError(t, b.UpdateStackTags(ctx, stack, map[apitype.StackTagName]string{
+		apitype.ProjectNameTag: "proj",
+	}))
+	assert.NoError(t, os.Remove(filepath.Join(tmpDir, ".pulumi", "layout.json")))
+	for _, name := range []string{"dev.json.bak", "dev.json.gz.bak"} {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(stacksDir, name), []byte("{}"), 0600))
+	}
+
+	// Logging in keeps the legacy layout when asked to.
+	be, err := Login(cmdutil.Diag(), url)
+	assert.NoError(t, err)
+	assert.False(t, be.(*localBackend).projectScoped())
+
+	// Otherwise it migrates the bucket, along with the copies of the checkpoints, while opening it doesn't.
+	t.Setenv(LegacyLayoutEnvVar, "")
+	assert.False(t, newTestBackend(t, tmpDir).projectScoped())
+	be, err = Login(cmdutil.Diag(), url)
+	assert.NoError(t, err)
+	b = be.(*localBackend)
+	assert.True(t, b.projectScoped())
+	assert.Equal(t, []string{"proj/dev"}, listTestStacks(t, b))
+	for _, name := range []string{"dev.json.bak", "dev.json.gz.bak"} {
+		assert.FileExists(t, filepath.Join(stacksDir, "proj", name))
+		assert.NoFileExists(t, filepath.Join(stacksDir, name))
+	}
+
+	// Downgrading moves them back, and logging in again keeps the bucket downgraded.
+	assert.NoError(t, b.Downgrade(ctx))
+	for _, name := range []string{"dev.json.bak", "dev.json.gz.bak"} {
+		assert.FileExists(t, filepath.Join(stacksDir, name))
+		assert.NoFileExists(t, filepath.Join(stacksDir, "proj", name))
+	}
+	be, err = Login(cmdutil.Diag(), url)
+	assert.NoError(t, err)
+	assert.False(t, be.(*localBackend).projectScoped())
+	assert.Equal(t, []string{"dev"}, listTestStacks(t, be.(*localBackend)))
+}
+
+func TestEmptyBucketLayout(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "filestatebackend")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	t.Setenv("PROJECT_NAME", "")
+
+	// Opening an empty bucket writes nothing; its layout is recorded with its first stack.
+	b := newTestBackend(t, tmpDir)
+	assert.True(t, b.projectScoped())
+	assert.NoFileExists(t, filepath.Join(tmpDir, ".pulumi", "layout.json"))
+	createTestStack(t, b, "proj/dev")
+	assert.FileExists(t, filepath.Join(tmpDir, ".pulumi", "layout.json"))
+
+	// Unless asked otherwise, they are in the legacy layout.
+	legacyDir := filepath.Join(tmpDir, "legacy")
+	assert.NoError(t, os.MkdirAll(legacyDir, 0700))
+	t.Setenv(LegacyLayoutEnvVar, "true")
+	b = newTestBackend(t, legacyDir)
+	assert.False(t, b.projectScoped())
+	createTestStack(t, b, "dev")
+	t.Setenv(LegacyLayoutEnvVar, "")
+	b = newTestBackend(t, legacyDir)
+	assert.False(t, b.projectScoped())
+}
+
+func TestDowngradeNameCollision(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "filestatebackend")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	t.Setenv("PROJECT_NAME", "")
+	b := newTestBackend(t, tmpDir)
+
+	createTestStack(t, b, "proj/dev")
+	createTestStack(t, b, "other/dev")
+	assert.Error(t, b.Downgrade(context.Background()))
+	assert.True(t, b.projectScoped())
+	assert.Equal(t, []string{"other/dev", "proj/dev"}, listTestStacks(t, b))
+}
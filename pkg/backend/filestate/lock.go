@@ -15,31 +15,59 @@
 package filestate
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
 	"os/user"
 	"path"
+	"path/filepath"
+	"strings"
 	"time"
 
+	"cloud.google.com/go/storage"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/gofrs/uuid"
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/azureblob"
+	"gocloud.dev/blob/gcsblob"
+	"gocloud.dev/gcerrors"
+	"google.golang.org/api/googleapi"
+
 	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/pkg/v3/util/cancel"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/diag"
-	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/fsutil"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
 )
 
+// lockLeaseDuration is how long a lock stays valid unless its owner renews it. Owners renew their locks three times
+// per lease, so only the locks of crashed processes expire.
+var lockLeaseDuration = 5 * time.Minute
+
+// leaseFile is the lock of a stack in buckets supporting conditional writes. Other buckets have a lock per backend.
+const leaseFile = "lease.json"
+
 type lockContent struct {
 	Pid       int       `json:"pid"`
 	Username  string    `json:"username"`
 	Hostname  string    `json:"hostname"`
 	Timestamp time.Time `json:"timestamp"`
+	// ID identifies the backend holding the lock.
+	ID string `json:"id,omitempty"`
+	// Expires is when the lease on the lock ends. Locks written by older versions of the CLI have none, and never
+	// expire.
+	Expires time.Time `json:"expires,omitempty"`
 }
 
-func newLockContent() (*lockContent, error) {
+func newLockContent(id string) (*lockContent, error) {
 	u, err := user.Current()
 	if err != nil {
 		return nil, err
@@ -48,53 +76,206 @@ func newLockContent() (*lockContent, error) {
 	if err != nil {
 		return nil, err
 	}
+	now := time.Now()
 	return &lockContent{
 		Pid:       os.Getpid(),
 		Username:  u.Username,
 		Hostname:  hostname,
-		Timestamp: time.Now(),
+		Timestamp: now,
+		ID:        id,
+		Expires:   now.Add(lockLeaseDuration),
 	}, nil
 }
 
-// checkForLock looks for any existing locks for this stack, and returns a helpful diagnostic if there is one.
-func (b *localBackend) checkForLock(ctx context.Context, stackRef backend.StackReference) error {
-	allFiles, err := listBucket(b.bucket, stackLockDir(stackRef.Name()))
+// StackLock is a lock held on a stack of the filestate backend.
+type StackLock struct {
+	URL       string    // the location of the lock.
+	Pid       int       // the process holding the lock.
+	Username  string    // the user running the process.
+	Hostname  string    // the host running the process.
+	Timestamp time.Time // when the lock was taken.
+	Expires   time.Time // when the lease on the lock ends, or zero if it never does.
+
+	key     string       // the key of the lock in the bucket.
+	content *lockContent // the content of the lock, as read.
+	raw     []byte       // the content of the lock, as stored.
+	version lockVersion  // the version of the lock, as read.
+}
+
+// lockVersion is the version of a lock in a GCS or Azure bucket, which conditional writes and deletes of the lock
+// must match.
+type lockVersion struct {
+	generation int64       // the generation of a GCS object.
+	etag       azblob.ETag // the ETag of an Azure blob.
+}
+
+// ifMatch makes a write of a GCS or Azure bucket fail if the object is not at this version.
+func (v lockVersion) ifMatch(asFunc func(interface{}) bool) error {
+	var object **storage.ObjectHandle
+	if v.generation != 0 && asFunc(&object) {
+		*object = (*object).If(storage.Conditions{GenerationMatch: v.generation})
+		return nil
+	}
+	var opts *azblob.UploadStreamToBlockBlobOptions
+	if v.etag != azblob.ETagNone && asFunc(&opts) {
+		opts.AccessConditions.ModifiedAccessConditions.IfMatch = v.etag
+		return nil
+	}
+	return errors.New("the version of the lock is unknown")
+}
+
+func (l StackLock) String() string {
+	s := fmt.Sprintf("%v: created by %v@%v (pid %v) at %v",
+		l.URL, l.Username, l.Hostname, l.Pid, l.Timestamp.Format(time.RFC3339))
+	if !l.Expires.IsZero() {
+		s += fmt.Sprintf(", lease ends at %v", l.Expires.Format(time.RFC3339))
+	}
+	return s
+}
+
+// Expired returns whether the lease on the lock has ended.
+func (l StackLock) Expired() bool {
+	return !l.Expires.IsZero() && time.Now().After(l.Expires)
+}
+
+// GetStackLocks returns the locks held on a stack, including the ones whose lease has ended.
+func (b *localBackend) GetStackLocks(ctx context.Context, stackRef backend.StackReference) ([]StackLock, error) {
+	ref, err := b.getReference(stackRef)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	allFiles, err := listBucket(b.bucket, stackLockDir(ref))
+	if err != nil {
+		return nil, err
 	}
 
-	var lockKeys []string
+	var locks []StackLock
 	for _, file := range allFiles {
-		if file.IsDir {
+		// Skip the temporary files of locks being created.
+		if file.IsDir || path.Ext(file.Key) != ".json" {
 			continue
 		}
-		if file.Key != b.lockPath(stackRef.Name()) {
-			lockKeys = append(lockKeys, file.Key)
+		l, err := b.readLock(ctx, file.Key)
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			// The lock was released since listing them.
+			continue
+		}
+		if err != nil {
+			return nil, err
 		}
+		locks = append(locks, *l)
 	}
+	return locks, nil
+}
 
-	if len(lockKeys) > 0 {
-		errorString := fmt.Sprintf("the stack is currently locked by %v lock(s). Either wait for the other "+
-			"process(es) to end or manually delete the lock file(s).", len(lockKeys))
+func (b *localBackend) readLock(ctx context.Context, key string) (*StackLock, error) {
+	r, err := b.bucket.NewReader(ctx, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer contract.IgnoreClose(r)
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	l := &lockContent{}
+	if err = json.Unmarshal(content, &l); err != nil {
+		return nil, err
+	}
 
-		for _, lock := range lockKeys {
-			content, err := b.bucket.ReadAll(ctx, lock)
-			if err != nil {
-				return err
-			}
-			l := &lockContent{}
-			err = json.Unmarshal(content, &l)
-			if err != nil {
-				return err
-			}
+	var version lockVersion
+	var gcsReader *storage.Reader
+	var azureResponse azblob.DownloadResponse
+	switch {
+	case r.As(&gcsReader):
+		version.generation = gcsReader.Attrs.Generation
+	case r.As(&azureResponse):
+		version.etag = azureResponse.ETag()
+	}
+	return &StackLock{
+		URL:       b.url + "/" + key,
+		Pid:       l.Pid,
+		Username:  l.Username,
+		Hostname:  l.Hostname,
+		Timestamp: l.Timestamp,
+		Expires:   l.Expires,
+		key:       key,
+		content:   l,
+		raw:       content,
+		version:   version,
+	}, nil
+}
+
+// CancelCurrentUpdate breaks the locks held on a stack, whether their owners are still running or not. The owners
+// of live locks find out when renewing their lease.
+func (b *localBackend) CancelCurrentUpdate(ctx context.Context, stackRef backend.StackReference) error {
+	locks, err := b.GetStackLocks(ctx, stackRef)
+	if err != nil {
+		return err
+	}
+	if len(locks) == 0 {
+		return fmt.Errorf("stack '%s' is not locked", stackRef)
+	}
+	for _, l := range locks {
+		if err = b.bucket.Delete(ctx, l.key); err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+			return fmt.Errorf("deleting lock %v: %w", l.URL, err)
+		}
+	}
+	return nil
+}
+
+// otherLocks returns the live locks on a stack held by other backends. Expired locks are broken along the way.
+func (b *localBackend) otherLocks(ctx context.Context, ref localBackendReference) ([]StackLock, error) {
+	locks, err := b.GetStackLocks(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	var live []StackLock
+	for _, l := range locks {
+		if l.content.ID == b.lockID {
+			continue
+		}
+		if l.Expired() {
+			b.breakExpiredLock(ctx, l)
+			continue
+		}
+		live = append(live, l)
+	}
+	return live, nil
+}
+
+// breakExpiredLock deletes an expired lock, unless it was renewed or taken by someone else since it was read.
+func (b *localBackend) breakExpiredLock(ctx context.Context, l StackLock) {
+	logging.V(5).Infof("breaking expired lock %v", l)
+	broken, err := b.replaceLock(ctx, &l, nil)
+	switch {
+	case err != nil:
+		logging.V(5).Infof("error deleting expired lock: %v (%v) skipping", l.key, err)
+	case !broken:
+		logging.V(5).Infof("expired lock %v changed since it was read, skipping", l.key)
+	}
+}
+
+// checkForLock looks for any existing locks for this stack, and returns a helpful diagnostic if there is one.
+func (b *localBackend) checkForLock(ctx context.Context, stackRef backend.StackReference) error {
+	ref, err := b.getReference(stackRef)
+	if err != nil {
+		return err
+	}
+
+	locks, err := b.otherLocks(ctx, ref)
+	if err != nil {
+		return err
+	}
 
-			errorString += fmt.Sprintf("\n  %v: created by %v@%v (pid %v) at %v",
-				b.url+"/"+lock,
-				l.Username,
-				l.Hostname,
-				l.Pid,
-				l.Timestamp.Format(time.RFC3339),
-			)
+	if len(locks) > 0 {
+		errorString := fmt.Sprintf("the stack is currently locked by %v lock(s). Either wait for the other "+
+			"process(es) to end or run `pulumi cancel` to break the lock(s).", len(locks))
+
+		for _, l := range locks {
+			errorString += fmt.Sprintf("\n  %v", l)
 		}
 
 		return errors.New(errorString)
@@ -103,12 +284,11 @@ func (b *localBackend) checkForLock(ctx context.Context, stackRef backend.StackR
 }
 
 func (b *localBackend) Lock(ctx context.Context, stackRef backend.StackReference) error {
-	//
-	err := b.checkForLock(ctx, stackRef)
+	ref, err := b.getReference(stackRef)
 	if err != nil {
 		return err
 	}
-	lockContent, err := newLockContent()
+	lockContent, err := newLockContent(b.lockID)
 	if err != nil {
 		return err
 	}
@@ -116,38 +296,406 @@ func (b *localBackend) Lock(ctx context.Context, stackRef backend.StackReference
 	if err != nil {
 		return err
 	}
-	err = b.bucket.WriteAll(ctx, b.lockPath(stackRef.Name()), content, nil)
+
+	created, err := b.createLock(ctx, b.lockPath(ref), content)
 	if err != nil {
 		return err
 	}
+	if !created {
+		// The stack is locked, but its lease may have expired, in which case the lock was just broken.
+		if err = b.checkForLock(ctx, stackRef); err != nil {
+			return err
+		}
+		if created, err = b.createLock(ctx, b.lockPath(ref), content); err != nil {
+			return err
+		}
+		if !created {
+			return b.checkForLock(ctx, stackRef)
+		}
+	}
+
+	// Older versions of the CLI, and buckets without conditional writes, lock stacks with a file per backend, so
+	// look for those too.
 	err = b.checkForLock(ctx, stackRef)
 	if err != nil {
 		b.Unlock(ctx, stackRef)
 		return err
 	}
+
+	b.startLease(ref)
 	return nil
 }
 
 func (b *localBackend) Unlock(ctx context.Context, stackRef backend.StackReference) {
-	err := b.bucket.Delete(ctx, b.lockPath(stackRef.Name()))
-	if err != nil {
+	// The stack was locked with the same reference, so it must be a local one.
+	ref, err := b.getReference(stackRef)
+	contract.AssertNoError(err)
+
+	b.stopLease(ref)
+
+	// Don't delete the lock of another backend, if ours was broken.
+	l, err := b.readLock(ctx, b.lockPath(ref))
+	if err == nil {
+		if l.content.ID != b.lockID {
+			return
+		}
+		_, err = b.replaceLock(ctx, l, nil)
+	}
+	if err != nil && gcerrors.Code(err) != gcerrors.NotFound {
 		b.d.Errorf(
 			diag.Message("", "there was a problem deleting the lock at %v, manual clean up may be required: %v"),
-			path.Join(b.url, b.lockPath(stackRef.Name())),
+			path.Join(b.url, b.lockPath(ref)),
 			err)
 	}
 }
 
+// lease renews the lock on a stack until it is stopped, or until the lock is lost.
+type lease struct {
+	stop chan struct{}
+	done chan struct{}
+	lost chan struct{}
+}
+
+func (b *localBackend) startLease(ref localBackendReference) {
+	l := &lease{stop: make(chan struct{}), done: make(chan struct{}), lost: make(chan struct{})}
+	b.leaseMutex.Lock()
+	if b.leases == nil {
+		b.leases = make(map[string]*lease)
+	}
+	b.leases[b.lockPath(ref)] = l
+	b.leaseMutex.Unlock()
+
+	go func() {
+		defer close(l.done)
+		ticker := time.NewTicker(lockLeaseDuration / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-l.stop:
+				return
+			case <-ticker.C:
+				if err := b.renewLease(ref); err != nil {
+					b.d.Errorf(diag.Message("", "the lock on stack %s was lost, canceling the update: %v"), ref, err)
+					close(l.lost)
+					return
+				}
+			}
+		}
+	}()
+}
+
+func (b *localBackend) stopLease(ref localBackendReference) {
+	b.leaseMutex.Lock()
+	l, has := b.leases[b.lockPath(ref)]
+	delete(b.leases, b.lockPath(ref))
+	b.leaseMutex.Unlock()
+
+	if has {
+		close(l.stop)
+		<-l.done
+	}
+}
+
+// cancelOnLostLock returns a cancellation context that is canceled or terminated along with c, and also canceled when
+// the lease on the lock of a stack is lost, since another process may be updating the stack then. The returned
+// function releases the context.
+func (b *localBackend) cancelOnLostLock(ref localBackendReference, c *cancel.Context) (*cancel.Context, func()) {
+	// Stacks that aren't locked, as in previews, have no lease and so a nil channel, which never receives.
+	var lost chan struct{}
+	b.leaseMutex.Lock()
+	if l, has := b.leases[b.lockPath(ref)]; has {
+		lost = l.lost
+	}
+	b.leaseMutex.Unlock()
+
+	cancelContext, cancelSource := cancel.NewContext(context.Background())
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-lost:
+		case <-c.Canceled():
+		case <-done:
+			return
+		}
+		cancelSource.Cancel()
+
+		select {
+		case <-c.Terminated():
+			cancelSource.Terminate()
+		case <-done:
+		}
+	}()
+	return cancelContext, func() { close(done) }
+}
+
+// errLockBroken is returned when renewing the lease on a lock that another process broke.
+var errLockBroken = errors.New("it was broken by another process, possibly with `pulumi cancel`")
+
+// renewLease extends the lease on the lock of a stack, unless the lock was broken.
+func (b *localBackend) renewLease(ref localBackendReference) error {
+	ctx := context.TODO()
+	l, err := b.readLock(ctx, b.lockPath(ref))
+	if gcerrors.Code(err) == gcerrors.NotFound || (err == nil && l.content.ID != b.lockID) {
+		return errLockBroken
+	}
+	if err != nil {
+		return err
+	}
+
+	l.content.Expires = time.Now().Add(lockLeaseDuration)
+	content, err := json.Marshal(l.content)
+	if err != nil {
+		return err
+	}
+	renewed, err := b.replaceLock(ctx, l, content)
+	if err != nil {
+		return err
+	}
+	if !renewed {
+		return errLockBroken
+	}
+	return nil
+}
+
+// conditionalLocks returns whether the bucket can create a lock only if there is none yet, and replace or delete a
+// lock only if it didn't change since it was read. S3 can't, so S3 buckets keep a lock per backend: two processes
+// locking a stack at the same time may then both fail, and an expired lock renewed just as it is broken is lost.
+func (b *localBackend) conditionalLocks() bool {
+	u, err := url.Parse(b.url)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "file", gcsblob.Scheme, azureblob.Scheme:
+		return true
+	default:
+		return false
+	}
+}
+
+// createLock writes a lock unless one already exists at the key, which it reports by returning false. Buckets without
+// conditional writes just write the lock, since their locks are per backend.
+func (b *localBackend) createLock(ctx context.Context, key string, content []byte) (bool, error) {
+	if !b.conditionalLocks() {
+		return true, b.bucket.WriteAll(ctx, key, content, nil)
+	}
+
+	if strings.HasPrefix(b.url, FilePathPrefix) {
+		return createLocalLock(b.url, key, content)
+	}
+
+	err := b.bucket.WriteAll(ctx, key, content, &blob.WriterOptions{BeforeWrite: ifNotExist})
+	switch {
+	case lockChanged(err):
+		return false, nil
+	case err != nil:
+		return false, err
+	default:
+		return true, nil
+	}
+}
+
+// replaceLock overwrites a lock with content, or deletes it if content is nil, unless the lock changed since it was
+// read, which it reports by returning false. Buckets without conditional writes can only check that the lock didn't
+// change just before replacing it.
+func (b *localBackend) replaceLock(ctx context.Context, l *StackLock, content []byte) (bool, error) {
+	if !b.conditionalLocks() {
+		current, err := b.readLock(ctx, l.key)
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if !bytes.Equal(current.raw, l.raw) {
+			return false, nil
+		}
+		if content == nil {
+			return true, b.bucket.Delete(ctx, l.key)
+		}
+		return true, b.bucket.WriteAll(ctx, l.key, content, nil)
+	}
+
+	if strings.HasPrefix(b.url, FilePathPrefix) {
+		return replaceLocalLock(b.url, l.key, l.raw, content)
+	}
+
+	var err error
+	if content == nil {
+		err = b.deleteLock(ctx, l)
+	} else {
+		err = b.bucket.WriteAll(ctx, l.key, content, &blob.WriterOptions{BeforeWrite: l.version.ifMatch})
+	}
+	switch {
+	case lockChanged(err):
+		return false, nil
+	case err != nil:
+		return false, err
+	default:
+		return true, nil
+	}
+}
+
+// deleteLock deletes a lock of a GCS or Azure bucket unless it changed since it was read. Go CDK can't delete objects
+// conditionally, so this uses the clients of the buckets, with the keys of the objects in the buckets.
+func (b *localBackend) deleteLock(ctx context.Context, l *StackLock) error {
+	u, err := url.Parse(b.url)
+	if err != nil {
+		return err
+	}
+	key := path.Join(strings.Trim(u.Path, "/"), l.key)
+
+	var client *storage.Client
+	var container *azblob.ContainerURL
+	switch {
+	case l.version.generation != 0 && b.bucket.As(&client):
+		object := client.Bucket(u.Host).Object(key)
+		return object.If(storage.Conditions{GenerationMatch: l.version.generation}).Delete(ctx)
+	case l.version.etag != azblob.ETagNone && b.bucket.As(&container):
+		_, err = container.NewBlockBlobURL(key).Delete(ctx, azblob.DeleteSnapshotsOptionInclude,
+			azblob.BlobAccessConditions{ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfMatch: l.version.etag}})
+		return err
+	default:
+		return errors.New("the version of the lock is unknown")
+	}
+}
+
+// lockChanged returns whether a conditional write or delete of a lock failed because the lock exists, or because it
+// changed or is gone since it was read.
+func lockChanged(err error) bool {
+	var gerr *googleapi.Error
+	var serr azblob.StorageError
+	switch {
+	case err == nil:
+		return false
+	case gcerrors.Code(err) == gcerrors.FailedPrecondition, gcerrors.Code(err) == gcerrors.NotFound:
+		return true
+	case errors.Is(err, storage.ErrObjectNotExist):
+		return true
+	case errors.As(err, &gerr):
+		return gerr.Code == http.StatusPreconditionFailed
+	case errors.As(err, &serr):
+		switch serr.ServiceCode() {
+		case azblob.ServiceCodeConditionNotMet, azblob.ServiceCodeBlobAlreadyExists, azblob.ServiceCodeBlobNotFound:
+			return true
+		}
+	}
+	return false
+}
+
+// ifNotExist makes a write of a GCS or Azure bucket fail if the object exists.
+func ifNotExist(asFunc func(interface{}) bool) error {
+	var object **storage.ObjectHandle
+	if asFunc(&object) {
+		*object = (*object).If(storage.Conditions{DoesNotExist: true})
+		return nil
+	}
+	var opts *azblob.UploadStreamToBlockBlobOptions
+	if asFunc(&opts) {
+		opts.AccessConditions.ModifiedAccessConditions.IfNoneMatch = azblob.ETagAny
+		return nil
+	}
+	return errors.New("the bucket does not support conditional writes")
+}
+
+// localLockFile returns the file of a lock in a file:// bucket.
+func localLockFile(bucketURL, key string) (string, error) {
+	u, err := url.Parse(bucketURL)
+	if err != nil {
+		return "", err
+	}
+	// Like fileblob, drop the leading slash of Windows paths such as /C:/foo.
+	root := u.Path
+	if os.PathSeparator != '/' {
+		root = strings.TrimPrefix(root, "/")
+	}
+	return filepath.Join(filepath.FromSlash(root), filepath.FromSlash(key)), nil
+}
+
+// createLocalLock creates a lock in a file:// bucket by linking a complete temporary file to it, which fails if it
+// already exists.
+func createLocalLock(bucketURL, key string, content []byte) (bool, error) {
+	file, err := localLockFile(bucketURL, key)
+	if err != nil {
+		return false, err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(file), 0777); err != nil {
+		return false, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "*.tmp")
+	if err != nil {
+		return false, err
+	}
+	defer func() { contract.IgnoreError(os.Remove(tmp.Name())) }()
+	_, err = tmp.Write(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, err
+	}
+
+	err = os.Link(tmp.Name(), file)
+	if os.IsExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// replaceLocalLock replaces a lock in a file:// bucket with content, or deletes it if content is nil, unless the lock
+// changed since it was read. Only one process can claim the lock by renaming it, so the lock can be checked and then
+// replaced or deleted safely. A lock claimed by mistake is put back unless another one was created meanwhile, and
+// its owner then finds out it was lost when renewing its lease.
+func replaceLocalLock(bucketURL, key string, read, content []byte) (bool, error) {
+	file, err := localLockFile(bucketURL, key)
+	if err != nil {
+		return false, err
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		return false, err
+	}
+
+	claim := file + "." + id.String() + ".tmp"
+	if err = os.Rename(file, claim); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer func() { contract.IgnoreError(os.Remove(claim)) }()
+
+	claimed, err := ioutil.ReadFile(claim)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(claimed, read) {
+		if err = os.Link(claim, file); err != nil && !os.IsExist(err) {
+			return false, err
+		}
+		return false, nil
+	}
+
+	if content == nil {
+		return true, nil
+	}
+	return createLocalLock(bucketURL, key, content)
+}
+
 func lockDir() string {
 	return path.Join(workspace.BookkeepingDir, workspace.LockDir)
 }
 
-func stackLockDir(stack tokens.QName) string {
-	contract.Require(stack != "", "stack")
-	return path.Join(lockDir(), fsutil.QnamePath(stack))
+func stackLockDir(ref localBackendReference) string {
+	contract.Require(ref.name != "", "ref")
+	return path.Join(lockDir(), fsutil.QnamePath(ref.qualifiedName()))
 }
 
-func (b *localBackend) lockPath(stack tokens.QName) string {
-	contract.Require(stack != "", "stack")
-	return path.Join(stackLockDir(stack), b.lockID+".json")
+func (b *localBackend) lockPath(ref localBackendReference) string {
+	contract.Require(ref.name != "", "ref")
+	if b.conditionalLocks() {
+		return path.Join(stackLockDir(ref), leaseFile)
+	}
+	return path.Join(stackLockDir(ref), b.lockID+".json")
 }
@@ -0,0 +1,188 @@
+package filestate
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/pkg/v3/util/cancel"
+)
+
+// newLockTestBackends returns two backends of the same bucket, and the directory of the bucket.
+func newLockTestBackends(t *testing.T) (*localBackend, *localBackend, backend.StackReference, string) {
+	tmpDir, err := ioutil.TempDir("", "filestatebackend")
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	t.Setenv("PROJECT_NAME", "")
+
+	b1 := newTestBackend(t, tmpDir)
+	b2 := newTestBackend(t, tmpDir)
+	ref, err := b1.ParseStackReference("proj/a")
+	assert.NoError(t, err)
+	return b1, b2, ref, tmpDir
+}
+
+func setLockLeaseDuration(t *testing.T, d time.Duration) {
+	old := lockLeaseDuration
+	lockLeaseDuration = d
+	t.Cleanup(func() { lockLeaseDuration = old })
+}
+
+func TestLockContention(t *testing.T) {
+	b1, b2, ref, _ := newLockTestBackends(t)
+	ctx := context.Background()
+
+	assert.NoError(t, b1.Lock(ctx, ref))
+	err := b2.Lock(ctx, ref)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "the stack is currently locked by 1 lock(s)")
+	}
+
+	b1.Unlock(ctx, ref)
+	assert.NoError(t, b2.Lock(ctx, ref))
+	b2.Unlock(ctx, ref)
+
+	locks, err := b1.GetStackLocks(ctx, ref)
+	assert.NoError(t, err)
+	assert.Empty(t, locks)
+}
+
+func TestExpiredLockIsBroken(t *testing.T) {
+	setLockLeaseDuration(t, 100*time.Millisecond)
+	b1, b2, ref, _ := newLockTestBackends(t)
+	ctx := context.Background()
+
+	// Stopping the lease without unlocking is what a crash looks like.
+	assert.NoError(t, b1.Lock(ctx, ref))
+	lref, err := b1.getReference(ref)
+	assert.NoError(t, err)
+	b1.stopLease(lref)
+	assert.Error(t, b2.Lock(ctx, ref))
+
+	time.Sleep(2 * lockLeaseDuration)
+	assert.NoError(t, b2.Lock(ctx, ref))
+	b2.Unlock(ctx, ref)
+}
+
+func TestLockLeaseIsRenewed(t *testing.T) {
+	setLockLeaseDuration(t, 150*time.Millisecond)
+	b1, b2, ref, _ := newLockTestBackends(t)
+	ctx := context.Background()
+
+	assert.NoError(t, b1.Lock(ctx, ref))
+	time.Sleep(3 * lockLeaseDuration)
+	assert.Error(t, b2.Lock(ctx, ref))
+
+	b1.Unlock(ctx, ref)
+	assert.NoError(t, b2.Lock(ctx, ref))
+	b2.Unlock(ctx, ref)
+}
+
+func TestLegacyLockFileBlocks(t *testing.T) {
+	b1, b2, ref, tmpDir := newLockTestBackends(t)
+	ctx := context.Background()
+
+	// Older versions of the CLI write a lock per backend, without a lease.
+	content, err := json.Marshal(map[string]interface{}{
+		"pid":       1,
+		"username":  "someone",
+		"hostname":  "somewhere",
+		"timestamp": time.Now(),
+	})
+	assert.NoError(t, err)
+	lockDir := filepath.Join(tmpDir, b1.StateDir(), "locks", "proj", "a")
+	assert.NoError(t, os.MkdirAll(lockDir, 0700))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(lockDir, "1234.json"), content, 0600))
+
+	err = b1.Lock(ctx, ref)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "someone@somewhere (pid 1)")
+	}
+	assert.NoFileExists(t, filepath.Join(lockDir, leaseFile))
+
+	assert.NoError(t, b2.CancelCurrentUpdate(ctx, ref))
+	assert.NoError(t, b1.Lock(ctx, ref))
+	b1.Unlock(ctx, ref)
+}
+
+func TestCancelBreaksLock(t *testing.T) {
+	b1, b2, ref, _ := newLockTestBackends(t)
+	ctx := context.Background()
+
+	assert.Error(t, b2.CancelCurrentUpdate(ctx, ref))
+
+	assert.NoError(t, b1.Lock(ctx, ref))
+	locks, err := b2.GetStackLocks(ctx, ref)
+	assert.NoError(t, err)
+	if assert.Len(t, locks, 1) {
+		assert.Equal(t, os.Getpid(), locks[0].Pid)
+		assert.False(t, locks[0].Expired())
+	}
+
+	assert.NoError(t, b2.CancelCurrentUpdate(ctx, ref))
+	assert.NoError(t, b2.Lock(ctx, ref))
+
+	// The previous owner must not release the lock it lost.
+	b1.Unlock(ctx, ref)
+	locks, err = b1.GetStackLocks(ctx, ref)
+	assert.NoError(t, err)
+	assert.Len(t, locks, 1)
+	b2.Unlock(ctx, ref)
+}
+
+func TestChangedLockIsNotReplaced(t *testing.T) {
+	b1, b2, ref, _ := newLockTestBackends(t)
+	ctx := context.Background()
+
+	assert.NoError(t, b1.Lock(ctx, ref))
+	lref, err := b1.getReference(ref)
+	assert.NoError(t, err)
+	b1.stopLease(lref)
+	l, err := b1.readLock(ctx, b1.lockPath(lref))
+	assert.NoError(t, err)
+
+	// Renewing or breaking the lock as it was read must not touch the lock taken by another process meanwhile.
+	assert.NoError(t, b2.CancelCurrentUpdate(ctx, ref))
+	assert.NoError(t, b2.Lock(ctx, ref))
+	replaced, err := b1.replaceLock(ctx, l, []byte("{}"))
+	assert.NoError(t, err)
+	assert.False(t, replaced)
+	b1.breakExpiredLock(ctx, *l)
+	assert.Error(t, b1.renewLease(lref))
+
+	locks, err := b1.GetStackLocks(ctx, ref)
+	assert.NoError(t, err)
+	if assert.Len(t, locks, 1) {
+		assert.Equal(t, b2.lockID, locks[0].content.ID)
+	}
+	b2.Unlock(ctx, ref)
+}
+
+func TestLostLockCancelsUpdate(t *testing.T) {
+	setLockLeaseDuration(t, 150*time.Millisecond)
+	b1, b2, ref, _ := newLockTestBackends(t)
+	ctx := context.Background()
+
+	assert.NoError(t, b1.Lock(ctx, ref))
+	lref, err := b1.getReference(ref)
+	assert.NoError(t, err)
+	scope, _ := cancel.NewContext(ctx)
+	cancelContext, release := b1.cancelOnLostLock(lref, scope)
+	defer release()
+
+	assert.NoError(t, b2.CancelCurrentUpdate(ctx, ref))
+	select {
+	case <-cancelContext.Canceled():
+	case <-time.After(10 * lockLeaseDuration):
+		assert.Fail(t, "the update was not canceled when its lock was lost")
+	}
+	assert.NoError(t, cancelContext.TerminateErr())
+	b1.Unlock(ctx, ref)
+}
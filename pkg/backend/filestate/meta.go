@@ -0,0 +1,145 @@
+// Copyright 2016-2022, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	"gocloud.dev/gcerrors"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/fsutil"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
+)
+
+// stackMetadataExt is the extension of the file holding a stack's metadata. It is not a checkpoint extension, so
+// metadata files are not mistaken for stacks when listing them.
+const stackMetadataExt = ".meta"
+
+// stackMetadata is the information about a stack that is not part of its checkpoint. It is kept in a file next to
+// the checkpoint, so it is left untouched when the checkpoint is rewritten by updates and imports.
+type stackMetadata struct {
+	Tags map[apitype.StackTagName]string `json:"tags,omitempty"`
+}
+
+func (b *localBackend) stackMetadataPath(ref localBackendReference) string {
+	contract.Require(ref.name != "", "ref")
+	return filepath.Join(b.stacksDirectory(), fsutil.QnamePath(ref.qualifiedName())+stackMetadataExt)
+}
+
+// getStackMetadata loads the metadata of a stack. Stacks created before metadata was persisted have empty metadata.
+func (b *localBackend) getStackMetadata(ref localBackendReference) (*stackMetadata, error) {
+	byts, err := b.bucket.ReadAll(context.TODO(), b.stackMetadataPath(ref))
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		return &stackMetadata{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading stack metadata: %w", err)
+	}
+
+	var meta stackMetadata
+	if err = json.Unmarshal(byts, &meta); err != nil {
+		return nil, fmt.Errorf("unmarshalling stack metadata: %w", err)
+	}
+	return &meta, nil
+}
+
+func (b *localBackend) saveStackMetadata(ref localBackendReference, meta *stackMetadata) error {
+	byts, err := json.MarshalIndent(meta, "", "    ")
+	if err != nil {
+		return fmt.Errorf("marshalling stack metadata: %w", err)
+	}
+	if err = b.bucket.WriteAll(context.TODO(), b.stackMetadataPath(ref), byts, nil); err != nil {
+		return fmt.Errorf("writing stack metadata: %w", err)
+	}
+	return nil
+}
+
+// removeStackMetadata removes the metadata of a stack, if it has any.
+func (b *localBackend) removeStackMetadata(ref localBackendReference) {
+	err := b.bucket.Delete(context.TODO(), b.stackMetadataPath(ref))
+	if err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+		logging.V(5).Infof("error deleting stack metadata: %v (%v) skipping", ref.qualifiedName(), err)
+	}
+}
+
+// renameStackMetadata moves the metadata of a stack to its new name. If the stack moves to another project, its
+// project tag follows it.
+func (b *localBackend) renameStackMetadata(oldRef, newRef localBackendReference) error {
+	meta, err := b.getStackMetadata(oldRef)
+	if err != nil {
+		return err
+	}
+	if _, has := meta.Tags[apitype.ProjectNameTag]; has && newRef.project != oldRef.project && newRef.project != "" {
+		meta.Tags[apitype.ProjectNameTag] = string(newRef.project)
+	}
+	if err = b.saveStackMetadata(newRef, meta); err != nil {
+		return err
+	}
+	b.removeStackMetadata(oldRef)
+	return nil
+}
+
+// updateEnvironmentTags merges the latest tags of the environment (the project, runtime and vcs tags) into the
+// stack's tags, as the service does at the start of every update.
+func (b *localBackend) updateEnvironmentTags(ref localBackendReference) error {
+	envTags, err := backend.GetEnvironmentTagsForCurrentStack()
+	if err != nil {
+		return err
+	}
+	if len(envTags) == 0 {
+		return nil
+	}
+
+	meta, err := b.getStackMetadata(ref)
+	if err != nil {
+		return err
+	}
+	if meta.Tags == nil {
+		meta.Tags = make(map[apitype.StackTagName]string)
+	}
+	for k, v := range envTags {
+		meta.Tags[k] = v
+	}
+	return b.saveStackMetadata(ref, meta)
+}
+
+// matchesStackFilter returns whether a stack with the given tags passes the filter. Local stacks belong to no
+// organization, so the organization filter is ignored. In the legacy layout, the project of a stack is its project
+// tag, and stacks without one, such as the ones created before tags were persisted, match any project.
+func matchesStackFilter(filter backend.ListStacksFilter, ref localBackendReference,
+	tags map[apitype.StackTagName]string) bool {
+	if filter.Project != nil {
+		project := string(ref.project)
+		if project == "" {
+			project = tags[apitype.ProjectNameTag]
+		}
+		if project != "" && project != *filter.Project {
+			return false
+		}
+	}
+	if filter.TagName != nil {
+		value, ok := tags[*filter.TagName]
+		if !ok || (filter.TagValue != nil && value != *filter.TagValue) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,653 @@
+// Copyright 2016-2022, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gocloud.dev/gcerrors"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/pkg/v3/engine"
+	resourceanalyzer "github.com/pulumi/pulumi/pkg/v3/resource/analyzer"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/plugin"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/result"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// DefaultPolicyGroup is the Policy Group enforced on the stacks that belong to no other Policy Group.
+const DefaultPolicyGroup = "default-policy-group"
+
+// localPolicyGroups is the content of the file recording the Policy Groups of a bucket.
+type localPolicyGroups struct {
+	Groups map[string]*localPolicyGroup `json:"groups,omitempty"`
+}
+
+// localPolicyGroup is a set of stacks and the Policy Packs enforced on their updates.
+type localPolicyGroup struct {
+	// Stacks are the qualified names of the stacks of the group.
+	Stacks []string `json:"stacks,omitempty"`
+	// PolicyPacks are the Policy Packs enabled for the group.
+	PolicyPacks []enabledPolicyPack `json:"policyPacks,omitempty"`
+}
+
+// enabledPolicyPack is a version of a Policy Pack published to the bucket that is enabled for a Policy Group.
+type enabledPolicyPack struct {
+	Name       string                      `json:"name"`
+	VersionTag string                      `json:"versionTag"`
+	Config     map[string]*json.RawMessage `json:"config,omitempty"`
+}
+
+func (b *localBackend) policiesDirectory() string {
+	return filepath.Join(b.StateDir(), workspace.PolicyDir)
+}
+
+func (b *localBackend) policyGroupsPath() string {
+	return filepath.Join(b.policiesDirectory(), "groups.json")
+}
+
+func (b *localBackend) policyPackDirectory(name string) string {
+	return filepath.Join(b.policiesDirectory(), "packs", name)
+}
+
+// policyPackPath returns the path of the archive of a published Policy Pack. Its metadata is next to it, with the
+// .json extension.
+func (b *localBackend) policyPackPath(name, versionTag string) string {
+	return filepath.Join(b.policyPackDirectory(name), versionTag+".tgz")
+}
+
+func (b *localBackend) policyPackInfoPath(name, versionTag string) string {
+	return filepath.Join(b.policyPackDirectory(name), versionTag+".json")
+}
+
+func (b *localBackend) getPolicyGroups(ctx context.Context) (*localPolicyGroups, error) {
+	byts, err := b.bucket.ReadAll(ctx, b.policyGroupsPath())
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		return &localPolicyGroups{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading policy groups: %w", err)
+	}
+
+	var groups localPolicyGroups
+	if err = json.Unmarshal(byts, &groups); err != nil {
+		return nil, fmt.Errorf("unmarshalling policy groups: %w", err)
+	}
+	return &groups, nil
+}
+
+func (b *localBackend) savePolicyGroups(ctx context.Context, groups *localPolicyGroups) error {
+	byts, err := json.MarshalIndent(groups, "", "    ")
+	if err != nil {
+		return fmt.Errorf("marshalling policy groups: %w", err)
+	}
+	if err = b.bucket.WriteAll(ctx, b.policyGroupsPath(), byts, nil); err != nil {
+		return fmt.Errorf("writing policy groups: %w", err)
+	}
+	return nil
+}
+
+// stackPolicyGroup returns the Policy Group of a stack, or nil if it has none.
+func (groups *localPolicyGroups) stackPolicyGroup(ref localBackendReference) *localPolicyGroup {
+	for _, group := range groups.Groups {
+		for _, s := range group.Stacks {
+			if s == ref.qualifiedName().String() {
+				return group
+			}
+		}
+	}
+	return groups.Groups[DefaultPolicyGroup]
+}
+
+// renamePolicyGroupStacks renames the stacks of the Policy Groups, dropping the ones renamed to "".
+func (b *localBackend) renamePolicyGroupStacks(ctx context.Context, rename func(name string) string) error {
+	groups, err := b.getPolicyGroups(ctx)
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for _, group := range groups.Groups {
+		stacks := group.Stacks[:0]
+		for _, s := range group.Stacks {
+			newName := rename(s)
+			if newName != s {
+				changed = true
+			}
+			if newName != "" {
+				stacks = append(stacks, newName)
+			}
+		}
+		group.Stacks = stacks
+	}
+	if !changed {
+		return nil
+	}
+	return b.savePolicyGroups(ctx, groups)
+}
+
+// AddStackToPolicyGroup makes a stack a member of a Policy Group, removing it from its previous group.
+func (b *localBackend) AddStackToPolicyGroup(ctx context.Context, policyGroup string,
+	stackRef backend.StackReference) error {
+
+	ref, err := b.getReference(stackRef)
+	if err != nil {
+		return err
+	}
+	if policyGroup == DefaultPolicyGroup {
+		return fmt.Errorf("stacks that are in no other policy group are in %s", DefaultPolicyGroup)
+	}
+
+	groups, err := b.getPolicyGroups(ctx)
+	if err != nil {
+		return err
+	}
+	group, has := groups.Groups[policyGroup]
+	if !has {
+		return fmt.Errorf("policy group %q does not exist; enable a policy pack for it first", policyGroup)
+	}
+	name := ref.qualifiedName().String()
+	for _, g := range groups.Groups {
+		for i, s := range g.Stacks {
+			if s == name {
+				g.Stacks = append(g.Stacks[:i], g.Stacks[i+1:]...)
+				break
+			}
+		}
+	}
+	group.Stacks = append(group.Stacks, name)
+	sort.Strings(group.Stacks)
+	return b.savePolicyGroups(ctx, groups)
+}
+
+// RemoveStackFromPolicyGroup removes a stack from a Policy Group, which puts it back in the default one.
+func (b *localBackend) RemoveStackFromPolicyGroup(ctx context.Context, policyGroup string,
+	stackRef backend.StackReference) error {
+
+	ref, err := b.getReference(stackRef)
+	if err != nil {
+		return err
+	}
+
+	groups, err := b.getPolicyGroups(ctx)
+	if err != nil {
+		return err
+	}
+	if group, has := groups.Groups[policyGroup]; has {
+		for i, s := range group.Stacks {
+			if s == ref.qualifiedName().String() {
+				group.Stacks = append(group.Stacks[:i], group.Stacks[i+1:]...)
+				return b.savePolicyGroups(ctx, groups)
+			}
+		}
+	}
+	return fmt.Errorf("stack %s is not in policy group %q", ref, policyGroup)
+}
+
+// getRequiredPolicies returns the Policy Packs enforced on the updates of a stack.
+func (b *localBackend) getRequiredPolicies(ctx context.Context,
+	ref localBackendReference) ([]engine.RequiredPolicy, error) {
+
+	groups, err := b.getPolicyGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	group := groups.stackPolicyGroup(ref)
+	if group == nil {
+		return nil, nil
+	}
+
+	policies := make([]engine.RequiredPolicy, len(group.PolicyPacks))
+	for i, pack := range group.PolicyPacks {
+		policies[i] = &localRequiredPolicy{pack: pack, b: b}
+	}
+	return policies, nil
+}
+
+func (b *localBackend) GetPolicyPack(ctx context.Context, policyPack string,
+	d diag.Sink) (backend.PolicyPack, error) {
+
+	ref, err := b.parsePolicyPackReference(policyPack)
+	if err != nil {
+		return nil, err
+	}
+	return &localPolicyPack{ref: ref, b: b}, nil
+}
+
+// parsePolicyPackReference parses the name of a Policy Pack published to the bucket. Buckets have no organizations, so
+// the organization a name may be prefixed with is ignored. The name is empty when publishing, as it is only known from
+// the Policy Pack then.
+func (b *localBackend) parsePolicyPackReference(s string) (*localPolicyPackReference, error) {
+	// The Policy Groups are shared by everyone using the bucket, so they can't refer to the disk of one of them.
+	// `pulumi policy enable` publishes local Policy Packs to the bucket before enabling them by name.
+	if _, err := os.Stat(filepath.Join(s, "PulumiPolicy.yaml")); err == nil {
+		return nil, fmt.Errorf("%s is a local policy pack; enable it with `pulumi policy enable %s latest`, "+
+			"which publishes it to the backend, and use its name otherwise", s, s)
+	}
+
+	split := strings.Split(s, "/")
+	if len(split) > 2 {
+		return nil, fmt.Errorf("could not parse policy pack name '%s'; must be of the form "+
+			"<org-name>/<policy-pack-name>", s)
+	}
+	name := split[len(split)-1]
+	if name != "" && !tokens.IsQName(name) {
+		return nil, fmt.Errorf("invalid policy pack name %q", name)
+	}
+	return &localPolicyPackReference{name: tokens.QName(name)}, nil
+}
+
+func (b *localBackend) ListPolicyGroups(ctx context.Context, orgName string, _ backend.ContinuationToken) (
+	apitype.ListPolicyGroupsResponse, backend.ContinuationToken, error) {
+
+	groups, err := b.getPolicyGroups(ctx)
+	if err != nil {
+		return apitype.ListPolicyGroupsResponse{}, nil, err
+	}
+
+	var resp apitype.ListPolicyGroupsResponse
+	for name, group := range groups.Groups {
+		resp.PolicyGroups = append(resp.PolicyGroups, apitype.PolicyGroupSummary{
+			Name:                  name,
+			IsOrgDefault:          name == DefaultPolicyGroup,
+			NumStacks:             len(group.Stacks),
+			NumEnabledPolicyPacks: len(group.PolicyPacks),
+		})
+	}
+	sort.Slice(resp.PolicyGroups, func(i, j int) bool {
+		return resp.PolicyGroups[i].Name < resp.PolicyGroups[j].Name
+	})
+	return resp, nil, nil
+}
+
+func (b *localBackend) ListPolicyPacks(ctx context.Context, orgName string, _ backend.ContinuationToken) (
+	apitype.ListPolicyPacksResponse, backend.ContinuationToken, error) {
+
+	var resp apitype.ListPolicyPacksResponse
+	dirs, err := listBucket(b.bucket, path.Join(filepath.ToSlash(b.policiesDirectory()), "packs"))
+	if err != nil {
+		return resp, nil, fmt.Errorf("error listing policy packs: %w", err)
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir {
+			continue
+		}
+		name := path.Base(dir.Key)
+		versions, err := b.policyPackVersions(name)
+		if err != nil {
+			return resp, nil, err
+		}
+		if len(versions) == 0 {
+			continue
+		}
+
+		info, err := b.getPolicyPackInfo(ctx, name, versions[len(versions)-1])
+		if err != nil {
+			return resp, nil, err
+		}
+		resp.PolicyPacks = append(resp.PolicyPacks, apitype.PolicyPackWithVersions{
+			Name:        name,
+			DisplayName: info.DisplayName,
+			VersionTags: versions,
+		})
+	}
+	return resp, nil, nil
+}
+
+// policyPackVersions returns the versions published of a Policy Pack, from the oldest to the latest.
+func (b *localBackend) policyPackVersions(name string) ([]string, error) {
+	files, err := listBucket(b.bucket, b.policyPackDirectory(name))
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error listing policy pack versions: %w", err)
+	}
+
+	type version struct {
+		tag  string
+		time int64
+	}
+	var versions []version
+	for _, file := range files {
+		fileName := objectName(file)
+		if file.IsDir || path.Ext(fileName) != ".json" {
+			continue
+		}
+		versions = append(versions, version{
+			tag:  strings.TrimSuffix(fileName, ".json"),
+			time: file.ModTime.UnixNano(),
+		})
+	}
+	// Version tags are free-form, so the latest version is the one published last.
+	sort.Slice(versions, func(i, j int) bool {
+		if versions[i].time == versions[j].time {
+			return versions[i].tag < versions[j].tag
+		}
+		return versions[i].time < versions[j].time
+	})
+
+	tags := make([]string, len(versions))
+	for i, v := range versions {
+		tags[i] = v.tag
+	}
+	return tags, nil
+}
+
+func (b *localBackend) getPolicyPackInfo(ctx context.Context, name, versionTag string) (*plugin.AnalyzerInfo, error) {
+	byts, err := b.bucket.ReadAll(ctx, b.policyPackInfoPath(name, versionTag))
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		return nil, fmt.Errorf("policy pack %s version %s has not been published", name, versionTag)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading policy pack %s version %s: %w", name, versionTag, err)
+	}
+
+	var info plugin.AnalyzerInfo
+	if err = json.Unmarshal(byts, &info); err != nil {
+		return nil, fmt.Errorf("unmarshalling policy pack %s version %s: %w", name, versionTag, err)
+	}
+	return &info, nil
+}
+
+// localPolicyPackReference is a reference to a Policy Pack published to the bucket.
+type localPolicyPackReference struct {
+	name tokens.QName
+}
+
+var _ backend.PolicyPackReference = (*localPolicyPackReference)(nil)
+
+func (r *localPolicyPackReference) String() string {
+	return string(r.name)
+}
+
+func (r *localPolicyPackReference) OrgName() string {
+	return localOrganization
+}
+
+func (r *localPolicyPackReference) Name() tokens.QName {
+	return r.name
+}
+
+// localPolicyPack is the filestate implementation of the PolicyPack interface. Policy Packs are published to the
+// bucket, and enabled for Policy Groups recorded in the bucket.
+type localPolicyPack struct {
+	ref *localPolicyPackReference
+	b   *localBackend
+}
+
+var _ backend.PolicyPack = (*localPolicyPack)(nil)
+
+func (pack *localPolicyPack) Ref() backend.PolicyPackReference {
+	return pack.ref
+}
+
+func (pack *localPolicyPack) Backend() backend.Backend {
+	return pack.b
+}
+
+var policyPackVersionTagRE = regexp.MustCompile("^[a-zA-Z0-9-_.]{1,100}$")
+
+func (pack *localPolicyPack) Publish(ctx context.Context, op backend.PublishOperation) result.Result {
+	fmt.Println("Obtaining policy metadata from policy plugin")
+
+	abs, err := filepath.Abs(op.PlugCtx.Pwd)
+	if err != nil {
+		return result.FromError(err)
+	}
+	analyzer, err := op.PlugCtx.Host.PolicyAnalyzer(tokens.QName(abs), op.PlugCtx.Pwd, nil /*opts*/)
+	if err != nil {
+		return result.FromError(err)
+	}
+	analyzerInfo, err := analyzer.GetAnalyzerInfo()
+	if err != nil {
+		return result.FromError(err)
+	}
+	if !policyPackVersionTagRE.MatchString(analyzerInfo.Version) {
+		return result.Errorf("invalid version %q - version may only contain alphanumeric, hyphens, or underscores. "+
+			"It must also be between 1 and 100 characters long.", analyzerInfo.Version)
+	}
+	if !tokens.IsQName(analyzerInfo.Name) {
+		return result.Errorf("invalid policy pack name %q", analyzerInfo.Name)
+	}
+	pack.ref.name = tokens.QName(analyzerInfo.Name)
+
+	fmt.Println("Compressing policy pack")
+
+	packTarball, err := backend.ArchivePolicyPack(op.PlugCtx.Pwd, op.PolicyPack)
+	if err != nil {
+		return result.FromError(fmt.Errorf("could not publish policies: %w", err))
+	}
+	infoBytes, err := json.Marshal(analyzerInfo)
+	if err != nil {
+		return result.FromError(err)
+	}
+
+	fmt.Printf("Publishing %q - version %s to %s\n", analyzerInfo.Name, analyzerInfo.Version, pack.b.url)
+
+	name, version := analyzerInfo.Name, analyzerInfo.Version
+	if err = pack.b.bucket.WriteAll(ctx, pack.b.policyPackPath(name, version), packTarball, nil); err != nil {
+		return result.FromError(fmt.Errorf("writing policy pack: %w", err))
+	}
+	// The metadata is written last, as it is what makes the version visible.
+	if err = pack.b.bucket.WriteAll(ctx, pack.b.policyPackInfoPath(name, version), infoBytes, nil); err != nil {
+		return result.FromError(fmt.Errorf("writing policy pack: %w", err))
+	}
+	return nil
+}
+
+// resolveVersion returns the version tag of a published Policy Pack, defaulting to its latest version.
+func (pack *localPolicyPack) resolveVersion(versionTag *string) (string, error) {
+	versions, err := pack.b.policyPackVersions(string(pack.ref.name))
+	if err != nil {
+		return "", err
+	}
+	if len(versions) == 0 {
+		return "", fmt.Errorf("policy pack %s has not been published", pack.ref.name)
+	}
+	if versionTag == nil {
+		return versions[len(versions)-1], nil
+	}
+	for _, v := range versions {
+		if v == *versionTag {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("policy pack %s version %s has not been published", pack.ref.name, *versionTag)
+}
+
+func (pack *localPolicyPack) Enable(ctx context.Context, policyGroup string, op backend.PolicyPackOperation) error {
+	version, err := pack.resolveVersion(op.VersionTag)
+	if err != nil {
+		return err
+	}
+	enabled := enabledPolicyPack{Name: string(pack.ref.name), VersionTag: version, Config: op.Config}
+	if policyGroup == "" {
+		policyGroup = DefaultPolicyGroup
+	}
+
+	groups, err := pack.b.getPolicyGroups(ctx)
+	if err != nil {
+		return err
+	}
+	if groups.Groups == nil {
+		groups.Groups = make(map[string]*localPolicyGroup)
+	}
+	group, has := groups.Groups[policyGroup]
+	if !has {
+		group = &localPolicyGroup{}
+		groups.Groups[policyGroup] = group
+	}
+
+	// Enabling another version of a Policy Pack replaces the enabled one.
+	for i, p := range group.PolicyPacks {
+		if p.Name == enabled.Name {
+			group.PolicyPacks = append(group.PolicyPacks[:i], group.PolicyPacks[i+1:]...)
+			break
+		}
+	}
+	group.PolicyPacks = append(group.PolicyPacks, enabled)
+	return pack.b.savePolicyGroups(ctx, groups)
+}
+
+func (pack *localPolicyPack) Disable(ctx context.Context, policyGroup string, op backend.PolicyPackOperation) error {
+	if policyGroup == "" {
+		policyGroup = DefaultPolicyGroup
+	}
+
+	groups, err := pack.b.getPolicyGroups(ctx)
+	if err != nil {
+		return err
+	}
+	if group, has := groups.Groups[policyGroup]; has {
+		for i, p := range group.PolicyPacks {
+			if p.Name == string(pack.ref.name) && (op.VersionTag == nil || p.VersionTag == *op.VersionTag) {
+				group.PolicyPacks = append(group.PolicyPacks[:i], group.PolicyPacks[i+1:]...)
+				return pack.b.savePolicyGroups(ctx, groups)
+			}
+		}
+	}
+	return fmt.Errorf("policy pack %s is not enabled for policy group %q", pack.ref, policyGroup)
+}
+
+func (pack *localPolicyPack) Validate(ctx context.Context, op backend.PolicyPackOperation) error {
+	version, err := pack.resolveVersion(op.VersionTag)
+	if err != nil {
+		return err
+	}
+	info, err := pack.b.getPolicyPackInfo(ctx, string(pack.ref.name), version)
+	if err != nil {
+		return err
+	}
+	schema, err := policyConfigSchemas(info)
+	if err != nil {
+		return err
+	}
+	return resourceanalyzer.ValidatePolicyPackConfig(schema, op.Config)
+}
+
+// policyConfigSchemas returns the JSON schemas of the configuration of the policies of a Policy Pack.
+func policyConfigSchemas(info *plugin.AnalyzerInfo) (map[string]apitype.PolicyConfigSchema, error) {
+	schemas := make(map[string]apitype.PolicyConfigSchema)
+	for _, policy := range info.Policies {
+		if policy.ConfigSchema == nil {
+			continue
+		}
+		properties := map[string]*json.RawMessage{}
+		for k, v := range policy.ConfigSchema.Properties {
+			byts, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			raw := json.RawMessage(byts)
+			properties[k] = &raw
+		}
+		schemas[policy.Name] = apitype.PolicyConfigSchema{
+			Type:       apitype.Object,
+			Properties: properties,
+			Required:   policy.ConfigSchema.Required,
+		}
+	}
+	return schemas, nil
+}
+
+func (pack *localPolicyPack) Remove(ctx context.Context, op backend.PolicyPackOperation) error {
+	// Like the service, refuse to remove versions that are still enabled.
+	groups, err := pack.b.getPolicyGroups(ctx)
+	if err != nil {
+		return err
+	}
+	for name, group := range groups.Groups {
+		for _, p := range group.PolicyPacks {
+			if p.Name == string(pack.ref.name) && (op.VersionTag == nil || p.VersionTag == *op.VersionTag) {
+				return fmt.Errorf("policy pack %s is enabled for policy group %q; disable it first", pack.ref, name)
+			}
+		}
+	}
+
+	var versions []string
+	if op.VersionTag != nil {
+		version, err := pack.resolveVersion(op.VersionTag)
+		if err != nil {
+			return err
+		}
+		versions = []string{version}
+	} else if versions, err = pack.b.policyPackVersions(string(pack.ref.name)); err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return fmt.Errorf("policy pack %s has not been published", pack.ref.name)
+	}
+
+	for _, version := range versions {
+		// Remove the metadata first, so that a failure leaves no half-removed version visible.
+		for _, key := range []string{
+			pack.b.policyPackInfoPath(string(pack.ref.name), version),
+			pack.b.policyPackPath(string(pack.ref.name), version),
+		} {
+			if err := pack.b.bucket.Delete(ctx, key); err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+				return fmt.Errorf("removing policy pack %s version %s: %w", pack.ref.name, version, err)
+			}
+		}
+	}
+	return nil
+}
+
+// localRequiredPolicy is a Policy Pack enforced on the update of a stack by its Policy Group.
+type localRequiredPolicy struct {
+	pack enabledPolicyPack
+	b    *localBackend
+}
+
+var _ engine.RequiredPolicy = (*localRequiredPolicy)(nil)
+
+func (rp *localRequiredPolicy) Name() string { return rp.pack.Name }
+
+func (rp *localRequiredPolicy) Version() string { return rp.pack.VersionTag }
+
+func (rp *localRequiredPolicy) Install(ctx context.Context) (string, error) {
+	policyPackPath, installed, err := workspace.GetPolicyPath(localOrganization,
+		strings.Replace(rp.pack.Name, tokens.QNameDelimiter, "_", -1), rp.pack.VersionTag)
+	if err != nil {
+		// Failed to get a sensible PolicyPack path.
+		return "", err
+	} else if installed {
+		// We've already downloaded and installed the PolicyPack. Return.
+		return policyPackPath, nil
+	}
+
+	fmt.Printf("Installing policy pack %s %s...\n", rp.pack.Name, rp.pack.VersionTag)
+
+	tarball, err := rp.b.bucket.ReadAll(ctx, rp.b.policyPackPath(rp.pack.Name, rp.pack.VersionTag))
+	if err != nil {
+		return "", fmt.Errorf("reading policy pack %s version %s: %w", rp.pack.Name, rp.pack.VersionTag, err)
+	}
+	return policyPackPath, backend.InstallPolicyPack(policyPackPath, ioutil.NopCloser(bytes.NewReader(tarball)))
+}
+
+func (rp *localRequiredPolicy) Config() map[string]*json.RawMessage { return rp.pack.Config }
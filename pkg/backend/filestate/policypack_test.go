@@ -0,0 +1,188 @@
+package filestate
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/plugin"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// publishTestPolicyPack writes a Policy Pack version to the bucket as Publish does, without running the Policy Pack.
+func publishTestPolicyPack(t *testing.T, b *localBackend, name, version string) {
+	info, err := json.Marshal(plugin.AnalyzerInfo{
+		Name:    name,
+		Version: version,
+		Policies: []plugin.AnalyzerPolicyInfo{{
+			Name: "max-size",
+			ConfigSchema: &plugin.AnalyzerPolicyConfigSchema{
+				Properties: map[string]plugin.JSONSchema{"size": {"type": "integer"}},
+				Required:   []string{"size"},
+			},
+		}},
+	})
+	assert.NoError(t, err)
+	ctx := context.Background()
+	assert.NoError(t, b.bucket.WriteAll(ctx, b.policyPackPath(name, version), []byte("tgz"), nil))
+	assert.NoError(t, b.bucket.WriteAll(ctx, b.policyPackInfoPath(name, version), info, nil))
+}
+
+// testRequiredPolicies returns the names and versions of the Policy Packs enforced on a stack.
+func testRequiredPolicies(t *testing.T, b *localBackend, stack backend.Stack) map[string]string {
+	ref, err := b.getReference(stack.Ref())
+	assert.NoError(t, err)
+	policies, err := b.getRequiredPolicies(context.Background(), ref)
+	assert.NoError(t, err)
+
+	versions := make(map[string]string)
+	for _, p := range policies {
+		versions[p.Name()] = p.Version()
+	}
+	return versions
+}
+
+func TestLocalPolicyPackIsRejected(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "filestatebackend")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	t.Setenv("PROJECT_NAME", "")
+
+	// The policy groups are shared, so they can't refer to a directory of one machine.
+	packDir := filepath.Join(tmpDir, "security")
+	assert.NoError(t, os.MkdirAll(packDir, 0700))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(packDir, "PulumiPolicy.yaml"), []byte("runtime: nodejs\n"), 0600))
+
+	b := newTestBackend(t, tmpDir)
+	_, err = b.GetPolicyPack(context.Background(), packDir, b.d)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "pulumi policy enable")
+	}
+}
+
+// testAnalyzerHost is a plugin host whose policy analyzers report the info of a Policy Pack.
+type testAnalyzerHost struct {
+	plugin.Host
+	info plugin.AnalyzerInfo
+}
+
+func (h *testAnalyzerHost) PolicyAnalyzer(name tokens.QName, path string,
+	opts *plugin.PolicyAnalyzerOptions) (plugin.Analyzer, error) {
+	return &testAnalyzer{info: h.info}, nil
+}
+
+type testAnalyzer struct {
+	plugin.Analyzer
+	info plugin.AnalyzerInfo
+}
+
+func (a *testAnalyzer) GetAnalyzerInfo() (plugin.AnalyzerInfo, error) { return a.info, nil }
+
+func TestLocalPolicyPackIsPublishedWhenEnabled(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "filestatebackend")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	t.Setenv("PROJECT_NAME", "")
+	ctx := context.Background()
+
+	packDir := filepath.Join(tmpDir, "security")
+	assert.NoError(t, os.MkdirAll(packDir, 0700))
+	projectPath := filepath.Join(packDir, "PulumiPolicy.yaml")
+	assert.NoError(t, ioutil.WriteFile(projectPath, []byte("runtime: python\n"), 0600))
+	proj, err := workspace.LoadPolicyPack(projectPath)
+	assert.NoError(t, err)
+
+	b := newTestBackend(t, tmpDir)
+	stack := createTestStack(t, b, "proj/a")
+
+	// `pulumi policy enable <path>` publishes the Policy Pack, and enables the version it published.
+	pack, err := b.GetPolicyPack(ctx, "/", b.d)
+	assert.NoError(t, err)
+	host := &testAnalyzerHost{info: plugin.AnalyzerInfo{Name: "security", Version: "1.0.0"}}
+	res := pack.Publish(ctx, backend.PublishOperation{
+		Root:       packDir,
+		PlugCtx:    &plugin.Context{Host: host, Pwd: packDir},
+		PolicyPack: proj,
+	})
+	assert.Nil(t, res)
+	assert.NoError(t, pack.Enable(ctx, "", backend.PolicyPackOperation{}))
+	assert.Equal(t, map[string]string{"security": "1.0.0"}, testRequiredPolicies(t, b, stack))
+}
+
+func TestPolicyGroups(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "filestatebackend")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	t.Setenv("PROJECT_NAME", "")
+	ctx := context.Background()
+
+	b := newTestBackend(t, tmpDir)
+	a := createTestStack(t, b, "proj/a")
+	other := createTestStack(t, b, "proj/b")
+	publishTestPolicyPack(t, b, "security", "1.0.0")
+	publishTestPolicyPack(t, b, "security", "2.0.0")
+
+	packs, _, err := b.ListPolicyPacks(ctx, "", nil)
+	assert.NoError(t, err)
+	if assert.Len(t, packs.PolicyPacks, 1) {
+		assert.Equal(t, "security", packs.PolicyPacks[0].Name)
+		assert.Equal(t, []string{"1.0.0", "2.0.0"}, packs.PolicyPacks[0].VersionTags)
+	}
+
+	// Published Policy Packs are validated against the schema of their configuration.
+	pack, err := b.GetPolicyPack(ctx, "organization/security", b.d)
+	assert.NoError(t, err)
+	size := json.RawMessage(`{"size": 3}`)
+	config := map[string]*json.RawMessage{"max-size": &size}
+	assert.NoError(t, pack.Validate(ctx, backend.PolicyPackOperation{Config: config}))
+	assert.Error(t, pack.Validate(ctx, backend.PolicyPackOperation{Config: map[string]*json.RawMessage{}}))
+
+	// The latest version is the one enabled for the default Policy Group, and explicit versions for other groups.
+	assert.NoError(t, pack.Enable(ctx, "", backend.PolicyPackOperation{Config: config}))
+	version := "1.0.0"
+	assert.NoError(t, pack.Enable(ctx, "prod", backend.PolicyPackOperation{VersionTag: &version}))
+	missing := "3.0.0"
+	assert.Error(t, pack.Enable(ctx, "prod", backend.PolicyPackOperation{VersionTag: &missing}))
+
+	assert.Error(t, b.AddStackToPolicyGroup(ctx, "staging", a.Ref()))
+	assert.NoError(t, b.AddStackToPolicyGroup(ctx, "prod", a.Ref()))
+	assert.Equal(t, map[string]string{"security": "1.0.0"}, testRequiredPolicies(t, b, a))
+	assert.Equal(t, map[string]string{"security": "2.0.0"}, testRequiredPolicies(t, b, other))
+
+	groups, _, err := b.ListPolicyGroups(ctx, "", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []apitype.PolicyGroupSummary{
+		{Name: DefaultPolicyGroup, IsOrgDefault: true, NumEnabledPolicyPacks: 1},
+		{Name: "prod", NumStacks: 1, NumEnabledPolicyPacks: 1},
+	}, groups.PolicyGroups)
+
+	// Stacks keep their Policy Group when renamed, and leave it when removed.
+	renamed, err := b.RenameStack(ctx, a, "proj/c")
+	assert.NoError(t, err)
+	a, err = b.GetStack(ctx, renamed)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"security": "1.0.0"}, testRequiredPolicies(t, b, a))
+	_, err = b.RemoveStack(ctx, a, false)
+	assert.NoError(t, err)
+	groups, _, err = b.ListPolicyGroups(ctx, "", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, groups.PolicyGroups[1].NumStacks)
+
+	// Enabled versions can't be removed.
+	assert.Error(t, pack.Remove(ctx, backend.PolicyPackOperation{}))
+	assert.NoError(t, pack.Disable(ctx, "prod", backend.PolicyPackOperation{}))
+	assert.NoError(t, pack.Remove(ctx, backend.PolicyPackOperation{VersionTag: &version}))
+	packs, _, err = b.ListPolicyPacks(ctx, "", nil)
+	assert.NoError(t, err)
+	if assert.Len(t, packs.PolicyPacks, 1) {
+		assert.Equal(t, []string{"2.0.0"}, packs.PolicyPacks[0].VersionTags)
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright 2016-2022, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gocloud.dev/gcerrors"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
+)
+
+const (
+	// RetainLastEnvVar keeps only the given number of the most recent history entries, backups and backup
+	// checkpoints of each stack.
+	RetainLastEnvVar = "PULUMI_FILESTATE_RETAIN_LAST"
+	// RetainMaxAgeEnvVar drops the history entries, backups and backup checkpoints of stacks that are older than
+	// the given duration, such as 720h.
+	RetainMaxAgeEnvVar = "PULUMI_FILESTATE_RETAIN_MAX_AGE"
+)
+
+// RetentionPolicy tells which of the history entries, backups and backup checkpoints of a stack to keep. Files are
+// dropped when either limit is exceeded, and the zero policy keeps everything.
+type RetentionPolicy struct {
+	// KeepLast is the number of the most recent files of each kind to keep, or zero for all of them.
+	KeepLast int
+	// MaxAge is the age above which files are dropped, or zero for no limit.
+	MaxAge time.Duration
+}
+
+// IsZero returns whether the policy keeps everything.
+func (p RetentionPolicy) IsZero() bool {
+	return p.KeepLast <= 0 && p.MaxAge <= 0
+}
+
+// RetentionPolicyFromEnv returns the retention policy set by RetainLastEnvVar and RetainMaxAgeEnvVar.
+func RetentionPolicyFromEnv() (RetentionPolicy, error) {
+	var policy RetentionPolicy
+	if v := os.Getenv(RetainLastEnvVar); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return RetentionPolicy{}, fmt.Errorf("%s must be a positive number, not %q", RetainLastEnvVar, v)
+		}
+		policy.KeepLast = n
+	}
+	if v := os.Getenv(RetainMaxAgeEnvVar); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return RetentionPolicy{}, fmt.Errorf("%s must be a positive duration, such as 720h, not %q",
+				RetainMaxAgeEnvVar, v)
+		}
+		policy.MaxAge = d
+	}
+	return policy, nil
+}
+
+// GarbageStats summarizes the files removed by a garbage collection.
+type GarbageStats struct {
+	Files int   // the number of files removed.
+	Bytes int64 // the size of the files removed.
+}
+
+// retainedEntry is a history entry, backup or backup checkpoint of a stack, made of one or more files.
+type retainedEntry struct {
+	keys []string
+	size int64
+	time time.Time
+}
+
+// expired returns the entries of one kind that the policy doesn't keep.
+func (p RetentionPolicy) expired(entries []*retainedEntry, now time.Time) []*retainedEntry {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].time.After(entries[j].time)
+	})
+
+	var expired []*retainedEntry
+	for i, e := range entries {
+		if (p.KeepLast > 0 && i >= p.KeepLast) || (p.MaxAge > 0 && now.Sub(e.time) > p.MaxAge) {
+			expired = append(expired, e)
+		}
+	}
+	return expired
+}
+
+// CollectGarbage removes the history entries, backups and backup checkpoints of a stack that the policy doesn't keep.
+// If the stack is nil, it does so for every stack, including the backup checkpoints of removed stacks. With dryRun,
+// nothing is removed, but the stats tell what would be.
+func (b *localBackend) CollectGarbage(ctx context.Context, stackRef backend.StackReference,
+	policy RetentionPolicy, dryRun bool) (GarbageStats, error) {
+
+	if policy.IsZero() {
+		return GarbageStats{}, nil
+	}
+
+	var stacks []localBackendReference
+	var checkpointDirs []string
+	var checkpointFilter func(base string) bool
+	if stackRef != nil {
+		ref, err := b.getReference(stackRef)
+		if err != nil {
+			return GarbageStats{}, err
+		}
+		stacks = []localBackendReference{ref}
+		checkpointDirs = []string{path.Dir(filepath.ToSlash(b.checkpointPath(ref, false)))}
+		checkpointFilter = func(base string) bool {
+			return base == path.Base(filepath.ToSlash(b.checkpointPath(ref, false)))
+		}
+	} else {
+		refs, err := b.getLocalStacks()
+		if err != nil {
+			return GarbageStats{}, err
+		}
+		stacks = refs
+		if checkpointDirs, err = b.checkpointDirectories(); err != nil {
+			return GarbageStats{}, err
+		}
+		checkpointFilter = func(string) bool { return true }
+	}
+
+	now := time.Now()
+	var garbage []*retainedEntry
+	for _, ref := range stacks {
+		history, err := b.historyEntries(ref)
+		if err != nil {
+			return GarbageStats{}, err
+		}
+		garbage = append(garbage, policy.expired(history, now)...)
+
+		backups, err := b.backupEntries(ref)
+		if err != nil {
+			return GarbageStats{}, err
+		}
+		garbage = append(garbage, policy.expired(backups, now)...)
+	}
+	for _, dir := range checkpointDirs {
+		copies, err := b.checkpointCopies(dir)
+		if err != nil {
+			return GarbageStats{}, err
+		}
+		for base, entries := range copies {
+			if checkpointFilter(base) {
+				garbage = append(garbage, policy.expired(entries, now)...)
+			}
+		}
+	}
+
+	var stats GarbageStats
+	for _, e := range garbage {
+		for _, key := range e.keys {
+			if !dryRun {
+				err := b.bucket.Delete(ctx, key)
+				if err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+					return stats, fmt.Errorf("deleting %s: %w", key, err)
+				}
+			}
+			stats.Files++
+		}
+		stats.Bytes += e.size
+	}
+	return stats, nil
+}
+
+// collectStackGarbage applies the retention policy of the environment to a stack after an update. Failures are only
+// logged, as the update itself succeeded.
+func (b *localBackend) collectStackGarbage(ctx context.Context, ref localBackendReference) {
+	if b.retention.IsZero() {
+		return
+	}
+	stats, err := b.CollectGarbage(ctx, ref, b.retention, false /*dryRun*/)
+	if err != nil {
+		logging.V(5).Infof("error collecting garbage of stack %s: %v (skipping)", ref.qualifiedName(), err)
+		return
+	}
+	logging.V(7).Infof("removed %d file(s) (%d bytes) of stack %s", stats.Files, stats.Bytes, ref.qualifiedName())
+}
+
+// historyEntries returns the history entries of a stack, each made of an update record and a checkpoint.
+func (b *localBackend) historyEntries(ref localBackendReference) ([]*retainedEntry, error) {
+	files, err := listBucket(b.bucket, b.historyDirectory(ref))
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	// The files of an entry are named <stack-name>-<timestamp>.[checkpoint|history].json.
+	entries := make(map[string]*retainedEntry)
+	var result []*retainedEntry
+	for _, file := range files {
+		name := objectName(file)
+		if file.IsDir || !strings.HasPrefix(name, string(ref.name)+"-") {
+			continue
+		}
+		timestamp := strings.SplitN(strings.TrimPrefix(name, string(ref.name)+"-"), ".", 2)[0]
+		nanos, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		e, has := entries[timestamp]
+		if !has {
+			e = &retainedEntry{time: time.Unix(0, nanos)}
+			entries[timestamp] = e
+			result = append(result, e)
+		}
+		e.keys = append(e.keys, file.Key)
+		e.size += file.Size
+	}
+	return result, nil
+}
+
+// backupEntries returns the backups of a stack, which are named <stack-name>.<timestamp>.json.
+func (b *localBackend) backupEntries(ref localBackendReference) ([]*retainedEntry, error) {
+	files, err := listBucket(b.bucket, b.backupDirectory(ref))
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var result []*retainedEntry
+	for _, file := range files {
+		name := objectName(file)
+		if file.IsDir || !strings.HasPrefix(name, string(ref.name)+".") {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(name, string(ref.name)+"."), ".", 2)
+		nanos, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		result = append(result, &retainedEntry{keys: []string{file.Key}, size: file.Size, time: time.Unix(0, nanos)})
+	}
+	return result, nil
+}
+
+// checkpointDirectories returns the directories holding checkpoints.
+func (b *localBackend) checkpointDirectories() ([]string, error) {
+	dirs := []string{filepath.ToSlash(b.stacksDirectory())}
+	if !b.projectScoped() {
+		return dirs, nil
+	}
+
+	files, err := listBucket(b.bucket, b.stacksDirectory())
+	if err != nil {
+		return nil, fmt.Errorf("error listing projects: %w", err)
+	}
+	for _, file := range files {
+		if file.IsDir {
+			dirs = append(dirs, path.Join(filepath.ToSlash(b.stacksDirectory()), path.Base(file.Key)))
+		}
+	}
+	return dirs, nil
+}
+
+// checkpointCopies returns the backup checkpoints in a directory by the name of their checkpoint, such as
+// <stack-name>.json. Those are the .bak files of saved and removed stacks, and the checkpoints retained with
+// PULUMI_RETAIN_CHECKPOINTS.
+func (b *localBackend) checkpointCopies(dir string) (map[string][]*retainedEntry, error) {
+	files, err := listBucket(b.bucket, dir)
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	copies := make(map[string][]*retainedEntry)
+	for _, file := range files {
+		name := objectName(file)
+		i := strings.Index(name, ".json.")
+		if file.IsDir || i < 0 || strings.HasSuffix(name, ".json"+gzipExt) {
+			continue
+		}
+		base := name[:i+len(".json")]
+		copies[base] = append(copies[base], &retainedEntry{
+			keys: []string{file.Key},
+			size: file.Size,
+			time: file.ModTime,
+		})
+	}
+	return copies, nil
+}
@@ -0,0 +1,133 @@
+package filestate
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+)
+
+// importTestDeployment imports a checkpoint with one resource into a stack.
+func importTestDeployment(t *testing.T, b *localBackend, stack backend.Stack) {
+	deployment, err := makeUntypedDeployment("a", "abc123",
+		"v1:4iF78gb0nF0=:v1:Co6IbTWYs/UdrjgY:FSrAWOFZnj9ealCUDdJL7LrUKXX9BA==")
+	assert.NoError(t, err)
+	t.Setenv("PULUMI_CONFIG_PASSPHRASE", "abc123")
+	assert.NoError(t, b.ImportDeployment(context.Background(), stack, deployment))
+}
+
+// testStackResources returns the resources of a stack, as saved.
+func testStackResources(t *testing.T, b *localBackend, name string) []*resource.State {
+	ref, err := b.ParseStackReference(name)
+	assert.NoError(t, err)
+	stack, err := b.GetStack(context.Background(), ref)
+	assert.NoError(t, err)
+	if !assert.NotNil(t, stack) {
+		return nil
+	}
+	snap, err := stack.Snapshot(context.Background())
+	assert.NoError(t, err)
+	if !assert.NotNil(t, snap) {
+		return nil
+	}
+	return snap.Resources
+}
+
+func TestGzipCheckpoints(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "filestatebackend")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	t.Setenv("PROJECT_NAME", "")
+	stacksDir := filepath.Join(tmpDir, ".pulumi", "stacks", "proj")
+
+	t.Setenv(GzipEnvVar, "true")
+	b := newTestBackend(t, tmpDir)
+	stack := createTestStack(t, b, "proj/a")
+	importTestDeployment(t, b, stack)
+	assert.FileExists(t, filepath.Join(stacksDir, "a.json.gz"))
+	assert.NoFileExists(t, filepath.Join(stacksDir, "a.json"))
+	assert.Equal(t, []string{"proj/a"}, listTestStacks(t, b))
+	assert.Len(t, testStackResources(t, b, "proj/a"), 1)
+
+	// Compressed checkpoints are still read once compression is turned off, and replaced when saved.
+	t.Setenv(GzipEnvVar, "")
+	b = newTestBackend(t, tmpDir)
+	assert.Len(t, testStackResources(t, b, "proj/a"), 1)
+
+	importTestDeployment(t, b, stack)
+	assert.FileExists(t, filepath.Join(stacksDir, "a.json"))
+	assert.NoFileExists(t, filepath.Join(stacksDir, "a.json.gz"))
+	assert.FileExists(t, filepath.Join(stacksDir, "a.json.gz.bak"))
+	assert.Equal(t, []string{"proj/a"}, listTestStacks(t, b))
+}
+
+func TestCollectGarbage(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "filestatebackend")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	t.Setenv("PROJECT_NAME", "")
+	ctx := context.Background()
+
+	b := newTestBackend(t, tmpDir)
+	stack := createTestStack(t, b, "proj/a")
+	importTestDeployment(t, b, stack)
+	ref, err := b.getReference(stack.Ref())
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, b.addToHistory(ref, backend.UpdateInfo{Kind: apitype.UpdateUpdate}))
+		assert.NoError(t, b.backupStack(ref))
+	}
+	backups, err := listBucket(b.bucket, b.backupDirectory(ref))
+	assert.NoError(t, err)
+	assert.Len(t, backups, 3)
+
+	// A dry run only tells what would be removed: two history entries of two files each, and two backups.
+	stats, err := b.CollectGarbage(ctx, stack.Ref(), RetentionPolicy{KeepLast: 1}, true /*dryRun*/)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, stats.Files)
+	assert.True(t, stats.Bytes > 0)
+	history, err := b.GetHistory(ctx, stack.Ref(), 0, 0)
+	assert.NoError(t, err)
+	assert.Len(t, history, 3)
+
+	stats, err = b.CollectGarbage(ctx, nil, RetentionPolicy{KeepLast: 1}, false /*dryRun*/)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, stats.Files)
+	history, err = b.GetHistory(ctx, stack.Ref(), 0, 0)
+	assert.NoError(t, err)
+	assert.Len(t, history, 1)
+	backups, err = listBucket(b.bucket, b.backupDirectory(ref))
+	assert.NoError(t, err)
+	assert.Len(t, backups, 1)
+
+	// Everything older than the maximum age goes, including the .bak file, but the checkpoint stays.
+	time.Sleep(10 * time.Millisecond)
+	_, err = b.CollectGarbage(ctx, nil, RetentionPolicy{MaxAge: time.Millisecond}, false /*dryRun*/)
+	assert.NoError(t, err)
+	history, err = b.GetHistory(ctx, stack.Ref(), 0, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, history)
+	assert.NoFileExists(t, filepath.Join(tmpDir, ".pulumi", "stacks", "proj", "a.json.bak"))
+	assert.FileExists(t, filepath.Join(tmpDir, ".pulumi", "stacks", "proj", "a.json"))
+	assert.Len(t, testStackResources(t, b, "proj/a"), 1)
+}
+
+func TestRetentionPolicyFromEnv(t *testing.T) {
+	t.Setenv(RetainLastEnvVar, "5")
+	t.Setenv(RetainMaxAgeEnvVar, "720h")
+	policy, err := RetentionPolicyFromEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, RetentionPolicy{KeepLast: 5, MaxAge: 720 * time.Hour}, policy)
+
+	t.Setenv(RetainMaxAgeEnvVar, "a month")
+	_, err = RetentionPolicyFromEnv()
+	assert.Error(t, err)
+}
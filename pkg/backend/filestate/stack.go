@@ -105,13 +105,21 @@ func (s *localStack) ImportDeployment(ctx context.Context, deployment *apitype.U
 	return backend.ImportStackDeployment(ctx, s, deployment)
 }
 
+// StackSummary is a local stack summary. This adds the stack's tags atop the standard backend stack summary interface.
+type StackSummary interface {
+	backend.StackSummary
+	Tags() map[apitype.StackTagName]string // the stack's tags.
+}
+
 type localStackSummary struct {
 	name backend.StackReference
 	chk  *apitype.CheckpointV3
+	tags map[apitype.StackTagName]string
 }
 
-func newLocalStackSummary(name backend.StackReference, chk *apitype.CheckpointV3) localStackSummary {
-	return localStackSummary{name: name, chk: chk}
+func newLocalStackSummary(name backend.StackReference, chk *apitype.CheckpointV3,
+	tags map[apitype.StackTagName]string) StackSummary {
+	return localStackSummary{name: name, chk: chk, tags: tags}
 }
 
 func (lss localStackSummary) Name() backend.StackReference {
@@ -134,3 +142,7 @@ func (lss localStackSummary) ResourceCount() *int {
 	}
 	return nil
 }
+
+func (lss localStackSummary) Tags() map[apitype.StackTagName]string {
+	return lss.tags
+}
@@ -15,10 +15,13 @@
 package filestate
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
@@ -39,7 +42,6 @@ import (
 	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/encoding"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/config"
-	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/cmdutil"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/fsutil"
@@ -49,6 +51,13 @@ import (
 
 const DisableCheckpointBackupsEnvVar = "PULUMI_DISABLE_CHECKPOINT_BACKUPS"
 
+// GzipEnvVar makes the backend compress the checkpoints it writes with gzip. Checkpoints are read whether they are
+// compressed or not, so it can be turned on and off at any time.
+const GzipEnvVar = "PULUMI_FILESTATE_GZIP"
+
+// gzipExt is the extension added to the paths of compressed checkpoints.
+const gzipExt = ".gz"
+
 // DisableIntegrityChecking can be set to true to disable checkpoint state integrity verification.  This is not
 // recommended, because it could mean proceeding even in the face of a corrupted checkpoint state file, but can
 // be used as a last resort when a command absolutely must be run.
@@ -93,11 +102,11 @@ func (b *localBackend) newQuery(ctx context.Context,
 	return &localQuery{root: op.Root, proj: op.Proj}, nil
 }
 
-func (b *localBackend) newUpdate(stackName tokens.QName, op backend.UpdateOperation) (*update, error) {
-	contract.Require(stackName != "", "stackName")
+func (b *localBackend) newUpdate(ref localBackendReference, op backend.UpdateOperation) (*update, error) {
+	contract.Require(ref.name != "", "ref")
 
 	// Construct the deployment target.
-	target, err := b.getTarget(stackName, op.StackConfiguration.Config, op.StackConfiguration.Decrypter)
+	target, err := b.getTarget(ref, op.StackConfiguration.Config, op.StackConfiguration.Decrypter)
 	if err != nil {
 		return nil, err
 	}
@@ -111,27 +120,28 @@ func (b *localBackend) newUpdate(stackName tokens.QName, op backend.UpdateOperat
 	}, nil
 }
 
-func (b *localBackend) getTarget(stackName tokens.QName, cfg config.Map, dec config.Decrypter) (*deploy.Target, error) {
-	snapshot, _, err := b.getStack(stackName)
+func (b *localBackend) getTarget(ref localBackendReference, cfg config.Map,
+	dec config.Decrypter) (*deploy.Target, error) {
+	snapshot, _, err := b.getStack(ref)
 	if err != nil {
 		return nil, err
 	}
 	return &deploy.Target{
-		Name:      stackName,
+		Name:      ref.name,
 		Config:    cfg,
 		Decrypter: dec,
 		Snapshot:  snapshot,
 	}, nil
 }
 
-func (b *localBackend) getStack(name tokens.QName) (*deploy.Snapshot, string, error) {
-	if name == "" {
+func (b *localBackend) getStack(ref localBackendReference) (*deploy.Snapshot, string, error) {
+	if ref.name == "" {
 		return nil, "", errors.New("invalid empty stack name")
 	}
 
-	file := b.stackPath(name)
+	file := b.stackPath(ref)
 
-	chk, err := b.getCheckpoint(name)
+	chk, err := b.getCheckpoint(ref)
 	if err != nil {
 		return nil, file, fmt.Errorf("failed to load checkpoint: %w", err)
 	}
@@ -153,27 +163,51 @@ func (b *localBackend) getStack(name tokens.QName) (*deploy.Snapshot, string, er
 }
 
 // GetCheckpoint loads a checkpoint file for the given stack in this project, from the current project workspace.
-func (b *localBackend) getCheckpoint(stackName tokens.QName) (*apitype.CheckpointV3, error) {
-	chkpath := b.stackPath(stackName)
+func (b *localBackend) getCheckpoint(ref localBackendReference) (*apitype.CheckpointV3, error) {
+	chkpath := b.stackPath(ref)
 	bytes, err := b.bucket.ReadAll(context.TODO(), chkpath)
 	if err != nil {
 		return nil, err
 	}
+	if strings.HasSuffix(chkpath, gzipExt) {
+		if bytes, err = decompressCheckpoint(bytes); err != nil {
+			return nil, fmt.Errorf("decompressing checkpoint %s: %w", chkpath, err)
+		}
+	}
 
 	return stack.UnmarshalVersionedCheckpointToLatestCheckpoint(bytes)
 }
 
-func (b *localBackend) saveStack(name tokens.QName, snap *deploy.Snapshot, sm secrets.Manager) (string, error) {
+func compressCheckpoint(byts []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(byts); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompressCheckpoint(byts []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(byts))
+	if err != nil {
+		return nil, err
+	}
+	defer contract.IgnoreClose(r)
+	return ioutil.ReadAll(r)
+}
+
+func (b *localBackend) saveStack(ref localBackendReference, snap *deploy.Snapshot,
+	sm secrets.Manager) (string, error) {
 	// Make a serializable stack and then use the encoder to encode it.
-	file := b.stackPath(name)
-	m, ext := encoding.Detect(file)
+	file := b.checkpointPath(ref, b.gzip)
+	m, ext := encoding.Detect(strings.TrimSuffix(file, gzipExt))
 	if m == nil {
 		return "", fmt.Errorf("resource serialization failed; illegal markup extension: '%v'", ext)
 	}
-	if filepath.Ext(file) == "" {
-		file = file + ext
-	}
-	chk, err := stack.SerializeCheckpoint(name, snap, sm, false /* showSecrets */)
+	chk, err := stack.SerializeCheckpoint(ref.name, snap, sm, false /* showSecrets */)
 	if err != nil {
 		return "", fmt.Errorf("serializaing checkpoint: %w", err)
 	}
@@ -181,10 +215,21 @@ func (b *localBackend) saveStack(name tokens.QName, snap *deploy.Snapshot, sm se
 	if err != nil {
 		return "", fmt.Errorf("An IO error occurred while marshalling the checkpoint: %w", err)
 	}
+	if b.gzip {
+		if byts, err = compressCheckpoint(byts); err != nil {
+			return "", fmt.Errorf("compressing checkpoint: %w", err)
+		}
+	}
 
 	// Back up the existing file if it already exists.
 	bck := backupTarget(b.bucket, file)
 
+	// A checkpoint that was compressed, or not, when compression was turned the other way is replaced as well.
+	other := b.checkpointPath(ref, !b.gzip)
+	if hasOther, err := b.bucket.Exists(context.TODO(), other); err == nil && hasOther {
+		bck = backupTarget(b.bucket, other)
+	}
+
 	// And now write out the new snapshot file, overwriting that location.
 	if err = b.bucket.WriteAll(context.TODO(), file, byts, nil); err != nil {
 
@@ -219,7 +264,7 @@ func (b *localBackend) saveStack(name tokens.QName, snap *deploy.Snapshot, sm se
 		}
 	}
 
-	logging.V(7).Infof("Saved stack %s checkpoint to: %s (backup=%s)", name, file, bck)
+	logging.V(7).Infof("Saved stack %s checkpoint to: %s (backup=%s)", ref.qualifiedName(), file, bck)
 
 	// And if we are retaining historical checkpoint information, write it out again
 	if cmdutil.IsTruthy(os.Getenv("PULUMI_RETAIN_CHECKPOINTS")) {
@@ -244,14 +289,15 @@ func (b *localBackend) saveStack(name tokens.QName, snap *deploy.Snapshot, sm se
 }
 
 // removeStack removes information about a stack from the current workspace.
-func (b *localBackend) removeStack(name tokens.QName) error {
-	contract.Require(name != "", "name")
+func (b *localBackend) removeStack(ref localBackendReference) error {
+	contract.Require(ref.name != "", "ref")
 
 	// Just make a backup of the file and don't write out anything new.
-	file := b.stackPath(name)
+	file := b.stackPath(ref)
 	backupTarget(b.bucket, file)
+	b.removeStackMetadata(ref)
 
-	historyDir := b.historyDirectory(name)
+	historyDir := b.historyDirectory(ref)
 	return removeAllByPrefix(b.bucket, historyDir)
 }
 
@@ -267,8 +313,8 @@ func backupTarget(bucket Bucket, file string) string {
 }
 
 // backupStack copies the current Checkpoint file to ~/.pulumi/backups.
-func (b *localBackend) backupStack(name tokens.QName) error {
-	contract.Require(name != "", "name")
+func (b *localBackend) backupStack(ref localBackendReference) error {
+	contract.Require(ref.name != "", "ref")
 
 	// Exit early if backups are disabled.
 	if cmdutil.IsTruthy(os.Getenv(DisableCheckpointBackupsEnvVar)) {
@@ -276,48 +322,70 @@ func (b *localBackend) backupStack(name tokens.QName) error {
 	}
 
 	// Read the current checkpoint file. (Assuming it aleady exists.)
-	stackPath := b.stackPath(name)
+	stackPath := b.stackPath(ref)
 	byts, err := b.bucket.ReadAll(context.TODO(), stackPath)
 	if err != nil {
 		return err
 	}
 
 	// Get the backup directory.
-	backupDir := b.backupDirectory(name)
+	backupDir := b.backupDirectory(ref)
 
-	// Write out the new backup checkpoint file.
+	// Write out the new backup checkpoint file, compressed if the checkpoint is.
 	stackFile := filepath.Base(stackPath)
+	var gz string
+	if strings.HasSuffix(stackFile, gzipExt) {
+		gz = gzipExt
+		stackFile = strings.TrimSuffix(stackFile, gzipExt)
+	}
 	ext := filepath.Ext(stackFile)
 	base := strings.TrimSuffix(stackFile, ext)
-	backupFile := fmt.Sprintf("%s.%v%s", base, time.Now().UnixNano(), ext)
+	backupFile := fmt.Sprintf("%s.%v%s%s", base, time.Now().UnixNano(), ext, gz)
 	return b.bucket.WriteAll(context.TODO(), filepath.Join(backupDir, backupFile), byts, nil)
 }
 
-func (b *localBackend) stackPath(stack tokens.QName) string {
-	path := filepath.Join(b.StateDir(), workspace.StackDir)
-	if stack != "" {
-		path = filepath.Join(path, fsutil.QnamePath(stack)+".json")
+func (b *localBackend) stacksDirectory() string {
+	return filepath.Join(b.StateDir(), workspace.StackDir)
+}
+
+// stackPath returns the path of the checkpoint of a stack. The checkpoint stays compressed, or not, until the stack is
+// saved again, so an existing checkpoint is looked for first.
+func (b *localBackend) stackPath(ref localBackendReference) string {
+	for _, compressed := range []bool{b.gzip, !b.gzip} {
+		file := b.checkpointPath(ref, compressed)
+		if exists, err := b.bucket.Exists(context.TODO(), file); err == nil && exists {
+			return file
+		}
 	}
+	return b.checkpointPath(ref, b.gzip)
+}
 
-	return path
+// checkpointPath returns the path of the checkpoint of a stack, when it is compressed or not.
+func (b *localBackend) checkpointPath(ref localBackendReference, compressed bool) string {
+	contract.Require(ref.name != "", "ref")
+	file := filepath.Join(b.stacksDirectory(), fsutil.QnamePath(ref.qualifiedName())+".json")
+	if compressed {
+		file += gzipExt
+	}
+	return file
 }
 
-func (b *localBackend) historyDirectory(stack tokens.QName) string {
-	contract.Require(stack != "", "stack")
-	return filepath.Join(b.StateDir(), workspace.HistoryDir, fsutil.QnamePath(stack))
+func (b *localBackend) historyDirectory(ref localBackendReference) string {
+	contract.Require(ref.name != "", "ref")
+	return filepath.Join(b.StateDir(), workspace.HistoryDir, fsutil.QnamePath(ref.qualifiedName()))
 }
 
-func (b *localBackend) backupDirectory(stack tokens.QName) string {
-	contract.Require(stack != "", "stack")
-	return filepath.Join(b.StateDir(), workspace.BackupDir, fsutil.QnamePath(stack))
+func (b *localBackend) backupDirectory(ref localBackendReference) string {
+	contract.Require(ref.name != "", "ref")
+	return filepath.Join(b.StateDir(), workspace.BackupDir, fsutil.QnamePath(ref.qualifiedName()))
 }
 
 // getHistory returns locally stored update history. The first element of the result will be
 // the most recent update record.
-func (b *localBackend) getHistory(name tokens.QName, pageSize int, page int) ([]backend.UpdateInfo, error) {
-	contract.Require(name != "", "name")
+func (b *localBackend) getHistory(ref localBackendReference, pageSize int, page int) ([]backend.UpdateInfo, error) {
+	contract.Require(ref.name != "", "ref")
 
-	dir := b.historyDirectory(name)
+	dir := b.historyDirectory(ref)
 	// TODO: we could consider optimizing the list operation using `page` and `pageSize`.
 	// Unfortunately, this is mildly invasive given the gocloud List API.
 	allFiles, err := listBucket(b.bucket, dir)
@@ -381,12 +449,12 @@ func (b *localBackend) getHistory(name tokens.QName, pageSize int, page int) ([]
 	return updates, nil
 }
 
-func (b *localBackend) renameHistory(oldName tokens.QName, newName tokens.QName) error {
-	contract.Require(oldName != "", "oldName")
-	contract.Require(newName != "", "newName")
+func (b *localBackend) renameHistory(oldRef localBackendReference, newRef localBackendReference) error {
+	contract.Require(oldRef.name != "", "oldRef")
+	contract.Require(newRef.name != "", "newRef")
 
-	oldHistory := b.historyDirectory(oldName)
-	newHistory := b.historyDirectory(newName)
+	oldHistory := b.historyDirectory(oldRef)
+	newHistory := b.historyDirectory(newRef)
 
 	allFiles, err := listBucket(b.bucket, oldHistory)
 	if err != nil {
@@ -403,7 +471,7 @@ func (b *localBackend) renameHistory(oldName tokens.QName, newName tokens.QName)
 
 		// The filename format is <stack-name>-<timestamp>.[checkpoint|history].json, we need to change
 		// the stack name part but retain the other parts.
-		newFileName := string(newName) + fileName[strings.LastIndex(fileName, "-"):]
+		newFileName := string(newRef.name) + fileName[strings.LastIndex(fileName, "-"):]
 		newBlob := path.Join(newHistory, newFileName)
 
 		if err := b.bucket.Copy(context.TODO(), newBlob, oldBlob, nil); err != nil {
@@ -418,13 +486,13 @@ func (b *localBackend) renameHistory(oldName tokens.QName, newName tokens.QName)
 }
 
 // addToHistory saves the UpdateInfo and makes a copy of the current Checkpoint file.
-func (b *localBackend) addToHistory(name tokens.QName, update backend.UpdateInfo) error {
-	contract.Require(name != "", "name")
+func (b *localBackend) addToHistory(ref localBackendReference, update backend.UpdateInfo) error {
+	contract.Require(ref.name != "", "ref")
 
-	dir := b.historyDirectory(name)
+	dir := b.historyDirectory(ref)
 
 	// Prefix for the update and checkpoint files.
-	pathPrefix := path.Join(dir, fmt.Sprintf("%s-%d", name, time.Now().UnixNano()))
+	pathPrefix := path.Join(dir, fmt.Sprintf("%s-%d", ref.name, time.Now().UnixNano()))
 
 	// Save the history file.
 	byts, err := json.MarshalIndent(&update, "", "    ")
@@ -438,6 +506,10 @@ func (b *localBackend) addToHistory(name tokens.QName, update backend.UpdateInfo
 	}
 
 	// Make a copy of the checkpoint file. (Assuming it already exists.)
+	stackPath := b.stackPath(ref)
 	checkpointFile := fmt.Sprintf("%s.checkpoint.json", pathPrefix)
-	return b.bucket.Copy(context.TODO(), checkpointFile, b.stackPath(name), nil)
+	if strings.HasSuffix(stackPath, gzipExt) {
+		checkpointFile += gzipExt
+	}
+	return b.bucket.Copy(context.TODO(), checkpointFile, stackPath, nil)
 }
@@ -17,10 +17,21 @@ package backend
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/plugin"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/archive"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/result"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+	"github.com/pulumi/pulumi/sdk/v3/nodejs/npm"
+	"github.com/pulumi/pulumi/sdk/v3/python"
 )
 
 // PublishOperation publishes a PolicyPack to the backend.
@@ -62,3 +73,114 @@ type PolicyPack interface {
 	// all Policy Groups before it can be removed.
 	Remove(ctx context.Context, op PolicyPackOperation) error
 }
+
+// ArchivePolicyPack compresses the Policy Pack in dir into a .tgz, with its files in a "package" directory.
+func ArchivePolicyPack(dir string, proj *workspace.PolicyPackProject) ([]byte, error) {
+	// TODO[pulumi/pulumi#1334]: move to the language plugins so we don't have to hard code here.
+	if strings.EqualFold(proj.Runtime.Name(), "nodejs") {
+		packTarball, err := npm.Pack(dir, os.Stderr)
+		if err != nil {
+			return nil, fmt.Errorf("error running npm pack: %w", err)
+		}
+		return packTarball, nil
+	}
+
+	// npm pack puts all the files in a "package" subdirectory inside the .tgz it produces, so we'll do
+	// the same for other runtimes. That way, after unpacking, we can look for the PulumiPolicy.yaml inside the
+	// package directory to determine the runtime of the policy pack.
+	packTarball, err := archive.TGZ(dir, packageDir, true /*useDefaultExcludes*/)
+	if err != nil {
+		return nil, fmt.Errorf("error creating the .tgz: %w", err)
+	}
+	return packTarball, nil
+}
+
+const packageDir = "package"
+
+// InstallPolicyPack unpacks a Policy Pack archive, as made by ArchivePolicyPack, into finalDir and installs its
+// dependencies.
+func InstallPolicyPack(finalDir string, tgz io.ReadCloser) error {
+	// If part of the directory tree is missing, ioutil.TempDir will return an error, so make sure
+	// the path we're going to create the temporary folder in actually exists.
+	if err := os.MkdirAll(filepath.Dir(finalDir), 0700); err != nil {
+		return fmt.Errorf("creating plugin root: %w", err)
+	}
+
+	tempDir, err := ioutil.TempDir(filepath.Dir(finalDir), fmt.Sprintf("%s.tmp", filepath.Base(finalDir)))
+	if err != nil {
+		return fmt.Errorf("creating plugin directory %s: %w", tempDir, err)
+	}
+
+	// The policy pack files are actually in a directory called `package`.
+	tempPackageDir := filepath.Join(tempDir, packageDir)
+	if err := os.MkdirAll(tempPackageDir, 0700); err != nil {
+		return fmt.Errorf("creating plugin root: %w", err)
+	}
+
+	// If we early out of this function, try to remove the temp folder we created.
+	defer func() {
+		contract.IgnoreError(os.RemoveAll(tempDir))
+	}()
+
+	// Uncompress the policy pack.
+	err = archive.ExtractTGZ(tgz, tempDir)
+	if err != nil {
+		return err
+	}
+
+	logging.V(7).Infof("Unpacking policy pack %q %q\n", tempDir, finalDir)
+
+	// If two calls to `plugin install` for the same plugin are racing, the second one will be
+	// unable to rename the directory. That's OK, just ignore the error. The temp directory created
+	// as part of the install will be cleaned up when we exit by the defer above.
+	if err := os.Rename(tempPackageDir, finalDir); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("moving plugin: %w", err)
+	}
+
+	projPath := filepath.Join(finalDir, "PulumiPolicy.yaml")
+	proj, err := workspace.LoadPolicyPack(projPath)
+	if err != nil {
+		return fmt.Errorf("failed to load policy project at %s: %w", finalDir, err)
+	}
+
+	// TODO[pulumi/pulumi#1334]: move to the language plugins so we don't have to hard code here.
+	if strings.EqualFold(proj.Runtime.Name(), "nodejs") {
+		if err := completeNodeJSInstall(finalDir); err != nil {
+			return err
+		}
+	} else if strings.EqualFold(proj.Runtime.Name(), "python") {
+		if err := completePythonInstall(finalDir, projPath, proj); err != nil {
+			return err
+		}
+	}
+
+	fmt.Println("Finished installing policy pack")
+	fmt.Println()
+
+	return nil
+}
+
+func completeNodeJSInstall(finalDir string) error {
+	if bin, err := npm.Install(finalDir, false /*production*/, nil, os.Stderr); err != nil {
+		return fmt.Errorf("failed to install dependencies of policy pack; you may need to re-run `%s install` "+
+			"in %q before this policy pack works"+": %w", bin, finalDir, err)
+
+	}
+
+	return nil
+}
+
+func completePythonInstall(finalDir, projPath string, proj *workspace.PolicyPackProject) error {
+	const venvDir = "venv"
+	if err := python.InstallDependencies(finalDir, venvDir, false /*showOutput*/); err != nil {
+		return err
+	}
+
+	// Save project with venv info.
+	proj.Runtime.SetOption("virtualenv", venvDir)
+	if err := proj.Save(projPath); err != nil {
+		return fmt.Errorf("saving project at %s: %w", projPath, err)
+	}
+
+	return nil
+}
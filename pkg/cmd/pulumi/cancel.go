@@ -15,13 +15,16 @@
 package main
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/result"
 
 	"github.com/spf13/cobra"
 
+	"github.com/pulumi/pulumi/pkg/v3/backend"
 	"github.com/pulumi/pulumi/pkg/v3/backend/display"
+	"github.com/pulumi/pulumi/pkg/v3/backend/filestate"
 	"github.com/pulumi/pulumi/pkg/v3/backend/httpstate"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/diag/colors"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/cmdutil"
@@ -41,7 +44,12 @@ func newCancelCmd() *cobra.Command {
 			"inconsistent state if a resource operation was pending when the update was canceled.\n" +
 			"\n" +
 			"After this command completes successfully, the stack will be ready for further\n" +
-			"updates.",
+			"updates.\n" +
+			"\n" +
+			"For stacks stored in local or cloud buckets, this command breaks the locks held on the\n" +
+			"stack. A running update notices when it renews the lease on its lock, within a few minutes,\n" +
+			"and is then canceled. S3 buckets don't support the conditional writes these locks rely on,\n" +
+			"so two updates of a stack in S3 started at the same time may both fail to lock it.",
 		Run: cmdutil.RunResultFunc(func(cmd *cobra.Command, args []string) result.Result {
 			// Use the stack provided or, if missing, default to the current one.
 			if len(args) > 0 {
@@ -61,22 +69,41 @@ func newCancelCmd() *cobra.Command {
 				return result.FromError(err)
 			}
 
-			// Ensure that we are targeting the Pulumi cloud.
-			backend, ok := s.Backend().(httpstate.Backend)
-			if !ok {
-				return result.Error("the `cancel` command is not supported for local stacks")
-			}
-
 			// Ensure the user really wants to do this.
 			stackName := string(s.Ref().Name())
 			prompt := fmt.Sprintf("This will irreversibly cancel the currently running update for '%s'!", stackName)
+
+			var canceler updateCanceler
+			switch b := s.Backend().(type) {
+			case httpstate.Backend:
+				canceler = b
+			case filestate.Backend:
+				// Local stacks are canceled by breaking their locks, so show whose locks they are first.
+				locks, err := b.GetStackLocks(commandContext(), s.Ref())
+				if err != nil {
+					return result.FromError(err)
+				}
+				if len(locks) == 0 {
+					return result.Errorf("stack '%s' has no update running", stackName)
+				}
+				fmt.Printf("Stack '%s' is locked by:\n", stackName)
+				for _, l := range locks {
+					fmt.Printf("  %v\n", l)
+				}
+				prompt = fmt.Sprintf("This will irreversibly break the lock(s) on '%s'! "+
+					"Make sure their processes are no longer running.", stackName)
+				canceler = b
+			default:
+				return result.Error("the `cancel` command is not supported for this backend")
+			}
+
 			if cmdutil.Interactive() && (!yes && !confirmPrompt(prompt, stackName, opts)) {
 				fmt.Println("confirmation declined")
 				return result.Bail()
 			}
 
 			// Cancel the update.
-			if err := backend.CancelCurrentUpdate(commandContext(), s.Ref()); err != nil {
+			if err := canceler.CancelCurrentUpdate(commandContext(), s.Ref()); err != nil {
 				return result.FromError(err)
 			}
 
@@ -98,3 +125,8 @@ func newCancelCmd() *cobra.Command {
 
 	return cmd
 }
+
+// updateCanceler is a backend that can cancel the update running on a stack.
+type updateCanceler interface {
+	CancelCurrentUpdate(ctx context.Context, stackRef backend.StackReference) error
+}
@@ -84,7 +84,10 @@ func newLoginCmd() *cobra.Command {
 			"\n" +
 			"Azure Blob:\n" +
 			"\n" +
-			"    $ pulumi login azblob://my-pulumi-state-bucket\n",
+			"    $ pulumi login azblob://my-pulumi-state-bucket\n" +
+			"\n" +
+			"Logging in to a bucket created by an older version of the CLI moves its stacks under the directories of\n" +
+			"their projects, unless `PULUMI_FILESTATE_LEGACY_LAYOUT` is set. `pulumi state downgrade` moves them back.\n",
 		Args: cmdutil.MaximumNArgs(1),
 		Run: cmdutil.RunFunc(func(cmd *cobra.Command, args []string) error {
 			displayOptions := display.Options{
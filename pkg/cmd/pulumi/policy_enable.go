@@ -16,8 +16,13 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
 
 	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/pkg/v3/backend/filestate"
 	resourceanalyzer "github.com/pulumi/pulumi/pkg/v3/resource/analyzer"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/plugin"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/cmdutil"
@@ -35,15 +40,24 @@ func newPolicyEnableCmd() *cobra.Command {
 	args := policyEnableArgs{}
 
 	var cmd = &cobra.Command{
-		Use:   "enable <org-name>/<policy-pack-name> <latest|version>",
+		Use:   "enable <org-name>/<policy-pack-name>|<path> <latest|version>",
 		Args:  cmdutil.ExactArgs(2),
 		Short: "Enable a Policy Pack for a Pulumi organization",
 		Long: "Enable a Policy Pack for a Pulumi organization. " +
-			"Can specify latest to enable the latest version of the Policy Pack or a specific version number.",
+			"Can specify latest to enable the latest version of the Policy Pack or a specific version number.\n" +
+			"\n" +
+			"When logged into a bucket backend, the path of a local Policy Pack may be given instead of its name, " +
+			"in which case it is published to the bucket and its latest version is enabled.",
 		Run: cmdutil.RunFunc(func(cmd *cobra.Command, cliArgs []string) error {
-			// Obtain current PolicyPack, tied to the Pulumi service backend.
-			policyPack, err := requirePolicyPack(cliArgs[0])
-			if err != nil {
+			// Obtain current PolicyPack, tied to the Pulumi service backend. Bucket backends publish a Policy Pack
+			// given as the path of a local directory first, as everyone using the bucket has to be able to install it.
+			var policyPack backend.PolicyPack
+			var err error
+			if isPolicyPackDirectory(cliArgs[0]) {
+				if policyPack, err = publishLocalPolicyPack(cliArgs[0], cliArgs[1]); err != nil {
+					return err
+				}
+			} else if policyPack, err = requirePolicyPack(cliArgs[0]); err != nil {
 				return err
 			}
 
@@ -83,6 +97,32 @@ func newPolicyEnableCmd() *cobra.Command {
 	return cmd
 }
 
+// isPolicyPackDirectory returns whether a Policy Pack argument is the path of a local Policy Pack.
+func isPolicyPackDirectory(s string) bool {
+	_, err := os.Stat(filepath.Join(s, "PulumiPolicy.yaml"))
+	return err == nil
+}
+
+// publishLocalPolicyPack publishes the local Policy Pack of a directory to the current bucket backend, and returns it.
+func publishLocalPolicyPack(dir, version string) (backend.PolicyPack, error) {
+	policyPack, err := requirePolicyPack("/")
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := policyPack.Backend().(filestate.Backend); !ok {
+		return nil, fmt.Errorf("%s is a local policy pack; publish it with `pulumi policy publish` "+
+			"and enable it by name instead", dir)
+	}
+	if version != latestKeyword {
+		return nil, errors.New("local policy packs are enabled at the version they are published with; " +
+			"use latest instead")
+	}
+	if err = publishPolicyPack(policyPack, dir); err != nil {
+		return nil, err
+	}
+	return policyPack, nil
+}
+
 func loadPolicyConfigFromFile(file string) (map[string]*json.RawMessage, error) {
 	analyzerPolicyConfigMap, err := resourceanalyzer.LoadPolicyPackConfigFromFile(file)
 	if err != nil {
@@ -0,0 +1,97 @@
+// Copyright 2016-2022, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/pkg/v3/backend/display"
+	"github.com/pulumi/pulumi/pkg/v3/backend/filestate"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/cmdutil"
+)
+
+// requirePolicyGroupStack returns the stack whose Policy Group is managed, which must be stored in a bucket. The
+// Pulumi service manages the stacks of Policy Groups in its console.
+func requirePolicyGroupStack(stackName string) (filestate.Backend, backend.StackReference, error) {
+	s, err := requireStack(stackName, false, display.Options{Color: cmdutil.GetGlobalColorization()},
+		false /*setCurrent*/)
+	if err != nil {
+		return nil, nil, err
+	}
+	lb, ok := s.Backend().(filestate.Backend)
+	if !ok {
+		return nil, nil, errors.New("the stacks of policy groups of the Pulumi service are managed in its console")
+	}
+	return lb, s.Ref(), nil
+}
+
+func newPolicyGroupAddStackCmd() *cobra.Command {
+	var stack string
+	var cmd = &cobra.Command{
+		Use:   "add-stack <policy-group>",
+		Args:  cmdutil.ExactArgs(1),
+		Short: "Add a local stack to a Policy Group",
+		Long: "Add a local stack to a Policy Group\n" +
+			"\n" +
+			"The Policy Packs enabled for the Policy Group are then enforced on the updates of the stack, instead\n" +
+			"of the ones of the default Policy Group. A stack is in one Policy Group at most.",
+		Run: cmdutil.RunFunc(func(cmd *cobra.Command, args []string) error {
+			b, ref, err := requirePolicyGroupStack(stack)
+			if err != nil {
+				return err
+			}
+			if err = b.AddStackToPolicyGroup(commandContext(), args[0], ref); err != nil {
+				return err
+			}
+			fmt.Printf("Added stack %s to policy group %s\n", ref, args[0])
+			return nil
+		}),
+	}
+	cmd.PersistentFlags().StringVarP(
+		&stack, "stack", "s", "",
+		"The name of the stack to operate on. Defaults to the current stack")
+	return cmd
+}
+
+func newPolicyGroupRmStackCmd() *cobra.Command {
+	var stack string
+	var cmd = &cobra.Command{
+		Use:   "rm-stack <policy-group>",
+		Args:  cmdutil.ExactArgs(1),
+		Short: "Remove a local stack from a Policy Group",
+		Long: "Remove a local stack from a Policy Group\n" +
+			"\n" +
+			"The Policy Packs of the default Policy Group are then enforced on the updates of the stack.",
+		Run: cmdutil.RunFunc(func(cmd *cobra.Command, args []string) error {
+			b, ref, err := requirePolicyGroupStack(stack)
+			if err != nil {
+				return err
+			}
+			if err = b.RemoveStackFromPolicyGroup(commandContext(), args[0], ref); err != nil {
+				return err
+			}
+			fmt.Printf("Removed stack %s from policy group %s\n", ref, args[0])
+			return nil
+		}),
+	}
+	cmd.PersistentFlags().StringVarP(
+		&stack, "stack", "s", "",
+		"The name of the stack to operate on. Defaults to the current stack")
+	return cmd
+}
@@ -21,6 +21,7 @@ import (
 
 	"github.com/pulumi/pulumi/pkg/v3/backend"
 	"github.com/pulumi/pulumi/pkg/v3/backend/display"
+	"github.com/pulumi/pulumi/pkg/v3/backend/filestate"
 	"github.com/pulumi/pulumi/pkg/v3/backend/httpstate"
 	"github.com/pulumi/pulumi/pkg/v3/engine"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/plugin"
@@ -65,52 +66,63 @@ func newPolicyPublishCmd() *cobra.Command {
 				return err
 			}
 
-			//
-			// Load metadata about the current project.
-			//
-
-			proj, _, root, err := readPolicyProject()
-			if err != nil {
-				return err
-			}
+			return publishPolicyPack(policyPack, "")
+		}),
+	}
 
-			projinfo := &engine.PolicyPackInfo{Proj: proj, Root: root}
-			pwd, _, err := projinfo.GetPwdMain()
-			if err != nil {
-				return err
-			}
+	return cmd
+}
 
-			plugctx, err := plugin.NewContextWithRoot(cmdutil.Diag(), cmdutil.Diag(), nil, nil, pwd, projinfo.Root,
-				projinfo.Proj.Runtime.Options(), false, nil)
-			if err != nil {
-				return err
-			}
+// publishPolicyPack publishes the Policy Pack project of a directory, or of the current directory when dir is empty.
+func publishPolicyPack(policyPack backend.PolicyPack, dir string) error {
+	//
+	// Load metadata about the project.
+	//
 
-			//
-			// Attempt to publish the PolicyPack.
-			//
+	var proj *workspace.PolicyPackProject
+	var root string
+	var err error
+	if dir == "" {
+		proj, _, root, err = readPolicyProject()
+	} else {
+		proj, _, root, err = readPolicyProjectFrom(dir)
+	}
+	if err != nil {
+		return err
+	}
 
-			res := policyPack.Publish(commandContext(), backend.PublishOperation{
-				Root: root, PlugCtx: plugctx, PolicyPack: proj, Scopes: cancellationScopes})
-			if res != nil && res.Error() != nil {
-				return res.Error()
-			}
+	projinfo := &engine.PolicyPackInfo{Proj: proj, Root: root}
+	pwd, _, err := projinfo.GetPwdMain()
+	if err != nil {
+		return err
+	}
 
-			return nil
-		}),
+	plugctx, err := plugin.NewContextWithRoot(cmdutil.Diag(), cmdutil.Diag(), nil, nil, pwd, projinfo.Root,
+		projinfo.Proj.Runtime.Options(), false, nil)
+	if err != nil {
+		return err
 	}
 
-	return cmd
+	//
+	// Attempt to publish the PolicyPack.
+	//
+
+	res := policyPack.Publish(commandContext(), backend.PublishOperation{
+		Root: root, PlugCtx: plugctx, PolicyPack: proj, Scopes: cancellationScopes})
+	if res != nil && res.Error() != nil {
+		return res.Error()
+	}
+	return nil
 }
 
 func requirePolicyPack(policyPack string) (backend.PolicyPack, error) {
 	//
-	// Attempt to log into cloud backend.
+	// Attempt to log into the backend. Bucket backends store their Policy Packs and Policy Groups in the bucket.
 	//
 
 	cloudURL, err := workspace.GetCurrentCloudURL()
 	if err != nil {
-		return nil, fmt.Errorf("`pulumi policy` command requires the user to be logged into the Pulumi service: %w", err)
+		return nil, fmt.Errorf("`pulumi policy` command requires the user to be logged in: %w", err)
 
 	}
 
@@ -118,7 +130,12 @@ func requirePolicyPack(policyPack string) (backend.PolicyPack, error) {
 		Color: cmdutil.GetGlobalColorization(),
 	}
 
-	b, err := httpstate.Login(commandContext(), cmdutil.Diag(), cloudURL, displayOptions)
+	var b backend.Backend
+	if filestate.IsFileStateBackendURL(cloudURL) {
+		b, err = filestate.Login(cmdutil.Diag(), cloudURL)
+	} else {
+		b, err = httpstate.Login(commandContext(), cmdutil.Diag(), cloudURL, displayOptions)
+	}
 	if err != nil {
 		return nil, err
 	}
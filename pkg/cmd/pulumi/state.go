@@ -47,6 +47,9 @@ troubleshooting a stack or when performing specific edits that otherwise would r
 
 	cmd.AddCommand(newStateDeleteCommand())
 	cmd.AddCommand(newStateUnprotectCommand())
+	cmd.AddCommand(newStateGCCommand())
+	cmd.AddCommand(newStateUpgradeCommand())
+	cmd.AddCommand(newStateDowngradeCommand())
 	return cmd
 }
 
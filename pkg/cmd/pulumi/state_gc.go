@@ -0,0 +1,115 @@
+// Copyright 2016-2022, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/pkg/v3/backend/display"
+	"github.com/pulumi/pulumi/pkg/v3/backend/filestate"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/cmdutil"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/result"
+)
+
+func newStateGCCommand() *cobra.Command {
+	var stack string
+	var all bool
+	var keepLast int
+	var maxAge time.Duration
+	var dryRun bool
+
+	cmd := &cobra.Command{
+		Use:   "gc",
+		Short: "Remove old history and backups of local stacks",
+		Long: `Remove old history and backups of local stacks
+
+This command removes the update history, checkpoint backups and .bak files of a stack stored in a local or cloud
+bucket backend that are not retained. By default, the retention policy is the one set by the
+` + filestate.RetainLastEnvVar + ` and ` + filestate.RetainMaxAgeEnvVar + ` environment variables, which are also
+applied after every update. The current checkpoint of a stack is never removed.`,
+		Args: cmdutil.NoArgs,
+		Run: cmdutil.RunResultFunc(func(cmd *cobra.Command, args []string) result.Result {
+			opts := display.Options{
+				Color: cmdutil.GetGlobalColorization(),
+			}
+
+			policy, err := filestate.RetentionPolicyFromEnv()
+			if err != nil {
+				return result.FromError(err)
+			}
+			if cmd.Flags().Changed("keep-last") {
+				policy.KeepLast = keepLast
+			}
+			if cmd.Flags().Changed("max-age") {
+				policy.MaxAge = maxAge
+			}
+			if policy.IsZero() {
+				return result.Errorf("no retention policy; pass --keep-last or --max-age, or set %s or %s",
+					filestate.RetainLastEnvVar, filestate.RetainMaxAgeEnvVar)
+			}
+
+			var b backend.Backend
+			var stackRef backend.StackReference
+			if all {
+				if stack != "" {
+					return result.Error("only one of --stack or --all may be specified, not both")
+				}
+				if b, err = currentBackend(opts); err != nil {
+					return result.FromError(err)
+				}
+			} else {
+				s, err := requireStack(stack, false, opts, false /*setCurrent*/)
+				if err != nil {
+					return result.FromError(err)
+				}
+				b, stackRef = s.Backend(), s.Ref()
+			}
+
+			lb, ok := b.(filestate.Backend)
+			if !ok {
+				return result.Error("the `state gc` command is only supported for local stacks")
+			}
+
+			stats, err := lb.CollectGarbage(commandContext(), stackRef, policy, dryRun)
+			if err != nil {
+				return result.FromError(err)
+			}
+
+			verb := "Removed"
+			if dryRun {
+				verb = "Would remove"
+			}
+			fmt.Printf("%s %d file(s), %s\n", verb, stats.Files, humanize.Bytes(uint64(stats.Bytes)))
+			return nil
+		}),
+	}
+
+	cmd.PersistentFlags().StringVarP(
+		&stack, "stack", "s", "",
+		"The name of the stack to operate on. Defaults to the current stack")
+	cmd.Flags().BoolVar(&all, "all", false, "Remove the old history and backups of all the stacks of the backend")
+	cmd.Flags().IntVar(&keepLast, "keep-last", 0,
+		"The number of most recent history entries and backups of each kind to keep")
+	cmd.Flags().DurationVar(&maxAge, "max-age", 0,
+		"The age above which history entries and backups are removed, such as 720h")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Only show what would be removed")
+
+	return cmd
+}
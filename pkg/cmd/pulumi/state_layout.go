@@ -0,0 +1,105 @@
+// Copyright 2016-2022, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend/display"
+	"github.com/pulumi/pulumi/pkg/v3/backend/filestate"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/cmdutil"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/result"
+)
+
+// migrateBucketLayout migrates the current backend, which must be a bucket, to another layout after confirmation.
+func migrateBucketLayout(yes bool, prompt string, migrate func(filestate.Backend, context.Context) error) result.Result {
+	opts := display.Options{
+		Color: cmdutil.GetGlobalColorization(),
+	}
+
+	b, err := currentBackend(opts)
+	if err != nil {
+		return result.FromError(err)
+	}
+	lb, ok := b.(filestate.Backend)
+	if !ok {
+		return result.Error("only the layout of local or cloud bucket backends can be migrated")
+	}
+
+	if !(yes || skipConfirmations()) && !confirmPrompt(prompt, "yes", opts) {
+		fmt.Println("confirmation declined")
+		return result.Bail()
+	}
+
+	if err = migrate(lb, commandContext()); err != nil {
+		return result.FromError(err)
+	}
+	fmt.Printf("Migrated the stacks of %s\n", lb.URL())
+	return nil
+}
+
+func newStateUpgradeCommand() *cobra.Command {
+	var yes bool
+
+	cmd := &cobra.Command{
+		Use:   "upgrade",
+		Short: "Migrate the current backend to project-scoped stacks",
+		Long: `Migrate the current backend to project-scoped stacks
+
+This command moves every stack of a local or cloud bucket backend under the directory of its project, so that
+projects may have stacks of the same name. The project of a stack is its ` + "`pulumi:project`" + ` tag, or else the
+project of the resources in its checkpoint. Versions of the CLI that don't support project-scoped stacks can't use
+the backend anymore; ` + "`pulumi state downgrade`" + ` moves the stacks back.`,
+		Args: cmdutil.NoArgs,
+		Run: cmdutil.RunResultFunc(func(cmd *cobra.Command, args []string) result.Result {
+			return migrateBucketLayout(yes,
+				"This will move every stack of the backend under the directory of its project!",
+				filestate.Backend.Upgrade)
+		}),
+	}
+
+	cmd.PersistentFlags().BoolVarP(
+		&yes, "yes", "y", false,
+		"Skip confirmation prompts, and proceed with the migration anyway")
+	return cmd
+}
+
+func newStateDowngradeCommand() *cobra.Command {
+	var yes bool
+
+	cmd := &cobra.Command{
+		Use:   "downgrade",
+		Short: "Migrate the current backend back to unscoped stack names",
+		Long: `Migrate the current backend back to unscoped stack names
+
+This command moves the stacks of a local or cloud bucket backend out of the directories of their projects, as
+older versions of the CLI expect them. Stack names must be unique across projects for that. The backend keeps this
+layout until ` + "`pulumi state upgrade`" + ` is run.`,
+		Args: cmdutil.NoArgs,
+		Run: cmdutil.RunResultFunc(func(cmd *cobra.Command, args []string) result.Result {
+			return migrateBucketLayout(yes,
+				"This will move every stack of the backend out of the directory of its project!",
+				filestate.Backend.Downgrade)
+		}),
+	}
+
+	cmd.PersistentFlags().BoolVarP(
+		&yes, "yes", "y", false,
+		"Skip confirmation prompts, and proceed with the migration anyway")
+	return cmd
+}
@@ -500,7 +500,11 @@ func readPolicyProject() (*workspace.PolicyPackProject, string, string, error) {
 	if err != nil {
 		return nil, "", "", err
 	}
+	return readPolicyProjectFrom(pwd)
+}
 
+// readPolicyProjectFrom loads the Policy Pack project of a directory, searching upwards from it.
+func readPolicyProjectFrom(pwd string) (*workspace.PolicyPackProject, string, string, error) {
 	// Now that we got here, we have a path, so we will try to load it.
 	path, err := workspace.DetectPolicyPackPathFrom(pwd)
 	if err != nil {
@@ -7,11 +7,17 @@ import (
 	"github.com/pulumi/pulumi/pkg/v3/util/cancel"
 	"os"
 	"os/signal"
+	"time"
 )
 
+// terminateGracePeriod is how long a canceled engine is given to finish its
+// in-flight steps before its provider plugins are terminated.
+const terminateGracePeriod = 30 * time.Second
+
 type cancellationScope struct {
 	context *cancel.Context
 	sigint  chan os.Signal
+	closed  chan bool
 	done    chan bool
 }
 
@@ -21,21 +27,51 @@ func (s *cancellationScope) Context() *cancel.Context {
 
 func (s *cancellationScope) Close() {
 	signal.Stop(s.sigint)
-	close(s.sigint)
+	close(s.closed)
 	<-s.done
 }
 
-type cancellationScopeSource int
-func (cancellationScopeSource) NewScope(events chan<- engine.Event, isPreview bool) backend.CancellationScope {
-	cancelContext, _ := cancel.NewContext(context.Background())
+// cancellationScopeSource cancels the engine once ctx is done or on SIGINT,
+// and terminates it if it hasn't stopped after terminateGracePeriod.
+type cancellationScopeSource struct {
+	ctx context.Context
+}
+
+func (s cancellationScopeSource) NewScope(events chan<- engine.Event, isPreview bool) backend.CancellationScope {
+	// the engine context isn't parented to ctx, as that would terminate the
+	// engine right away instead of letting it cancel gracefully first
+	cancelContext, cancelSource := cancel.NewContext(context.Background())
 	c := &cancellationScope{
 		context: cancelContext,
-		sigint:  make(chan os.Signal),
+		sigint:  make(chan os.Signal, 1),
+		closed:  make(chan bool),
 		done:    make(chan bool),
 	}
 
+	ctx := s.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
 	go func() {
-		close(c.done)
+		defer close(c.done)
+		select {
+		case <-ctx.Done():
+		case <-c.sigint:
+		case <-c.closed:
+			return
+		}
+		cancelSource.Cancel()
+
+		timer := time.NewTimer(terminateGracePeriod)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			cancelSource.Terminate()
+		case <-c.sigint:
+			cancelSource.Terminate()
+		case <-c.closed:
+		}
 	}()
 	signal.Notify(c.sigint, os.Interrupt)
 
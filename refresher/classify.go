@@ -0,0 +1,115 @@
+package refresher
+
+import (
+	"fmt"
+	"github.com/hashicorp/go-multierror"
+	"github.com/pulumi/pulumi/pkg/v3/engine"
+	"github.com/pulumi/pulumi/pkg/v3/resource/deploy"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+)
+
+// ResourceState is the drift classification of a mapped resource.
+type ResourceState string
+
+const (
+	// StateManaged is a resource in the IaC state that matches the provider.
+	StateManaged ResourceState = "managed"
+	// StateModified is a resource in the IaC state that drifted in the provider.
+	StateModified ResourceState = "modified"
+	// StateGhost is a resource in the IaC state that no longer exists in the provider.
+	StateGhost ResourceState = "ghost"
+	// StateUnmanaged is a resource the stack only reads (e.g. with `.get()`) and
+	// whose lifecycle is not controlled by the IaC.
+	StateUnmanaged ResourceState = "unmanaged"
+)
+
+// DriftOptions tune which differences count as drift for a resource.
+type DriftOptions struct {
+	// IgnoreChanges holds the property paths set with the ignoreChanges
+	// resource option. Neither the checkpoint nor the refresh steps carry
+	// them, so only the paths supplied by the caller are ignored.
+	IgnoreChanges []string
+	// Secrets redacts the secret values of drifts.
+	Secrets SecretRedactor
+}
+
+// ClassifyResource returns the state of the resource of a refresh step and its
+// drifts, which compare the outputs of the checkpoint with the ones read from
+// the provider. Refresh steps carry no provider diff, and ignored property
+// paths never count as drift. An empty state means the step does not describe
+// a mappable resource.
+func ClassifyResource(step engine.StepEventMetadata, opts DriftOptions) (ResourceState, []Drift, error) {
+	switch step.Op {
+	case deploy.OpRead, deploy.OpReadReplacement:
+		return StateUnmanaged, nil, nil
+	case deploy.OpDelete:
+		return StateGhost, nil, nil
+	case deploy.OpSame:
+		if isExternal(step) {
+			return StateUnmanaged, nil, nil
+		}
+		return StateManaged, nil, nil
+	case deploy.OpUpdate:
+		if isExternal(step) {
+			return StateUnmanaged, nil, nil
+		}
+		drifts, err := CalcDrift(step, opts.Secrets)
+		drifts, filterErr := filterDrifts(drifts, opts)
+		if filterErr != nil {
+			err = multierror.Append(err, filterErr)
+		}
+		if len(drifts) == 0 {
+			return StateManaged, nil, err
+		}
+		return StateModified, drifts, err
+	default:
+		return "", nil, nil
+	}
+}
+
+func isExternal(step engine.StepEventMetadata) bool {
+	for _, state := range []*engine.StepEventStateMetadata{step.New, step.Old} {
+		if state != nil && state.State != nil {
+			return state.State.External
+		}
+	}
+	return false
+}
+
+// filterDrifts drops the drifts under ignored property paths.
+func filterDrifts(drifts []Drift, opts DriftOptions) ([]Drift, error) {
+	var merr *multierror.Error
+
+	ignored := make([]resource.PropertyPath, 0, len(opts.IgnoreChanges))
+	for _, ignoreChange := range opts.IgnoreChanges {
+		path, err := resource.ParsePropertyPath(ignoreChange)
+		if err != nil {
+			merr = multierror.Append(merr, fmt.Errorf("invalid ignoreChanges path %s: %w", ignoreChange, err))
+			continue
+		}
+		ignored = append(ignored, path)
+	}
+
+	var filtered []Drift
+	for _, drift := range drifts {
+		path, err := resource.ParsePropertyPath(drift.Path)
+		if err != nil {
+			merr = multierror.Append(merr, err)
+			continue
+		}
+		if containsPath(ignored, path) {
+			continue
+		}
+		filtered = append(filtered, drift)
+	}
+	return filtered, merr.ErrorOrNil()
+}
+
+func containsPath(paths []resource.PropertyPath, path resource.PropertyPath) bool {
+	for _, p := range paths {
+		if p.Contains(path) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package refresher
+
+import (
+	"github.com/pulumi/pulumi/pkg/v3/engine"
+	"github.com/pulumi/pulumi/pkg/v3/resource/deploy"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"testing"
+)
+
+func TestClassifyResource(t *testing.T) {
+	old := resource.NewPropertyMapFromMap(map[string]interface{}{
+		"instanceType": "t3.micro",
+		"tags":         map[string]interface{}{"Owner": "infra"},
+	})
+	drifted := resource.NewPropertyMapFromMap(map[string]interface{}{
+		"instanceType": "t3.large",
+		"tags":         map[string]interface{}{"Owner": "web"},
+	})
+	step := func(op deploy.StepOp, external bool) engine.StepEventMetadata {
+		return engine.StepEventMetadata{
+			Op:  op,
+			Old: &engine.StepEventStateMetadata{Outputs: old, State: &resource.State{External: external}},
+			New: &engine.StepEventStateMetadata{Outputs: drifted, State: &resource.State{External: external}},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		step   engine.StepEventMetadata
+		opts   DriftOptions
+		state  ResourceState
+		drifts []string
+	}{
+		{name: "same", step: step(deploy.OpSame, false), state: StateManaged},
+		{name: "deleted", step: step(deploy.OpDelete, false), state: StateGhost},
+		{name: "read", step: step(deploy.OpRead, false), state: StateUnmanaged},
+		{name: "external", step: step(deploy.OpUpdate, true), state: StateUnmanaged},
+		{name: "drifted", step: step(deploy.OpUpdate, false), state: StateModified, drifts: []string{"instanceType", "tags.Owner"}},
+		{name: "ignored", step: step(deploy.OpUpdate, false), opts: DriftOptions{IgnoreChanges: []string{"instanceType", "tags"}}, state: StateManaged},
+		{name: "partially ignored", step: step(deploy.OpUpdate, false), opts: DriftOptions{IgnoreChanges: []string{"tags.Owner"}}, state: StateModified, drifts: []string{"instanceType"}},
+		{name: "refresh", step: step(deploy.OpRefresh, false)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state, drifts, err := ClassifyResource(test.step, test.opts)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if state != test.state {
+				t.Errorf("expected state %q, got %q", test.state, state)
+			}
+			var paths []string
+			for _, drift := range drifts {
+				paths = append(paths, drift.Path)
+			}
+			if len(paths) != len(test.drifts) {
+				t.Fatalf("expected drifts %v, got %v", test.drifts, paths)
+			}
+			for i := range paths {
+				if paths[i] != test.drifts[i] {
+					t.Errorf("expected drifts %v, got %v", test.drifts, paths)
+				}
+			}
+		})
+	}
+}
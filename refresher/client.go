@@ -19,13 +19,13 @@ const (
 )
 
 type Client struct {
-	URL string
-	Ctx context.Context
-	Opts backend.UpdateOptions
+	URL     string
+	Ctx     context.Context
+	Opts    backend.UpdateOptions
 	Project *workspace.Project
 }
 
-func NewClient(ctx context.Context, url string) (*Client, error ) {
+func NewClient(ctx context.Context, url string) (*Client, error) {
 	var merr *multierror.Error
 	var err error
 	var project *workspace.Project
@@ -34,16 +34,15 @@ func NewClient(ctx context.Context, url string) (*Client, error ) {
 	}
 
 	var c = Client{
-		URL: url,
-		Ctx: ctx,
-		Opts: getOpts(),
+		URL:     url,
+		Ctx:     ctx,
+		Opts:    getOpts(),
 		Project: project,
 	}
 	return &c, nil
 }
 
-
-func (client *Client)GetHttpBackend(backend httpstate.Backend, url string) (*httpstate.CloudBackend) {
+func (client *Client) GetHttpBackend(backend httpstate.Backend, url string) *httpstate.CloudBackend {
 	httpCloudBackend := httpstate.CloudBackend{
 		D:              cmdutil.Diag(),
 		Url:            url,
@@ -65,7 +64,7 @@ func (client *Client) GetUpdateOpts() *backend.UpdateOperation {
 		Opts:               client.Opts,
 		SecretsManager:     nil,
 		StackConfiguration: backend.StackConfiguration{},
-		Scopes:             backend.CancellationScopeSource(cancellationScopeSource(0)),
+		Scopes:             backend.CancellationScopeSource(cancellationScopeSource{ctx: client.Ctx}),
 	}
 	return &updateOpts
 
@@ -79,7 +78,7 @@ func (client *Client) GetDryRunApplierOpts() *backend.ApplierOptions {
 	return &opts
 }
 
-func getOpts() backend.UpdateOptions{
+func getOpts() backend.UpdateOptions {
 	var opts backend.UpdateOptions
 	opts.Display = display.Options{
 		Color:                cmdutil.GetGlobalColorization(),
@@ -123,4 +122,4 @@ func getProject() (*workspace.Project, error) {
 		return nil, err
 	}
 	return project, err
-}
\ No newline at end of file
+}
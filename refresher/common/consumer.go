@@ -2,32 +2,32 @@ package common
 
 import (
 	"fmt"
-	"github.com/infralight/go-kit/db/elasticsearch"
-	"github.com/infralight/go-kit/db/mongo"
 	"github.com/infralight/pulumi/refresher/config"
+	"github.com/infralight/pulumi/refresher/storage"
+	"github.com/rs/zerolog"
 )
 
 type Consumer struct {
-	MongoDb *mongo.Client
-	Config  *config.Config
-	ES      *elasticsearch.Client
+	Config *config.Config
+	Sink   storage.Sink
+	Store  storage.InventoryStore
 }
 
-func NewConsumer(cfg *config.Config) (*Consumer, error) {
+func NewConsumer(cfg *config.Config, logger *zerolog.Logger) (*Consumer, error) {
 	var err error
 
 	consumer := &Consumer{
 		Config: cfg,
 	}
 
-	consumer.MongoDb, err = mongo.NewClient(cfg.MongoURI)
+	consumer.Sink, err = storage.NewSink(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to mongoDB: %v", err)
+		return nil, fmt.Errorf("failed to create sink: %v", err)
 	}
 
-	consumer.ES, err = elasticsearch.NewClient(cfg.ElasticsearchUrl)
+	consumer.Store, err = storage.NewInventoryStore(cfg, logger)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create to ES client: %v", err)
+		return nil, fmt.Errorf("failed to create inventory store: %v", err)
 	}
 
 	return consumer, nil
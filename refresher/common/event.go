@@ -0,0 +1,54 @@
+package common
+
+import "errors"
+
+type PulumiMapperEvent struct {
+	AccountId        string `json:"accountId"`
+	IntegrationId    string `json:"integrationId"`
+	StackId          string `json:"stackId"`
+	ProjectName      string `json:"projectName"`
+	StackName        string `json:"stackName"`
+	OrganizationName string `json:"organizationName"`
+	LastUpdated      int64  `json:"lastUpdated"`
+	ResourceCount    int    `json:"resourceCounts"`
+	AwsIntegrationId string `json:"awsIntegrationId,omitempty"`
+	// BackendUrl points to a self-managed backend (e.g. file:// or s3://) to
+	// read the stack from instead of the Pulumi Service.
+	BackendUrl string `json:"backendUrl,omitempty"`
+	// CheckpointFile is the path of a `pulumi stack export` file or a raw
+	// checkpoint to scan offline.
+	CheckpointFile string `json:"checkpointFile,omitempty"`
+	// IgnoreChanges maps a resource URN or type token to the property paths
+	// set with its ignoreChanges option. Neither the checkpoint nor refresh
+	// persist them, so these are the only paths left out of drifts.
+	IgnoreChanges map[string][]string `json:"ignoreChanges,omitempty"`
+	// AllowMassDeletion lets a run delete more of the stack's assets than
+	// MASS_DELETION_THRESHOLD allows, e.g. when a stack was intentionally
+	// torn down.
+	AllowMassDeletion bool `json:"allowMassDeletion,omitempty"`
+}
+
+// IgnoreChangesFor returns the ignored property paths of a resource.
+func (e *PulumiMapperEvent) IgnoreChangesFor(urn, resourceType string) []string {
+	var ignoreChanges []string
+	ignoreChanges = append(ignoreChanges, e.IgnoreChanges[resourceType]...)
+	ignoreChanges = append(ignoreChanges, e.IgnoreChanges[urn]...)
+	return ignoreChanges
+}
+
+// IsSelfManaged returns whether the stack is read from a checkpoint file or a
+// self-managed backend rather than the Pulumi Service.
+func (e *PulumiMapperEvent) IsSelfManaged() bool {
+	return e.CheckpointFile != "" || e.BackendUrl != ""
+}
+
+func (e *PulumiMapperEvent) Validate() error {
+	if e.AccountId == "" || e.IntegrationId == "" || e.StackName == "" || e.ProjectName == "" || e.StackId == "" {
+		return errors.New("failed, invalid message attributes missing [account id / integration id / stackName / projectName / organizationName]")
+	}
+	// self-managed stacks are not owned by a Pulumi Service organization
+	if e.OrganizationName == "" && !e.IsSelfManaged() {
+		return errors.New("failed, invalid message attributes missing [account id / integration id / stackName / projectName / organizationName]")
+	}
+	return nil
+}
@@ -4,20 +4,36 @@ import (
 	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/hashicorp/go-multierror"
 	"github.com/pulumi/pulumi/pkg/v3/backend/httpstate"
 	"os"
 	"strconv"
+	"time"
 )
 
-var PULUMI_AWS_CREDS_ENVS = []string{
-	"AWS_ACCESS_KEY_ID",
-	"AWS_ACCESS_KEY",
-	"AWS_SECRET_ACCESS_KEY",
-	"AWS_SECRET_KEY",
-	"AWS_SESSION_TOKEN",
-}
+const (
+	S3Sink     = "s3"
+	FileSink   = "file"
+	MemorySink = "memory"
+)
+
+const (
+	DatabaseInventoryStore = "database"
+	MemoryInventoryStore   = "memory"
+)
+
+const (
+	NoCompression   = "none"
+	GzipCompression = "gzip"
+)
+
+const (
+	defaultStackTimeout  = 30 * time.Minute
+	defaultRetryAttempts = 3
+	defaultMetricsAddr   = ":9090"
+)
 
 type Config struct {
 	RunImmediately             bool
@@ -26,21 +42,30 @@ type Config struct {
 	PulumiToken                string
 	PulumiUrl                  string
 	FetchedResourcesBucket     string
+	SinkType                   string
+	InventoryStoreType         string
+	OutputDir                  string
 	AwsRegion                  string
-	PulumiIntegrationId        string
-	AccountId                  string
-	ProjectName                string
-	StackName                  string
-	OrganizationName           string
-	StackId                    string
-	ResourceCount              int
-	LastUpdate                 int
-	ClientAWSIntegrationId     string
 	FireflyAWSRoleARN          string
 	FireflyAWSWebIdentityToken string
 	ElasticsearchUrl           string
 	EngineAccumulatorDynamo    string
 	EngineAccumulatorTTL       int
+	WorkerMode                 bool
+	WorkerConcurrency          int
+	QueueUrl                   string
+	DeadLetterQueueUrl         string
+	QueueVisibilityTimeout     int
+	QueueFile                  string
+	DeadLetterFile             string
+	MetricsAddr                string
+	OutputCompression          string
+	OutputChunkSize            int
+	SecretsHashSalt            string
+	FullRefreshInterval        time.Duration
+	MassDeletionThreshold      float64
+	StackTimeout               time.Duration
+	RetryAttempts              int
 }
 
 func LoadConfig() (*Config, error) {
@@ -56,12 +81,8 @@ func LoadConfig() (*Config, error) {
 		cfg.DebugMode = true
 	}
 
-	if cfg.MongoURI = os.Getenv("MONGO_URI"); cfg.MongoURI == "" {
-		merr = multierror.Append(merr, errors.New("failed, environment variable MONGO_URI must be provided"))
-	}
-
-	if cfg.PulumiToken = os.Getenv(httpstate.AccessTokenEnvVar); cfg.PulumiToken == "" {
-		merr = multierror.Append(merr, errors.New(fmt.Sprintf("failed, environment variable %s must be provided", httpstate.AccessTokenEnvVar)))
+	if cfg.WorkerMode, err = strconv.ParseBool(os.Getenv("WORKER_MODE")); err != nil {
+		cfg.WorkerMode = false
 	}
 
 	if cfg.PulumiUrl = os.Getenv("PULUMI_URL"); cfg.PulumiUrl == "" {
@@ -74,91 +95,193 @@ func LoadConfig() (*Config, error) {
 		}
 	}
 
-	if cfg.FetchedResourcesBucket = os.Getenv("FETCHED_RESOURCES_BUCKET"); cfg.FetchedResourcesBucket == "" {
-		merr = multierror.Append(merr, errors.New("failed, environment variable FETCHED_RESOURCES_BUCKET must be provided"))
+	merr = loadSinkConfig(cfg, merr)
+	merr = loadInventoryStoreConfig(cfg, merr)
+
+	// when set, secrets are replaced with a salted hash of their value instead
+	// of a fixed mask, so drifts of secrets can still be detected
+	cfg.SecretsHashSalt = os.Getenv("SECRETS_HASH_SALT")
+
+	// when set, stacks are fully refreshed at most once in the interval, and
+	// are otherwise mapped from their checkpoint (or skipped if unchanged)
+	if interval := os.Getenv("FULL_REFRESH_INTERVAL"); interval != "" {
+		if cfg.FullRefreshInterval, err = time.ParseDuration(interval); err != nil {
+			merr = multierror.Append(merr, fmt.Errorf("failed, invalid FULL_REFRESH_INTERVAL %s: %w", interval, err))
+		}
 	}
 
-	if cfg.PulumiIntegrationId = os.Getenv("INTEGRATION_ID"); cfg.PulumiIntegrationId == "" {
-		merr = multierror.Append(merr, errors.New("failed, environment variable INTEGRATION_ID must be provided"))
+	// a stack's run is canceled once it takes longer than its timeout, so a
+	// hung provider plugin doesn't block the job forever
+	cfg.StackTimeout = defaultStackTimeout
+	if timeout := os.Getenv("STACK_TIMEOUT"); timeout != "" {
+		if cfg.StackTimeout, err = time.ParseDuration(timeout); err != nil {
+			merr = multierror.Append(merr, fmt.Errorf("failed, invalid STACK_TIMEOUT %s: %w", timeout, err))
+		}
 	}
 
-	if cfg.AccountId = os.Getenv("ACCOUNT_ID"); cfg.AccountId == "" {
-		merr = multierror.Append(merr, errors.New("failed, environment variable ACCOUNT_ID must be provided"))
+	if cfg.RetryAttempts, err = strconv.Atoi(os.Getenv("RETRY_ATTEMPTS")); err != nil || cfg.RetryAttempts < 1 {
+		cfg.RetryAttempts = defaultRetryAttempts
 	}
 
-	if cfg.ProjectName = os.Getenv("PROJECT_NAME"); cfg.ProjectName == "" {
-		merr = multierror.Append(merr, errors.New("failed, environment variable PROJECT_NAME must be provided"))
+	// when set, runs that would delete more than this fraction of a stack's
+	// previously mapped assets fail instead
+	if threshold := os.Getenv("MASS_DELETION_THRESHOLD"); threshold != "" {
+		if cfg.MassDeletionThreshold, err = strconv.ParseFloat(threshold, 64); err != nil || cfg.MassDeletionThreshold < 0 || cfg.MassDeletionThreshold > 1 {
+			merr = multierror.Append(merr, fmt.Errorf("failed, MASS_DELETION_THRESHOLD must be a fraction between 0 and 1, got %s", threshold))
+		}
 	}
 
-	if cfg.StackName = os.Getenv("STACK_NAME"); cfg.StackName == "" {
-		merr = multierror.Append(merr, errors.New("failed, environment variable STACK_NAME must be provided"))
+	if cfg.WorkerMode {
+		if cfg.WorkerConcurrency, err = strconv.Atoi(os.Getenv("WORKER_CONCURRENCY")); err != nil || cfg.WorkerConcurrency < 1 {
+			cfg.WorkerConcurrency = 1
+		}
+
+		if cfg.QueueVisibilityTimeout, err = strconv.Atoi(os.Getenv("QUEUE_VISIBILITY_TIMEOUT")); err != nil {
+			cfg.QueueVisibilityTimeout = 0
+		}
+
+		// when no SQS queue is given, messages are read as JSON lines from
+		// QUEUE_FILE (or stdin), which is mostly useful for local testing
+		cfg.QueueUrl = os.Getenv("QUEUE_URL")
+		cfg.DeadLetterQueueUrl = os.Getenv("DEAD_LETTER_QUEUE_URL")
+		cfg.QueueFile = os.Getenv("QUEUE_FILE")
+		cfg.DeadLetterFile = os.Getenv("DEAD_LETTER_FILE")
+
+		// the worker exposes prometheus metrics on this address, unless it
+		// is set to "off"
+		if cfg.MetricsAddr = os.Getenv("METRICS_ADDR"); cfg.MetricsAddr == "" {
+			cfg.MetricsAddr = defaultMetricsAddr
+		}
 	}
 
-	if cfg.OrganizationName = os.Getenv("ORGANIZATION_NAME"); cfg.OrganizationName == "" {
-		merr = multierror.Append(merr, errors.New("failed, environment variable ORGANIZATION_NAME must be provided"))
+	merr = loadServiceCredentials(cfg, merr)
+
+	return cfg, merr.ErrorOrNil()
+}
+
+// usesServices returns whether the configuration uses any of the services the
+// mapper runs against in production: the S3 sink, the SQS queue or the
+// database inventory store.
+func (cfg *Config) usesServices() bool {
+	return cfg.SinkType == S3Sink || cfg.InventoryStoreType == DatabaseInventoryStore ||
+		(cfg.WorkerMode && cfg.QueueUrl != "")
+}
+
+// loadServiceCredentials loads the service's AWS web identity and the Pulumi
+// access token. They are only required along with the services they are used
+// for, so the mapper can run locally with the file sink and the memory store.
+func loadServiceCredentials(cfg *Config, merr *multierror.Error) *multierror.Error {
+	cfg.PulumiToken = os.Getenv(httpstate.AccessTokenEnvVar)
+	cfg.FireflyAWSRoleARN = os.Getenv("AWS_ROLE_ARN")
+	cfg.FireflyAWSWebIdentityToken = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	if !cfg.usesServices() {
+		return merr
 	}
 
-	if cfg.StackId = os.Getenv("STACK_ID"); cfg.StackId == "" {
-		merr = multierror.Append(merr, errors.New("failed, environment variable STACK_ID must be provided"))
+	if cfg.PulumiToken == "" {
+		merr = multierror.Append(merr, errors.New(fmt.Sprintf("failed, environment variable %s must be provided", httpstate.AccessTokenEnvVar)))
 	}
 
-	if cfg.FireflyAWSRoleARN = os.Getenv("AWS_ROLE_ARN"); cfg.FireflyAWSRoleARN == "" {
+	if cfg.FireflyAWSRoleARN == "" {
 		merr = multierror.Append(merr, errors.New("failed, environment variable AWS_ROLE_ARN must be provided"))
 	}
 
-	if cfg.FireflyAWSWebIdentityToken = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"); cfg.FireflyAWSWebIdentityToken == "" {
+	if cfg.FireflyAWSWebIdentityToken == "" {
 		merr = multierror.Append(merr, errors.New("failed, environment variable AWS_WEB_IDENTITY_TOKEN_FILE must be provided"))
 	}
+	return merr
+}
 
-	cfg.ResourceCount, err = strconv.Atoi(os.Getenv("RESOURCE_COUNT"))
-	if err != nil {
-		merr = multierror.Append(merr, errors.New("failed, environment variable RESOURCE_COUNT must be provided"))
+// loadSinkConfig loads the configuration of the sink iac objects are written
+// to, and of how they are written.
+func loadSinkConfig(cfg *Config, merr *multierror.Error) *multierror.Error {
+	var err error
+	if cfg.SinkType = os.Getenv("SINK_TYPE"); cfg.SinkType == "" {
+		cfg.SinkType = S3Sink
 	}
 
-	cfg.LastUpdate, err = strconv.Atoi(os.Getenv("LAST_UPDATE"))
-	if err != nil {
-		merr = multierror.Append(merr, errors.New("failed, environment variable LAST_UPDATE must be provided"))
+	switch cfg.SinkType {
+	case S3Sink:
+		if cfg.FetchedResourcesBucket = os.Getenv("FETCHED_RESOURCES_BUCKET"); cfg.FetchedResourcesBucket == "" {
+			merr = multierror.Append(merr, errors.New("failed, environment variable FETCHED_RESOURCES_BUCKET must be provided"))
+		}
+	case FileSink:
+		if cfg.OutputDir = os.Getenv("OUTPUT_DIR"); cfg.OutputDir == "" {
+			merr = multierror.Append(merr, errors.New("failed, environment variable OUTPUT_DIR must be provided when SINK_TYPE is file"))
+		}
+	case MemorySink:
+	default:
+		merr = multierror.Append(merr, fmt.Errorf("failed, unsupported SINK_TYPE %s", cfg.SinkType))
 	}
 
-	if cfg.ElasticsearchUrl = os.Getenv("ELASTICSEARCH_URL"); cfg.ElasticsearchUrl == "" {
-		merr = multierror.Append(merr, errors.New("failed, environment variable ELASTICSEARCH_URL must be provided"))
+	// large stacks may be written gzipped, and split into chunks of
+	// OUTPUT_CHUNK_SIZE records, in which case consumers should follow the
+	// stack's iac_objects.manifest.json
+	if cfg.OutputCompression = os.Getenv("OUTPUT_COMPRESSION"); cfg.OutputCompression == "" {
+		cfg.OutputCompression = NoCompression
 	}
-
-	if cfg.EngineAccumulatorDynamo = os.Getenv("ACCUMULATOR_DYNAMODB_NAME"); cfg.EngineAccumulatorDynamo == "" {
-		merr = multierror.Append(merr, errors.New("failed, environment variable ACCUMULATOR_DYNAMODB_NAME must be provided"))
+	if cfg.OutputCompression != NoCompression && cfg.OutputCompression != GzipCompression {
+		merr = multierror.Append(merr, fmt.Errorf("failed, unsupported OUTPUT_COMPRESSION %s", cfg.OutputCompression))
 	}
-
-	cfg.EngineAccumulatorTTL, err = strconv.Atoi(os.Getenv("DYNAMO_EXPIRATION_IN_SECONDS"))
-	if err != nil {
-		merr = multierror.Append(merr, errors.New("failed, environment variable DYNAMO_EXPIRATION_IN_SECONDS must be provided"))
+	if chunkSize := os.Getenv("OUTPUT_CHUNK_SIZE"); chunkSize != "" {
+		if cfg.OutputChunkSize, err = strconv.Atoi(chunkSize); err != nil || cfg.OutputChunkSize < 0 {
+			merr = multierror.Append(merr, fmt.Errorf("failed, OUTPUT_CHUNK_SIZE must be a non-negative number, got %s", chunkSize))
+		}
 	}
 
-	cfg.ClientAWSIntegrationId = os.Getenv("AWS_INTEGRATION_ID")
-	return cfg, merr.ErrorOrNil()
+	return merr
 }
 
-func (cfg *Config) LoadAwsSession() *session.Session {
-	// We clear the static AWS credentials of the AWS pulumi integration in order to use the web token identity
-	if !cfg.RunImmediately {
-		for _, env := range PULUMI_AWS_CREDS_ENVS {
-			os.Unsetenv(env)
-		}
+// loadInventoryStoreConfig loads the configuration of the store integrations,
+// stack records and IaC assets are read from and written to. The memory store
+// needs no database, so the mapper can run locally along with the file or
+// memory sinks.
+func loadInventoryStoreConfig(cfg *Config, merr *multierror.Error) *multierror.Error {
+	var err error
+	if cfg.InventoryStoreType = os.Getenv("INVENTORY_STORE"); cfg.InventoryStoreType == "" {
+		cfg.InventoryStoreType = DatabaseInventoryStore
 	}
 
-	config := aws.NewConfig()
-	region := os.Getenv("AWS_REGION")
-	if region == "" {
-		region = os.Getenv("AWS_DEFAULT_REGION")
-	}
+	switch cfg.InventoryStoreType {
+	case DatabaseInventoryStore:
+		if cfg.MongoURI = os.Getenv("MONGO_URI"); cfg.MongoURI == "" {
+			merr = multierror.Append(merr, errors.New("failed, environment variable MONGO_URI must be provided"))
+		}
+
+		if cfg.ElasticsearchUrl = os.Getenv("ELASTICSEARCH_URL"); cfg.ElasticsearchUrl == "" {
+			merr = multierror.Append(merr, errors.New("failed, environment variable ELASTICSEARCH_URL must be provided"))
+		}
 
-	if region != "" {
-		config.WithRegion(region)
+		if cfg.EngineAccumulatorDynamo = os.Getenv("ACCUMULATOR_DYNAMODB_NAME"); cfg.EngineAccumulatorDynamo == "" {
+			merr = multierror.Append(merr, errors.New("failed, environment variable ACCUMULATOR_DYNAMODB_NAME must be provided"))
+		}
+
+		cfg.EngineAccumulatorTTL, err = strconv.Atoi(os.Getenv("DYNAMO_EXPIRATION_IN_SECONDS"))
+		if err != nil {
+			merr = multierror.Append(merr, errors.New("failed, environment variable DYNAMO_EXPIRATION_IN_SECONDS must be provided"))
+		}
+	case MemoryInventoryStore:
+	default:
+		merr = multierror.Append(merr, fmt.Errorf("failed, unsupported INVENTORY_STORE %s", cfg.InventoryStoreType))
 	}
 
+	return merr
+}
+
+// LoadServiceAwsSession returns a session for the service's own resources (e.g.
+// the worker queue, the output bucket and the engine accumulator). It uses the
+// service's web identity rather than clearing the static credentials of the
+// AWS pulumi integration, which the stacks refreshed concurrently or later on
+// in the same process still need.
+func (cfg *Config) LoadServiceAwsSession() *session.Session {
 	sess := session.Must(session.NewSessionWithOptions(session.Options{
-		Config:            *config,
+		Config:            *aws.NewConfig().WithRegion(cfg.AwsRegion),
 		SharedConfigState: session.SharedConfigEnable,
 	}))
 
+	if cfg.FireflyAWSRoleARN != "" && cfg.FireflyAWSWebIdentityToken != "" {
+		return sess.Copy(aws.NewConfig().WithCredentials(
+			stscreds.NewWebIdentityCredentials(sess, cfg.FireflyAWSRoleARN, "", cfg.FireflyAWSWebIdentityToken)))
+	}
 	return sess
 }
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigServiceCredentials(t *testing.T) {
+	credentials := []string{"PULUMI_ACCESS_TOKEN", "AWS_ROLE_ARN", "AWS_WEB_IDENTITY_TOKEN_FILE"}
+	tests := []struct {
+		name string
+		env  map[string]string
+		// required tells whether the credentials must be provided
+		required bool
+	}{
+		{
+			name: "local",
+			env:  map[string]string{"INVENTORY_STORE": MemoryInventoryStore, "SINK_TYPE": FileSink, "OUTPUT_DIR": "out"},
+		},
+		{
+			name: "local worker",
+			env: map[string]string{"INVENTORY_STORE": MemoryInventoryStore, "SINK_TYPE": MemorySink,
+				"WORKER_MODE": "true", "QUEUE_FILE": "jobs.jsonl"},
+		},
+		{
+			name:     "s3 sink",
+			env:      map[string]string{"INVENTORY_STORE": MemoryInventoryStore, "SINK_TYPE": S3Sink, "FETCHED_RESOURCES_BUCKET": "bucket"},
+			required: true,
+		},
+		{
+			name:     "database store",
+			env:      map[string]string{"INVENTORY_STORE": DatabaseInventoryStore, "SINK_TYPE": FileSink, "OUTPUT_DIR": "out"},
+			required: true,
+		},
+		{
+			name: "sqs queue",
+			env: map[string]string{"INVENTORY_STORE": MemoryInventoryStore, "SINK_TYPE": FileSink, "OUTPUT_DIR": "out",
+				"WORKER_MODE": "true", "QUEUE_URL": "https://sqs.us-west-2.amazonaws.com/123456789012/jobs"},
+			required: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, name := range append(credentials, "WORKER_MODE", "QUEUE_URL", "QUEUE_FILE") {
+				t.Setenv(name, "")
+			}
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			_, err := LoadConfig()
+			for _, name := range credentials {
+				missing := err != nil && strings.Contains(err.Error(), name)
+				if missing != test.required {
+					t.Errorf("expected %s to be required: %t, got error %v", name, test.required, err)
+				}
+			}
+			if !test.required && err != nil {
+				t.Errorf("expected the configuration to load, got %v", err)
+			}
+		})
+	}
+}
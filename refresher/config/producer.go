@@ -0,0 +1,113 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hashicorp/go-multierror"
+	"github.com/pulumi/pulumi/pkg/v3/backend/httpstate"
+	"os"
+	"strconv"
+)
+
+// ProducerConfig configures the producer, which enumerates the stacks of a
+// Pulumi organization and emits a mapper job for every stack that changed.
+type ProducerConfig struct {
+	// Config holds the Pulumi, AWS, sink and inventory store configuration
+	// shared with the consumer. The sink holds the consumer's run summaries,
+	// which tell the last processed update of every stack.
+	Config
+
+	AccountId        string
+	IntegrationId    string
+	AwsIntegrationId string
+	OrganizationName string
+	ProjectFilter    string
+	TagNameFilter    string
+	TagValueFilter   string
+	// Force emits jobs for all stacks, even the ones that did not change.
+	Force bool
+	// OutputFile is the JSONL file jobs are written to when there is no
+	// QueueUrl, where "-" (or no file) is stdout.
+	OutputFile string
+}
+
+func LoadProducerConfig() (*ProducerConfig, error) {
+	var err error
+	var merr *multierror.Error
+	cfg := &ProducerConfig{}
+
+	if cfg.RunImmediately, err = strconv.ParseBool(os.Getenv("RUN_IMMEDIATELY")); err != nil {
+		cfg.RunImmediately = false
+	}
+
+	if cfg.DebugMode, err = strconv.ParseBool(os.Getenv("DEBUG_MODE")); err != nil {
+		cfg.DebugMode = true
+	}
+
+	if cfg.Force, err = strconv.ParseBool(os.Getenv("FORCE")); err != nil {
+		cfg.Force = false
+	}
+
+	if cfg.PulumiToken = os.Getenv(httpstate.AccessTokenEnvVar); cfg.PulumiToken == "" {
+		merr = multierror.Append(merr, errors.New(fmt.Sprintf("failed, environment variable %s must be provided", httpstate.AccessTokenEnvVar)))
+	}
+
+	if cfg.PulumiUrl = os.Getenv("PULUMI_URL"); cfg.PulumiUrl == "" {
+		cfg.PulumiUrl = "https://api.pulumi.com"
+	}
+
+	if cfg.AwsRegion = os.Getenv("AWS_REGION"); cfg.AwsRegion == "" {
+		if cfg.AwsRegion = os.Getenv("AWS_DEFAULT_REGION"); cfg.AwsRegion == "" {
+			cfg.AwsRegion = "us-west-2"
+		}
+	}
+
+	if cfg.AccountId = os.Getenv("ACCOUNT_ID"); cfg.AccountId == "" {
+		merr = multierror.Append(merr, errors.New("failed, environment variable ACCOUNT_ID must be provided"))
+	}
+
+	if cfg.IntegrationId = os.Getenv("INTEGRATION_ID"); cfg.IntegrationId == "" {
+		merr = multierror.Append(merr, errors.New("failed, environment variable INTEGRATION_ID must be provided"))
+	}
+
+	if cfg.OrganizationName = os.Getenv("ORGANIZATION_NAME"); cfg.OrganizationName == "" {
+		merr = multierror.Append(merr, errors.New("failed, environment variable ORGANIZATION_NAME must be provided"))
+	}
+
+	cfg.AwsIntegrationId = os.Getenv("AWS_INTEGRATION_ID")
+	cfg.ProjectFilter = os.Getenv("PROJECT_FILTER")
+	cfg.TagNameFilter = os.Getenv("TAG_NAME_FILTER")
+	cfg.TagValueFilter = os.Getenv("TAG_VALUE_FILTER")
+	if cfg.TagValueFilter != "" && cfg.TagNameFilter == "" {
+		merr = multierror.Append(merr, errors.New("failed, environment variable TAG_NAME_FILTER must be provided with TAG_VALUE_FILTER"))
+	}
+
+	merr = loadSinkConfig(&cfg.Config, merr)
+
+	// the producer only reads the stack records of the inventory store
+	if cfg.InventoryStoreType = os.Getenv("INVENTORY_STORE"); cfg.InventoryStoreType == "" {
+		cfg.InventoryStoreType = DatabaseInventoryStore
+	}
+	switch cfg.InventoryStoreType {
+	case DatabaseInventoryStore:
+		if cfg.MongoURI = os.Getenv("MONGO_URI"); cfg.MongoURI == "" {
+			merr = multierror.Append(merr, errors.New("failed, environment variable MONGO_URI must be provided"))
+		}
+	case MemoryInventoryStore:
+	default:
+		merr = multierror.Append(merr, fmt.Errorf("failed, unsupported INVENTORY_STORE %s", cfg.InventoryStoreType))
+	}
+
+	if cfg.RetryAttempts, err = strconv.Atoi(os.Getenv("RETRY_ATTEMPTS")); err != nil || cfg.RetryAttempts < 1 {
+		cfg.RetryAttempts = defaultRetryAttempts
+	}
+
+	// the role is optional here since jobs may be written to a file
+	cfg.FireflyAWSRoleARN = os.Getenv("AWS_ROLE_ARN")
+	cfg.FireflyAWSWebIdentityToken = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+
+	cfg.QueueUrl = os.Getenv("QUEUE_URL")
+	cfg.OutputFile = os.Getenv("OUTPUT_FILE")
+
+	return cfg, merr.ErrorOrNil()
+}
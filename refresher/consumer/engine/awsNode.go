@@ -0,0 +1,227 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"github.com/infralight/go-kit/db/mongo"
+	"github.com/infralight/go-kit/flywheel/arn"
+	goKit "github.com/infralight/go-kit/pulumi"
+	goKitTypes "github.com/infralight/go-kit/types"
+	"github.com/infralight/pulumi/refresher"
+	"github.com/infralight/pulumi/refresher/common"
+	"github.com/pulumi/pulumi/pkg/v3/engine"
+	"github.com/pulumi/pulumi/pkg/v3/resource/deploy"
+	"github.com/rs/zerolog"
+)
+
+type awsNodeBuilder struct {
+	logger          *zerolog.Logger
+	mapperEvent     *common.PulumiMapperEvent
+	secrets         refresher.SecretRedactor
+	integrations    []mongo.AwsIntegration
+	commonProviders map[string]int
+	// providers holds the account and region of the aws providers by reference
+	providers map[string]awsProviderConfig
+}
+
+// awsProviderConfig is the account and region an aws provider deploys to, as
+// far as they can be told from its configuration.
+type awsProviderConfig struct {
+	account string
+	region  string
+}
+
+func newAwsNodeBuilder(ctx context.Context, logger *zerolog.Logger, consumer *common.Consumer, mapperEvent *common.PulumiMapperEvent) (NodeBuilder, error) {
+	awsIntegrations, err := consumer.Store.ListAWSIntegrations(ctx, mapperEvent.AccountId)
+	if err != nil {
+		logger.Err(err).Msg("failed to list aws integrations")
+		return nil, err
+	}
+	return &awsNodeBuilder{
+		logger:          logger,
+		mapperEvent:     mapperEvent,
+		secrets:         refresher.NewSecretRedactor(consumer.Config.SecretsHashSalt),
+		integrations:    awsIntegrations,
+		commonProviders: make(map[string]int),
+		providers:       make(map[string]awsProviderConfig),
+	}, nil
+}
+
+func (b *awsNodeBuilder) Build(metadata engine.StepEventMetadata, node PulumiNode) (*PulumiNode, []string, error) {
+	var state engine.StepEventStateMetadata
+	var ok bool
+
+	node.Type = "aws"
+	terraformType, err := goKit.GetTerraformTypeByPulumi(metadata.Type.String())
+	if err != nil {
+		b.logger.Err(err).Str("pulumiAssetType", metadata.Type.String()).Msg("missing pulumi to terraform type mapping")
+	} else {
+		node.ObjectType = terraformType
+	}
+
+	refreshPreEvent := metadata.Op == deploy.OpRefresh
+	if refreshPreEvent {
+		// refresh pre-events are only used for finding the most common
+		// aws account when the stack has no aws integration
+		if b.mapperEvent.AwsIntegrationId != "" {
+			return nil, nil, nil
+		}
+		state = *metadata.New
+	} else if state, ok = classifyNode(&node, metadata, b.mapperEvent, b.secrets, b.logger); !ok {
+		return nil, nil, nil
+	}
+	if len(state.Outputs) == 0 {
+		return nil, nil, nil
+	}
+	node.Attributes = getIacAttributes(state.Outputs, b.secrets)
+	if ARN := state.Outputs["arn"].V; ARN != nil {
+		node.Arn = goKitTypes.ToString(ARN)
+		awsAccount, region, err := getAccountAndRegionFromArn(fmt.Sprintf("%v", ARN))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse arn %v: %w", ARN, err)
+		}
+		node.Region = region
+		node.ProviderAccountId = awsAccount
+		node.AssetId = node.Arn
+		b.commonProviders[awsAccount]++
+	} else {
+		// resources without an arn (e.g. route table associations) are
+		// resolved from their provider, and don't count towards the most
+		// common account as they don't tell it apart
+		if refreshPreEvent {
+			return nil, nil, nil
+		}
+		if state.ID == "" {
+			return nil, nil, ErrNoArn
+		}
+		provider := b.providers[state.Provider]
+		node.ProviderAccountId = provider.account
+		if node.ProviderAccountId == "" {
+			node.ProviderAccountId = b.integrationAccount()
+		}
+		node.Region = provider.region
+		if node.Region == "" {
+			node.Region = "global"
+		}
+		node.ResourceId = string(state.ID)
+		if node.ProviderAccountId != "" {
+			setSyntheticAssetId(&node)
+		}
+	}
+	node.AwsIntegration = b.IntegrationId(node.ProviderAccountId)
+
+	var assetTypes []string
+	if len(node.ObjectType) > 0 {
+		assetTypes = append(assetTypes, fmt.Sprintf("%s-%s", node.ObjectType, node.Region))
+	}
+	// if we don't have the aws integration id - we use the only calculating the most common provider.
+	if b.mapperEvent.AwsIntegrationId == "" {
+		return nil, assetTypes, nil
+	}
+	return &node, assetTypes, nil
+}
+
+// Finish sets the account of the nodes that could not be resolved from their
+// provider to the most common account of the stack.
+func (b *awsNodeBuilder) Finish(ctx context.Context, nodes []PulumiNode) ([]PulumiNode, map[string]int, error) {
+	stackAccount := getMostCommonProvider(b.commonProviders)
+
+	resolved := make([]PulumiNode, 0, len(nodes))
+	for _, node := range nodes {
+		if node.AssetId == "" {
+			if stackAccount == "" {
+				b.logger.Warn().Str("type", node.Metadata.PulumiType).Str("id", node.ResourceId).Msg("failed to resolve the aws account of resource")
+				continue
+			}
+			node.ProviderAccountId = stackAccount
+			node.AwsIntegration = b.IntegrationId(stackAccount)
+			setSyntheticAssetId(&node)
+		}
+		resolved = append(resolved, node)
+	}
+	return resolved, b.commonProviders, nil
+}
+
+func (b *awsNodeBuilder) IntegrationId(providerAccountId string) string {
+	return getAwsIntegrationId(b.integrations, providerAccountId)
+}
+
+// AddProvider resolves the account and region of an aws provider. The account
+// is taken from the role the provider assumes, or from its allowed account ids
+// when there is only one.
+func (b *awsNodeBuilder) AddProvider(ref string, state engine.StepEventStateMetadata) {
+	config := state.Inputs
+	if len(config) == 0 {
+		config = state.Outputs
+	}
+	var provider awsProviderConfig
+	provider.region = getProviderConfigString(config, "region")
+
+	var roleArns []string
+	if assumeRole, ok := getProviderConfigObject(config, "assumeRole").(map[string]interface{}); ok {
+		roleArns = append(roleArns, goKitTypes.ToString(assumeRole["roleArn"]))
+	}
+	if assumeRoles, ok := getProviderConfigObject(config, "assumeRoles").([]interface{}); ok {
+		for _, assumeRole := range assumeRoles {
+			if assumeRole, ok := assumeRole.(map[string]interface{}); ok {
+				roleArns = append(roleArns, goKitTypes.ToString(assumeRole["roleArn"]))
+			}
+		}
+	}
+	// with chained roles the last one is the role resources are deployed by
+	for i := len(roleArns) - 1; i >= 0 && provider.account == ""; i-- {
+		if account, _, err := getAccountAndRegionFromArn(roleArns[i]); err == nil {
+			provider.account = account
+		}
+	}
+	if provider.account == "" {
+		if accountIds, ok := getProviderConfigObject(config, "allowedAccountIds").([]interface{}); ok && len(accountIds) == 1 {
+			provider.account = goKitTypes.ToString(accountIds[0])
+		}
+	}
+	b.providers[ref] = provider
+}
+
+// integrationAccount returns the account of the stack's aws integration.
+func (b *awsNodeBuilder) integrationAccount() string {
+	for _, integration := range b.integrations {
+		if integration.ID == b.mapperEvent.AwsIntegrationId {
+			return integration.AccountNumber
+		}
+	}
+	return ""
+}
+
+// setSyntheticAssetId sets a stable asset id for an aws resource without an
+// arn, built from its type, account, region and id.
+func setSyntheticAssetId(node *PulumiNode) {
+	assetType := node.ObjectType
+	if assetType == "" {
+		assetType = node.Metadata.PulumiType
+	}
+	node.AssetId = fmt.Sprintf("pulumi:%s:%s:%s:%s", assetType, node.ProviderAccountId, node.Region, node.ResourceId)
+	node.Arn = node.AssetId
+}
+
+func getAccountAndRegionFromArn(assetArn string) (account, region string, err error) {
+	parsedArn, err := arn.Parse(assetArn)
+	if err != nil {
+		return "", "", err
+	}
+	region = parsedArn.Location
+	if region == "" {
+		region = "global"
+	}
+	return parsedArn.AccountID, region, nil
+}
+
+func getAwsIntegrationId(awsIntegrations []mongo.AwsIntegration, providerAccountId string) string {
+	if awsIntegrations != nil {
+		for _, integration := range awsIntegrations {
+			if integration.AccountNumber == providerAccountId {
+				return integration.ID
+			}
+		}
+	}
+	return ""
+}
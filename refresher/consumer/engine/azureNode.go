@@ -0,0 +1,109 @@
+//go:build gcpazure
+
+package engine
+
+import (
+	"context"
+	"fmt"
+	"github.com/infralight/pulumi/refresher"
+	"github.com/infralight/pulumi/refresher/common"
+	"github.com/infralight/pulumi/refresher/storage"
+	"github.com/pulumi/pulumi/pkg/v3/engine"
+	"github.com/rs/zerolog"
+	"strings"
+)
+
+// The Azure node builder needs a go-kit release that lists Azure integrations,
+// which v1.155.0 can't, so it is only built with the gcpazure build tag.
+func init() {
+	RegisterNodeBuilder("azure", newAzureNodeBuilder, "azure", "azure-native")
+}
+
+type azureNodeBuilder struct {
+	logger          *zerolog.Logger
+	mapperEvent     *common.PulumiMapperEvent
+	secrets         refresher.SecretRedactor
+	integrations    []storage.AzureIntegration
+	commonProviders map[string]int
+}
+
+func newAzureNodeBuilder(ctx context.Context, logger *zerolog.Logger, consumer *common.Consumer, mapperEvent *common.PulumiMapperEvent) (NodeBuilder, error) {
+	azureIntegrations, err := consumer.Store.ListAzureIntegrations(ctx, mapperEvent.AccountId)
+	if err != nil {
+		logger.Err(err).Msg("failed to list azure integrations")
+		return nil, err
+	}
+	return &azureNodeBuilder{
+		logger:          logger,
+		mapperEvent:     mapperEvent,
+		secrets:         refresher.NewSecretRedactor(consumer.Config.SecretsHashSalt),
+		integrations:    azureIntegrations,
+		commonProviders: make(map[string]int),
+	}, nil
+}
+
+func (b *azureNodeBuilder) Build(metadata engine.StepEventMetadata, node PulumiNode) (*PulumiNode, []string, error) {
+	node.Type = "azure"
+	state, ok := classifyNode(&node, metadata, b.mapperEvent, b.secrets, b.logger)
+	if !ok || len(state.Outputs) == 0 {
+		return nil, nil, nil
+	}
+	if err := buildAzureNode(&node, state); err != nil {
+		return nil, nil, err
+	}
+	node.Attributes = getIacAttributes(state.Outputs, b.secrets)
+	node.AzureIntegration = b.IntegrationId(node.ProviderAccountId)
+	b.commonProviders[node.ProviderAccountId]++
+
+	terraformType, err := getTerraformType(metadata.Type.String())
+	if err != nil {
+		b.logger.Err(err).Str("pulumiAssetType", metadata.Type.String()).Msg("missing pulumi to terraform type mapping")
+		return &node, nil, nil
+	}
+	node.ObjectType = terraformType
+	return &node, []string{fmt.Sprintf("%s-%s", node.ObjectType, node.Region)}, nil
+}
+
+func (b *azureNodeBuilder) Finish(ctx context.Context, nodes []PulumiNode) ([]PulumiNode, map[string]int, error) {
+	return nodes, b.commonProviders, nil
+}
+
+func (b *azureNodeBuilder) IntegrationId(providerAccountId string) string {
+	return getAzureIntegrationId(b.integrations, providerAccountId)
+}
+
+// buildAzureNode sets the asset id, subscription and location of an azure
+// node. Both the azure and azure-native providers use the azure resource id as
+// the pulumi id.
+func buildAzureNode(node *PulumiNode, state engine.StepEventStateMetadata) error {
+	resourceId := string(state.ID)
+	if resourceId == "" {
+		resourceId = getStringOutput(state.Outputs, "id")
+	}
+	if !strings.HasPrefix(strings.ToLower(resourceId), "/subscriptions/") {
+		return fmt.Errorf("%w: no azure resource id for resource", ErrNoArn)
+	}
+	node.AssetId = resourceId
+	node.Arn = resourceId
+	node.Name = getStringOutput(state.Outputs, "name")
+	node.ProviderAccountId = strings.ToLower(getPathSegment(resourceId, "subscriptions"))
+
+	// locations are reported both as display names (West Europe) and as names (westeurope)
+	location := strings.ToLower(strings.ReplaceAll(getStringOutput(state.Outputs, "location"), " ", ""))
+	if location == "" {
+		location = "global"
+	}
+	node.Region = location
+	return nil
+}
+
+func getAzureIntegrationId(azureIntegrations []storage.AzureIntegration, subscriptionId string) string {
+	if azureIntegrations != nil {
+		for _, integration := range azureIntegrations {
+			if strings.EqualFold(integration.SubscriptionId, subscriptionId) {
+				return integration.ID
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,210 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/infralight/pulumi/refresher"
+	"github.com/infralight/pulumi/refresher/common"
+	"github.com/pulumi/pulumi/pkg/v3/engine"
+	"sort"
+	"time"
+)
+
+const (
+	ChangeAdded   = "added"
+	ChangeRemoved = "removed"
+	ChangeChanged = "changed"
+)
+
+const (
+	// ReasonNew is an asset that was not in the previous snapshot.
+	ReasonNew = "new"
+	// ReasonDeleted is an asset whose resource is no longer in the stack.
+	ReasonDeleted = "deleted"
+	// ReasonUnmapped is an asset whose resource is still in the stack but could
+	// not be mapped this time. Unmapped assets are kept as they were.
+	ReasonUnmapped = "unmapped"
+	// ReasonAttributes, ReasonState and ReasonDrifts are assets whose
+	// attributes, pulumi state or drifts changed.
+	ReasonAttributes = "attributes"
+	ReasonState      = "state"
+	ReasonDrifts     = "drifts"
+)
+
+// ErrMassDeletion is returned when a run would delete more of the stack's
+// assets than the configured threshold allows.
+var ErrMassDeletion = errors.New("refusing mass deletion of assets")
+
+// AssetChange is a single change of the stack's assets since the previous run.
+type AssetChange struct {
+	ChangeType string    `json:"changeType"`
+	AssetId    string    `json:"assetId"`
+	ObjectType string    `json:"objectType,omitempty"`
+	PulumiType string    `json:"pulumiType,omitempty"`
+	Urn        string    `json:"urn,omitempty"`
+	Reasons    []string  `json:"reasons"`
+	DetectedAt time.Time `json:"detectedAt"`
+}
+
+// ChangeCounts counts the changes of a run by their kind.
+type ChangeCounts struct {
+	Added    int `json:"added" bson:"added"`
+	Deleted  int `json:"deleted" bson:"deleted"`
+	Unmapped int `json:"unmapped" bson:"unmapped"`
+	Changed  int `json:"changed" bson:"changed"`
+}
+
+// SnapshotDiff is the difference between the nodes of the previous run and the
+// current one.
+type SnapshotDiff struct {
+	Changes []AssetChange
+	Counts  ChangeCounts
+	// Unmapped holds the previous nodes of the unmapped assets.
+	Unmapped []IacNode
+	// Previous is the number of assets in the previous snapshot.
+	Previous int
+}
+
+func changesPath(event *common.PulumiMapperEvent) string {
+	return stackOutputPath(event, "changes.jsonl")
+}
+
+// diffSnapshots compares the current nodes to the previous ones by asset id.
+// Removed assets whose urn is still in the stack (stackUrns) are unmapped
+// rather than deleted.
+func diffSnapshots(previous, current []IacNode, stackUrns map[string]bool, now time.Time) *SnapshotDiff {
+	diff := &SnapshotDiff{Previous: len(previous)}
+	previousNodes := nodesByAssetId(previous)
+	currentNodes := nodesByAssetId(current)
+
+	for _, assetId := range sortedAssetIds(currentNodes) {
+		node := currentNodes[assetId]
+		previousNode, ok := previousNodes[assetId]
+		if !ok {
+			diff.Changes = append(diff.Changes, newAssetChange(ChangeAdded, node, []string{ReasonNew}, now))
+			diff.Counts.Added++
+			continue
+		}
+		var reasons []string
+		if node.Attributes != previousNode.Attributes {
+			reasons = append(reasons, ReasonAttributes)
+		}
+		if node.Metadata.PulumiState != previousNode.Metadata.PulumiState {
+			reasons = append(reasons, ReasonState)
+		}
+		if !sameDrifts(node.Metadata.PulumiDrifts, previousNode.Metadata.PulumiDrifts) {
+			reasons = append(reasons, ReasonDrifts)
+		}
+		if len(reasons) > 0 {
+			diff.Changes = append(diff.Changes, newAssetChange(ChangeChanged, node, reasons, now))
+			diff.Counts.Changed++
+		}
+	}
+
+	for _, assetId := range sortedAssetIds(previousNodes) {
+		if _, ok := currentNodes[assetId]; ok {
+			continue
+		}
+		previousNode := previousNodes[assetId]
+		change := newAssetChange(ChangeRemoved, previousNode, []string{ReasonDeleted}, now)
+		if change.Urn != "" && stackUrns[change.Urn] {
+			change.Reasons = []string{ReasonUnmapped}
+			diff.Unmapped = append(diff.Unmapped, previousNode)
+			diff.Counts.Unmapped++
+		} else {
+			diff.Counts.Deleted++
+		}
+		diff.Changes = append(diff.Changes, change)
+	}
+	return diff
+}
+
+// sameDrifts compares drifts by their json encoding, since the values of the
+// previous drifts were decoded from json.
+func sameDrifts(a, b []refresher.Drift) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	aJson, aErr := json.Marshal(a)
+	bJson, bErr := json.Marshal(b)
+	return aErr == nil && bErr == nil && bytes.Equal(aJson, bJson)
+}
+
+// exceedsDeletionThreshold returns whether the diff deletes more than the
+// given fraction of the previous assets. A zero threshold is disabled.
+func (d *SnapshotDiff) exceedsDeletionThreshold(threshold float64) bool {
+	if threshold <= 0 || d.Previous == 0 {
+		return false
+	}
+	return float64(d.Counts.Deleted)/float64(d.Previous) > threshold
+}
+
+func (d *SnapshotDiff) toJsonLines() ([]byte, error) {
+	var jsonLines []byte
+	for _, change := range d.Changes {
+		line, err := json.Marshal(change)
+		if err != nil {
+			return nil, err
+		}
+		jsonLines = append(jsonLines, line...)
+		jsonLines = append(jsonLines, '\n')
+	}
+	return jsonLines, nil
+}
+
+func newAssetChange(changeType string, node IacNode, reasons []string, now time.Time) AssetChange {
+	return AssetChange{
+		ChangeType: changeType,
+		AssetId:    node.AssetId,
+		ObjectType: node.ObjectType,
+		PulumiType: node.Metadata.PulumiType,
+		Urn:        node.Metadata.Urn,
+		Reasons:    reasons,
+		DetectedAt: now,
+	}
+}
+
+func nodesByAssetId(nodes []IacNode) map[string]IacNode {
+	byAssetId := make(map[string]IacNode, len(nodes))
+	for _, node := range nodes {
+		if node.AssetId != "" {
+			byAssetId[node.AssetId] = node
+		}
+	}
+	return byAssetId
+}
+
+func sortedAssetIds(nodes map[string]IacNode) []string {
+	assetIds := make([]string, 0, len(nodes))
+	for assetId := range nodes {
+		assetIds = append(assetIds, assetId)
+	}
+	sort.Strings(assetIds)
+	return assetIds
+}
+
+// diffPreviousSnapshot diffs the current nodes against the previous nodes,
+// telling deleted resources from unmapped ones by the urns of the stack's
+// events.
+func diffPreviousSnapshot(previous, current []IacNode, events []engine.Event) *SnapshotDiff {
+	stackUrns := make(map[string]bool, len(events))
+	for _, event := range events {
+		if urn := getSameMetadata(event).URN; urn != "" {
+			stackUrns[string(urn)] = true
+		}
+	}
+	return diffSnapshots(previous, current, stackUrns, time.Now().UTC())
+}
+
+func writeChanges(ctx context.Context, consumer *common.Consumer, event *common.PulumiMapperEvent, diff *SnapshotDiff) error {
+	if len(diff.Changes) == 0 {
+		return nil
+	}
+	jsonLines, err := diff.toJsonLines()
+	if err != nil {
+		return err
+	}
+	return consumer.Sink.Write(ctx, changesPath(event), jsonLines, "jsonl")
+}
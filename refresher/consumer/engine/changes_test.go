@@ -0,0 +1,71 @@
+package engine
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiffSnapshots(t *testing.T) {
+	nodes := newOutputTestNodes(5)
+	previous := nodes[:4]
+	changed := previous[0]
+	changed.Attributes = `{"versioning": true}`
+	// the second node is unchanged, the third is still in the stack but was
+	// not mapped and the fourth is gone, while the fifth is new
+	current := []IacNode{changed, previous[1], nodes[4]}
+	stackUrns := map[string]bool{previous[2].Metadata.Urn: true}
+
+	diff := diffSnapshots(previous, current, stackUrns, time.Unix(0, 0))
+	if diff.Counts != (ChangeCounts{Added: 1, Deleted: 1, Unmapped: 1, Changed: 1}) {
+		t.Errorf("unexpected counts %+v", diff.Counts)
+	}
+	if diff.Previous != 4 {
+		t.Errorf("expected 4 previous assets, got %d", diff.Previous)
+	}
+	if !reflect.DeepEqual(diff.Unmapped, []IacNode{previous[2]}) {
+		t.Errorf("expected the unmapped node to be kept, got %+v", diff.Unmapped)
+	}
+
+	type change struct {
+		changeType, assetId string
+		reasons             []string
+	}
+	var changes []change
+	for _, c := range diff.Changes {
+		changes = append(changes, change{c.ChangeType, c.AssetId, c.Reasons})
+	}
+	expected := []change{
+		{ChangeChanged, previous[0].AssetId, []string{ReasonAttributes}},
+		{ChangeAdded, nodes[4].AssetId, []string{ReasonNew}},
+		{ChangeRemoved, previous[2].AssetId, []string{ReasonUnmapped}},
+		{ChangeRemoved, previous[3].AssetId, []string{ReasonDeleted}},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected changes %+v, got %+v", expected, changes)
+	}
+}
+
+func TestExceedsDeletionThreshold(t *testing.T) {
+	tests := []struct {
+		name      string
+		counts    ChangeCounts
+		previous  int
+		threshold float64
+		exceeds   bool
+	}{
+		{name: "above", counts: ChangeCounts{Deleted: 3}, previous: 4, threshold: 0.5, exceeds: true},
+		{name: "at", counts: ChangeCounts{Deleted: 2}, previous: 4, threshold: 0.5},
+		{name: "unmapped", counts: ChangeCounts{Deleted: 1, Unmapped: 3}, previous: 4, threshold: 0.5},
+		{name: "disabled", counts: ChangeCounts{Deleted: 4}, previous: 4},
+		{name: "no previous assets", threshold: 0.5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			diff := &SnapshotDiff{Counts: test.counts, Previous: test.previous}
+			if exceeds := diff.exceedsDeletionThreshold(test.threshold); exceeds != test.exceeds {
+				t.Errorf("expected %t, got %t", test.exceeds, exceeds)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package engine
+
+import (
+	"github.com/infralight/pulumi/refresher"
+	"github.com/pulumi/pulumi/pkg/v3/engine"
+	"github.com/pulumi/pulumi/pkg/v3/resource/deploy"
+	"github.com/pulumi/pulumi/pkg/v3/resource/deploy/providers"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+)
+
+const (
+	// componentNodeType is the type of the grouping nodes of component resources.
+	componentNodeType = "pulumi"
+	// componentObjectType is the object type of component nodes, which have no
+	// terraform type as they are not cloud resources.
+	componentObjectType = "pulumi_component"
+)
+
+// isComponentResource returns whether a step is of a component resource, i.e.
+// a resource that only groups other resources, other than the stack itself.
+func isComponentResource(metadata engine.StepEventMetadata) bool {
+	state := getStepState(metadata)
+	return state != nil && !state.Custom && metadata.Type != resource.RootStackType
+}
+
+// buildComponentNode builds the grouping node of a component resource, whose
+// asset id is its urn. Only the final step of a component is mapped.
+func buildComponentNode(metadata engine.StepEventMetadata, node PulumiNode) *PulumiNode {
+	if metadata.Op == deploy.OpRefresh {
+		return nil
+	}
+	state := getStepState(metadata)
+	if state == nil {
+		return nil
+	}
+	node.Type = componentNodeType
+	node.ObjectType = componentObjectType
+	node.AssetId = string(metadata.URN)
+	node.Arn = node.AssetId
+	node.Name = string(metadata.URN.Name())
+	node.Region = "global"
+	node.Metadata.PulumiState = string(refresher.StateManaged)
+	if metadata.Op == deploy.OpDelete {
+		node.Metadata.PulumiState = string(refresher.StateGhost)
+	}
+	return &node
+}
+
+// getStepState returns the latest state of the resource of a step.
+func getStepState(metadata engine.StepEventMetadata) *engine.StepEventStateMetadata {
+	if metadata.New != nil {
+		return metadata.New
+	}
+	return metadata.Old
+}
+
+// setRelations sets the urns of the resources a node relates to.
+func setRelations(node *PulumiNode, metadata engine.StepEventMetadata) {
+	node.Metadata.Urn = string(metadata.URN)
+	state := getStepState(metadata)
+	if state == nil {
+		return
+	}
+	node.Metadata.Parent = string(state.Parent)
+	if state.Provider != "" {
+		if ref, err := providers.ParseReference(state.Provider); err == nil {
+			node.Metadata.Provider = string(ref.URN())
+		}
+	}
+	if state.State == nil {
+		return
+	}
+	for _, dependency := range state.State.Dependencies {
+		node.Metadata.Dependencies = append(node.Metadata.Dependencies, string(dependency))
+	}
+	if len(state.State.PropertyDependencies) > 0 {
+		node.Metadata.PropertyDependencies = make(map[string][]string, len(state.State.PropertyDependencies))
+		for key, dependencies := range state.State.PropertyDependencies {
+			for _, dependency := range dependencies {
+				node.Metadata.PropertyDependencies[string(key)] = append(node.Metadata.PropertyDependencies[string(key)], string(dependency))
+			}
+		}
+	}
+}
+
+// resolveRelations replaces the urns of the resources the nodes relate to with
+// their asset ids, for the resources that were mapped to nodes.
+func resolveRelations(nodes []PulumiNode) {
+	assetIds := make(map[string]string, len(nodes))
+	for _, node := range nodes {
+		if node.Metadata.Urn != "" && node.AssetId != "" {
+			assetIds[node.Metadata.Urn] = node.AssetId
+		}
+	}
+	resolve := func(urn string) string {
+		if assetId, ok := assetIds[urn]; ok {
+			return assetId
+		}
+		return urn
+	}
+	for i := range nodes {
+		metadata := &nodes[i].Metadata
+		metadata.Parent = resolve(metadata.Parent)
+		metadata.Provider = resolve(metadata.Provider)
+		for j, dependency := range metadata.Dependencies {
+			metadata.Dependencies[j] = resolve(dependency)
+		}
+		for _, dependencies := range metadata.PropertyDependencies {
+			for j, dependency := range dependencies {
+				dependencies[j] = resolve(dependency)
+			}
+		}
+	}
+}
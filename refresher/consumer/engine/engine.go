@@ -3,10 +3,8 @@ package engine
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/infralight/pulumi/refresher/common"
-	engine "github.com/infralight/pulumi/refresher/consumer/internal"
 	"github.com/rs/zerolog"
 	"time"
 )
@@ -14,12 +12,22 @@ import (
 var component = "pulumi-mapper-consumer"
 
 func ProcessMessage(ctx context.Context, logger *zerolog.Logger, consumer *common.Consumer, message string) error {
-	var event engine.PulumiMapperEvent
+	var event common.PulumiMapperEvent
 	err := json.Unmarshal([]byte(message), &event)
 	if err != nil {
 		logger.Debug().Msg("failed to unmarshall producer message")
 	}
 
+	logger.Info().
+		Str("body", message).
+		Msg("Handling message")
+
+	return ProcessEvent(ctx, logger, consumer, &event)
+}
+
+// ProcessEvent maps a single stack. Everything stack specific is taken from
+// the event, so events of different stacks can be processed concurrently.
+func ProcessEvent(ctx context.Context, logger *zerolog.Logger, consumer *common.Consumer, event *common.PulumiMapperEvent) error {
 	start := time.Now()
 	*logger = logger.With().
 		Str("accountId", event.AccountId).
@@ -36,15 +44,11 @@ func ProcessMessage(ctx context.Context, logger *zerolog.Logger, consumer *commo
 			Msg("Finished processing job")
 	}()
 
-	logger.Info().
-		Str("body", message).
-		Msg("Handling message")
-
-	if event.AccountId == "" || event.IntegrationId == "" || event.StackName == "" || event.ProjectName == "" || event.OrganizationName == "" || event.StackId == "" {
-		return errors.New("failed, invalid message attributes missing [account id / integration id / stackName / projectName / organizationName]")
+	if err := event.Validate(); err != nil {
+		return err
 	}
 
-	err = PulumiMapper(ctx, logger, consumer, &event.LastUpdated, &event.ResourceCount)
+	err := PulumiMapper(ctx, logger, consumer, event)
 	if err != nil {
 		return fmt.Errorf("failed processing job: %w", err)
 	}
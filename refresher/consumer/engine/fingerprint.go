@@ -0,0 +1,158 @@
+package engine
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/infralight/pulumi/refresher/common"
+	"github.com/infralight/pulumi/refresher/storage"
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/pkg/v3/engine"
+	"github.com/pulumi/pulumi/pkg/v3/resource/deploy"
+	"time"
+)
+
+const (
+	// MappingModeRefresh maps a stack from a refresh preview of its resources.
+	MappingModeRefresh = "refresh"
+	// MappingModeCheckpoint maps a stack from its checkpoint only, without
+	// calling the cloud providers.
+	MappingModeCheckpoint = "checkpoint"
+	// MappingModeSkip does not map a stack that did not change since it was
+	// last mapped.
+	MappingModeSkip = "skip"
+)
+
+// StackFingerprint identifies the version of a stack that was last mapped.
+type StackFingerprint struct {
+	LastUpdated    int64     `json:"lastUpdated"`
+	ResourceCount  int       `json:"resourceCount"`
+	CheckpointHash string    `json:"checkpointHash"`
+	LastRefreshAt  time.Time `json:"lastRefreshAt"`
+	LastMappedAt   time.Time `json:"lastMappedAt"`
+}
+
+func fingerprintPath(event *common.PulumiMapperEvent) string {
+	return fmt.Sprintf("%s/pulumi_resources/%s/fingerprint.json", event.AccountId, event.StackId)
+}
+
+// newStackFingerprint returns the fingerprint of the current version of the
+// stack, hashing its exported checkpoint.
+func newStackFingerprint(ctx context.Context, stack backend.Stack, event *common.PulumiMapperEvent) (*StackFingerprint, error) {
+	deployment, err := stack.ExportDeployment(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to export deployment: %w", err)
+	}
+	hash := sha256.Sum256(deployment.Deployment)
+	return &StackFingerprint{
+		LastUpdated:    event.LastUpdated,
+		ResourceCount:  event.ResourceCount,
+		CheckpointHash: hex.EncodeToString(hash[:]),
+	}, nil
+}
+
+// readStackFingerprint returns the fingerprint stored by the previous run, or
+// nil if there is none.
+func readStackFingerprint(ctx context.Context, consumer *common.Consumer, event *common.PulumiMapperEvent) (*StackFingerprint, error) {
+	content, err := consumer.Sink.Read(ctx, fingerprintPath(event))
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var fingerprint StackFingerprint
+	if err = json.Unmarshal(content, &fingerprint); err != nil {
+		return nil, fmt.Errorf("failed to parse fingerprint: %w", err)
+	}
+	return &fingerprint, nil
+}
+
+func writeStackFingerprint(ctx context.Context, consumer *common.Consumer, event *common.PulumiMapperEvent, fingerprint *StackFingerprint) error {
+	content, err := json.Marshal(fingerprint)
+	if err != nil {
+		return err
+	}
+	return consumer.Sink.Write(ctx, fingerprintPath(event), content, "json")
+}
+
+// mappingMode decides how to map a stack given its previous fingerprint. A
+// stack is fully refreshed at most once per interval: within it, unchanged
+// stacks are skipped and changed ones are mapped from their checkpoint. A zero
+// interval always refreshes.
+func mappingMode(previous, current *StackFingerprint, interval time.Duration, now time.Time) string {
+	if interval <= 0 || previous == nil || previous.LastRefreshAt.IsZero() || now.Sub(previous.LastRefreshAt) >= interval {
+		return MappingModeRefresh
+	}
+	if previous.CheckpointHash == current.CheckpointHash &&
+		previous.LastUpdated == current.LastUpdated &&
+		previous.ResourceCount == current.ResourceCount {
+		return MappingModeSkip
+	}
+	return MappingModeCheckpoint
+}
+
+// checkpointEvents returns the engine events of a stack's checkpoint, as if
+// all of its resources were refreshed without changes.
+func checkpointEvents(ctx context.Context, stack backend.Stack) ([]engine.Event, error) {
+	snapshot, err := stack.Snapshot(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load snapshot: %w", err)
+	}
+	if snapshot == nil {
+		return nil, nil
+	}
+	events := make([]engine.Event, 0, len(snapshot.Resources))
+	for _, state := range snapshot.Resources {
+		if state.Delete {
+			continue
+		}
+		stateMetadata := &engine.StepEventStateMetadata{
+			State:      state,
+			Type:       state.Type,
+			URN:        state.URN,
+			Custom:     state.Custom,
+			Delete:     state.Delete,
+			ID:         state.ID,
+			Parent:     state.Parent,
+			Protect:    state.Protect,
+			Inputs:     state.Inputs,
+			Outputs:    state.Outputs,
+			Provider:   state.Provider,
+			InitErrors: state.InitErrors,
+		}
+		events = append(events, engine.NewEvent(engine.ResourceOutputsEvent, engine.ResourceOutputsEventPayload{
+			Metadata: engine.StepEventMetadata{
+				Op:       deploy.OpSame,
+				URN:      state.URN,
+				Type:     state.Type,
+				Old:      stateMetadata,
+				New:      stateMetadata,
+				Res:      stateMetadata,
+				Provider: state.Provider,
+			},
+		}))
+	}
+	return events, nil
+}
+
+// carryOverStates keeps the state and drifts the previous run found for nodes
+// mapped from a checkpoint, which can not tell drifts on its own.
+func carryOverStates(previousNodes []IacNode, nodes []IacNode) {
+	previousMetadata := make(map[string]PulumiIacMetadata, len(previousNodes))
+	for _, node := range previousNodes {
+		if node.AssetId != "" {
+			previousMetadata[node.AssetId] = node.Metadata
+		}
+	}
+	for i := range nodes {
+		previous, ok := previousMetadata[nodes[i].AssetId]
+		if !ok {
+			continue
+		}
+		nodes[i].Metadata.PulumiState = previous.PulumiState
+		nodes[i].Metadata.PulumiDrifts = previous.PulumiDrifts
+	}
+}
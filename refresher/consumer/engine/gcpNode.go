@@ -0,0 +1,139 @@
+//go:build gcpazure
+
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/infralight/pulumi/refresher"
+	"github.com/infralight/pulumi/refresher/common"
+	"github.com/infralight/pulumi/refresher/storage"
+	"github.com/pulumi/pulumi/pkg/v3/engine"
+	"github.com/rs/zerolog"
+	"strings"
+)
+
+// The GCP node builder needs a go-kit release that lists GCP integrations,
+// which v1.155.0 can't, so it is only built with the gcpazure build tag.
+func init() {
+	RegisterNodeBuilder("gcp", newGcpNodeBuilder, "gcp")
+}
+
+type gcpNodeBuilder struct {
+	logger          *zerolog.Logger
+	mapperEvent     *common.PulumiMapperEvent
+	secrets         refresher.SecretRedactor
+	integrations    []storage.GcpIntegration
+	commonProviders map[string]int
+}
+
+func newGcpNodeBuilder(ctx context.Context, logger *zerolog.Logger, consumer *common.Consumer, mapperEvent *common.PulumiMapperEvent) (NodeBuilder, error) {
+	gcpIntegrations, err := consumer.Store.ListGCPIntegrations(ctx, mapperEvent.AccountId)
+	if err != nil {
+		logger.Err(err).Msg("failed to list gcp integrations")
+		return nil, err
+	}
+	return &gcpNodeBuilder{
+		logger:          logger,
+		mapperEvent:     mapperEvent,
+		secrets:         refresher.NewSecretRedactor(consumer.Config.SecretsHashSalt),
+		integrations:    gcpIntegrations,
+		commonProviders: make(map[string]int),
+	}, nil
+}
+
+func (b *gcpNodeBuilder) Build(metadata engine.StepEventMetadata, node PulumiNode) (*PulumiNode, []string, error) {
+	node.Type = "gcp"
+	state, ok := classifyNode(&node, metadata, b.mapperEvent, b.secrets, b.logger)
+	if !ok || len(state.Outputs) == 0 {
+		return nil, nil, nil
+	}
+	if err := buildGcpNode(&node, state); err != nil {
+		return nil, nil, err
+	}
+	node.Attributes = getIacAttributes(state.Outputs, b.secrets)
+	node.GcpIntegration = b.IntegrationId(node.ProviderAccountId)
+	b.commonProviders[node.ProviderAccountId]++
+
+	terraformType, err := getTerraformType(metadata.Type.String())
+	if err != nil {
+		b.logger.Err(err).Str("pulumiAssetType", metadata.Type.String()).Msg("missing pulumi to terraform type mapping")
+		return &node, nil, nil
+	}
+	node.ObjectType = terraformType
+	return &node, []string{fmt.Sprintf("%s-%s", node.ObjectType, node.Region)}, nil
+}
+
+func (b *gcpNodeBuilder) Finish(ctx context.Context, nodes []PulumiNode) ([]PulumiNode, map[string]int, error) {
+	return nodes, b.commonProviders, nil
+}
+
+func (b *gcpNodeBuilder) IntegrationId(providerAccountId string) string {
+	return getGcpIntegrationId(b.integrations, providerAccountId)
+}
+
+// buildGcpNode sets the asset id, project and region of a gcp node. The asset
+// id is the resource's self link when it has one, and its id otherwise.
+func buildGcpNode(node *PulumiNode, state engine.StepEventStateMetadata) error {
+	outputs := state.Outputs
+	if selfLink := getStringOutput(outputs, "selfLink"); selfLink != "" {
+		node.AssetId = selfLink
+	} else if state.ID != "" {
+		node.AssetId = string(state.ID)
+	} else {
+		return fmt.Errorf("%w: no self link or id for gcp resource", ErrNoArn)
+	}
+	node.Arn = node.AssetId
+	node.Name = getStringOutput(outputs, "name")
+
+	project := getStringOutput(outputs, "project")
+	if project == "" {
+		project = getPathSegment(node.AssetId, "projects")
+	}
+	if project == "" {
+		return errors.New("no project for gcp resource")
+	}
+	node.ProviderAccountId = project
+
+	region := getStringOutput(outputs, "region")
+	if region == "" {
+		region = getPathSegment(node.AssetId, "regions")
+	}
+	if region == "" {
+		zone := getStringOutput(outputs, "zone")
+		if zone == "" {
+			zone = getPathSegment(node.AssetId, "zones")
+		}
+		region = gcpZoneToRegion(zone)
+	}
+	if region == "" {
+		// e.g. storage buckets only have a (multi-)region location
+		region = getStringOutput(outputs, "location")
+	}
+	if region == "" {
+		region = "global"
+	}
+	node.Region = strings.ToLower(region)
+	return nil
+}
+
+// gcpZoneToRegion returns the region of a zone, e.g. us-central1 for us-central1-a.
+func gcpZoneToRegion(zone string) string {
+	parts := strings.Split(zone, "-")
+	if len(parts) < 3 {
+		return zone
+	}
+	return strings.Join(parts[:len(parts)-1], "-")
+}
+
+func getGcpIntegrationId(gcpIntegrations []storage.GcpIntegration, projectId string) string {
+	if gcpIntegrations != nil {
+		for _, integration := range gcpIntegrations {
+			if integration.ProjectId == projectId {
+				return integration.ID
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,317 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"github.com/blang/semver"
+	"github.com/infralight/go-kit/db/mongo"
+	"github.com/infralight/pulumi/refresher"
+	"github.com/infralight/pulumi/refresher/common"
+	"github.com/infralight/pulumi/refresher/config"
+	"github.com/infralight/pulumi/refresher/storage"
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/pkg/v3/engine"
+	"github.com/pulumi/pulumi/pkg/v3/resource/deploy"
+	"github.com/pulumi/pulumi/pkg/v3/resource/deploy/deploytest"
+	"github.com/pulumi/pulumi/pkg/v3/resource/deploy/providers"
+	"github.com/pulumi/pulumi/pkg/v3/resource/stack"
+	"github.com/pulumi/pulumi/pkg/v3/secrets/b64"
+	"github.com/pulumi/pulumi/pkg/v3/util/cancel"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	resourceConfig "github.com/pulumi/pulumi/sdk/v3/go/common/resource/config"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/plugin"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/result"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+	"github.com/rs/zerolog"
+	"go.mongodb.org/mongo-driver/bson"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+const (
+	testProject         = "project"
+	testStack           = "dev"
+	testProviderVersion = "1.0.0"
+)
+
+// harness maps a stack end to end. The stack is loaded from a checkpoint file
+// like any self-managed stack, and is refreshed against fake providers that
+// report the states set with addResource. Mongo, Elasticsearch and DynamoDB
+// are replaced by an in-memory store, and the output is written to an
+// in-memory sink.
+type harness struct {
+	t         *testing.T
+	resources []*resource.State
+	// reads holds the states the fake providers report by urn. Resources
+	// without one no longer exist in their provider.
+	reads map[resource.URN]resource.PropertyMap
+
+	Store    *storage.MemoryInventoryStore
+	Sink     *storage.MemorySink
+	Config   *config.Config
+	Event    *common.PulumiMapperEvent
+	Consumer *common.Consumer
+}
+
+func newHarness(t *testing.T) *harness {
+	store := storage.NewMemoryInventoryStore()
+	sink := storage.NewMemorySink()
+	cfg := &config.Config{SinkType: config.MemorySink, OutputCompression: config.NoCompression}
+	event := &common.PulumiMapperEvent{
+		AccountId:     "account",
+		IntegrationId: "pulumi-integration",
+		StackId:       "stack",
+		ProjectName:   testProject,
+		StackName:     testStack,
+	}
+	store.Stacks[event.StackId] = &mongo.GlobalStack{}
+	return &harness{
+		t:        t,
+		reads:    make(map[resource.URN]resource.PropertyMap),
+		Store:    store,
+		Sink:     sink,
+		Config:   cfg,
+		Event:    event,
+		Consumer: &common.Consumer{Config: cfg, Sink: sink, Store: store},
+	}
+}
+
+func (h *harness) urn(t tokens.Type, name string) resource.URN {
+	return resource.NewURN(testStack, testProject, "", t, tokens.QName(name))
+}
+
+// addProvider adds an explicit provider resource of a package and returns its
+// reference.
+func (h *harness) addProvider(pkg tokens.Package, name string, inputs resource.PropertyMap) string {
+	if inputs == nil {
+		inputs = resource.PropertyMap{}
+	}
+	inputs["version"] = resource.NewStringProperty(testProviderVersion)
+	state := &resource.State{
+		Type:    providers.MakeProviderType(pkg),
+		URN:     h.urn(providers.MakeProviderType(pkg), name),
+		Custom:  true,
+		ID:      resource.ID(name + "-id"),
+		Inputs:  inputs,
+		Outputs: inputs,
+	}
+	h.resources = append(h.resources, state)
+	ref, err := providers.NewReference(state.URN, state.ID)
+	if err != nil {
+		h.t.Fatalf("failed to reference provider %s: %v", name, err)
+	}
+	return ref.String()
+}
+
+// addResource adds a resource whose checkpoint state is outputs, and whose
+// provider reports refreshed. A nil refreshed means the resource was deleted.
+func (h *harness) addResource(t tokens.Type, name, id, provider string, outputs, refreshed resource.PropertyMap) {
+	state := &resource.State{
+		Type:     t,
+		URN:      h.urn(t, name),
+		Custom:   true,
+		ID:       resource.ID(id),
+		Inputs:   outputs,
+		Outputs:  outputs,
+		Provider: provider,
+	}
+	h.resources = append(h.resources, state)
+	if refreshed != nil {
+		h.reads[state.URN] = refreshed
+	}
+}
+
+// writeCheckpoint exports the stack's resources as `pulumi stack export` does.
+// Secrets are encrypted with the base64 secrets provider, which needs no key.
+func (h *harness) writeCheckpoint() string {
+	secretsManager := b64.NewBase64SecretsManager()
+	snapshot := deploy.NewSnapshot(deploy.Manifest{}, secretsManager, h.resources, nil)
+	deployment, err := stack.SerializeDeployment(snapshot, secretsManager, false)
+	if err != nil {
+		h.t.Fatalf("failed to serialize deployment: %v", err)
+	}
+	raw, err := json.Marshal(deployment)
+	if err != nil {
+		h.t.Fatalf("failed to marshal deployment: %v", err)
+	}
+	content, err := json.Marshal(apitype.UntypedDeployment{Version: apitype.DeploymentSchemaVersionCurrent, Deployment: raw})
+	if err != nil {
+		h.t.Fatalf("failed to marshal checkpoint: %v", err)
+	}
+	path := filepath.Join(h.t.TempDir(), "checkpoint.json")
+	if err = os.WriteFile(path, content, 0600); err != nil {
+		h.t.Fatalf("failed to write checkpoint: %v", err)
+	}
+	return path
+}
+
+// run maps the stack with PulumiMapper and returns the error of the run.
+func (h *harness) run() error {
+	h.Event.CheckpointFile = h.writeCheckpoint()
+
+	previous := openStackFunc
+	openStackFunc = func(ctx context.Context, logger *zerolog.Logger, client *refresher.Client, consumer *common.Consumer,
+		event *common.PulumiMapperEvent) (stackApplier, backend.Stack, func(), error) {
+
+		_, stack, cleanup, err := openStack(ctx, logger, client, consumer, event)
+		return &fakeApplier{reads: h.reads}, stack, cleanup, err
+	}
+	defer func() { openStackFunc = previous }()
+
+	logger := zerolog.Nop()
+	return PulumiMapper(context.Background(), &logger, h.Consumer, h.Event)
+}
+
+// fakeApplier refreshes stacks with the engine, loading fake providers instead
+// of plugins.
+type fakeApplier struct {
+	reads map[resource.URN]resource.PropertyMap
+}
+
+func (a *fakeApplier) Apply(ctx context.Context, kind apitype.UpdateKind, stack backend.Stack,
+	op backend.UpdateOperation, opts backend.ApplierOptions,
+	events chan<- engine.Event) (*deploy.Plan, engine.ResourceChanges, result.Result) {
+
+	snapshot, err := stack.Snapshot(ctx)
+	if err != nil {
+		return nil, nil, result.FromError(err)
+	}
+
+	version := semver.MustParse(testProviderVersion)
+	var loaders []*deploytest.ProviderLoader
+	for _, pkg := range []tokens.Package{"aws", "kubernetes", "gcp", "azure", "azure-native"} {
+		loaders = append(loaders, deploytest.NewProviderLoader(pkg, version, func() (plugin.Provider, error) {
+			return &deploytest.Provider{
+				ReadF: func(urn resource.URN, id resource.ID,
+					inputs, state resource.PropertyMap) (plugin.ReadResult, resource.Status, error) {
+
+					outputs, ok := a.reads[urn]
+					if !ok {
+						return plugin.ReadResult{}, resource.StatusOK, nil
+					}
+					return plugin.ReadResult{ID: id, Inputs: inputs, Outputs: outputs}, resource.StatusOK, nil
+				},
+			}, nil
+		}))
+	}
+
+	info := &updateInfo{
+		project: workspace.Project{Name: testProject, Runtime: workspace.NewProjectRuntimeInfo("test", nil)},
+		target: deploy.Target{
+			Name:      stack.Ref().Name(),
+			Config:    resourceConfig.Map{},
+			Decrypter: resourceConfig.NopDecrypter,
+			Snapshot:  snapshot,
+		},
+	}
+	cancelCtx, _ := cancel.NewContext(ctx)
+	engineCtx := &engine.Context{
+		Cancel:          cancelCtx,
+		Events:          events,
+		SnapshotManager: engine.NewJournal(),
+	}
+	updateOpts := engine.UpdateOptions{Host: deploytest.NewPluginHost(nil, nil, nil, loaders...)}
+	return engine.Refresh(info, engineCtx, updateOpts, opts.DryRun)
+}
+
+type updateInfo struct {
+	project workspace.Project
+	target  deploy.Target
+}
+
+func (u *updateInfo) GetRoot() string {
+	return ""
+}
+
+func (u *updateInfo) GetProject() *workspace.Project {
+	return &u.project
+}
+
+func (u *updateInfo) GetTarget() *deploy.Target {
+	return &u.target
+}
+
+// harnessOutput is what a mapper run is compared to its golden file by.
+type harnessOutput struct {
+	Status        string         `json:"status"`
+	FailedStage   string         `json:"failedStage,omitempty"`
+	Mapping       MappingSummary `json:"mapping"`
+	Nodes         []IacNode      `json:"nodes"`
+	StackUpdates  []bson.M       `json:"stackUpdates,omitempty"`
+	TriggeredAtrs []string       `json:"triggeredAtrs,omitempty"`
+}
+
+// output collects the outcome of the last run, leaving out the timestamps.
+func (h *harness) output() harnessOutput {
+	var summary RunSummary
+	content, ok := h.Sink.Get(h.Event.AccountId + "/pulumi_resources/" + h.Event.StackId + "/run_summary.json")
+	if !ok {
+		h.t.Fatal("run summary was not written")
+	}
+	if err := json.Unmarshal(content, &summary); err != nil {
+		h.t.Fatalf("failed to unmarshal run summary: %v", err)
+	}
+
+	nodes, err := readPreviousNodes(context.Background(), h.Consumer, h.Event)
+	if err != nil {
+		h.t.Fatalf("failed to read iac nodes: %v", err)
+	}
+	for i := range nodes {
+		nodes[i].UpdatedAt = 0
+	}
+
+	// the run summary is left out of the stack updates, as its timings differ
+	// on every run
+	var stackUpdates []bson.M
+	for _, update := range h.Store.StackUpdates[h.Event.StackId] {
+		if set, ok := update["$set"].(bson.M); ok {
+			delete(set, "updatedAt")
+			delete(set, "lastRunSummary")
+			if len(set) == 0 {
+				continue
+			}
+		}
+		stackUpdates = append(stackUpdates, update)
+	}
+
+	return harnessOutput{
+		Status:        summary.Status,
+		FailedStage:   summary.FailedStage,
+		Mapping:       summary.MappingSummary,
+		Nodes:         nodes,
+		StackUpdates:  stackUpdates,
+		TriggeredAtrs: h.Store.TriggeredAtrs,
+	}
+}
+
+// assertGolden compares the output of the last run to testdata/<name>.golden.json,
+// rewriting the file instead when the tests run with -update.
+func (h *harness) assertGolden(name string) {
+	actual, err := json.MarshalIndent(h.output(), "", "  ")
+	if err != nil {
+		h.t.Fatalf("failed to marshal output: %v", err)
+	}
+	actual = append(actual, '\n')
+
+	path := filepath.Join("testdata", name+".golden.json")
+	if *update {
+		if err = os.WriteFile(path, actual, 0644); err != nil {
+			h.t.Fatalf("failed to update golden file: %v", err)
+		}
+		return
+	}
+	expected, err := os.ReadFile(path)
+	if err != nil {
+		h.t.Fatalf("failed to read golden file, run the tests with -update to create it: %v", err)
+	}
+	if !bytes.Equal(expected, actual) {
+		h.t.Errorf("output does not match %s, run the tests with -update to accept it:\n%s", path, actual)
+	}
+}
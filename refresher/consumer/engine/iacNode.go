@@ -0,0 +1,96 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/infralight/pulumi/refresher/schema"
+)
+
+// IacNode is a single record of the stack's iac objects, as published in
+// schema/iac-node.json.
+type IacNode struct {
+	SchemaVersion      int               `json:"schemaVersion"`
+	StackId            string            `json:"stackId"`
+	AccountId          string            `json:"accountId"`
+	Iac                string            `json:"iac"`
+	IntegrationId      string            `json:"integrationId"`
+	IsOrchestrator     bool              `json:"isOrchestrator"`
+	UpdatedAt          int64             `json:"updatedAt"`
+	ObjectType         string            `json:"objectType"`
+	Metadata           PulumiIacMetadata `json:"metadata"`
+	Arn                string            `json:"arn"`
+	Region             string            `json:"region"`
+	Attributes         string            `json:"attributes"`
+	Name               string            `json:"name"`
+	AssetId            string            `json:"assetId"`
+	ProviderAccountId  string            `json:"providerAccountId,omitempty"`
+	AwsIntegrationId   string            `json:"awsIntegrationId,omitempty"`
+	K8sIntegrationId   string            `json:"k8sIntegrationId,omitempty"`
+	GcpIntegrationId   string            `json:"gcpIntegrationId,omitempty"`
+	AzureIntegrationId string            `json:"azureIntegrationId,omitempty"`
+	Location           string            `json:"location,omitempty"`
+	ResourceId         string            `json:"resourceId,omitempty"`
+	Kind               string            `json:"kind,omitempty"`
+}
+
+func newIacNode(node PulumiNode) IacNode {
+	iacNode := IacNode{
+		SchemaVersion:      schema.IacNodeSchemaVersion,
+		StackId:            node.StackId,
+		AccountId:          node.AccountId,
+		Iac:                node.Iac,
+		IntegrationId:      node.PulumiIntegrationId,
+		IsOrchestrator:     node.IsOrchestrator,
+		UpdatedAt:          node.UpdatedAt,
+		ObjectType:         node.ObjectType,
+		Metadata:           node.Metadata,
+		Arn:                node.Arn,
+		Region:             node.Region,
+		Attributes:         node.Attributes,
+		Name:               node.Name,
+		AssetId:            node.AssetId,
+		ProviderAccountId:  node.ProviderAccountId,
+		AwsIntegrationId:   node.AwsIntegration,
+		K8sIntegrationId:   node.K8sIntegration,
+		GcpIntegrationId:   node.GcpIntegration,
+		AzureIntegrationId: node.AzureIntegration,
+	}
+	if node.Type == "k8s" {
+		iacNode.Location = node.Location
+		iacNode.ResourceId = node.ResourceId
+		iacNode.Kind = node.Kind
+	}
+	return iacNode
+}
+
+// encodeIacNode serializes a node as a single json line, failing if it doesn't
+// match the published schema.
+func encodeIacNode(node IacNode) ([]byte, error) {
+	record, err := json.Marshal(node)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal iac node %s: %w", node.AssetId, err)
+	}
+	if err = schema.ValidateIacNode(record); err != nil {
+		return nil, fmt.Errorf("iac node %s: %w", node.AssetId, err)
+	}
+	return append(record, '\n'), nil
+}
+
+// decodeIacNodes parses json lines of iac nodes. Records written before nodes
+// were versioned have no schema version, and are read as the first version.
+func decodeIacNodes(jsonLines []byte) ([]IacNode, error) {
+	var nodes []IacNode
+	decoder := json.NewDecoder(bytes.NewReader(jsonLines))
+	for decoder.More() {
+		var node IacNode
+		if err := decoder.Decode(&node); err != nil {
+			return nil, err
+		}
+		if node.SchemaVersion > schema.IacNodeSchemaVersion {
+			return nil, fmt.Errorf("iac node %s has an unsupported schema version %d", node.AssetId, node.SchemaVersion)
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
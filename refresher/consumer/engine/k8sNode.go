@@ -0,0 +1,295 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/infralight/go-kit/db/mongo"
+	"github.com/infralight/go-kit/helpers"
+	k8sUtils "github.com/infralight/go-kit/k8s"
+	goKitTypes "github.com/infralight/go-kit/types"
+	k8sApiUtils "github.com/infralight/k8s-api/pkg/utils"
+	"github.com/infralight/pulumi/refresher"
+	"github.com/infralight/pulumi/refresher/common"
+	"github.com/pulumi/pulumi/pkg/v3/engine"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/rs/zerolog"
+	"github.com/thoas/go-funk"
+	"gopkg.in/yaml.v3"
+)
+
+type k8sNodeBuilder struct {
+	logger       *zerolog.Logger
+	consumer     *common.Consumer
+	mapperEvent  *common.PulumiMapperEvent
+	secrets      refresher.SecretRedactor
+	integrations []mongo.K8sIntegration
+	// providers holds the cluster of the k8s providers by reference, when
+	// their configuration tells it
+	providers map[string]string
+	// nodeProviders holds the provider reference of the nodes by uid
+	nodeProviders map[string]string
+}
+
+func newK8sNodeBuilder(ctx context.Context, logger *zerolog.Logger, consumer *common.Consumer, mapperEvent *common.PulumiMapperEvent) (NodeBuilder, error) {
+	k8sIntegrations, err := consumer.Store.ListK8SIntegrations(ctx, mapperEvent.AccountId)
+	if err != nil {
+		logger.Err(err).Msg("failed to list k8s integrations")
+		return nil, err
+	}
+	return &k8sNodeBuilder{
+		logger:        logger,
+		consumer:      consumer,
+		mapperEvent:   mapperEvent,
+		secrets:       refresher.NewSecretRedactor(consumer.Config.SecretsHashSalt),
+		integrations:  k8sIntegrations,
+		providers:     make(map[string]string),
+		nodeProviders: make(map[string]string),
+	}, nil
+}
+
+func (b *k8sNodeBuilder) Build(metadata engine.StepEventMetadata, node PulumiNode) (*PulumiNode, []string, error) {
+	node.Type = "k8s"
+	state, ok := classifyNode(&node, metadata, b.mapperEvent, b.secrets, b.logger)
+	if !ok {
+		return nil, nil, nil
+	}
+	var err error
+	node.Attributes, err = getK8sIacAttributes(state.Outputs, b.secrets, []string{"status", "__inputs", "__initialApiVersion"})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get iac attributes: %w", err)
+	}
+	resourceMetadata := state.Outputs["metadata"].Mappable()
+	if resourceMetadata == nil {
+		return nil, nil, errors.New("found k8s resource without metadata")
+	}
+	namespace := funk.Get(resourceMetadata, "namespace")
+	name := funk.Get(resourceMetadata, "name")
+	interfaceUid := funk.Get(resourceMetadata, "uid")
+	if name == nil || interfaceUid == nil {
+		return nil, nil, errors.New("found resource with empty name/uid")
+	}
+	uid := goKitTypes.ToString(interfaceUid)
+	if namespace != nil {
+		node.Location = goKitTypes.ToString(namespace)
+	} else {
+		node.Location = ""
+	}
+	node.Name = goKitTypes.ToString(name)
+	node.ResourceId = uid
+
+	resourceKind := state.Outputs["kind"].V
+	if resourceKind == nil {
+		return nil, nil, errors.New("found k8s resource without kind")
+	}
+	kind := goKitTypes.ToString(resourceKind)
+	node.ObjectType = k8sUtils.GetKubernetesResourceType(kind, node.Name)
+	node.Kind = kind
+	b.nodeProviders[uid] = state.Provider
+	return &node, []string{node.ObjectType}, nil
+}
+
+// Finish attributes the k8s nodes to their clusters and sets their arns. The
+// nodes of each provider are looked up by their uids, and when that is not
+// conclusive they are attributed to the cluster the provider is configured
+// with. Nodes whose cluster can't be resolved are dropped.
+func (b *k8sNodeBuilder) Finish(ctx context.Context, nodes []PulumiNode) ([]PulumiNode, map[string]int, error) {
+	var refs []string
+	providerNodes := make(map[string][]PulumiNode)
+	for _, node := range nodes {
+		ref := b.nodeProviders[node.ResourceId]
+		if _, ok := providerNodes[ref]; !ok {
+			refs = append(refs, ref)
+		}
+		providerNodes[ref] = append(providerNodes[ref], node)
+	}
+
+	clusters := make(map[string]int)
+	resolved := make([]PulumiNode, 0, len(nodes))
+	for _, ref := range refs {
+		for _, node := range b.resolveClusters(ctx, ref, providerNodes[ref]) {
+			clusters[node.ProviderAccountId]++
+			resolved = append(resolved, node)
+		}
+	}
+	return resolved, clusters, nil
+}
+
+// Atrs returns the ATRs of the asset types of the nodes in each of their
+// clusters' integrations.
+func (b *k8sNodeBuilder) Atrs(nodes []PulumiNode) []string {
+	var atrs []string
+	for _, node := range nodes {
+		if node.K8sIntegration == "" || node.ObjectType == "" {
+			continue
+		}
+		atr := fmt.Sprintf("%s-%s", node.K8sIntegration, node.ObjectType)
+		if !helpers.StringSliceContains(atrs, atr) {
+			atrs = append(atrs, atr)
+		}
+	}
+	return atrs
+}
+
+// resolveClusters attributes the nodes of a single provider to their clusters.
+// When the nodes are found in more than one cluster, each half of them is
+// resolved on its own, so that a provider spanning a few clusters takes a few
+// lookups rather than one per node.
+func (b *k8sNodeBuilder) resolveClusters(ctx context.Context, ref string, nodes []PulumiNode) []PulumiNode {
+	var uids, kinds []string
+	for _, node := range nodes {
+		uids = append(uids, node.ResourceId)
+		if !helpers.StringSliceContains(kinds, node.Kind) {
+			kinds = append(kinds, node.Kind)
+		}
+	}
+	integrationIds, err := b.consumer.Store.GetK8sIntegrationIds(ctx, b.mapperEvent.AccountId, uids, kinds)
+	if err != nil {
+		b.logger.Warn().Err(err).Str("provider", ref).Msg("failed to get k8s integrations")
+	}
+
+	if len(integrationIds) > 1 && len(nodes) > 1 {
+		half := len(nodes) / 2
+		resolved := b.resolveClusters(ctx, ref, nodes[:half])
+		return append(resolved, b.resolveClusters(ctx, ref, nodes[half:])...)
+	}
+
+	resolved := make([]PulumiNode, 0, len(nodes))
+	for _, node := range nodes {
+		if b.setCluster(&node, ref, integrationIds) {
+			resolved = append(resolved, node)
+		}
+	}
+	return resolved
+}
+
+// setCluster sets the cluster of a node to the one of its single integration,
+// or to the cluster its provider is configured with. It returns false when the
+// cluster can't be resolved.
+func (b *k8sNodeBuilder) setCluster(node *PulumiNode, ref string, integrationIds []string) bool {
+	var clusterId, integrationId string
+	if len(integrationIds) == 1 {
+		if integration := getK8sIntegrationObjectById(b.integrations, integrationIds[0]); integration != nil {
+			clusterId = integration.ClusterId
+			integrationId = integration.ID
+		}
+	}
+	if clusterId == "" {
+		clusterId = b.providers[ref]
+		integrationId = getK8sIntegrationId(b.integrations, clusterId)
+	}
+	if clusterId == "" {
+		b.logger.Warn().Str("provider", ref).Str("uid", node.ResourceId).Str("kind", node.Kind).Msg("failed to resolve the cluster of k8s resource")
+		return false
+	}
+	node.ProviderAccountId = clusterId
+	node.K8sIntegration = integrationId
+	node.Arn = k8sUtils.BuildArn(node.Location, clusterId, node.Kind, node.Name)
+	node.AssetId = node.Arn
+	return true
+}
+
+// AddProvider resolves the cluster of a k8s provider from its cluster, context
+// or kubeconfig configuration. Default providers use the ambient kubeconfig,
+// so their cluster is only resolved from the uids of their resources.
+func (b *k8sNodeBuilder) AddProvider(ref string, state engine.StepEventStateMetadata) {
+	config := state.Inputs
+	if len(config) == 0 {
+		config = state.Outputs
+	}
+	cluster := getProviderConfigString(config, "cluster")
+	if cluster == "" {
+		cluster = getKubeconfigCluster(getProviderConfigString(config, "kubeconfig"), getProviderConfigString(config, "context"))
+	}
+	if cluster != "" {
+		b.providers[ref] = cluster
+	}
+}
+
+func (b *k8sNodeBuilder) IntegrationId(providerAccountId string) string {
+	return getK8sIntegrationId(b.integrations, providerAccountId)
+}
+
+func getK8sIacAttributes(outputs resource.PropertyMap, secrets refresher.SecretRedactor, blackList []string) (string, error) {
+	// in case we want k8s attributes we use blacklist for redundant attributes
+	iacAttributes := make(map[string]interface{})
+	for key, val := range outputs {
+		stringKey := fmt.Sprintf("%v", key)
+		if !helpers.StringSliceContains(blackList, stringKey) {
+			iacAttributes[stringKey] = secrets.Value(val)
+		}
+	}
+	if metadata, err := k8sApiUtils.GetMapFromMap(iacAttributes, "metadata"); err == nil {
+		_ = k8sApiUtils.ConvertItemToYaml(metadata, "managedFields")
+
+	} else {
+		return "", errors.New("failed to get metadata")
+	}
+
+	if data, err := k8sApiUtils.GetMapFromMap(iacAttributes, "data"); err == nil {
+		if dataSpec, err := k8sApiUtils.GetMapFromMap(data, "spec"); err == nil {
+			if err = k8sApiUtils.ConvertItemToYaml(dataSpec, "template"); err != nil {
+				return "", errors.New("failed to find or to yaml template")
+			}
+		}
+	}
+	attributesBytes, err := json.Marshal(&iacAttributes)
+	if err != nil {
+		return "", errors.New("failed to find or to marshal attributes")
+	}
+	return string(attributesBytes), nil
+}
+
+// kubeconfig is the part of a kubeconfig needed for telling its clusters.
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Contexts       []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+}
+
+// getKubeconfigCluster returns the cluster of a kubeconfig's context, or of
+// its current context when no context is given. Kubeconfigs given as a path
+// can't be read here, and a context name doesn't tell its cluster, so no
+// cluster is returned for them.
+func getKubeconfigCluster(content, context string) string {
+	var config kubeconfig
+	if content == "" || yaml.Unmarshal([]byte(content), &config) != nil {
+		return ""
+	}
+	if context == "" {
+		context = config.CurrentContext
+	}
+	for _, kubeContext := range config.Contexts {
+		if kubeContext.Name == context && kubeContext.Context.Cluster != "" {
+			return kubeContext.Context.Cluster
+		}
+	}
+	return ""
+}
+
+func getK8sIntegrationId(k8sIntegrations []mongo.K8sIntegration, clusterId string) string {
+	if k8sIntegrations != nil {
+		for _, integration := range k8sIntegrations {
+			if integration.ClusterId == clusterId {
+				return integration.ID
+			}
+		}
+	}
+	return ""
+}
+
+func getK8sIntegrationObjectById(k8sIntegrations []mongo.K8sIntegration, integrationId string) *mongo.K8sIntegration {
+	if k8sIntegrations != nil {
+		for _, integration := range k8sIntegrations {
+			if integration.ID == integrationId {
+				return &integration
+			}
+		}
+	}
+	return nil
+}
@@ -1,5 +1,7 @@
 package engine
 
+import "github.com/infralight/pulumi/refresher"
+
 type PulumiNode struct {
 	Type                string
 	AccountId           string
@@ -11,6 +13,8 @@ type PulumiNode struct {
 	ProviderAccountId   string
 	AwsIntegration      string
 	K8sIntegration      string
+	GcpIntegration      string
+	AzureIntegration    string
 	Location            string
 	Name                string
 	ResourceId          string
@@ -24,13 +28,21 @@ type PulumiNode struct {
 }
 
 type PulumiIacMetadata struct {
-	StackId          string                   `json:"stackId"`
-	StackName        string                   `json:"stackName"`
-	ProjectName      string                   `json:"projectName"`
-	OrganizationName string                   `json:"organizationName"`
-	PulumiType       string                   `json:"pulumiType"`
-	PulumiState      string                   `json:"pulumiState"`
-	PulumiDrifts     []map[string]interface{} `json:"pulumiDrifts"`
-	VcsRepo          string                   `json:"vcsRepo"`
-	VcsProvider      string                   `json:"vcsProvider"`
+	StackId          string `json:"stackId"`
+	StackName        string `json:"stackName"`
+	ProjectName      string `json:"projectName"`
+	OrganizationName string `json:"organizationName"`
+	PulumiType       string `json:"pulumiType"`
+	Urn              string `json:"urn"`
+	// Parent, Provider, Dependencies and PropertyDependencies hold the asset
+	// ids of the resources the node relates to, or their urns when they were
+	// not mapped to nodes.
+	Parent               string              `json:"parent,omitempty"`
+	Provider             string              `json:"provider,omitempty"`
+	Dependencies         []string            `json:"dependencies,omitempty"`
+	PropertyDependencies map[string][]string `json:"propertyDependencies,omitempty"`
+	PulumiState          string              `json:"pulumiState"`
+	PulumiDrifts         []refresher.Drift   `json:"pulumiDrifts"`
+	VcsRepo              string              `json:"vcsRepo"`
+	VcsProvider          string              `json:"vcsProvider"`
 }
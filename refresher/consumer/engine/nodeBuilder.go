@@ -0,0 +1,132 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"github.com/infralight/pulumi/refresher/common"
+	"github.com/pulumi/pulumi/pkg/v3/engine"
+	"github.com/rs/zerolog"
+)
+
+// NodeBuilder builds the inventory nodes of a single provider's resources. A
+// builder is created for every mapped stack, so it may keep state across the
+// steps it builds.
+type NodeBuilder interface {
+	// Build builds the node of a single step on top of node, which already has
+	// its stack fields set. It returns the node along with its asset type keys
+	// (used for triggering ATRs), or a nil node when the step is skipped.
+	Build(metadata engine.StepEventMetadata, node PulumiNode) (*PulumiNode, []string, error)
+
+	// Finish is called with the nodes returned by Build once all the steps
+	// were built. It returns the final nodes and the number of resources found
+	// per provider account.
+	Finish(ctx context.Context, nodes []PulumiNode) ([]PulumiNode, map[string]int, error)
+
+	// IntegrationId returns the id of the integration of a provider account,
+	// or an empty string when the account has no integration.
+	IntegrationId(providerAccountId string) string
+}
+
+// ProviderAwareNodeBuilder is implemented by node builders that resolve their
+// nodes using the configuration of the pulumi providers of the resources.
+// Providers are added before the resources that use them are built.
+type ProviderAwareNodeBuilder interface {
+	NodeBuilder
+
+	// AddProvider adds the state of a provider resource of the builder's
+	// package, referenced by ref from the resources using it.
+	AddProvider(ref string, state engine.StepEventStateMetadata)
+}
+
+// AtrNodeBuilder is implemented by node builders whose nodes may belong to
+// different integrations of the stack (e.g. k8s resources of a few clusters).
+// Their ATRs are built from their final nodes, rather than for the most common
+// integration of the stack.
+type AtrNodeBuilder interface {
+	NodeBuilder
+
+	// Atrs returns the ATRs of the nodes returned by Finish.
+	Atrs(nodes []PulumiNode) []string
+}
+
+// ErrNoArn is returned by node builders for resources that have no arn, or
+// any other id the asset id of the node could be built from.
+var ErrNoArn = errors.New("no arn for resource")
+
+// NodeBuilderFactory creates the node builder of a provider for a single
+// mapper event.
+type NodeBuilderFactory func(ctx context.Context, logger *zerolog.Logger, consumer *common.Consumer, mapperEvent *common.PulumiMapperEvent) (NodeBuilder, error)
+
+type nodeBuilderRegistration struct {
+	provider string
+	factory  NodeBuilderFactory
+}
+
+// nodeBuilders holds the registered node builders by pulumi package.
+var nodeBuilders = make(map[string]nodeBuilderRegistration)
+
+// RegisterNodeBuilder registers the node builder of a provider for the
+// resources of the given pulumi packages, replacing any builder previously
+// registered for them.
+func RegisterNodeBuilder(provider string, factory NodeBuilderFactory, packages ...string) {
+	for _, pkg := range packages {
+		nodeBuilders[pkg] = nodeBuilderRegistration{provider: provider, factory: factory}
+	}
+}
+
+func init() {
+	RegisterNodeBuilder("aws", newAwsNodeBuilder, "aws")
+	RegisterNodeBuilder("k8s", newK8sNodeBuilder, "kubernetes")
+}
+
+// MappingSummary counts the resources of a stack by how they were mapped.
+type MappingSummary struct {
+	// Mapped is the number of mapped nodes by provider.
+	Mapped map[string]int `json:"mapped" bson:"mapped"`
+	// States is the number of mapped nodes by their pulumi state.
+	States map[string]int `json:"states" bson:"states"`
+	// Resources is the number of mapped nodes by provider and pulumi state.
+	Resources map[string]map[string]int `json:"resources" bson:"resources"`
+	// Drifted is the number of mapped nodes with drifts by provider.
+	Drifted map[string]int `json:"drifted" bson:"drifted"`
+	// Unsupported is the number of resources without a node builder by pulumi type.
+	Unsupported map[string]int `json:"unsupported" bson:"unsupported"`
+	// MissingTerraformType is the number of mapped nodes without a terraform
+	// type mapping by pulumi type.
+	MissingTerraformType map[string]int `json:"missingTerraformType" bson:"missingTerraformType"`
+	// MissingArn is the number of resources without an arn by pulumi type.
+	MissingArn map[string]int `json:"missingArn" bson:"missingArn"`
+	// Failed is the number of resources their node could not be built by pulumi type.
+	Failed map[string]int `json:"failed" bson:"failed"`
+}
+
+func newMappingSummary() *MappingSummary {
+	return &MappingSummary{
+		Mapped:               make(map[string]int),
+		States:               make(map[string]int),
+		Resources:            make(map[string]map[string]int),
+		Drifted:              make(map[string]int),
+		Unsupported:          make(map[string]int),
+		MissingTerraformType: make(map[string]int),
+		MissingArn:           make(map[string]int),
+		Failed:               make(map[string]int),
+	}
+}
+
+// addNodes counts the final nodes of a provider.
+func (s *MappingSummary) addNodes(provider string, nodes []PulumiNode) {
+	s.Mapped[provider] += len(nodes)
+	for _, node := range nodes {
+		s.States[node.Metadata.PulumiState]++
+		if s.Resources[provider] == nil {
+			s.Resources[provider] = make(map[string]int)
+		}
+		s.Resources[provider][node.Metadata.PulumiState]++
+		if len(node.Metadata.PulumiDrifts) > 0 {
+			s.Drifted[provider]++
+		}
+		if node.ObjectType == "" {
+			s.MissingTerraformType[node.Metadata.PulumiType]++
+		}
+	}
+}
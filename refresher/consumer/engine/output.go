@@ -0,0 +1,196 @@
+package engine
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/infralight/pulumi/refresher/common"
+	"github.com/infralight/pulumi/refresher/config"
+	"github.com/infralight/pulumi/refresher/schema"
+	"github.com/infralight/pulumi/refresher/storage"
+	"io/ioutil"
+	"time"
+)
+
+// OutputManifest lists the files holding the stack's iac nodes. It is written
+// after the files themselves, so it only ever points to complete outputs.
+type OutputManifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	Compression   string       `json:"compression"`
+	Records       int          `json:"records"`
+	Files         []OutputFile `json:"files"`
+	WrittenAt     time.Time    `json:"writtenAt"`
+}
+
+// OutputFile is a single file of the stack's iac nodes, relative to the
+// manifest.
+type OutputFile struct {
+	Name    string `json:"name"`
+	Records int    `json:"records"`
+	Bytes   int    `json:"bytes"`
+}
+
+type outputFile struct {
+	OutputFile
+	content []byte
+}
+
+func stackOutputPath(event *common.PulumiMapperEvent, name string) string {
+	return fmt.Sprintf("%s/pulumi_resources/%s/%s", event.AccountId, event.StackId, name)
+}
+
+func iacObjectsPath(event *common.PulumiMapperEvent) string {
+	return stackOutputPath(event, "iac_objects.jsonl")
+}
+
+func manifestPath(event *common.PulumiMapperEvent) string {
+	return stackOutputPath(event, "iac_objects.manifest.json")
+}
+
+// encodeOutput serializes the nodes into the files they are written to. Nodes
+// are split into chunks of cfg.OutputChunkSize records when set, and each file
+// is gzipped when cfg.OutputCompression is gzip. An unchunked, uncompressed
+// output keeps the iac_objects.jsonl name existing consumers read.
+func encodeOutput(cfg *config.Config, nodes []IacNode) ([]outputFile, error) {
+	chunkSize := cfg.OutputChunkSize
+	if chunkSize <= 0 {
+		chunkSize = len(nodes)
+	}
+
+	var files []outputFile
+	for start := 0; start < len(nodes); start += chunkSize {
+		end := start + chunkSize
+		if end > len(nodes) {
+			end = len(nodes)
+		}
+
+		var content bytes.Buffer
+		for _, node := range nodes[start:end] {
+			record, err := encodeIacNode(node)
+			if err != nil {
+				return nil, err
+			}
+			content.Write(record)
+		}
+
+		name := "iac_objects.jsonl"
+		if cfg.OutputChunkSize > 0 {
+			name = fmt.Sprintf("iac_objects.%05d.jsonl", len(files))
+		}
+		file := outputFile{content: content.Bytes()}
+		if cfg.OutputCompression == config.GzipCompression {
+			name += ".gz"
+			compressed, err := gzipContent(file.content)
+			if err != nil {
+				return nil, err
+			}
+			file.content = compressed
+		}
+		file.Name = name
+		file.Records = end - start
+		file.Bytes = len(file.content)
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// writeOutput writes the encoded files of the stack's nodes, followed by the
+// manifest pointing to them.
+func writeOutput(ctx context.Context, consumer *common.Consumer, event *common.PulumiMapperEvent, files []outputFile) error {
+	manifest := OutputManifest{
+		SchemaVersion: schema.IacNodeSchemaVersion,
+		Compression:   consumer.Config.OutputCompression,
+		Files:         make([]OutputFile, 0, len(files)),
+		WrittenAt:     time.Now().UTC(),
+	}
+	for _, file := range files {
+		contentType := "jsonl"
+		if manifest.Compression == config.GzipCompression {
+			contentType = "application/gzip"
+		}
+		if err := consumer.Sink.Write(ctx, stackOutputPath(event, file.Name), file.content, contentType); err != nil {
+			return fmt.Errorf("failed to write %s: %w", file.Name, err)
+		}
+		manifest.Records += file.Records
+		manifest.Files = append(manifest.Files, file.OutputFile)
+	}
+
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return consumer.Sink.Write(ctx, manifestPath(event), content, "json")
+}
+
+// readPreviousNodes returns the nodes written by the previous run, or nil if
+// there are none. Stacks written before manifests were introduced are read
+// from their iac_objects.jsonl.
+func readPreviousNodes(ctx context.Context, consumer *common.Consumer, event *common.PulumiMapperEvent) ([]IacNode, error) {
+	content, err := consumer.Sink.Read(ctx, manifestPath(event))
+	if errors.Is(err, storage.ErrNotFound) {
+		return readLegacyNodes(ctx, consumer, event)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read the previous output manifest: %w", err)
+	}
+
+	var manifest OutputManifest
+	if err = json.Unmarshal(content, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse the previous output manifest: %w", err)
+	}
+	nodes := make([]IacNode, 0, manifest.Records)
+	for _, file := range manifest.Files {
+		content, err := consumer.Sink.Read(ctx, stackOutputPath(event, file.Name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the previous iac objects %s: %w", file.Name, err)
+		}
+		if manifest.Compression == config.GzipCompression {
+			if content, err = gunzipContent(content); err != nil {
+				return nil, fmt.Errorf("failed to decompress the previous iac objects %s: %w", file.Name, err)
+			}
+		}
+		fileNodes, err := decodeIacNodes(content)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the previous iac objects %s: %w", file.Name, err)
+		}
+		nodes = append(nodes, fileNodes...)
+	}
+	return nodes, nil
+}
+
+func readLegacyNodes(ctx context.Context, consumer *common.Consumer, event *common.PulumiMapperEvent) ([]IacNode, error) {
+	content, err := consumer.Sink.Read(ctx, iacObjectsPath(event))
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read the previous iac objects: %w", err)
+	}
+	nodes, err := decodeIacNodes(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the previous iac objects: %w", err)
+	}
+	return nodes, nil
+}
+
+func gzipContent(content []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(content); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+func gunzipContent(content []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
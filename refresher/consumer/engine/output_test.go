@@ -0,0 +1,144 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/infralight/pulumi/refresher/common"
+	"github.com/infralight/pulumi/refresher/config"
+	"github.com/infralight/pulumi/refresher/schema"
+	"github.com/infralight/pulumi/refresher/storage"
+	"reflect"
+	"testing"
+)
+
+func newOutputTestNodes(count int) []IacNode {
+	nodes := make([]IacNode, 0, count)
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("bucket-%d", i)
+		nodes = append(nodes, IacNode{
+			SchemaVersion: schema.IacNodeSchemaVersion,
+			StackId:       "stack",
+			AccountId:     "account",
+			Iac:           "pulumi",
+			IntegrationId: "integration",
+			UpdatedAt:     1,
+			ObjectType:    "aws_s3_bucket",
+			Metadata: PulumiIacMetadata{
+				StackId:     "stack",
+				StackName:   "dev",
+				ProjectName: "project",
+				PulumiType:  "aws:s3/bucket:Bucket",
+				Urn:         "urn:pulumi:dev::project::aws:s3/bucket:Bucket::" + name,
+				PulumiState: "managed",
+			},
+			Arn:        "arn:aws:s3:::" + name,
+			Region:     "us-east-1",
+			Attributes: "{}",
+			Name:       name,
+			AssetId:    "arn:aws:s3:::" + name,
+		})
+	}
+	return nodes
+}
+
+func TestOutputRoundTrip(t *testing.T) {
+	tests := []struct {
+		compression string
+		chunkSize   int
+		files       []string
+	}{
+		{compression: config.NoCompression, files: []string{"iac_objects.jsonl"}},
+		{compression: config.GzipCompression, files: []string{"iac_objects.jsonl.gz"}},
+		{compression: config.NoCompression, chunkSize: 2,
+			files: []string{"iac_objects.00000.jsonl", "iac_objects.00001.jsonl", "iac_objects.00002.jsonl"}},
+		{compression: config.GzipCompression, chunkSize: 2,
+			files: []string{"iac_objects.00000.jsonl.gz", "iac_objects.00001.jsonl.gz", "iac_objects.00002.jsonl.gz"}},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s/%d", test.compression, test.chunkSize), func(t *testing.T) {
+			ctx := context.Background()
+			sink := storage.NewMemorySink()
+			consumer := &common.Consumer{
+				Config: &config.Config{OutputCompression: test.compression, OutputChunkSize: test.chunkSize},
+				Sink:   sink,
+			}
+			event := &common.PulumiMapperEvent{AccountId: "account", StackId: "stack"}
+			nodes := newOutputTestNodes(5)
+
+			files, err := encodeOutput(consumer.Config, nodes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = writeOutput(ctx, consumer, event, files); err != nil {
+				t.Fatal(err)
+			}
+
+			content, ok := sink.Get(manifestPath(event))
+			if !ok {
+				t.Fatal("expected the manifest to be written")
+			}
+			var manifest OutputManifest
+			if err = json.Unmarshal(content, &manifest); err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, file := range manifest.Files {
+				names = append(names, file.Name)
+				if _, ok = sink.Get(stackOutputPath(event, file.Name)); !ok {
+					t.Errorf("expected %s to be written", file.Name)
+				}
+			}
+			if !reflect.DeepEqual(names, test.files) {
+				t.Errorf("expected the manifest to list %v, got %v", test.files, names)
+			}
+			if manifest.Records != len(nodes) || manifest.Compression != test.compression {
+				t.Errorf("unexpected manifest %+v", manifest)
+			}
+
+			read, err := readPreviousNodes(ctx, consumer, event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(read, nodes) {
+				t.Errorf("expected the nodes to be read back, got %+v", read)
+			}
+		})
+	}
+}
+
+func TestReadPreviousNodesLegacyOutput(t *testing.T) {
+	ctx := context.Background()
+	sink := storage.NewMemorySink()
+	consumer := &common.Consumer{Config: &config.Config{OutputCompression: config.NoCompression}, Sink: sink}
+	event := &common.PulumiMapperEvent{AccountId: "account", StackId: "stack"}
+
+	read, err := readPreviousNodes(ctx, consumer, event)
+	if err != nil || read != nil {
+		t.Fatalf("expected no previous nodes, got %v, %v", read, err)
+	}
+
+	// outputs written before manifests only have their iac_objects.jsonl, and
+	// their records have no schema version
+	nodes := newOutputTestNodes(2)
+	var content []byte
+	for i := range nodes {
+		nodes[i].SchemaVersion = 0
+		record, err := json.Marshal(nodes[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		content = append(append(content, record...), '\n')
+	}
+	if err = sink.Write(ctx, iacObjectsPath(event), content, "jsonl"); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err = readPreviousNodes(ctx, consumer, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, nodes) {
+		t.Errorf("expected the legacy nodes to be read, got %+v", read)
+	}
+}
@@ -2,94 +2,130 @@ package engine
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	goKitDynamo "github.com/infralight/go-kit/db/dynamo"
 	"github.com/infralight/pulumi/refresher"
 	"github.com/infralight/pulumi/refresher/common"
+	"github.com/infralight/pulumi/refresher/metrics"
 	"github.com/infralight/pulumi/refresher/utils"
 	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/pkg/v3/backend/filestate"
 	"github.com/pulumi/pulumi/pkg/v3/backend/httpstate"
 	"github.com/pulumi/pulumi/pkg/v3/engine"
+	"github.com/pulumi/pulumi/pkg/v3/resource/deploy"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/result"
 	"github.com/rs/zerolog"
 	"github.com/thoas/go-funk"
 	"strings"
-)
-
-const (
-	dynamoChunkSize = 25
+	"time"
 )
 
 func PulumiMapper(
 	ctx context.Context,
 	logger *zerolog.Logger,
 	consumer *common.Consumer,
-	lastUpdate *int64, resourceCount *int) error {
+	event *common.PulumiMapperEvent) error {
 
-	client, err := refresher.NewClient(context.Background(), consumer.Config.PulumiUrl)
-	cfg := consumer.Config
-	if err != nil {
-		logger.Fatal().Err(err).Msg("failed to create new pulumi client")
-		return err
+	summary := NewRunSummary(event)
+	var runCtx context.Context
+	var cancel context.CancelFunc
+	if consumer.Config.StackTimeout > 0 {
+		runCtx, cancel = context.WithTimeout(ctx, consumer.Config.StackTimeout)
+	} else {
+		runCtx, cancel = context.WithCancel(ctx)
 	}
-
-	httpBackend, err := client.Login()
-	if err != nil {
-		logger.Fatal().Err(err).Msg("failed to login to pulumi http backend")
-		return err
+	err := mapStack(runCtx, logger, consumer, event, summary)
+	cancel()
+	summary.Finish(err)
+	if err != nil && errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+		logger.Error().Dur("timeout", consumer.Config.StackTimeout).Msg("mapping the stack timed out")
+		summary.Status = RunStatusTimedOut
 	}
+	// the summary is written with the parent context, so it is still recorded
+	// when the run timed out
+	logger.Info().Str("status", summary.Status).Int("records", summary.Records).Int64("durationMillis", summary.DurationMillis).
+		Msg("finished mapping stack")
+	recordRunMetrics(summary)
+	writeRunSummary(ctx, logger, consumer, summary)
+	return err
+}
 
-	httpCloudBackend := client.GetHttpBackend(httpBackend, consumer.Config.PulumiUrl)
+// mapStack refreshes the stack of the event, and writes its resources as iac
+// objects to the sink, recording the outcome in summary.
+func mapStack(
+	ctx context.Context,
+	logger *zerolog.Logger,
+	consumer *common.Consumer,
+	event *common.PulumiMapperEvent,
+	summary *RunSummary) error {
 
-	stackRef := httpstate.CloudStackSummary{
-		Summary: apitype.StackSummary{
-			OrgName:       cfg.OrganizationName,
-			ProjectName:   cfg.ProjectName,
-			StackName:     cfg.StackName,
-			LastUpdate:    lastUpdate,
-			ResourceCount: resourceCount,
-		},
-		B: httpCloudBackend,
+	client, err := refresher.NewClient(ctx, consumer.Config.PulumiUrl)
+	if err != nil {
+		logger.Err(err).Msg("failed to create new pulumi client")
+		return failStage(StageOpenStack, err)
 	}
 
-	stack, err := httpBackend.GetStack(client.Ctx, stackRef.Name())
-	if err != nil || stack == nil {
-		logger.Err(err).Msg("failed getting stack")
-		return consumer.MongoDb.UpdateStateFileDeleted(ctx, consumer.Config.AccountId, consumer.Config.StackId)
+	applier, stack, cleanup, err := openStackFunc(ctx, logger, client, consumer, event)
+	if err != nil {
+		return failStage(StageOpenStack, err)
+	}
+	defer cleanup()
+	if stack == nil {
+		summary.Status = RunStatusDeleted
+		return consumer.Store.UpdateStateFileDeleted(ctx, event.AccountId, event.StackId)
 	}
 
 	stackTags, err := backend.GetMergedStackTags(ctx, stack)
 	if err != nil {
 		logger.Warn().Msg(fmt.Sprintf("failed getting stack tags %s", err))
+		summary.AddError(err)
 	}
 
 	vcsData := getVcsData(stackTags)
 
-	updateOpts := client.GetUpdateOpts()
-
-	dryRunApplierOpts := client.GetDryRunApplierOpts()
+	fingerprint, mode := resolveMappingMode(ctx, logger, consumer, event, stack, summary)
+	summary.Mode = mode
+	if mode == MappingModeSkip {
+		logger.Info().Msg("stack did not change since it was last mapped, skipping")
+		summary.Status = RunStatusUnchanged
+		return nil
+	}
+	// saveFingerprint stores the fingerprint of the mapped stack version once
+	// it is successfully mapped
+	saveFingerprint := func() {
+		if fingerprint == nil {
+			return
+		}
+		if err := writeStackFingerprint(ctx, consumer, event, fingerprint); err != nil {
+			logger.Err(err).Msg("failed to write stack fingerprint")
+			summary.AddError(err)
+		}
+	}
 
-	eventsChannel := make(chan engine.Event)
 	var events []engine.Event
-	go func() {
-		// pull the events from the channel and store them locally
-		for e := range eventsChannel {
-			if e.Type == engine.ResourcePreEvent ||
-				e.Type == engine.ResourceOutputsEvent ||
-				e.Type == engine.SummaryEvent {
-
-				events = append(events, e)
-			}
+	refreshStart := time.Now()
+	if mode == MappingModeCheckpoint {
+		events, err = checkpointEvents(ctx, stack)
+		if err != nil {
+			logger.Err(err).Msg("failed to load stack checkpoint")
+			return failStage(StageRefresh, err)
+		}
+	} else {
+		var response result.Result
+		events, response = refreshEvents(ctx, client, applier, stack)
+		if ctx.Err() != nil {
+			// the engine was canceled, its events don't tell the stack was deleted
+			return failStage(StageRefresh, fmt.Errorf("refresh of the stack was canceled: %w", ctx.Err()))
+		}
+		if response != nil && len(events) == 0 {
+			logger.Err(response.Error()).Msg("failed running pulumi preview")
+			summary.Status = RunStatusDeleted
+			summary.AddError(response.Error())
+			return consumer.Store.UpdateStateFileDeleted(ctx, event.AccountId, event.StackId)
 		}
-	}()
-
-	_, _, response := httpCloudBackend.Apply(ctx, apitype.RefreshUpdate, stack, *updateOpts, *dryRunApplierOpts, eventsChannel)
-	close(eventsChannel)
-
-	if response != nil && len(events) == 0 {
-		logger.Err(response.Error()).Msg("failed running pulumi preview")
-		return consumer.MongoDb.UpdateStateFileDeleted(ctx, consumer.Config.AccountId, consumer.Config.StackId)
 	}
+	metrics.RefreshFinished(mode, time.Since(refreshStart))
 
 	//filter out irrelevant events
 	events = funk.Filter(events, func(event engine.Event) bool {
@@ -98,66 +134,251 @@ func PulumiMapper(
 
 	if len(events) < 1 {
 		logger.Info().Msg("found empty state file")
-		return consumer.MongoDb.UpdateEmptyStateFile(ctx, consumer.Config.AccountId, consumer.Config.StackId)
+		summary.Status = RunStatusEmpty
+		saveFingerprint()
+		return consumer.Store.UpdateEmptyStateFile(ctx, event.AccountId, event.StackId)
 	}
-	nodes, atrsToTrigger, arns, err := CreateS3Node(events, logger, consumer.Config, consumer, vcsData)
+	nodes, atrsToTrigger, arns, mappingSummary, err := CreateS3Node(ctx, events, logger, consumer, event, vcsData)
 	if err != nil {
 		logger.Err(err).Msg("failed to create s3 nodes")
-		return err
+		return failStage(StageMap, err)
+	}
+	summary.MappingSummary = *mappingSummary
+	summary.Records = len(nodes)
+	if len(mappingSummary.Unsupported) > 0 || len(mappingSummary.Failed) > 0 {
+		logger.Warn().Interface("unsupported", mappingSummary.Unsupported).Interface("failed", mappingSummary.Failed).Msg("some of the stack's resources were not mapped")
 	}
 	if len(nodes) == 0 {
 		logger.Info().Msg("no nodes found")
+		saveFingerprint()
 		return nil
 	}
-	jsonlinesNodes, err := utils.ToJsonLines(nodes)
+	previousNodes, err := readPreviousNodes(ctx, consumer, event)
 	if err != nil {
-		logger.Fatal().Err(err).Msg("failed to create jsonlines format")
-		return err
+		logger.Warn().Err(err).Msg("failed to read the previous inventory snapshot, not tracking changes")
+		summary.AddError(err)
+	}
+	if mode == MappingModeCheckpoint {
+		carryOverStates(previousNodes, nodes)
 	}
 
-	err = consumer.ES.DeleteIacAssets(fmt.Sprintf("iac-%s" ,cfg.AccountId), cfg.AccountId, cfg.PulumiIntegrationId, cfg.StackId, arns)
+	var diff *SnapshotDiff
+	if previousNodes != nil {
+		diff = diffPreviousSnapshot(previousNodes, nodes, events)
+		summary.Changes = diff.Counts
+		if diff.exceedsDeletionThreshold(consumer.Config.MassDeletionThreshold) && !event.AllowMassDeletion {
+			logger.Error().Int("deleted", diff.Counts.Deleted).Int("previous", diff.Previous).
+				Float64("threshold", consumer.Config.MassDeletionThreshold).Msg("refusing to delete most of the stack's assets")
+			return failStage(StageDiff, fmt.Errorf("%w: %d of %d assets", ErrMassDeletion, diff.Counts.Deleted, diff.Previous))
+		}
+		// unmapped assets are kept as the previous run mapped them, so a
+		// transient mapping failure doesn't delete them
+		nodes = append(nodes, diff.Unmapped...)
+		for _, node := range diff.Unmapped {
+			arns = append(arns, node.Arn)
+		}
+	}
+
+	outputFiles, err := encodeOutput(consumer.Config, nodes)
+	if err != nil {
+		logger.Err(err).Msg("failed to encode iac nodes")
+		return failStage(StageMap, err)
+	}
+	if diff != nil {
+		if err = writeChanges(ctx, consumer, event, diff); err != nil {
+			logger.Warn().Err(err).Msg("failed to write the stack's changes")
+			summary.AddError(err)
+		}
+	}
+
+	err = consumer.Store.DeleteIacAssets(ctx, event.AccountId, event.IntegrationId, event.StackId, arns)
 	if err != nil {
 		logger.Err(err).Msg("failed to delete from ES the deleted assets")
+		summary.AddError(err)
 	}
 
-	s3Path := fmt.Sprintf("%s/pulumi_resources/%s/iac_objects.jsonl", cfg.AccountId, cfg.StackId)
-	err = utils.WriteFile(consumer.Config, s3Path, jsonlinesNodes, "jsonl")
+	err = writeOutput(ctx, consumer, event, outputFiles)
 	if err != nil {
-		logger.Err(err).Str("accountId", cfg.AccountId).Str("pulumiIntegrationId", cfg.PulumiIntegrationId).Str("projectName", cfg.ProjectName).
-			Str("stackName", cfg.StackName).Str("OrganizationName", cfg.OrganizationName).Msg("failed to write nodes to s3 bucket")
-		return err
+		logger.Err(err).Str("accountId", event.AccountId).Str("pulumiIntegrationId", event.IntegrationId).Str("projectName", event.ProjectName).
+			Str("stackName", event.StackName).Str("OrganizationName", event.OrganizationName).Msg("failed to write nodes to sink")
+		return failStage(StageWrite, err)
 	}
-	logger.Info().Str("accountId", cfg.AccountId).Str("pulumiIntegrationId", cfg.PulumiIntegrationId).Str("projectName", cfg.ProjectName).
-		Str("stackName", cfg.StackName).Int("records", len(nodes)).Str("OrganizationName", cfg.OrganizationName).Msg("Successfully wrote nodes to s3 bucket")
+	logger.Info().Str("accountId", event.AccountId).Str("pulumiIntegrationId", event.IntegrationId).Str("projectName", event.ProjectName).
+		Str("stackName", event.StackName).Int("records", len(nodes)).Str("OrganizationName", event.OrganizationName).Msg("Successfully wrote nodes to sink")
+	saveFingerprint()
 
-	dynamoClient, err := goKitDynamo.NewClient(consumer.Config.LoadAwsSession())
+	err = consumer.Store.TriggerAtrs(ctx, event.AccountId, atrsToTrigger)
 	if err != nil {
-		logger.Err(err).Msg("failed to load aws session")
-		return err
+		logger.Err(err).Msg("failed to trigger engine producer")
+		return failStage(StageTriggerAtrs, err)
 	}
-	atrsChunks := funk.Chunk(atrsToTrigger, dynamoChunkSize)
-	for _, chunk := range atrsChunks.([][]string) {
-		items, err := utils.GetAtrsFromDynamo(cfg.AccountId, cfg.EngineAccumulatorDynamo, chunk, dynamoClient)
-		if err != nil {
-			logger.Err(err).Msg("failed to get batch items from dynamodb")
-			continue
+
+	logger.Info().Msg("Successfully triggered engine producer from dynamodb")
+	return nil
+}
+
+// resolveMappingMode returns the fingerprint of the stack and how it should be
+// mapped. Stacks are refreshed whenever their fingerprint can't be resolved,
+// and aren't fingerprinted at all when there is no full refresh interval.
+func resolveMappingMode(ctx context.Context, logger *zerolog.Logger, consumer *common.Consumer,
+	event *common.PulumiMapperEvent, stack backend.Stack, summary *RunSummary) (*StackFingerprint, string) {
+
+	if consumer.Config.FullRefreshInterval <= 0 {
+		return nil, MappingModeRefresh
+	}
+	fingerprint, err := newStackFingerprint(ctx, stack, event)
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to fingerprint stack")
+		summary.AddError(err)
+		return nil, MappingModeRefresh
+	}
+	previous, err := readStackFingerprint(ctx, consumer, event)
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to read the previous stack fingerprint")
+		summary.AddError(err)
+	}
+
+	now := time.Now().UTC()
+	mode := mappingMode(previous, fingerprint, consumer.Config.FullRefreshInterval, now)
+	fingerprint.LastMappedAt = now
+	fingerprint.LastRefreshAt = now
+	if mode != MappingModeRefresh {
+		fingerprint.LastRefreshAt = previous.LastRefreshAt
+	}
+	return fingerprint, mode
+}
+
+// refreshEvents runs a refresh preview of the stack and returns its resource
+// and summary events.
+func refreshEvents(ctx context.Context, client *refresher.Client, applier stackApplier, stack backend.Stack) ([]engine.Event, result.Result) {
+	updateOpts := client.GetUpdateOpts()
+
+	dryRunApplierOpts := client.GetDryRunApplierOpts()
+
+	eventsChannel := make(chan engine.Event)
+	eventsDone := make(chan bool)
+	var events []engine.Event
+	go func() {
+		// pull the events from the channel and store them locally
+		for e := range eventsChannel {
+			if e.Type == engine.ResourcePreEvent ||
+				e.Type == engine.ResourceOutputsEvent ||
+				e.Type == engine.SummaryEvent {
+
+				events = append(events, e)
+			}
 		}
+		close(eventsDone)
+	}()
+
+	_, _, response := applier.Apply(ctx, apitype.RefreshUpdate, stack, *updateOpts, *dryRunApplierOpts, eventsChannel)
+	close(eventsChannel)
+	<-eventsDone
+	return events, response
+}
+
+// stackApplier is the part of a backend the mapper needs in order to run a
+// refresh preview and collect its engine events.
+type stackApplier interface {
+	Apply(ctx context.Context, kind apitype.UpdateKind, stack backend.Stack,
+		op backend.UpdateOperation, opts backend.ApplierOptions,
+		events chan<- engine.Event) (*deploy.Plan, engine.ResourceChanges, result.Result)
+}
 
-		filteredAtrs, err := utils.DiffDynamoItems(items, chunk, cfg.AccountId)
+// openStackFunc opens the stack of an event. Tests replace it to refresh the
+// stack against fake providers.
+var openStackFunc = openStack
+
+// openStack resolves the stack of the event on the backend it lives in: an
+// exported checkpoint file, a self-managed backend url, or the Pulumi Service.
+// A nil stack with a nil error means the stack no longer exists.
+func openStack(ctx context.Context, logger *zerolog.Logger, client *refresher.Client, consumer *common.Consumer,
+	event *common.PulumiMapperEvent) (stackApplier, backend.Stack, func(), error) {
+
+	noop := func() {}
+
+	if event.CheckpointFile != "" {
+		fileBackend, stack, cleanup, err := client.OpenCheckpoint(ctx, event.CheckpointFile, event.ProjectName, event.StackName)
 		if err != nil {
-			logger.Err(err).Msg("failed to calculate dynamo diff")
-			continue
+			logger.Err(err).Str("checkpointFile", event.CheckpointFile).Msg("failed to load checkpoint file")
+			return nil, nil, nil, err
 		}
+		return fileBackend, stack, cleanup, nil
+	}
 
-		err = utils.WriteAtrsToDynamo(cfg.AccountId, cfg.EngineAccumulatorDynamo, filteredAtrs, cfg.EngineAccumulatorTTL, dynamoClient)
-		logger.Info().Int("Records", len(filteredAtrs)).Msg("Successfully wrote chunk to dynamo")
+	if event.BackendUrl != "" && filestate.IsFileStateBackendURL(event.BackendUrl) {
+		fileBackend, err := client.LoginFileState(event.BackendUrl)
+		if err != nil {
+			logger.Err(err).Msg("failed to open self-managed backend")
+			return nil, nil, nil, err
+		}
+		stackRef, err := refresher.ParseFileStackReference(fileBackend, event.ProjectName, event.StackName)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		var stack backend.Stack
+		err = utils.Retry(ctx, consumer.Config.RetryAttempts, func() (err error) {
+			stack, err = fileBackend.GetStack(ctx, stackRef)
+			return err
+		})
+		if isStackNotFound(stack, err) {
+			logger.Warn().Err(err).Msg("stack was not found")
+			return nil, nil, noop, nil
+		}
 		if err != nil {
-			logger.Err(err).Msg("failed to write batch items to dynamo db")
+			logger.Err(err).Msg("failed getting stack")
+			return nil, nil, nil, err
 		}
+		return fileBackend, stack, noop, nil
 	}
 
-	logger.Info().Msg("Successfully triggered engine producer from dynamodb")
-	return nil
+	var httpBackend httpstate.Backend
+	err := utils.Retry(ctx, consumer.Config.RetryAttempts, func() (err error) {
+		httpBackend, err = client.Login()
+		return err
+	})
+	if err != nil {
+		logger.Err(err).Msg("failed to login to pulumi http backend")
+		return nil, nil, nil, err
+	}
+
+	httpCloudBackend := client.GetHttpBackend(httpBackend, consumer.Config.PulumiUrl)
+
+	stackRef := httpstate.CloudStackSummary{
+		Summary: apitype.StackSummary{
+			OrgName:       event.OrganizationName,
+			ProjectName:   event.ProjectName,
+			StackName:     event.StackName,
+			LastUpdate:    &event.LastUpdated,
+			ResourceCount: &event.ResourceCount,
+		},
+		B: httpCloudBackend,
+	}
+
+	var stack backend.Stack
+	err = utils.Retry(ctx, consumer.Config.RetryAttempts, func() (err error) {
+		stack, err = httpBackend.GetStack(client.Ctx, stackRef.Name())
+		return err
+	})
+	if isStackNotFound(stack, err) {
+		logger.Warn().Err(err).Msg("stack was not found")
+		return nil, nil, noop, nil
+	}
+	if err != nil {
+		logger.Err(err).Msg("failed getting stack")
+		return nil, nil, nil, err
+	}
+	return httpCloudBackend, stack, noop, nil
+}
+
+// isStackNotFound returns whether getting a stack definitely found it deleted.
+// Any other failure (e.g. a timeout or an unauthorized token) fails the run
+// rather than deleting the stack's assets.
+func isStackNotFound(stack backend.Stack, err error) bool {
+	if err != nil {
+		return utils.IsNotFound(err)
+	}
+	return stack == nil
 }
 
 func getVcsData(tags map[apitype.StackTagName]string) map[string]interface{} {
@@ -0,0 +1,36 @@
+//go:build gcpazure
+
+package engine
+
+import (
+	"github.com/infralight/pulumi/refresher/storage"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"testing"
+)
+
+func TestPulumiMapperGcpAzure(t *testing.T) {
+	h := newHarness(t)
+	h.Store.GcpIntegrations = []storage.GcpIntegration{{ID: "7a1b2c3d4e5f6a7b8c9d0e1f", ProjectId: "my-project"}}
+	h.Store.AzureIntegrations = []storage.AzureIntegration{{ID: "8a1b2c3d4e5f6a7b8c9d0e1f", SubscriptionId: "0000-1111"}}
+
+	gcp := h.addProvider("gcp", "main", nil)
+	bucket := resource.NewPropertyMapFromMap(map[string]interface{}{
+		"name":     "logs",
+		"project":  "my-project",
+		"location": "US",
+		"selfLink": "https://www.googleapis.com/storage/v1/b/logs",
+	})
+	h.addResource("gcp:storage/bucket:Bucket", "logs", "logs", gcp, bucket, bucket)
+
+	azure := h.addProvider("azure-native", "main", nil)
+	group := resource.NewPropertyMapFromMap(map[string]interface{}{
+		"name":     "rg",
+		"location": "westeurope",
+	})
+	h.addResource("azure-native:resources:ResourceGroup", "rg", "/subscriptions/0000-1111/resourceGroups/rg", azure, group, group)
+
+	if err := h.run(); err != nil {
+		t.Fatalf("failed to map stack: %v", err)
+	}
+	h.assertGolden("gcp_azure")
+}
@@ -0,0 +1,468 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/infralight/go-kit/db/mongo"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/rs/zerolog"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const (
+	testAwsAccount        = "123456789012"
+	testAwsIntegrationId  = "5f1b2c3d4e5f6a7b8c9d0e1f"
+	testK8sIntegrationIdA = "6a1b2c3d4e5f6a7b8c9d0e1f"
+	testK8sIntegrationIdB = "6b1b2c3d4e5f6a7b8c9d0e1f"
+)
+
+func TestPulumiMapperAwsDrifts(t *testing.T) {
+	h := newHarness(t)
+	h.Event.AwsIntegrationId = testAwsIntegrationId
+	h.Store.AwsIntegrations = []mongo.AwsIntegration{{ID: testAwsIntegrationId, AccountNumber: testAwsAccount}}
+	provider := h.addProvider("aws", "main", resource.NewPropertyMapFromMap(map[string]interface{}{
+		"region": "us-east-1",
+	}))
+
+	bucket := resource.NewPropertyMapFromMap(map[string]interface{}{
+		"arn":    "arn:aws:s3:::logs",
+		"bucket": "logs",
+	})
+	h.addResource("aws:s3/bucket:Bucket", "logs", "logs", provider, bucket, bucket)
+
+	h.addResource("aws:ec2/instance:Instance", "web", "i-0123456789", provider,
+		resource.NewPropertyMapFromMap(map[string]interface{}{
+			"arn":          "arn:aws:ec2:us-east-1:" + testAwsAccount + ":instance/i-0123456789",
+			"instanceType": "t3.micro",
+			"tags":         map[string]interface{}{"Owner": "infra"},
+		}),
+		resource.NewPropertyMapFromMap(map[string]interface{}{
+			"arn":          "arn:aws:ec2:us-east-1:" + testAwsAccount + ":instance/i-0123456789",
+			"instanceType": "t3.large",
+			"tags":         map[string]interface{}{"Owner": "infra", "Team": "web"},
+		}))
+
+	h.addResource("aws:iam/role:Role", "deployer", "deployer", provider,
+		resource.NewPropertyMapFromMap(map[string]interface{}{
+			"arn":  "arn:aws:iam::" + testAwsAccount + ":role/deployer",
+			"name": "deployer",
+		}), nil)
+
+	association := resource.NewPropertyMapFromMap(map[string]interface{}{
+		"routeTableId": "rtb-0123",
+		"subnetId":     "subnet-0123",
+	})
+	h.addResource("aws:ec2/routeTableAssociation:RouteTableAssociation", "public", "rtbassoc-0123", provider,
+		association, association)
+
+	invalid := resource.NewPropertyMapFromMap(map[string]interface{}{
+		"arn": "not-an-arn",
+	})
+	h.addResource("aws:s3/bucket:Bucket", "invalid", "invalid", provider, invalid, invalid)
+
+	if err := h.run(); err != nil {
+		t.Fatalf("failed to map stack: %v", err)
+	}
+	h.assertGolden("aws_drifts")
+}
+
+func TestPulumiMapperK8sClusters(t *testing.T) {
+	h := newHarness(t)
+	h.Store.K8sIntegrations = []mongo.K8sIntegration{
+		{ID: testK8sIntegrationIdA, ClusterId: "cluster-a"},
+		{ID: testK8sIntegrationIdB, ClusterId: "cluster-b"},
+	}
+
+	clusterA := h.addProvider("kubernetes", "cluster-a", resource.NewPropertyMapFromMap(map[string]interface{}{
+		"cluster": "cluster-a",
+	}))
+	clusterB := h.addProvider("kubernetes", "cluster-b", resource.NewPropertyMapFromMap(map[string]interface{}{
+		"kubeconfig": "current-context: prod\ncontexts:\n- name: prod\n  context:\n    cluster: cluster-b\n",
+	}))
+	// the cluster of providers using the ambient kubeconfig can only be told
+	// from the uids of their resources
+	ambient := h.addProvider("kubernetes", "ambient", nil)
+
+	deployment := resource.NewPropertyMapFromMap(map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata":   map[string]interface{}{"name": "api", "namespace": "default", "uid": "uid-api"},
+		"spec":       map[string]interface{}{"replicas": 2},
+		"status":     map[string]interface{}{"readyReplicas": 2},
+	})
+	h.addResource("kubernetes:apps/v1:Deployment", "api", "default/api", clusterA, deployment, deployment)
+
+	service := resource.NewPropertyMapFromMap(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Service",
+		"metadata":   map[string]interface{}{"name": "api", "namespace": "default", "uid": "uid-api-service"},
+		"spec":       map[string]interface{}{"type": "ClusterIP"},
+	})
+	h.addResource("kubernetes:core/v1:Service", "api", "default/api", clusterA, service, service)
+
+	configMap := resource.NewPropertyMapFromMap(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[string]interface{}{"name": "settings", "namespace": "apps", "uid": "uid-settings"},
+		"data":       map[string]interface{}{"mode": "production"},
+	})
+	h.addResource("kubernetes:core/v1:ConfigMap", "settings", "apps/settings", clusterB, configMap,
+		resource.NewPropertyMapFromMap(map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata":   map[string]interface{}{"name": "settings", "namespace": "apps", "uid": "uid-settings"},
+			"data":       map[string]interface{}{"mode": "debug"},
+		}))
+
+	namespace := resource.NewPropertyMapFromMap(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Namespace",
+		"metadata":   map[string]interface{}{"name": "apps", "uid": "uid-apps"},
+	})
+	h.addResource("kubernetes:core/v1:Namespace", "apps", "apps", ambient, namespace, namespace)
+
+	if err := h.run(); err != nil {
+		t.Fatalf("failed to map stack: %v", err)
+	}
+	h.assertGolden("k8s_clusters")
+}
+
+func TestPulumiMapperK8sProviderAcrossClusters(t *testing.T) {
+	h := newHarness(t)
+	h.Store.K8sIntegrations = []mongo.K8sIntegration{
+		{ID: testK8sIntegrationIdA, ClusterId: "cluster-a"},
+		{ID: testK8sIntegrationIdB, ClusterId: "cluster-b"},
+	}
+	// the ambient kubeconfig switched clusters between updates of the stack
+	ambient := h.addProvider("kubernetes", "ambient", nil)
+	for i, cluster := range []string{"a", "a", "a", "a", "b", "b", "b", "b"} {
+		name := fmt.Sprintf("settings-%d", i)
+		uid := "uid-" + name
+		h.Store.K8sUidIntegrations[uid] = map[string]string{"a": testK8sIntegrationIdA, "b": testK8sIntegrationIdB}[cluster]
+		configMap := resource.NewPropertyMapFromMap(map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata":   map[string]interface{}{"name": name, "namespace": "apps", "uid": uid},
+		})
+		h.addResource("kubernetes:core/v1:ConfigMap", name, "apps/"+name, ambient, configMap, configMap)
+	}
+
+	// a kubeconfig given as a path doesn't tell the cluster, whatever the
+	// name of its context
+	path := h.addProvider("kubernetes", "path", resource.NewPropertyMapFromMap(map[string]interface{}{
+		"kubeconfig": "~/.kube/config",
+		"context":    "cluster-a",
+	}))
+	secret := resource.NewPropertyMapFromMap(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata":   map[string]interface{}{"name": "token", "namespace": "apps", "uid": "uid-token"},
+	})
+	h.addResource("kubernetes:core/v1:Secret", "token", "apps/token", path, secret, secret)
+
+	if err := h.run(); err != nil {
+		t.Fatalf("failed to map stack: %v", err)
+	}
+	h.assertGolden("k8s_provider_across_clusters")
+	// the ATRs are triggered in the integration of each cluster
+	expectedAtrs := []string{
+		testK8sIntegrationIdA + "-kubernetes_configmap",
+		testK8sIntegrationIdB + "-kubernetes_configmap",
+	}
+	if !reflect.DeepEqual(h.Store.TriggeredAtrs, expectedAtrs) {
+		t.Errorf("expected ATRs %v, got %v", expectedAtrs, h.Store.TriggeredAtrs)
+	}
+	// the nodes of the ambient provider, then each half of them, and the
+	// node of the path provider
+	if h.Store.K8sIntegrationLookups != 4 {
+		t.Errorf("expected 4 k8s integration lookups, got %d", h.Store.K8sIntegrationLookups)
+	}
+}
+
+func TestPulumiMapperCommonProvider(t *testing.T) {
+	h := newHarness(t)
+	h.Store.AwsIntegrations = []mongo.AwsIntegration{
+		{ID: testAwsIntegrationId, AccountNumber: testAwsAccount},
+		{ID: "5f1b2c3d4e5f6a7b8c9d0e2f", AccountNumber: "210987654321"},
+	}
+	provider := h.addProvider("aws", "main", nil)
+
+	for _, instance := range []struct{ id, account string }{
+		{"i-01", testAwsAccount},
+		{"i-02", testAwsAccount},
+		{"i-03", "210987654321"},
+	} {
+		outputs := resource.NewPropertyMapFromMap(map[string]interface{}{
+			"arn": "arn:aws:ec2:eu-west-1:" + instance.account + ":instance/" + instance.id,
+		})
+		h.addResource("aws:ec2/instance:Instance", instance.id, instance.id, provider, outputs, outputs)
+	}
+
+	if err := h.run(); err != nil {
+		t.Fatalf("failed to map stack: %v", err)
+	}
+	h.assertGolden("common_provider")
+}
+
+func TestPulumiMapperCommonProviderChanged(t *testing.T) {
+	h := newHarness(t)
+	h.Store.AwsIntegrations = []mongo.AwsIntegration{
+		{ID: testAwsIntegrationId, AccountNumber: testAwsAccount},
+		{ID: "5f1b2c3d4e5f6a7b8c9d0e2f", AccountNumber: "210987654321"},
+	}
+	// The stack was recorded with the account that is now the least common.
+	h.Store.Stacks[h.Event.StackId].Integrations = map[string]map[string]interface{}{
+		"aws": {"externalId": "210987654321", "id": "5f1b2c3d4e5f6a7b8c9d0e2f"},
+	}
+	provider := h.addProvider("aws", "main", nil)
+
+	for _, instance := range []struct{ id, account string }{
+		{"i-01", testAwsAccount},
+		{"i-02", testAwsAccount},
+		{"i-03", "210987654321"},
+	} {
+		outputs := resource.NewPropertyMapFromMap(map[string]interface{}{
+			"arn": "arn:aws:ec2:eu-west-1:" + instance.account + ":instance/" + instance.id,
+		})
+		h.addResource("aws:ec2/instance:Instance", instance.id, instance.id, provider, outputs, outputs)
+	}
+
+	if err := h.run(); err != nil {
+		t.Fatalf("failed to map stack: %v", err)
+	}
+	h.assertGolden("common_provider_changed")
+}
+
+// TestPulumiMapperMassDeletion maps a stack whose instances are first not
+// mapped and then removed from the stack, and checks only the removed ones
+// count towards the mass deletion threshold.
+func TestPulumiMapperMassDeletion(t *testing.T) {
+	h := newHarness(t)
+	h.Config.MassDeletionThreshold = 0.5
+	h.Event.AwsIntegrationId = testAwsIntegrationId
+	h.Store.AwsIntegrations = []mongo.AwsIntegration{{ID: testAwsIntegrationId, AccountNumber: testAwsAccount}}
+	provider := h.addProvider("aws", "main", nil)
+
+	instances := []string{"i-01", "i-02", "i-03", "i-04"}
+	for _, id := range instances {
+		outputs := resource.NewPropertyMapFromMap(map[string]interface{}{
+			"arn": "arn:aws:ec2:eu-west-1:" + testAwsAccount + ":instance/" + id,
+		})
+		h.addResource("aws:ec2/instance:Instance", id, id, provider, outputs, outputs)
+	}
+	runSummary := func() *RunSummary {
+		summary, err := ReadRunSummary(context.Background(), h.Sink, h.Event.AccountId, h.Event.StackId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return summary
+	}
+
+	if err := h.run(); err != nil {
+		t.Fatalf("failed to map stack: %v", err)
+	}
+	if nodes := h.output().Nodes; len(nodes) != len(instances) {
+		t.Fatalf("expected %d nodes, got %d", len(instances), len(nodes))
+	}
+
+	// instances that can't be mapped are kept as they were, rather than deleted
+	invalid := resource.NewPropertyMapFromMap(map[string]interface{}{"arn": "not-an-arn"})
+	for _, id := range instances[1:] {
+		h.reads[h.urn("aws:ec2/instance:Instance", id)] = invalid
+	}
+	if err := h.run(); err != nil {
+		t.Fatalf("failed to map stack with unmapped instances: %v", err)
+	}
+	if changes := runSummary().Changes; changes != (ChangeCounts{Unmapped: 3}) {
+		t.Errorf("expected the instances to be unmapped, got %+v", changes)
+	}
+	if nodes := h.output().Nodes; len(nodes) != len(instances) {
+		t.Errorf("expected the unmapped nodes to be kept, got %d nodes", len(nodes))
+	}
+
+	// removing most of them from the stack is refused
+	h.resources = h.resources[:2]
+	if err := h.run(); !errors.Is(err, ErrMassDeletion) {
+		t.Fatalf("expected the mass deletion to be refused, got %v", err)
+	}
+	output := h.output()
+	if output.Status != RunStatusFailed || output.FailedStage != StageDiff {
+		t.Errorf("expected the run to fail at the diff, got %s at %s", output.Status, output.FailedStage)
+	}
+	if len(output.Nodes) != len(instances) {
+		t.Errorf("expected the previous nodes to be kept, got %d nodes", len(output.Nodes))
+	}
+
+	// unless the event allows it
+	h.Event.AllowMassDeletion = true
+	if err := h.run(); err != nil {
+		t.Fatalf("failed to map stack allowing mass deletion: %v", err)
+	}
+	if changes := runSummary().Changes; changes != (ChangeCounts{Deleted: 3}) {
+		t.Errorf("expected the instances to be deleted, got %+v", changes)
+	}
+	if nodes := h.output().Nodes; len(nodes) != 1 {
+		t.Errorf("expected a single node, got %d", len(nodes))
+	}
+}
+
+// TestPulumiMapperFingerprint maps a stack a few times within its full refresh
+// interval, and checks it is skipped while unchanged, mapped from its
+// checkpoint once changed, and refreshed again once the interval expires.
+func TestPulumiMapperFingerprint(t *testing.T) {
+	h := newHarness(t)
+	h.Config.FullRefreshInterval = time.Hour
+	h.Event.AwsIntegrationId = testAwsIntegrationId
+	h.Store.AwsIntegrations = []mongo.AwsIntegration{{ID: testAwsIntegrationId, AccountNumber: testAwsAccount}}
+	provider := h.addProvider("aws", "main", nil)
+
+	instanceArn := func(id string) string {
+		return "arn:aws:ec2:eu-west-1:" + testAwsAccount + ":instance/" + id
+	}
+	h.addResource("aws:ec2/instance:Instance", "i-01", "i-01", provider,
+		resource.NewPropertyMapFromMap(map[string]interface{}{"arn": instanceArn("i-01"), "instanceType": "t3.micro"}),
+		resource.NewPropertyMapFromMap(map[string]interface{}{"arn": instanceArn("i-01"), "instanceType": "t3.large"}))
+
+	// mapRun runs the mapper, and returns the run's status and mode along with
+	// the pulumi states of its nodes by resource id
+	mapRun := func() (string, string, map[string]string) {
+		if err := h.run(); err != nil {
+			t.Fatalf("failed to map stack: %v", err)
+		}
+		summary, err := ReadRunSummary(context.Background(), h.Sink, h.Event.AccountId, h.Event.StackId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		states := make(map[string]string)
+		for _, node := range h.output().Nodes {
+			states[node.Arn] = node.Metadata.PulumiState
+		}
+		return summary.Status, summary.Mode, states
+	}
+
+	status, mode, states := mapRun()
+	if status != RunStatusMapped || mode != MappingModeRefresh || states[instanceArn("i-01")] != "modified" {
+		t.Fatalf("expected the first run to refresh the stack, got %s by %s with %v", status, mode, states)
+	}
+
+	if status, mode, _ = mapRun(); status != RunStatusUnchanged || mode != MappingModeSkip {
+		t.Errorf("expected the unchanged stack to be skipped, got %s by %s", status, mode)
+	}
+
+	// the new instance no longer exists in its provider, which only a refresh
+	// can tell, while the drifts found by the last refresh are kept
+	h.addResource("aws:ec2/instance:Instance", "i-02", "i-02", provider,
+		resource.NewPropertyMapFromMap(map[string]interface{}{"arn": instanceArn("i-02")}), nil)
+	status, mode, states = mapRun()
+	expected := map[string]string{instanceArn("i-01"): "modified", instanceArn("i-02"): "managed"}
+	if status != RunStatusMapped || mode != MappingModeCheckpoint || !reflect.DeepEqual(states, expected) {
+		t.Errorf("expected the changed stack to be mapped from its checkpoint, got %s by %s with %v", status, mode, states)
+	}
+
+	fingerprint, err := readStackFingerprint(context.Background(), h.Consumer, h.Event)
+	if err != nil || fingerprint == nil {
+		t.Fatalf("expected the fingerprint to be written, got %v", err)
+	}
+	fingerprint.LastRefreshAt = fingerprint.LastRefreshAt.Add(-2 * time.Hour)
+	if err = writeStackFingerprint(context.Background(), h.Consumer, h.Event, fingerprint); err != nil {
+		t.Fatal(err)
+	}
+	status, mode, states = mapRun()
+	expected = map[string]string{instanceArn("i-01"): "modified", instanceArn("i-02"): "ghost"}
+	if status != RunStatusMapped || mode != MappingModeRefresh || !reflect.DeepEqual(states, expected) {
+		t.Errorf("expected the stack to be refreshed once the interval expired, got %s by %s with %v", status, mode, states)
+	}
+}
+
+func TestAwsNodeBuilderFinishTie(t *testing.T) {
+	logger := zerolog.Nop()
+	// The accounts are tied, so resources without an account of their own
+	// always go to the smallest account id, whatever order they are counted in.
+	for i := 0; i < 100; i++ {
+		builder := &awsNodeBuilder{
+			logger:          &logger,
+			commonProviders: map[string]int{"210987654321": 1, testAwsAccount: 1, "999999999999": 1},
+		}
+		nodes, _, err := builder.Finish(context.Background(), []PulumiNode{{ResourceId: "rtbassoc-01"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nodes) != 1 || nodes[0].ProviderAccountId != testAwsAccount {
+			t.Fatalf("expected the node to be in account %s, got %+v", testAwsAccount, nodes)
+		}
+	}
+}
+
+func TestPulumiMapperSecrets(t *testing.T) {
+	h := newHarness(t)
+	h.Config.SecretsHashSalt = "salt"
+	h.Config.FullRefreshInterval = time.Hour
+	h.Event.AwsIntegrationId = testAwsIntegrationId
+	h.Store.AwsIntegrations = []mongo.AwsIntegration{{ID: testAwsIntegrationId, AccountNumber: testAwsAccount}}
+	provider := h.addProvider("aws", "main", resource.NewPropertyMapFromMap(map[string]interface{}{
+		"region": "us-east-1",
+	}))
+
+	secretOutputs := func(name, password string) resource.PropertyMap {
+		outputs := resource.NewPropertyMapFromMap(map[string]interface{}{
+			"arn":  "arn:aws:rds:us-east-1:" + testAwsAccount + ":db:" + name,
+			"name": name,
+		})
+		outputs["password"] = resource.MakeSecret(resource.NewStringProperty(password))
+		return outputs
+	}
+	h.addResource("aws:rds/instance:Instance", "main", "main", provider,
+		secretOutputs("main", "hunter2"), secretOutputs("main", "hunter2"))
+	h.addResource("aws:rds/instance:Instance", "replica", "replica", provider,
+		secretOutputs("replica", "hunter2"), secretOutputs("replica", "hunter3"))
+
+	if err := h.run(); err != nil {
+		t.Fatalf("failed to map stack: %v", err)
+	}
+	h.assertGolden("secrets")
+	refreshed := h.output().Nodes
+
+	// Mapping the stack from its checkpoint serializes the secrets the same way.
+	bucket := resource.NewPropertyMapFromMap(map[string]interface{}{
+		"arn":    "arn:aws:s3:::logs",
+		"bucket": "logs",
+	})
+	h.addResource("aws:s3/bucket:Bucket", "logs", "logs", provider, bucket, bucket)
+	if err := h.run(); err != nil {
+		t.Fatalf("failed to map stack: %v", err)
+	}
+	for _, node := range h.output().Nodes {
+		if node.Metadata.Urn == refreshed[0].Metadata.Urn && node.Attributes != refreshed[0].Attributes {
+			t.Errorf("checkpoint attributes %s differ from refreshed attributes %s", node.Attributes, refreshed[0].Attributes)
+		}
+	}
+}
+
+func TestIsStackNotFound(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		notFound bool
+	}{
+		{name: "missing", notFound: true},
+		{name: "404", err: &apitype.ErrorResponse{Code: 404}, notFound: true},
+		{name: "wrapped 404", err: fmt.Errorf("getting stack: %w", &apitype.ErrorResponse{Code: 404}), notFound: true},
+		{name: "401", err: &apitype.ErrorResponse{Code: 401}},
+		{name: "403", err: &apitype.ErrorResponse{Code: 403}},
+		{name: "500", err: &apitype.ErrorResponse{Code: 500}},
+		{name: "deadline exceeded", err: context.DeadlineExceeded},
+		{name: "canceled", err: context.Canceled},
+		{name: "network", err: fmt.Errorf("connection refused")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if notFound := isStackNotFound(nil, test.err); notFound != test.notFound {
+				t.Errorf("expected not found to be %t, got %t", test.notFound, notFound)
+			}
+		})
+	}
+}
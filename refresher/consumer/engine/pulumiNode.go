@@ -6,398 +6,314 @@ import (
 	"errors"
 	"fmt"
 	"github.com/infralight/go-kit/db/mongo"
-	"github.com/infralight/go-kit/flywheel/arn"
 	"github.com/infralight/go-kit/helpers"
-	k8sUtils "github.com/infralight/go-kit/k8s"
-	goKit "github.com/infralight/go-kit/pulumi"
-	goKitTypes "github.com/infralight/go-kit/types"
-	k8sApiUtils "github.com/infralight/k8s-api/pkg/utils"
 	"github.com/infralight/pulumi/refresher"
 	"github.com/infralight/pulumi/refresher/common"
-	"github.com/infralight/pulumi/refresher/config"
-	"github.com/infralight/pulumi/refresher/utils"
 	"github.com/pulumi/pulumi/pkg/v3/engine"
-	"github.com/pulumi/pulumi/pkg/v3/resource/deploy"
+	"github.com/pulumi/pulumi/pkg/v3/resource/deploy/providers"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
 	"github.com/rs/zerolog"
-	"github.com/thoas/go-funk"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"strings"
 	"time"
 )
 
-func CreatePulumiNodes(events []engine.Event, logger *zerolog.Logger, config *config.Config, consumer *common.Consumer, vcsData map[string]interface{}) (result []PulumiNode, assetTypesWithRegions []string, err error) {
+func CreatePulumiNodes(ctx context.Context, events []engine.Event, logger *zerolog.Logger, consumer *common.Consumer, mapperEvent *common.PulumiMapperEvent, vcsData map[string]interface{}) (result []PulumiNode, atrs []string, summary *MappingSummary, err error) {
+	summary = newMappingSummary()
 
-	var nodes []PulumiNode
-	var k8sNodes []PulumiNode
-	var uids []string
-	var kinds []string
-	awsCommonProviders := make(map[string]int)
-	k8sCommonProviders := make(map[string]int)
-	ctx := context.Background()
-
-	awsIntegrations, err := consumer.MongoDb.ListAWSIntegrations(ctx, config.AccountId)
-	if err != nil {
-		logger.Err(err).Msg("failed to list aws integrations")
-		return nil, nil, err
-	}
-	k8sIntegrations, err := consumer.MongoDb.ListK8SIntegrations(ctx, config.AccountId)
+	stack, err := consumer.Store.GetStack(ctx, mapperEvent.AccountId, mapperEvent.StackId)
 	if err != nil {
-		logger.Err(err).Msg("failed to list k8s integrations")
-		return nil, nil, err
+		logger.Err(err).Msg("failed to get stack")
+		return nil, nil, nil, err
 	}
 
-	stack, err := consumer.MongoDb.GetStack(ctx, config.AccountId, config.StackId, nil)
-	if err != nil {
-		logger.Err(err).Msg("failed to get stack")
-		return nil, nil, err
+	// builders are created on the first resource of their provider, and are
+	// kept in that order so the output is stable
+	var builderOrder []string
+	builders := make(map[string]NodeBuilder)
+	providerNodes := make(map[string][]PulumiNode)
+	providerAssetTypes := make(map[string][]string)
+	var componentNodes []PulumiNode
+
+	getBuilder := func(pkg tokens.Package) (NodeBuilder, string, error) {
+		registration, ok := nodeBuilders[string(pkg)]
+		if !ok {
+			return nil, "", nil
+		}
+		if builder, ok := builders[registration.provider]; ok {
+			return builder, registration.provider, nil
+		}
+		builder, err := registration.factory(ctx, logger, consumer, mapperEvent)
+		if err != nil {
+			return nil, "", err
+		}
+		builders[registration.provider] = builder
+		builderOrder = append(builderOrder, registration.provider)
+		return builder, registration.provider, nil
 	}
 
 	for _, event := range events {
-		var metadata = getSameMetadata(event)
-		var state engine.StepEventStateMetadata
+		var metadata = refresher.RawStepMetadata(getSameMetadata(event))
+		pulumiType := metadata.Type.String()
+
+		if providers.IsProviderType(metadata.Type) {
+			builder, _, err := getBuilder(providers.GetProviderPackage(metadata.Type))
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if providerBuilder, ok := builder.(ProviderAwareNodeBuilder); ok {
+				if ref, state, ok := getProviderReference(metadata); ok {
+					providerBuilder.AddProvider(ref, state)
+				}
+			}
+			continue
+		}
 
 		var node PulumiNode
-		node.Metadata.StackId = config.StackId
-		node.Metadata.StackName = config.StackName
-		node.Metadata.ProjectName = config.ProjectName
-		node.Metadata.OrganizationName = config.OrganizationName
-		node.Metadata.PulumiType = metadata.Type.String()
+		node.Metadata.StackId = mapperEvent.StackId
+		node.Metadata.StackName = mapperEvent.StackName
+		node.Metadata.ProjectName = mapperEvent.ProjectName
+		node.Metadata.OrganizationName = mapperEvent.OrganizationName
+		node.Metadata.PulumiType = pulumiType
 		node.Metadata.VcsRepo = vcsData["vcsRepo"].(string)
 		node.Metadata.VcsProvider = vcsData["vcsProvider"].(string)
-		node.StackId = config.StackId
+		node.StackId = mapperEvent.StackId
 		node.Iac = "pulumi"
-		node.AccountId = config.AccountId
-		node.PulumiIntegrationId = config.PulumiIntegrationId
+		node.AccountId = mapperEvent.AccountId
+		node.PulumiIntegrationId = mapperEvent.IntegrationId
 		node.IsOrchestrator = false
 		node.UpdatedAt = time.Now().Unix()
 
-		if strings.HasPrefix(metadata.Type.String(), "aws:") {
-			node.Type = "aws"
-			terraformType, err := goKit.GetTerraformTypeByPulumi(metadata.Type.String())
-			if err != nil {
-				logger.Err(err).Str("pulumiAssetType", metadata.Type.String()).Msg("missing pulumi to terraform type mapping")
-			} else {
-				node.ObjectType = terraformType
-			}
-
-			switch metadata.Op {
-			case deploy.OpSame:
-				state = *metadata.New
-				node.Metadata.PulumiState = "managed"
-			case deploy.OpDelete:
-				state = *metadata.Old
-				node.Metadata.PulumiState = "ghost"
-			case deploy.OpUpdate:
-				state = *metadata.New
-				drifts, err := refresher.CalcDrift(metadata)
-				if err != nil {
-					logger.Warn().Err(err).Msg("failed to calc some of the drifts")
-				}
-				if drifts == nil {
-					node.Metadata.PulumiState = "managed"
-
-				} else {
-					node.Metadata.PulumiState = "modified"
-					node.Metadata.PulumiDrifts = drifts
-				}
-			case deploy.OpRefresh:
-				if consumer.Config.ClientAWSIntegrationId == "" {
-					state = *metadata.New
-				} else {
-					continue
-				}
-
-			default:
-				continue
-			}
-			if len(state.Outputs) == 0 {
-				continue
-			}
-			node.Attributes = getIacAttributes(state.Outputs)
-			if ARN := state.Outputs["arn"].V; ARN != nil {
-				node.Arn = goKitTypes.ToString(ARN)
-				awsAccount, region, err := getAccountAndRegionFromArn(fmt.Sprintf("%v", ARN))
-				if err != nil {
-					logger.Err(err).Interface("arn", ARN).Msg("failed to parse arn")
-					continue
-				}
-				node.Region = region
-				node.ProviderAccountId = awsAccount
-				node.AssetId = node.Arn
-				if awsIntegrationId := getAwsIntegrationId(awsIntegrations, awsAccount); awsIntegrationId != "" {
-					node.AwsIntegration = awsIntegrationId
-				}
-				if count, ok := awsCommonProviders[awsAccount]; ok {
-					awsCommonProviders[awsAccount] = count + 1
-				} else {
-					awsCommonProviders[awsAccount] = 1
-				}
-				if len(node.ObjectType) > 0 {
-					assetTypeAndRegion := fmt.Sprintf("%s-%s", node.ObjectType, node.Region)
-					if !helpers.StringSliceContains(assetTypesWithRegions, assetTypeAndRegion) {
-						assetTypesWithRegions = append(assetTypesWithRegions, assetTypeAndRegion)
-					}
-				}
-
-			} else {
-				logger.Warn().Str("type", metadata.Type.String()).Msg("no arn for resource")
-				continue
-			}
-			// if we don't have the aws integration id - we use the only calculating the most common provider.
-			if consumer.Config.ClientAWSIntegrationId != "" {
-				nodes = append(nodes, node)
-
-			}
-		} else if strings.HasPrefix(metadata.Type.String(), "kubernetes:") {
-			node.Type = "k8s"
-			// k8s flow currently supports only managed state
-			var uid string
-			var state engine.StepEventStateMetadata
-			switch metadata.Op {
-			case deploy.OpSame:
-				state = *metadata.New
-			case deploy.OpUpdate:
-				state = *metadata.New
-			case deploy.OpDelete:
-				state = *metadata.Old
-			default:
-				continue
+		setRelations(&node, metadata)
 
+		if isComponentResource(metadata) {
+			if componentNode := buildComponentNode(metadata, node); componentNode != nil {
+				componentNodes = append(componentNodes, *componentNode)
 			}
-			node.Attributes, err = getK8sIacAttributes(state.Outputs, []string{"status", "__inputs", "__initialApiVersion"})
-			if err != nil {
-				logger.Err(err).Msg("failed to get iac attributes")
-				continue
-			}
-			if resourceMetadata := state.Outputs["metadata"].Mappable(); resourceMetadata != nil {
-				namespace := funk.Get(resourceMetadata, "namespace")
-				name := funk.Get(resourceMetadata, "name")
-				interfaceUid := funk.Get(resourceMetadata, "uid")
-				uid = goKitTypes.ToString(interfaceUid)
-
-				if name == nil || interfaceUid == nil {
-					logger.Warn().Err(errors.New("found resource with empty name/uid"))
-					continue
-				}
-				if namespace != nil {
-					node.Location = goKitTypes.ToString(namespace)
-				} else {
-					node.Location = ""
-				}
-				node.Name = goKitTypes.ToString(name)
-				node.ResourceId = uid
+			continue
+		}
 
-			} else {
-				logger.Warn().Msg("found k8s resource without metadata")
-				continue
-			}
-			var resourceKind interface{}
-			if resourceKind = state.Outputs["kind"].V; resourceKind == nil {
-				logger.Warn().Msg("found k8s resource without kind")
-				continue
-			}
-			kind := goKitTypes.ToString(resourceKind)
-			node.ObjectType = k8sUtils.GetKubernetesResourceType(kind, node.Name)
-			node.Kind = kind
-			if !helpers.StringSliceContains(uids, uid) {
-				uids = append(uids, uid)
+		builder, provider, err := getBuilder(metadata.Type.Package())
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if builder == nil {
+			if isMappableResource(metadata) {
+				summary.Unsupported[pulumiType]++
 			}
+			continue
+		}
 
-			if !helpers.StringSliceContains(kinds, kind) {
-				kinds = append(kinds, kind)
+		built, assetTypes, err := builder.Build(metadata, node)
+		if errors.Is(err, ErrNoArn) {
+			logger.Warn().Err(err).Str("type", pulumiType).Str("urn", string(metadata.URN)).Msg("no arn for resource")
+			summary.MissingArn[pulumiType]++
+			continue
+		} else if err != nil {
+			logger.Warn().Err(err).Str("type", pulumiType).Str("urn", string(metadata.URN)).Msg("failed to build node")
+			summary.Failed[pulumiType]++
+			continue
+		}
+		for _, assetType := range assetTypes {
+			if !helpers.StringSliceContains(providerAssetTypes[provider], assetType) {
+				providerAssetTypes[provider] = append(providerAssetTypes[provider], assetType)
 			}
+		}
+		if built != nil {
+			providerNodes[provider] = append(providerNodes[provider], *built)
+		}
+	}
 
-			if !helpers.StringSliceContains(assetTypesWithRegions, node.ObjectType) {
-				assetTypesWithRegions = append(assetTypesWithRegions, node.ObjectType)
+	var nodes []PulumiNode
+	for _, provider := range builderOrder {
+		builder := builders[provider]
+		builtNodes, commonProviders, finishErr := builder.Finish(ctx, providerNodes[provider])
+		if finishErr != nil {
+			logger.Err(finishErr).Str("provider", provider).Msg("failed to finish building nodes")
+			for _, node := range providerNodes[provider] {
+				summary.Failed[node.Metadata.PulumiType]++
 			}
-			k8sNodes = append(k8sNodes, node)
+		} else {
+			nodes = append(nodes, builtNodes...)
+			summary.addNodes(provider, builtNodes)
 		}
 
-	}
-	if len(k8sNodes) > 0 {
-		k8sNodes, clusterId, err := buildK8sArns(k8sNodes, uids, kinds, logger, consumer, k8sIntegrations)
+		err, integrationId := handleCommonProviders(ctx, mapperEvent, commonProviders, stack, builder.IntegrationId, consumer, provider)
 		if err != nil {
-			logger.Err(err).Msg("failed to build k8s arns")
+			logger.Err(err).Msgf("failed to update %s common provider", provider)
+		}
+		if atrBuilder, ok := builder.(AtrNodeBuilder); ok {
+			if finishErr == nil {
+				atrs = append(atrs, atrBuilder.Atrs(builtNodes)...)
+			}
 		} else {
-			nodes = append(nodes, k8sNodes...)
-			k8sCommonProviders[clusterId] = 1
-
+			atrs = append(atrs, buildAtrs(integrationId, providerAssetTypes[provider])...)
 		}
 	}
+	nodes = append(nodes, componentNodes...)
+	summary.addNodes(componentNodeType, componentNodes)
+	resolveRelations(nodes)
 
-	err, awsIntegrationId := handleCommonProviders(ctx, awsCommonProviders, stack, awsIntegrations, consumer, "aws")
-	if err != nil {
-		logger.Err(err).Msg("failed to update aws common provider")
-	}
+	return nodes, atrs, summary, nil
+}
 
-	err, k8sIntegrationId := handleCommonProviders(ctx, k8sCommonProviders, stack, k8sIntegrations, consumer, "k8s")
+// getProviderReference returns the reference resources use for the provider
+// resource of a step, along with the provider's state.
+func getProviderReference(metadata engine.StepEventMetadata) (string, engine.StepEventStateMetadata, bool) {
+	state := getStepState(metadata)
+	if state == nil {
+		return "", engine.StepEventStateMetadata{}, false
+	}
+	ref, err := providers.NewReference(metadata.URN, state.ID)
 	if err != nil {
-		logger.Err(err).Msg("failed to update aws common provider")
+		return "", engine.StepEventStateMetadata{}, false
 	}
-
-	atrs := buildAtrs(awsIntegrationId, k8sIntegrationId, assetTypesWithRegions)
-
-	return nodes, atrs, nil
+	return ref.String(), *state, true
 }
 
-func getSameMetadata(event engine.Event) engine.StepEventMetadata {
-	var metadata engine.StepEventMetadata
-	if event.Type == engine.ResourcePreEvent {
-		metadata = event.Payload().(engine.ResourcePreEventPayload).Metadata
-
-	} else if event.Type == engine.ResourceOutputsEvent {
-		metadata = event.Payload().(engine.ResourceOutputsEventPayload).Metadata
+// isMappableResource returns whether a step is of a resource that could be
+// mapped to a node, as opposed to the stack, providers and components.
+func isMappableResource(metadata engine.StepEventMetadata) bool {
+	if metadata.Type.Package() == "pulumi" {
+		return false
 	}
-	return metadata
+	state := getStepState(metadata)
+	return state != nil && state.Custom
 }
 
-func getAccountAndRegionFromArn(assetArn string) (account, region string, err error) {
-	parsedArn, err := arn.Parse(assetArn)
+// classifyNode sets the pulumi state and drifts of the node from the step, and
+// returns the resource state the node should be built from. It returns false
+// when the step does not describe a mappable resource.
+func classifyNode(node *PulumiNode, metadata engine.StepEventMetadata, mapperEvent *common.PulumiMapperEvent, secrets refresher.SecretRedactor, logger *zerolog.Logger) (engine.StepEventStateMetadata, bool) {
+	driftOptions := refresher.DriftOptions{
+		IgnoreChanges: mapperEvent.IgnoreChangesFor(string(metadata.URN), metadata.Type.String()),
+		Secrets:       secrets,
+	}
+	resourceState, drifts, err := refresher.ClassifyResource(metadata, driftOptions)
 	if err != nil {
-		return "", "", err
+		logger.Warn().Err(err).Msg("failed to calc some of the drifts")
 	}
-	region = parsedArn.Location
-	if region == "" {
-		region = "global"
+	if resourceState == "" {
+		return engine.StepEventStateMetadata{}, false
 	}
-	return parsedArn.AccountID, region, nil
-}
 
-func getK8sIacAttributes(outputs resource.PropertyMap, blackList []string) (string, error) {
-	// in case we want k8s attributes we use blacklist for redundant attributes
-	iacAttributes := make(map[string]interface{})
-	for key, val := range outputs {
-		stringKey := fmt.Sprintf("%v", key)
-		if !helpers.StringSliceContains(blackList, stringKey) {
-			iacAttributes[stringKey] = val.Mappable()
-		}
+	state := metadata.New
+	if resourceState == refresher.StateGhost {
+		state = metadata.Old
 	}
-	if metadata, err := k8sApiUtils.GetMapFromMap(iacAttributes, "metadata"); err == nil {
-		_ = k8sApiUtils.ConvertItemToYaml(metadata, "managedFields")
-
-	} else {
-		return "", errors.New("failed to get metadata")
+	if state == nil {
+		return engine.StepEventStateMetadata{}, false
 	}
 
-	if data, err := k8sApiUtils.GetMapFromMap(iacAttributes, "data"); err == nil {
-		if dataSpec, err := k8sApiUtils.GetMapFromMap(data, "spec"); err == nil {
-			if err = k8sApiUtils.ConvertItemToYaml(dataSpec, "template"); err != nil {
-				return "", errors.New("failed to find or to yaml template")
-			}
-		}
-	}
-	attributesBytes, err := json.Marshal(&iacAttributes)
-	if err != nil {
-		return "", errors.New("failed to find or to marshal attributes")
-	}
-	return string(attributesBytes), nil
+	node.Metadata.PulumiState = string(resourceState)
+	node.Metadata.PulumiDrifts = drifts
+	return *state, true
 }
 
-func getIacAttributes(outputs resource.PropertyMap) string {
-	iacAttributes := make(map[string]interface{})
-	for key, val := range outputs {
-		stringKey := fmt.Sprintf("%v", key)
-		iacAttributes[stringKey] = val.Mappable()
+// getProviderConfigString returns a string value of a provider's config.
+func getProviderConfigString(config resource.PropertyMap, key string) string {
+	if val, ok := getProviderConfigObject(config, key).(string); ok {
+		return val
 	}
-
-	attributesBytes, err := json.Marshal(&iacAttributes)
-	if err != nil {
-		return ""
-	}
-	return string(attributesBytes)
+	return ""
 }
 
-func buildK8sArns(k8sNodes []PulumiNode, uids, kinds []string, logger *zerolog.Logger, consumer *common.Consumer, k8sIntegrations []mongo.K8sIntegration) ([]PulumiNode, string, error) {
-	var clusterId string
-	integrationIds, err := utils.GetK8sIntegrationIds(consumer.Config.AccountId, uids, kinds, consumer.ES, logger)
-	if err != nil || len(integrationIds) == 0 {
-		logger.Err(err).Msg("failed to get k8s integration")
-		clusterId = "K8sCluster"
+// getProviderConfigObject returns a value of a provider's config. Providers
+// keep non-string config values as json strings, so these are decoded.
+func getProviderConfigObject(config resource.PropertyMap, key string) interface{} {
+	val, ok := config[resource.PropertyKey(key)]
+	if !ok || val.IsNull() {
+		return nil
 	}
-	if len(integrationIds) > 1 {
-		return nil, "", errors.New("found more than one k8s integrations")
+	if val.IsSecret() {
+		val = val.SecretValue().Element
 	}
-	if clusterId != "K8sCluster" {
-		k8sIntegration := getK8sIntegrationObjectById(k8sIntegrations, integrationIds[0])
-		if k8sIntegration == nil {
-			logger.Err(err).Msg("failed to get k8s integration")
-			return nil, "", err
+	if val.IsString() {
+		var decoded interface{}
+		if err := json.Unmarshal([]byte(val.StringValue()), &decoded); err == nil {
+			if _, isString := decoded.(string); !isString {
+				return decoded
+			}
 		}
-		clusterId = k8sIntegration.ClusterId
+		return val.StringValue()
 	}
-
-	k8sNodes = funk.Map(k8sNodes, func(node PulumiNode) PulumiNode {
-		node.Arn = k8sUtils.BuildArn(goKitTypes.ToString(node.Location), clusterId, goKitTypes.ToString(node.Kind), goKitTypes.ToString(node.Name))
-		node.AssetId = k8sUtils.BuildArn(goKitTypes.ToString(node.Location), clusterId, goKitTypes.ToString(node.Kind), goKitTypes.ToString(node.Name))
-		if len(integrationIds) > 0 {
-			node.K8sIntegration = integrationIds[0]
-		}
-		return node
-	}).([]PulumiNode)
-	return k8sNodes, clusterId, nil
+	return val.Mappable()
 }
 
-func getAwsIntegrationId(awsIntegrations []mongo.AwsIntegration, providerAccountId string) string {
-	if awsIntegrations != nil {
-		for _, integration := range awsIntegrations {
-			if integration.AccountNumber == providerAccountId {
-				return integration.ID
-			}
-		}
+func getStringOutput(outputs resource.PropertyMap, key string) string {
+	if val, ok := outputs[resource.PropertyKey(key)]; ok && val.IsString() {
+		return val.StringValue()
 	}
 	return ""
 }
 
-func getK8sIntegrationId(k8sIntegrations []mongo.K8sIntegration, clusterId string) string {
-	if k8sIntegrations != nil {
-		for _, integration := range k8sIntegrations {
-			if integration.ClusterId == clusterId {
-				return integration.ID
-			}
+// getPathSegment returns the segment following key in a resource path, e.g.
+// the project of projects/my-project/zones/us-central1-a/instances/vm.
+func getPathSegment(path, key string) string {
+	segments := strings.Split(path, "/")
+	for i := 0; i < len(segments)-1; i++ {
+		if strings.EqualFold(segments[i], key) {
+			return segments[i+1]
 		}
 	}
 	return ""
 }
 
-func getK8sIntegrationObjectById(k8sIntegrations []mongo.K8sIntegration, integrationId string) *mongo.K8sIntegration {
-	if k8sIntegrations != nil {
-		for _, integration := range k8sIntegrations {
-			if integration.ID == integrationId {
-				return &integration
-			}
+func getSameMetadata(event engine.Event) engine.StepEventMetadata {
+	var metadata engine.StepEventMetadata
+	if event.Type == engine.ResourcePreEvent {
+		metadata = event.Payload().(engine.ResourcePreEventPayload).Metadata
+
+	} else if event.Type == engine.ResourceOutputsEvent {
+		metadata = event.Payload().(engine.ResourceOutputsEventPayload).Metadata
+	}
+	return metadata
+}
+
+// getIacAttributes returns the outputs of a resource as json, with their
+// secrets redacted.
+func getIacAttributes(outputs resource.PropertyMap, secrets refresher.SecretRedactor) string {
+	iacAttributes := secrets.Map(outputs)
+
+	attributesBytes, err := json.Marshal(&iacAttributes)
+	if err != nil {
+		return ""
+	}
+	return string(attributesBytes)
+}
+
+// getMostCommonProvider returns the provider account used by the most
+// resources. Ties go to the smallest account id, so that the integration of a
+// stack doesn't change between runs.
+func getMostCommonProvider(commonProviderMap map[string]int) string {
+	max := 0
+	var mostCommonProvider string
+	for providerId, count := range commonProviderMap {
+		if count > max || (count == max && providerId < mostCommonProvider) {
+			max = count
+			mostCommonProvider = providerId
 		}
 	}
-	return nil
+	return mostCommonProvider
 }
 
-func handleCommonProviders(ctx context.Context, commonProviderMap map[string]int, stack *mongo.GlobalStack, integrationsArray interface{}, consumer *common.Consumer, provider string) (error, string) {
+// handleCommonProviders records the most common account of a provider as the
+// externalId of the provider's integration on the stack, along with the id of
+// the matching integration.
+func handleCommonProviders(ctx context.Context, mapperEvent *common.PulumiMapperEvent, commonProviderMap map[string]int, stack *mongo.GlobalStack, getIntegrationId func(providerAccountId string) string, consumer *common.Consumer, provider string) (error, string) {
 	var integrationId string
 	if len(commonProviderMap) != 0 {
-		max := 0
-		var mostCommonProvider string
 		var err error
 		updateDict := make(bson.M)
-		for providerId, count := range commonProviderMap {
-			if count > max {
-				mostCommonProvider = providerId
-			}
-		}
-		if provider == "aws" {
-			integrationArray := integrationsArray.([]mongo.AwsIntegration)
-			integrationId = getAwsIntegrationId(integrationArray, mostCommonProvider)
-
-		} else if provider == "k8s" {
-			integrationArray := integrationsArray.([]mongo.K8sIntegration)
-			integrationId = getK8sIntegrationId(integrationArray, mostCommonProvider)
-
-		}
+		mostCommonProvider := getMostCommonProvider(commonProviderMap)
+		integrationId = getIntegrationId(mostCommonProvider)
 
 		if mongoIntegrationObject, ok := stack.Integrations[provider]; ok {
 			if externalId, ok := mongoIntegrationObject["externalId"]; ok {
 				if externalId != mostCommonProvider {
-					updateDict["integrations.aws.externalId"] = externalId
+					updateDict[fmt.Sprintf("integrations.%s.externalId", provider)] = mostCommonProvider
 				}
 			}
 			if IntegrationId, ok := mongoIntegrationObject["id"]; ok {
@@ -426,7 +342,7 @@ func handleCommonProviders(ctx context.Context, commonProviderMap map[string]int
 
 		if len(updateDict) != 0 {
 			updateDict["updatedAt"] = time.Now().Format(time.RFC3339)
-			_, err = consumer.MongoDb.UpdateStack(ctx, consumer.Config.AccountId, consumer.Config.StackId, nil, bson.M{
+			err = consumer.Store.UpdateStack(ctx, mapperEvent.AccountId, mapperEvent.StackId, bson.M{
 				"$set": updateDict,
 			})
 			if err != nil {
@@ -438,16 +354,12 @@ func handleCommonProviders(ctx context.Context, commonProviderMap map[string]int
 	return nil, integrationId
 }
 
-func buildAtrs(awsIntegrationId, k8sIntegrationId string, assetTypesWithRegions []string) (atrs []string) {
+func buildAtrs(integrationId string, assetTypesWithRegions []string) (atrs []string) {
+	if len(integrationId) == 0 {
+		return nil
+	}
 	for _, assetTypesWithRegion := range assetTypesWithRegions {
-		var atr string
-		if strings.HasPrefix(assetTypesWithRegion, "aws") && len(awsIntegrationId) > 0 {
-			atr = fmt.Sprintf("%s-%s", awsIntegrationId, assetTypesWithRegion)
-			atrs = append(atrs, atr)
-		} else if strings.HasPrefix(assetTypesWithRegion, "kubernetes") && len(k8sIntegrationId) > 0 {
-			atr = fmt.Sprintf("%s-%s", k8sIntegrationId, assetTypesWithRegion)
-			atrs = append(atrs, atr)
-		}
+		atrs = append(atrs, fmt.Sprintf("%s-%s", integrationId, assetTypesWithRegion))
 	}
 	return
 }
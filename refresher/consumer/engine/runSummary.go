@@ -0,0 +1,182 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/infralight/pulumi/refresher/common"
+	"github.com/infralight/pulumi/refresher/metrics"
+	"github.com/infralight/pulumi/refresher/storage"
+	"github.com/rs/zerolog"
+	"go.mongodb.org/mongo-driver/bson"
+	"time"
+)
+
+const (
+	RunStatusMapped    = "mapped"
+	RunStatusEmpty     = "empty"
+	RunStatusUnchanged = "unchanged"
+	RunStatusDeleted   = "deleted"
+	RunStatusFailed    = "failed"
+	RunStatusTimedOut  = "timed_out"
+)
+
+// The stages a run may fail in.
+const (
+	StageOpenStack   = "open_stack"
+	StageRefresh     = "refresh"
+	StageMap         = "map"
+	StageDiff        = "diff"
+	StageWrite       = "write"
+	StageTriggerAtrs = "trigger_atrs"
+	StageUnknown     = "unknown"
+)
+
+// stageError is an error that failed a run in a specific stage.
+type stageError struct {
+	stage string
+	err   error
+}
+
+func (e *stageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stageError) Unwrap() error {
+	return e.err
+}
+
+// failStage marks err as failing the run in the given stage.
+func failStage(stage string, err error) error {
+	return &stageError{stage: stage, err: err}
+}
+
+// RunSummary describes a single mapper run of a stack. It is written next to
+// the stack's iac objects and stored on the stack record, so stacks that stop
+// being mapped can be alerted on.
+type RunSummary struct {
+	AccountId     string `json:"accountId" bson:"accountId"`
+	IntegrationId string `json:"integrationId" bson:"integrationId"`
+	StackId       string `json:"stackId" bson:"stackId"`
+	StackName     string `json:"stackName" bson:"stackName"`
+	ProjectName   string `json:"projectName" bson:"projectName"`
+	// LastUpdated is the update of the stack the run was produced for
+	LastUpdated    int64     `json:"lastUpdated" bson:"lastUpdated"`
+	Status         string    `json:"status" bson:"status"`
+	Mode           string    `json:"mode" bson:"mode"`
+	Records        int       `json:"records" bson:"records"`
+	StartedAt      time.Time `json:"startedAt" bson:"startedAt"`
+	FinishedAt     time.Time `json:"finishedAt" bson:"finishedAt"`
+	DurationMillis int64     `json:"durationMillis" bson:"durationMillis"`
+	Errors         []string  `json:"errors" bson:"errors"`
+	FailedStage    string    `json:"failedStage,omitempty" bson:"failedStage,omitempty"`
+	// Changes counts the changes since the previous run's inventory snapshot
+	Changes ChangeCounts `json:"changes" bson:"changes"`
+
+	MappingSummary `bson:",inline"`
+}
+
+func NewRunSummary(event *common.PulumiMapperEvent) *RunSummary {
+	return &RunSummary{
+		AccountId:      event.AccountId,
+		IntegrationId:  event.IntegrationId,
+		StackId:        event.StackId,
+		StackName:      event.StackName,
+		ProjectName:    event.ProjectName,
+		LastUpdated:    event.LastUpdated,
+		Status:         RunStatusMapped,
+		StartedAt:      time.Now().UTC(),
+		Errors:         []string{},
+		MappingSummary: *newMappingSummary(),
+	}
+}
+
+// AddError records an error that did not fail the run.
+func (s *RunSummary) AddError(err error) {
+	if err != nil {
+		s.Errors = append(s.Errors, err.Error())
+	}
+}
+
+// Finish sets the duration of the run, and fails it if err isn't nil.
+func (s *RunSummary) Finish(err error) {
+	s.FinishedAt = time.Now().UTC()
+	s.DurationMillis = s.FinishedAt.Sub(s.StartedAt).Milliseconds()
+	if err != nil {
+		s.Status = RunStatusFailed
+		s.FailedStage = StageUnknown
+		var stageErr *stageError
+		if errors.As(err, &stageErr) {
+			s.FailedStage = stageErr.stage
+		}
+		s.AddError(err)
+	}
+}
+
+// Succeeded reports whether the run went through the stack, whatever it found.
+func (s *RunSummary) Succeeded() bool {
+	return s.Status != RunStatusFailed && s.Status != RunStatusTimedOut
+}
+
+// RunSummaryPath returns the sink path of the summary of a stack's last run.
+func RunSummaryPath(accountId, stackId string) string {
+	return fmt.Sprintf("%s/pulumi_resources/%s/run_summary.json", accountId, stackId)
+}
+
+// ReadRunSummary returns the summary of the last run of a stack, or nil if it
+// never ran.
+func ReadRunSummary(ctx context.Context, sink storage.Sink, accountId, stackId string) (*RunSummary, error) {
+	content, err := sink.Read(ctx, RunSummaryPath(accountId, stackId))
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var summary RunSummary
+	if err = json.Unmarshal(content, &summary); err != nil {
+		return nil, fmt.Errorf("failed to parse run summary: %w", err)
+	}
+	return &summary, nil
+}
+
+// recordRunMetrics records the outcome of a finished run in the metrics.
+func recordRunMetrics(s *RunSummary) {
+	failed := !s.Succeeded()
+	metrics.RunFinished(s.Status, s.Mode, failed, s.FinishedAt.Sub(s.StartedAt))
+	if s.FailedStage != "" {
+		metrics.StageFailed(s.FailedStage)
+	}
+	for provider, states := range s.Resources {
+		for state, count := range states {
+			metrics.ResourcesMapped(provider, state, s.Mode, count)
+		}
+	}
+	for provider, count := range s.Drifted {
+		metrics.DriftedResourcesMapped(provider, s.Mode, count)
+	}
+}
+
+// writeRunSummary writes the run summary alongside the stack's iac objects and
+// stores it on the stack record. Failing to do so doesn't fail the run.
+func writeRunSummary(ctx context.Context, logger *zerolog.Logger, consumer *common.Consumer, summary *RunSummary) {
+	content, err := json.Marshal(summary)
+	if err != nil {
+		logger.Err(err).Msg("failed to marshal run summary")
+		return
+	}
+	path := RunSummaryPath(summary.AccountId, summary.StackId)
+	if err = consumer.Sink.Write(ctx, path, content, "json"); err != nil {
+		logger.Err(err).Msg("failed to write run summary to sink")
+	}
+
+	if summary.Status == RunStatusDeleted {
+		return
+	}
+	err = consumer.Store.UpdateStack(ctx, summary.AccountId, summary.StackId, bson.M{
+		"$set": bson.M{"lastRunSummary": summary},
+	})
+	if err != nil {
+		logger.Err(err).Msg("failed to store run summary on stack")
+	}
+}
@@ -0,0 +1,94 @@
+package engine
+
+import (
+	"fmt"
+	goKit "github.com/infralight/go-kit/pulumi"
+	"strings"
+	"unicode"
+)
+
+// terraformTypeOverrides holds the pulumi types whose terraform type can't be
+// derived from the module and resource names.
+var terraformTypeOverrides = map[string]string{
+	"gcp:projects/iAMMember:IAMMember":                           "google_project_iam_member",
+	"gcp:projects/iAMBinding:IAMBinding":                         "google_project_iam_binding",
+	"gcp:projects/iAMPolicy:IAMPolicy":                           "google_project_iam_policy",
+	"gcp:projects/service:Service":                               "google_project_service",
+	"gcp:organizations/project:Project":                          "google_project",
+	"gcp:organizations/folder:Folder":                            "google_folder",
+	"gcp:serviceAccount/account:Account":                         "google_service_account",
+	"gcp:serviceAccount/key:Key":                                 "google_service_account_key",
+	"gcp:serviceAccount/iAMMember:IAMMember":                     "google_service_account_iam_member",
+	"gcp:sql/databaseInstance:DatabaseInstance":                  "google_sql_database_instance",
+	"gcp:container/nodePool:NodePool":                            "google_container_node_pool",
+	"azure:core/resourceGroup:ResourceGroup":                     "azurerm_resource_group",
+	"azure:compute/virtualMachine:VirtualMachine":                "azurerm_virtual_machine",
+	"azure:compute/linuxVirtualMachine:LinuxVirtualMachine":      "azurerm_linux_virtual_machine",
+	"azure:compute/windowsVirtualMachine:WindowsVirtualMachine":  "azurerm_windows_virtual_machine",
+	"azure:network/virtualNetwork:VirtualNetwork":                "azurerm_virtual_network",
+	"azure:network/subnet:Subnet":                                "azurerm_subnet",
+	"azure:network/networkInterface:NetworkInterface":            "azurerm_network_interface",
+	"azure:network/networkSecurityGroup:NetworkSecurityGroup":    "azurerm_network_security_group",
+	"azure:network/publicIp:PublicIp":                            "azurerm_public_ip",
+	"azure:containerservice/kubernetesCluster:KubernetesCluster": "azurerm_kubernetes_cluster",
+	"azure:keyvault/keyVault:KeyVault":                           "azurerm_key_vault",
+	"azure:appservice/appService:AppService":                     "azurerm_app_service",
+	"azure-native:resources:ResourceGroup":                       "azurerm_resource_group",
+	"azure-native:storage:StorageAccount":                        "azurerm_storage_account",
+	"azure-native:storage:BlobContainer":                         "azurerm_storage_container",
+	"azure-native:network:PublicIPAddress":                       "azurerm_public_ip",
+	"azure-native:containerservice:ManagedCluster":               "azurerm_kubernetes_cluster",
+	"azure-native:keyvault:Vault":                                "azurerm_key_vault",
+	"azure-native:web:WebApp":                                    "azurerm_app_service",
+	"azure-native:web:AppServicePlan":                            "azurerm_app_service_plan",
+	"azure-native:sql:Server":                                    "azurerm_mssql_server",
+	"azure-native:sql:Database":                                  "azurerm_mssql_database",
+	"azure-native:documentdb:DatabaseAccount":                    "azurerm_cosmosdb_account",
+}
+
+// getTerraformType maps a pulumi type to its terraform equivalent, using the
+// shared mapping first and falling back to the naming conventions of the
+// terraform bridged providers.
+func getTerraformType(pulumiType string) (string, error) {
+	if terraformType, err := goKit.GetTerraformTypeByPulumi(pulumiType); err == nil && terraformType != "" {
+		return terraformType, nil
+	}
+	if terraformType, ok := terraformTypeOverrides[pulumiType]; ok {
+		return terraformType, nil
+	}
+
+	parts := strings.Split(pulumiType, ":")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("invalid pulumi type %s", pulumiType)
+	}
+	// azure-native modules may carry an api version, e.g. compute/v20210301
+	module := strings.Split(parts[1], "/")[0]
+	name := toSnakeCase(parts[2])
+
+	switch parts[0] {
+	case "gcp":
+		return fmt.Sprintf("google_%s_%s", toSnakeCase(module), name), nil
+	case "azure", "azure-native":
+		return fmt.Sprintf("azurerm_%s", name), nil
+	default:
+		return "", fmt.Errorf("missing terraform type mapping for %s", pulumiType)
+	}
+}
+
+func toSnakeCase(s string) string {
+	var builder strings.Builder
+	runes := []rune(s)
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			// split before an upper case letter that starts a new word, so that
+			// acronyms such as IPAddress become ip_address
+			if i > 0 && (unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+				builder.WriteRune('_')
+			}
+			builder.WriteRune(unicode.ToLower(r))
+		} else {
+			builder.WriteRune(r)
+		}
+	}
+	return builder.String()
+}
@@ -0,0 +1,58 @@
+package engine
+
+import (
+	"errors"
+	"github.com/hashicorp/go-multierror"
+	"github.com/infralight/pulumi/refresher/common"
+	"os"
+	"strconv"
+)
+
+// LoadEventFromEnv builds the event of a single stack run from the
+// environment variables the mapper job is launched with.
+func LoadEventFromEnv() (*common.PulumiMapperEvent, error) {
+	var err error
+	var merr *multierror.Error
+	event := &common.PulumiMapperEvent{}
+
+	if event.IntegrationId = os.Getenv("INTEGRATION_ID"); event.IntegrationId == "" {
+		merr = multierror.Append(merr, errors.New("failed, environment variable INTEGRATION_ID must be provided"))
+	}
+
+	if event.AccountId = os.Getenv("ACCOUNT_ID"); event.AccountId == "" {
+		merr = multierror.Append(merr, errors.New("failed, environment variable ACCOUNT_ID must be provided"))
+	}
+
+	if event.ProjectName = os.Getenv("PROJECT_NAME"); event.ProjectName == "" {
+		merr = multierror.Append(merr, errors.New("failed, environment variable PROJECT_NAME must be provided"))
+	}
+
+	if event.StackName = os.Getenv("STACK_NAME"); event.StackName == "" {
+		merr = multierror.Append(merr, errors.New("failed, environment variable STACK_NAME must be provided"))
+	}
+
+	event.BackendUrl = os.Getenv("BACKEND_URL")
+	event.CheckpointFile = os.Getenv("CHECKPOINT_FILE")
+
+	if event.OrganizationName = os.Getenv("ORGANIZATION_NAME"); event.OrganizationName == "" && !event.IsSelfManaged() {
+		merr = multierror.Append(merr, errors.New("failed, environment variable ORGANIZATION_NAME must be provided"))
+	}
+
+	if event.StackId = os.Getenv("STACK_ID"); event.StackId == "" {
+		merr = multierror.Append(merr, errors.New("failed, environment variable STACK_ID must be provided"))
+	}
+
+	event.ResourceCount, err = strconv.Atoi(os.Getenv("RESOURCE_COUNT"))
+	if err != nil {
+		merr = multierror.Append(merr, errors.New("failed, environment variable RESOURCE_COUNT must be provided"))
+	}
+
+	lastUpdate, err := strconv.Atoi(os.Getenv("LAST_UPDATE"))
+	if err != nil {
+		merr = multierror.Append(merr, errors.New("failed, environment variable LAST_UPDATE must be provided"))
+	}
+	event.LastUpdated = int64(lastUpdate)
+
+	event.AwsIntegrationId = os.Getenv("AWS_INTEGRATION_ID")
+	return event, merr.ErrorOrNil()
+}
@@ -2,16 +2,25 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"github.com/infralight/pulumi/refresher/common"
 	"github.com/infralight/pulumi/refresher/config"
 	"github.com/infralight/pulumi/refresher/consumer/engine"
+	internal "github.com/infralight/pulumi/refresher/consumer/internal"
+	"github.com/infralight/pulumi/refresher/consumer/worker"
+	"github.com/infralight/pulumi/refresher/metrics"
+	"github.com/infralight/pulumi/refresher/queue"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"io"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 var (
 	cfg       *config.Config
+	event     *common.PulumiMapperEvent
 	consumer  *common.Consumer
 	logger    zerolog.Logger
 	component = "pulumi-mapper-consumer"
@@ -25,16 +34,26 @@ func init() {
 	if err != nil {
 		logger.Fatal().Err(err).Msg("failed to load configuration from environment variables")
 	}
-	logger = logger.With().
-		Str("accountId", cfg.AccountId).
-		Str("component", component).
-		Str("integrationId", cfg.PulumiIntegrationId).
-		Str("stackName", cfg.StackName).
-		Str("stackId", cfg.StackId).
-		Str("organizationName", cfg.OrganizationName).
-		Str("projectName", cfg.ProjectName).Logger()
-
-	consumer, err = common.NewConsumer(cfg)
+	if cfg.WorkerMode {
+		logger = logger.With().
+			Str("component", component).
+			Bool("workerMode", true).Logger()
+	} else {
+		event, err = internal.LoadEventFromEnv()
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to load stack from environment variables")
+		}
+		logger = logger.With().
+			Str("accountId", event.AccountId).
+			Str("component", component).
+			Str("integrationId", event.IntegrationId).
+			Str("stackName", event.StackName).
+			Str("stackId", event.StackId).
+			Str("organizationName", event.OrganizationName).
+			Str("projectName", event.ProjectName).Logger()
+	}
+
+	consumer, err = common.NewConsumer(cfg, &logger)
 	if err != nil {
 		logger.Fatal().Err(err).Msg("failed to create new consumer")
 	}
@@ -51,9 +70,7 @@ func init() {
 }
 
 func handler(ctx context.Context) (string, error) {
-	lastUpdate := int64(cfg.LastUpdate)
-	resourceCount := cfg.ResourceCount
-	err := engine.PulumiMapper(ctx, &logger, consumer, &lastUpdate, &resourceCount)
+	err := engine.ProcessEvent(ctx, &logger, consumer, event)
 	if err != nil {
 		return "failed", err
 	}
@@ -61,9 +78,95 @@ func handler(ctx context.Context) (string, error) {
 
 }
 
+func workerHandler(ctx context.Context, logger *zerolog.Logger, message string) error {
+	return engine.ProcessMessage(ctx, logger, consumer, message)
+}
+
+func newQueue() (queue.Queue, func(), error) {
+	if cfg.QueueUrl != "" {
+		sqsQueue := queue.NewSQSQueue(cfg.LoadServiceAwsSession(), cfg.QueueUrl, cfg.DeadLetterQueueUrl, int64(cfg.QueueVisibilityTimeout))
+		return sqsQueue, func() {}, nil
+	}
+
+	var closers []io.Closer
+	closeAll := func() {
+		for _, closer := range closers {
+			_ = closer.Close()
+		}
+	}
+
+	var reader io.Reader = os.Stdin
+	if cfg.QueueFile != "" && cfg.QueueFile != "-" {
+		file, err := os.Open(cfg.QueueFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open queue file: %w", err)
+		}
+		closers = append(closers, file)
+		reader = file
+	}
+
+	var deadLetter io.Writer
+	if cfg.DeadLetterFile != "" {
+		file, err := os.OpenFile(cfg.DeadLetterFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("failed to open dead letter file: %w", err)
+		}
+		closers = append(closers, file)
+		deadLetter = file
+	}
+
+	return queue.NewFileQueue(reader, deadLetter), closeAll, nil
+}
+
+func runWorker() error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	jobQueue, closeQueue, err := newQueue()
+	if err != nil {
+		return err
+	}
+	defer closeQueue()
+
+	w := worker.Worker{
+		Queue:       jobQueue,
+		Handler:     workerHandler,
+		Concurrency: cfg.WorkerConcurrency,
+		Logger:      &logger,
+	}
+
+	// the metrics are served until the worker has drained its jobs, which
+	// goes on for a while after the signal
+	metricsCtx, stopMetrics := context.WithCancel(context.Background())
+	metricsDone := make(chan struct{})
+	if cfg.MetricsAddr != "off" {
+		go func() {
+			defer close(metricsDone)
+			metrics.Serve(metricsCtx, cfg.MetricsAddr, &logger)
+		}()
+	} else {
+		close(metricsDone)
+	}
+
+	logger.Info().Int("concurrency", cfg.WorkerConcurrency).Msg("Starting worker")
+	err = w.Run(ctx)
+	logger.Info().Msg("Worker stopped")
+	stopMetrics()
+	<-metricsDone
+	return err
+}
+
 func main() {
 	logger = log.With().
 		Str("component", component).Logger()
+
+	if cfg.WorkerMode {
+		if err := runWorker(); err != nil {
+			logger.Fatal().Err(err).Msg("worker failed")
+		}
+		return
+	}
 	handler(context.Background())
 
 }
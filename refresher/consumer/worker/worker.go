@@ -0,0 +1,109 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/infralight/pulumi/refresher/queue"
+	"github.com/rs/zerolog"
+	"sync"
+	"time"
+)
+
+const (
+	receiveRetryInterval = 5 * time.Second
+)
+
+// Handler processes the body of a single queue message.
+type Handler func(ctx context.Context, logger *zerolog.Logger, message string) error
+
+// Worker pulls messages from a queue and runs them through the handler with
+// bounded concurrency. Successfully handled messages are acked, failed ones are
+// dead-lettered.
+type Worker struct {
+	Queue       queue.Queue
+	Handler     Handler
+	Concurrency int
+	Logger      *zerolog.Logger
+}
+
+// Run pulls messages until the context is done or the queue is drained. It
+// stops pulling new messages as soon as the context is done, and waits for the
+// in-flight ones to finish before returning.
+func (w *Worker) Run(ctx context.Context) error {
+	concurrency := w.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	semaphore := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		messages, err := w.Queue.Receive(ctx)
+		if err != nil {
+			if errors.Is(err, queue.ErrDrained) {
+				w.Logger.Info().Msg("queue drained, waiting for in-flight messages")
+				return nil
+			}
+			if ctx.Err() != nil {
+				w.Logger.Info().Msg("shutting down, waiting for in-flight messages")
+				return nil
+			}
+			w.Logger.Err(err).Msg("failed to receive messages")
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(receiveRetryInterval):
+			}
+			continue
+		}
+
+		for _, message := range messages {
+			select {
+			case semaphore <- struct{}{}:
+			case <-ctx.Done():
+				// messages that were received but not started become visible
+				// again in the queue once their visibility timeout expires
+				w.Logger.Info().Msg("shutting down, waiting for in-flight messages")
+				return nil
+			}
+
+			wg.Add(1)
+			go func(message *queue.Message) {
+				defer wg.Done()
+				defer func() { <-semaphore }()
+				w.handle(message)
+			}(message)
+		}
+	}
+}
+
+func (w *Worker) handle(message *queue.Message) {
+	// in-flight messages are allowed to finish after a shutdown was requested,
+	// so they are not bound to the worker's context
+	ctx := context.Background()
+	logger := w.Logger.With().Str("messageId", message.Id).Logger()
+
+	if err := w.process(ctx, &logger, message); err != nil {
+		logger.Err(err).Msg("failed processing message, moving it to the dead letter queue")
+		if err = w.Queue.DeadLetter(ctx, message, err); err != nil {
+			logger.Err(err).Msg("failed to dead letter message")
+		}
+		return
+	}
+
+	if err := w.Queue.Ack(ctx, message); err != nil {
+		logger.Err(err).Msg("failed to ack message")
+	}
+}
+
+func (w *Worker) process(ctx context.Context, logger *zerolog.Logger, message *queue.Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while processing message: %v", r)
+		}
+	}()
+	return w.Handler(ctx, logger, message.Body)
+}
@@ -0,0 +1,92 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/infralight/pulumi/refresher/common"
+	"github.com/infralight/pulumi/refresher/queue"
+	"github.com/rs/zerolog"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// ackingQueue records the messages acked on a file queue.
+type ackingQueue struct {
+	*queue.FileQueue
+	mutex sync.Mutex
+	acked []string
+}
+
+func (q *ackingQueue) Ack(ctx context.Context, message *queue.Message) error {
+	q.mutex.Lock()
+	q.acked = append(q.acked, message.Id)
+	q.mutex.Unlock()
+	return q.FileQueue.Ack(ctx, message)
+}
+
+func TestWorkerRun(t *testing.T) {
+	jobs := `{"accountId": "account", "stackId": "good"}` + "\n" + `{"accountId": "account", "stackId": ` + "\n"
+	deadLetter := &bytes.Buffer{}
+	q := &ackingQueue{FileQueue: queue.NewFileQueue(strings.NewReader(jobs), deadLetter)}
+
+	var mutex sync.Mutex
+	var handled []string
+	logger := zerolog.Nop()
+	w := &Worker{
+		Queue: q,
+		Handler: func(ctx context.Context, logger *zerolog.Logger, message string) error {
+			var event common.PulumiMapperEvent
+			if err := json.Unmarshal([]byte(message), &event); err != nil {
+				return err
+			}
+			mutex.Lock()
+			handled = append(handled, event.StackId)
+			mutex.Unlock()
+			return nil
+		},
+		Concurrency: 2,
+		Logger:      &logger,
+	}
+
+	// the worker returns once the queue is drained and its messages are done
+	if err := w.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(handled, []string{"good"}) {
+		t.Errorf("expected the good job to be handled, got %v", handled)
+	}
+	if !reflect.DeepEqual(q.acked, []string{"1"}) {
+		t.Errorf("expected only the good job to be acked, got %v", q.acked)
+	}
+
+	var record map[string]string
+	if err := json.Unmarshal(deadLetter.Bytes(), &record); err != nil {
+		t.Fatalf("failed to parse dead letter %q: %v", deadLetter.String(), err)
+	}
+	if record["id"] != "2" || record["body"] != `{"accountId": "account", "stackId":` || record["error"] == "" {
+		t.Errorf("expected the bad job to be dead-lettered with its error, got %v", record)
+	}
+}
+
+func TestWorkerRecoversPanics(t *testing.T) {
+	deadLetter := &bytes.Buffer{}
+	q := &ackingQueue{FileQueue: queue.NewFileQueue(strings.NewReader("{}\n"), deadLetter)}
+	logger := zerolog.Nop()
+	w := &Worker{
+		Queue: q,
+		Handler: func(ctx context.Context, logger *zerolog.Logger, message string) error {
+			panic("boom")
+		},
+		Logger: &logger,
+	}
+
+	if err := w.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(q.acked) != 0 || !strings.Contains(deadLetter.String(), "panic while processing message: boom") {
+		t.Errorf("expected the panicking job to be dead-lettered, got acks %v and %q", q.acked, deadLetter.String())
+	}
+}
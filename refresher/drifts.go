@@ -1,19 +1,51 @@
 package refresher
 
 import (
-	"encoding/json"
-	"fmt"
-	"github.com/hashicorp/go-multierror"
-	"github.com/infralight/go-kit/helpers"
 	"github.com/pulumi/pulumi/pkg/v3/engine"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"sort"
 )
 
-func CalcDrift(step engine.StepEventMetadata) ([]map[string]interface{}, error) {
-	var merr *multierror.Error
+// DriftKind describes how a property of the provider state differs from the
+// IaC state.
+type DriftKind string
 
-	var drifts []map[string]interface{}
-	var outputDiff *resource.ObjectDiff
+const (
+	// DriftAdded is a property the provider reports but the IaC state does not have.
+	DriftAdded DriftKind = "added"
+	// DriftRemoved is a property the IaC state has but the provider no longer reports.
+	DriftRemoved DriftKind = "removed"
+	// DriftChanged is a property whose value differs between the IaC state and the provider.
+	DriftChanged DriftKind = "changed"
+)
+
+const (
+	// SecretMask replaces the value of secret properties.
+	SecretMask = "[secret]"
+	// SecretHashPrefix prefixes the salted hash replacing the value of secret
+	// properties when a salt is configured, e.g. `[secret:sha256:<hex>]`.
+	SecretHashPrefix = "[secret:sha256:"
+)
+
+// Drift is a single drifted property of a resource. Path is the full property
+// path (e.g. `tags.Owner` or `ingress[2].cidrBlocks[0]`) while KeyName is its
+// top-level property.
+type Drift struct {
+	KeyName       string      `json:"keyName"`
+	Path          string      `json:"path"`
+	Kind          DriftKind   `json:"kind"`
+	IacValue      interface{} `json:"iacValue"`
+	IacType       string      `json:"iacType"`
+	ProviderValue interface{} `json:"providerValue"`
+	ProviderType  string      `json:"providerType"`
+	Secret        bool        `json:"secret,omitempty"`
+}
+
+// CalcDrift compares the IaC state of a refresh step (Old) to the state
+// reported by the provider (New) and returns one drift per changed leaf
+// property, sorted by path. Secret values are redacted with secrets.
+func CalcDrift(step engine.StepEventMetadata, secrets SecretRedactor) ([]Drift, error) {
+	var drifts []Drift
 	var outs resource.PropertyMap
 	if step.New == nil || step.New.Outputs == nil {
 		outs = make(resource.PropertyMap)
@@ -22,61 +54,132 @@ func CalcDrift(step engine.StepEventMetadata) ([]map[string]interface{}, error)
 	}
 
 	if step.Old != nil && step.Old.Outputs != nil {
-		outputDiff = step.Old.Outputs.Diff(outs, resource.IsInternalPropertyKey)
-
+		outputDiff := step.Old.Outputs.Diff(outs, resource.IsInternalPropertyKey)
 		if outputDiff != nil {
-			for key, val := range outputDiff.Updates {
-				providerType := fmt.Sprintf("%T", val.New.Mappable())
-				var providerValue string
+			drifts = secrets.objectDrifts(nil, outputDiff, drifts)
+		}
+	}
 
-				if providerType != "string" {
-					providerJson, err := json.Marshal(val.New.Mappable())
-					if err != nil {
-						merr = multierror.Append(merr, err)
-						continue
-					}
-					providerValue = string(providerJson)
-				} else {
-					providerValue = fmt.Sprintf("%v", val.New.Mappable())
-				}
+	sort.Slice(drifts, func(i, j int) bool {
+		return drifts[i].Path < drifts[j].Path
+	})
+	return drifts, nil
+}
 
-				iacType := fmt.Sprintf("%T", val.Old.Mappable())
-				var iacValue string
+func (r SecretRedactor) objectDrifts(path resource.PropertyPath, diff *resource.ObjectDiff, drifts []Drift) []Drift {
+	for key, val := range diff.Adds {
+		if !isEmpty(val) {
+			drifts = append(drifts, r.newDrift(childPath(path, string(key)), DriftAdded, resource.NewNullProperty(), val))
+		}
+	}
+	for key, val := range diff.Deletes {
+		if !isEmpty(val) {
+			drifts = append(drifts, r.newDrift(childPath(path, string(key)), DriftRemoved, val, resource.NewNullProperty()))
+		}
+	}
+	for key, val := range diff.Updates {
+		drifts = r.valueDrifts(childPath(path, string(key)), val, drifts)
+	}
+	return drifts
+}
 
-				if iacType != "string" {
-					iacJson, err := json.Marshal(val.Old.Mappable())
-					if err != nil {
-						merr = multierror.Append(merr, err)
-						continue
-					}
-					iacValue = string(iacJson)
-				} else {
-					iacValue = fmt.Sprintf("%v", val.Old.Mappable())
-				}
+func (r SecretRedactor) arrayDrifts(path resource.PropertyPath, diff *resource.ArrayDiff, drifts []Drift) []Drift {
+	for index, val := range diff.Adds {
+		if !isEmpty(val) {
+			drifts = append(drifts, r.newDrift(childPath(path, index), DriftAdded, resource.NewNullProperty(), val))
+		}
+	}
+	for index, val := range diff.Deletes {
+		if !isEmpty(val) {
+			drifts = append(drifts, r.newDrift(childPath(path, index), DriftRemoved, val, resource.NewNullProperty()))
+		}
+	}
+	for index, val := range diff.Updates {
+		drifts = r.valueDrifts(childPath(path, index), val, drifts)
+	}
+	return drifts
+}
 
-				drifts = append(drifts, map[string]interface{}{
-					"keyName":       key,
-					"providerValue": providerValue,
-					"iacValue":      iacValue,
-				})
+func (r SecretRedactor) valueDrifts(path resource.PropertyPath, diff resource.ValueDiff, drifts []Drift) []Drift {
+	switch {
+	case diff.Object != nil:
+		return r.objectDrifts(path, diff.Object, drifts)
+	case diff.Array != nil:
+		return r.arrayDrifts(path, diff.Array, drifts)
+	default:
+		return append(drifts, r.newDrift(path, DriftChanged, diff.Old, diff.New))
+	}
+}
 
-			}
-			for key, val := range outputDiff.Adds {
-				if !isEmpty(val.String()) {
-					drifts = append(drifts, map[string]interface{}{
-						"keyName":       key,
-						"providerValue": "undefined",
-						"iacValue":      fmt.Sprintf("%v", val.Mappable()),
-					})
-				}
-			}
+func (r SecretRedactor) newDrift(path resource.PropertyPath, kind DriftKind, iac, provider resource.PropertyValue) Drift {
+	drift := Drift{
+		Path:          path.String(),
+		Kind:          kind,
+		IacValue:      r.Value(iac),
+		IacType:       valueType(iac),
+		ProviderValue: r.Value(provider),
+		ProviderType:  valueType(provider),
+		Secret:        iac.ContainsSecrets() || provider.ContainsSecrets(),
+	}
+	if len(path) > 0 {
+		if key, ok := path[0].(string); ok {
+			drift.KeyName = key
 		}
 	}
-	return drifts, nil
+	if kind == DriftAdded {
+		drift.IacValue = nil
+	} else if kind == DriftRemoved {
+		drift.ProviderValue = nil
+	}
+	return drift
+}
 
+func childPath(path resource.PropertyPath, key interface{}) resource.PropertyPath {
+	child := make(resource.PropertyPath, 0, len(path)+1)
+	child = append(child, path...)
+	return append(child, key)
 }
 
-func isEmpty(s string) bool {
-	emptyValeus := []string{"{[]}", "", "[]", "{}", "map[]"}
-	return helpers.StringSliceContains(emptyValeus, s)
+func valueType(v resource.PropertyValue) string {
+	switch {
+	case v.IsNull():
+		return "null"
+	case v.IsSecret():
+		return "secret"
+	case v.IsBool():
+		return "bool"
+	case v.IsNumber():
+		return "number"
+	case v.IsString():
+		return "string"
+	case v.IsArray():
+		return "array"
+	case v.IsObject():
+		return "object"
+	case v.IsComputed(), v.IsOutput():
+		return "unknown"
+	case v.IsAsset():
+		return "asset"
+	case v.IsArchive():
+		return "archive"
+	case v.IsResourceReference():
+		return "resourceReference"
+	default:
+		return v.TypeString()
+	}
+}
+
+func isEmpty(v resource.PropertyValue) bool {
+	switch {
+	case v.IsNull():
+		return true
+	case v.IsString():
+		return v.StringValue() == ""
+	case v.IsArray():
+		return len(v.ArrayValue()) == 0
+	case v.IsObject():
+		return len(v.ObjectValue()) == 0
+	default:
+		return false
+	}
 }
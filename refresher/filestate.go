@@ -0,0 +1,153 @@
+package refresher
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/pkg/v3/backend/filestate"
+	"github.com/pulumi/pulumi/pkg/v3/resource/stack"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/cmdutil"
+	"io"
+	"os"
+)
+
+// LoginFileState opens a self-managed backend (file://, s3://, gs://, azblob://).
+// Opening a backend never migrates the layout of its stacks, so the buckets of
+// customers keep working with their own tooling; only `pulumi login` and
+// `pulumi state upgrade` do that.
+func (c *Client) LoginFileState(url string) (filestate.Backend, error) {
+	if !filestate.IsFileStateBackendURL(url) {
+		return nil, fmt.Errorf("%s is not a self-managed backend url", url)
+	}
+	return filestate.New(cmdutil.Diag(), url)
+}
+
+// ParseFileStackReference parses the name of a stack of a self-managed backend.
+// The name is qualified with the project, unless the backend still uses the
+// legacy layout where stack names are not scoped by project.
+func ParseFileStackReference(b filestate.Backend, projectName, stackName string) (backend.StackReference, error) {
+	if projectName != "" {
+		if stackRef, err := b.ParseStackReference(projectName + "/" + stackName); err == nil {
+			return stackRef, nil
+		}
+	}
+	return b.ParseStackReference(stackName)
+}
+
+// OpenCheckpoint loads an exported deployment (`pulumi stack export`) or a raw
+// checkpoint file into a temporary file backend, so it can be refreshed like any
+// other stack. The returned cleanup function removes the temporary backend.
+func (c *Client) OpenCheckpoint(ctx context.Context, path, projectName, stackName string) (filestate.Backend, backend.Stack, func(), error) {
+	deployment, err := ReadDeployment(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	dir, err := os.MkdirTemp("", "pulumi-mapper-")
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create temporary backend directory: %w", err)
+	}
+	cleanup := func() {
+		_ = os.RemoveAll(dir)
+	}
+
+	fileBackend, err := c.LoginFileState(filestate.FilePathPrefix + dir)
+	if err != nil {
+		cleanup()
+		return nil, nil, nil, err
+	}
+
+	stackRef, err := ParseFileStackReference(fileBackend, projectName, stackName)
+	if err != nil {
+		cleanup()
+		return nil, nil, nil, err
+	}
+
+	fileStack, err := fileBackend.CreateStack(ctx, stackRef, nil)
+	if err != nil {
+		cleanup()
+		return nil, nil, nil, fmt.Errorf("failed to create temporary stack: %w", err)
+	}
+
+	if err = fileBackend.ImportDeployment(ctx, fileStack, deployment); err != nil {
+		cleanup()
+		return nil, nil, nil, fmt.Errorf("failed to import checkpoint %s: %w", path, err)
+	}
+
+	// reload the stack so it carries the imported snapshot
+	fileStack, err = fileBackend.GetStack(ctx, stackRef)
+	if err != nil || fileStack == nil {
+		cleanup()
+		return nil, nil, nil, fmt.Errorf("failed to load imported stack: %v", err)
+	}
+
+	return fileBackend, fileStack, cleanup, nil
+}
+
+// ReadDeployment reads either an UntypedDeployment, as written by
+// `pulumi stack export`, or a versioned checkpoint, as stored by the filestate
+// backend under .pulumi/stacks. Either may be gzip-compressed.
+func ReadDeployment(path string) (*apitype.UntypedDeployment, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint file: %w", err)
+	}
+	if bytes.HasPrefix(data, gzipMagic) {
+		if data, err = gunzip(data); err != nil {
+			return nil, fmt.Errorf("failed to decompress checkpoint file: %w", err)
+		}
+	}
+
+	var probe struct {
+		Version    int             `json:"version"`
+		Deployment json.RawMessage `json:"deployment"`
+		Checkpoint json.RawMessage `json:"checkpoint"`
+	}
+	if err = json.Unmarshal(data, &probe); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint file: %w", err)
+	}
+
+	switch {
+	case len(probe.Deployment) > 0:
+		return &apitype.UntypedDeployment{
+			Version:    probe.Version,
+			Deployment: probe.Deployment,
+		}, nil
+	case len(probe.Checkpoint) > 0:
+		checkpoint, err := stack.UnmarshalVersionedCheckpointToLatestCheckpoint(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse checkpoint: %w", err)
+		}
+		latest := checkpoint.Latest
+		if latest == nil {
+			latest = &apitype.DeploymentV3{}
+		}
+		deployment, err := json.Marshal(latest)
+		if err != nil {
+			return nil, err
+		}
+		return &apitype.UntypedDeployment{
+			Version:    apitype.DeploymentSchemaVersionCurrent,
+			Deployment: deployment,
+		}, nil
+	default:
+		return nil, errors.New("checkpoint file has neither a deployment nor a checkpoint")
+	}
+}
+
+// gzipMagic starts every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+func gunzip(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
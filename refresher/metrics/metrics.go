@@ -0,0 +1,155 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
+	"net/http"
+	"time"
+)
+
+const namespace = "pulumi_mapper"
+
+var (
+	// Registry holds the mapper's metrics, along with the go and process
+	// collectors.
+	Registry = prometheus.NewRegistry()
+
+	runs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "runs_total",
+		Help:      "Number of stack runs by their final status and mapping mode.",
+	}, []string{"status", "mode"})
+
+	runDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "run_duration_seconds",
+		Help:      "Duration of stack runs by their final status.",
+		Buckets:   []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600},
+	}, []string{"status"})
+
+	lastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_success_timestamp_seconds",
+		Help:      "Unix time of the last stack run that did not fail.",
+	})
+
+	failures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "failures_total",
+		Help:      "Number of failed stack runs by the stage they failed in.",
+	}, []string{"stage"})
+
+	refreshDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "refresh_duration_seconds",
+		Help:      "Duration of loading the resources of a stack, by mapping mode.",
+		Buckets:   []float64{0.5, 1, 5, 15, 30, 60, 120, 300, 600, 1200, 1800},
+	}, []string{"mode"})
+
+	resources = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "resources_total",
+		Help:      "Number of mapped resources by provider, pulumi state and mapping mode.",
+	}, []string{"provider", "state", "mode"})
+
+	driftedResources = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "drifted_resources_total",
+		Help:      "Number of mapped resources with drifts by provider and mapping mode.",
+	}, []string{"provider", "mode"})
+
+	s3BytesWritten = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "s3_written_bytes_total",
+		Help:      "Number of bytes written to the fetched resources bucket.",
+	})
+
+	atrsTriggered = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "atrs_triggered_total",
+		Help:      "Number of ATRs written to the engine accumulator.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		runs,
+		runDuration,
+		lastSuccess,
+		failures,
+		refreshDuration,
+		resources,
+		driftedResources,
+		s3BytesWritten,
+		atrsTriggered,
+	)
+}
+
+// RunFinished records a finished stack run. Runs that did not fail also mark
+// the time of the last success, so the freshness of the inventory can be
+// alerted on.
+func RunFinished(status, mode string, failed bool, duration time.Duration) {
+	runs.WithLabelValues(status, mode).Inc()
+	runDuration.WithLabelValues(status).Observe(duration.Seconds())
+	if !failed {
+		lastSuccess.SetToCurrentTime()
+	}
+}
+
+// StageFailed records a run that failed in the given stage.
+func StageFailed(stage string) {
+	failures.WithLabelValues(stage).Inc()
+}
+
+// RefreshFinished records how long it took to load the resources of a stack.
+func RefreshFinished(mode string, duration time.Duration) {
+	refreshDuration.WithLabelValues(mode).Observe(duration.Seconds())
+}
+
+// ResourcesMapped records the mapped resources of a provider in a state.
+func ResourcesMapped(provider, state, mode string, count int) {
+	resources.WithLabelValues(provider, state, mode).Add(float64(count))
+}
+
+// DriftedResourcesMapped records the mapped resources of a provider with drifts.
+func DriftedResourcesMapped(provider, mode string, count int) {
+	driftedResources.WithLabelValues(provider, mode).Add(float64(count))
+}
+
+// S3BytesWritten records the size of a file written to the bucket.
+func S3BytesWritten(count int) {
+	s3BytesWritten.Add(float64(count))
+}
+
+// AtrsTriggered records ATRs written to the engine accumulator.
+func AtrsTriggered(count int) {
+	atrsTriggered.Add(float64(count))
+}
+
+// Serve exposes the metrics on addr under /metrics until ctx is done, and
+// returns once the server is shut down.
+func Serve(ctx context.Context, addr string, logger *zerolog.Logger) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	logger.Info().Str("addr", addr).Msg("serving metrics")
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Err(err).Msg("failed to serve metrics")
+	}
+	<-shutdown
+}
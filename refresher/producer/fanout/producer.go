@@ -0,0 +1,163 @@
+package fanout
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/infralight/pulumi/refresher/common"
+	"github.com/infralight/pulumi/refresher/config"
+	"github.com/infralight/pulumi/refresher/consumer/engine"
+	"github.com/infralight/pulumi/refresher/queue"
+	"github.com/infralight/pulumi/refresher/storage"
+	"github.com/pulumi/pulumi/pkg/v3/backend/httpstate/client"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/rs/zerolog"
+)
+
+// publishBatchSize is the number of jobs published at once.
+const publishBatchSize = 100
+
+// StackLister lists the stacks of the Pulumi Service, as the httpstate client does.
+type StackLister interface {
+	ListStacks(ctx context.Context, filter client.ListStacksFilter, continuationToken *string) ([]apitype.StackSummary, *string, error)
+}
+
+// Producer emits a mapper job for every stack of an organization that was
+// updated since it was last processed.
+type Producer struct {
+	Config    *config.ProducerConfig
+	Stacks    StackLister
+	Publisher queue.Publisher
+	// StackFinder resolves the Firefly stack record the jobs are mapped to.
+	StackFinder storage.StackFinder
+	// Sink holds the run summaries the consumer writes, which tell the last
+	// update of every stack it processed.
+	Sink   storage.Sink
+	Logger *zerolog.Logger
+}
+
+// Result counts the stacks a producer run went over.
+type Result struct {
+	Listed    int `json:"listed"`
+	Published int `json:"published"`
+	Unchanged int `json:"unchanged"`
+	// Unregistered counts the stacks without a Firefly stack record
+	Unregistered int `json:"unregistered"`
+}
+
+// StackName returns the fully qualified name of the stack in the Pulumi Service.
+func StackName(stack apitype.StackSummary) string {
+	return fmt.Sprintf("%s/%s/%s", stack.OrgName, stack.ProjectName, stack.StackName)
+}
+
+// Run lists the stacks and publishes the jobs of the changed ones. A stack is
+// unchanged when the consumer's last run went through its current update, so
+// the jobs of failed runs are produced again by the next run.
+func (p *Producer) Run(ctx context.Context) (*Result, error) {
+	stacks, err := p.listStacks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{Listed: len(stacks)}
+	var bodies []string
+	flush := func() error {
+		if len(bodies) == 0 {
+			return nil
+		}
+		if err := p.Publisher.Publish(ctx, bodies); err != nil {
+			return err
+		}
+		result.Published += len(bodies)
+		bodies = nil
+		return nil
+	}
+
+	for _, stack := range stacks {
+		logger := p.Logger.With().Str("stack", StackName(stack)).Logger()
+		stackId, err := p.StackFinder.FindStackId(ctx, p.Config.AccountId, p.Config.IntegrationId,
+			stack.OrgName, stack.ProjectName, stack.StackName)
+		if errors.Is(err, storage.ErrStackNotFound) {
+			logger.Warn().Msg("stack has no stack record, skipping")
+			result.Unregistered++
+			continue
+		} else if err != nil {
+			return result, fmt.Errorf("failed to find the stack record of %s: %w", StackName(stack), err)
+		}
+
+		if !p.Config.Force {
+			summary, err := engine.ReadRunSummary(ctx, p.Sink, p.Config.AccountId, stackId)
+			if err != nil {
+				return result, fmt.Errorf("failed to read the run summary of %s: %w", StackName(stack), err)
+			}
+			if summary != nil && summary.Succeeded() && summary.LastUpdated == lastUpdate(stack) {
+				result.Unchanged++
+				continue
+			}
+		}
+
+		body, err := json.Marshal(p.newEvent(stackId, stack))
+		if err != nil {
+			return result, fmt.Errorf("failed to marshal the job of %s: %w", StackName(stack), err)
+		}
+		logger.Debug().Str("stackId", stackId).Int64("lastUpdate", lastUpdate(stack)).Msg("producing mapper job")
+		bodies = append(bodies, string(body))
+		if len(bodies) >= publishBatchSize {
+			if err = flush(); err != nil {
+				return result, err
+			}
+		}
+	}
+	return result, flush()
+}
+
+func (p *Producer) newEvent(stackId string, stack apitype.StackSummary) *common.PulumiMapperEvent {
+	event := &common.PulumiMapperEvent{
+		AccountId:        p.Config.AccountId,
+		IntegrationId:    p.Config.IntegrationId,
+		AwsIntegrationId: p.Config.AwsIntegrationId,
+		StackId:          stackId,
+		OrganizationName: stack.OrgName,
+		ProjectName:      stack.ProjectName,
+		StackName:        stack.StackName,
+		LastUpdated:      lastUpdate(stack),
+	}
+	if stack.ResourceCount != nil {
+		event.ResourceCount = *stack.ResourceCount
+	}
+	return event
+}
+func (p *Producer) listStacks(ctx context.Context) ([]apitype.StackSummary, error) {
+	filter := client.ListStacksFilter{Organization: &p.Config.OrganizationName}
+	if p.Config.ProjectFilter != "" {
+		filter.Project = &p.Config.ProjectFilter
+	}
+	if p.Config.TagNameFilter != "" {
+		filter.TagName = &p.Config.TagNameFilter
+	}
+	if p.Config.TagValueFilter != "" {
+		filter.TagValue = &p.Config.TagValueFilter
+	}
+
+	var stacks []apitype.StackSummary
+	var continuationToken *string
+	for {
+		page, nextToken, err := p.Stacks.ListStacks(ctx, filter, continuationToken)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list stacks: %w", err)
+		}
+		stacks = append(stacks, page...)
+		if nextToken == nil {
+			return stacks, nil
+		}
+		continuationToken = nextToken
+	}
+}
+
+func lastUpdate(stack apitype.StackSummary) int64 {
+	if stack.LastUpdate == nil {
+		return 0
+	}
+	return *stack.LastUpdate
+}
@@ -0,0 +1,267 @@
+package fanout
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/infralight/pulumi/refresher/common"
+	"github.com/infralight/pulumi/refresher/config"
+	"github.com/infralight/pulumi/refresher/consumer/engine"
+	"github.com/infralight/pulumi/refresher/queue"
+	"github.com/infralight/pulumi/refresher/storage"
+	"github.com/pulumi/pulumi/pkg/v3/backend/httpstate/client"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/rs/zerolog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// fakeLister serves its pages of stacks, the token of a page being its index.
+type fakeLister struct {
+	pages   [][]apitype.StackSummary
+	filters []client.ListStacksFilter
+	tokens  []string
+}
+
+func (l *fakeLister) ListStacks(ctx context.Context, filter client.ListStacksFilter, continuationToken *string) ([]apitype.StackSummary, *string, error) {
+	l.filters = append(l.filters, filter)
+	page := 0
+	if continuationToken != nil {
+		l.tokens = append(l.tokens, *continuationToken)
+		if _, err := fmt.Sscan(*continuationToken, &page); err != nil {
+			return nil, nil, err
+		}
+	}
+	if page+1 < len(l.pages) {
+		next := fmt.Sprint(page + 1)
+		return l.pages[page], &next, nil
+	}
+	return l.pages[page], nil, nil
+}
+
+// unregisteredFinder finds no stack record for the stacks it holds.
+type unregisteredFinder struct {
+	storage.StackFinder
+	unregistered string
+}
+
+func (f *unregisteredFinder) FindStackId(ctx context.Context, accountId, integrationId, organization, project, stack string) (string, error) {
+	if stack == f.unregistered {
+		return "", storage.ErrStackNotFound
+	}
+	return f.StackFinder.FindStackId(ctx, accountId, integrationId, organization, project, stack)
+}
+
+func newStack(name string, lastUpdate int64) apitype.StackSummary {
+	resourceCount := 1
+	return apitype.StackSummary{
+		OrgName:       "org",
+		ProjectName:   "project",
+		StackName:     name,
+		LastUpdate:    &lastUpdate,
+		ResourceCount: &resourceCount,
+	}
+}
+
+type producerTest struct {
+	Producer
+	store  *storage.MemoryInventoryStore
+	sink   *storage.MemorySink
+	output *bytes.Buffer
+}
+
+func newProducerTest(pages ...[]apitype.StackSummary) *producerTest {
+	logger := zerolog.Nop()
+	output := &bytes.Buffer{}
+	store := storage.NewMemoryInventoryStore()
+	sink := storage.NewMemorySink()
+	return &producerTest{
+		Producer: Producer{
+			Config: &config.ProducerConfig{
+				AccountId:        "account",
+				IntegrationId:    "pulumi-integration",
+				OrganizationName: "org",
+			},
+			Stacks:      &fakeLister{pages: pages},
+			Publisher:   queue.NewFilePublisher(output),
+			StackFinder: store,
+			Sink:        sink,
+			Logger:      &logger,
+		},
+		store:  store,
+		sink:   sink,
+		output: output,
+	}
+}
+
+// jobs returns the jobs published so far, and forgets them.
+func (p *producerTest) jobs(t *testing.T) []common.PulumiMapperEvent {
+	var jobs []common.PulumiMapperEvent
+	scanner := bufio.NewScanner(p.output)
+	for scanner.Scan() {
+		var job common.PulumiMapperEvent
+		if err := json.Unmarshal(scanner.Bytes(), &job); err != nil {
+			t.Fatalf("failed to parse job: %v", err)
+		}
+		jobs = append(jobs, job)
+	}
+	p.output.Reset()
+	return jobs
+}
+
+func (p *producerTest) writeRunSummary(t *testing.T, stackId, status string, lastUpdated int64) {
+	content, err := json.Marshal(engine.RunSummary{StackId: stackId, Status: status, LastUpdated: lastUpdated})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.sink.Write(context.Background(), engine.RunSummaryPath("account", stackId), content, "json"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func stackIds(jobs []common.PulumiMapperEvent) []string {
+	var ids []string
+	for _, job := range jobs {
+		ids = append(ids, job.StackId)
+	}
+	return ids
+}
+
+func TestProducerListsFilteredPages(t *testing.T) {
+	p := newProducerTest(
+		[]apitype.StackSummary{newStack("dev", 1), newStack("staging", 1)},
+		[]apitype.StackSummary{newStack("prod", 1)},
+	)
+	p.Config.ProjectFilter = "project"
+	p.Config.TagNameFilter = "team"
+	p.Config.TagValueFilter = "infra"
+	p.store.StackIds["org/project/dev"] = "dev-record"
+
+	result, err := p.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *result != (Result{Listed: 3, Published: 3}) {
+		t.Errorf("unexpected result %+v", *result)
+	}
+
+	lister := p.Stacks.(*fakeLister)
+	if !reflect.DeepEqual(lister.tokens, []string{"1"}) {
+		t.Errorf("expected the second page to be listed with its token, got %v", lister.tokens)
+	}
+	for _, filter := range lister.filters {
+		if *filter.Organization != "org" || *filter.Project != "project" || *filter.TagName != "team" || *filter.TagValue != "infra" {
+			t.Errorf("unexpected filter %+v", filter)
+		}
+	}
+
+	// jobs are mapped to the stack record, or to the stack name when there is none
+	ids := stackIds(p.jobs(t))
+	if expected := []string{"dev-record", "org/project/staging", "org/project/prod"}; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("expected jobs of %v, got %v", expected, ids)
+	}
+}
+
+func TestProducerSkipsProcessedStacks(t *testing.T) {
+	p := newProducerTest([]apitype.StackSummary{newStack("mapped", 2), newStack("updated", 2), newStack("failed", 2), newStack("new", 2)})
+	p.writeRunSummary(t, "org/project/mapped", engine.RunStatusMapped, 2)
+	p.writeRunSummary(t, "org/project/updated", engine.RunStatusMapped, 1)
+	p.writeRunSummary(t, "org/project/failed", engine.RunStatusFailed, 2)
+
+	result, err := p.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *result != (Result{Listed: 4, Published: 3, Unchanged: 1}) {
+		t.Errorf("unexpected result %+v", *result)
+	}
+	ids := stackIds(p.jobs(t))
+	if expected := []string{"org/project/updated", "org/project/failed", "org/project/new"}; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("expected jobs of %v, got %v", expected, ids)
+	}
+
+	// publishing a job is not processing it, so nothing is skipped until the
+	// consumer ran
+	if _, err = p.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if ids = stackIds(p.jobs(t)); len(ids) != 3 {
+		t.Errorf("expected the unprocessed jobs to be produced again, got %v", ids)
+	}
+
+	p.Config.Force = true
+	result, err = p.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *result != (Result{Listed: 4, Published: 4}) {
+		t.Errorf("expected all stacks to be published when forced, got %+v", *result)
+	}
+}
+
+func TestProducerSkipsUnregisteredStacks(t *testing.T) {
+	p := newProducerTest([]apitype.StackSummary{newStack("dev", 1), newStack("prod", 1)})
+	p.StackFinder = &unregisteredFinder{StackFinder: p.store, unregistered: "dev"}
+
+	result, err := p.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *result != (Result{Listed: 2, Published: 1, Unregistered: 1}) {
+		t.Errorf("unexpected result %+v", *result)
+	}
+	if ids := stackIds(p.jobs(t)); !reflect.DeepEqual(ids, []string{"org/project/prod"}) {
+		t.Errorf("expected only the registered stack to be published, got %v", ids)
+	}
+}
+
+// TestProducedJobRunsThroughConsumer runs a produced job through the consumer
+// against a Pulumi Service where the stack no longer exists, and checks the
+// consumer updates the stack record the producer resolved.
+func TestProducedJobRunsThroughConsumer(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/user":
+			_, _ = w.Write([]byte(`{"githubLogin": "firefly"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"code": 404, "message": "not found"}`))
+		}
+	}))
+	defer service.Close()
+	t.Setenv("PULUMI_HOME", t.TempDir())
+	t.Setenv("PULUMI_ACCESS_TOKEN", "token")
+
+	p := newProducerTest([]apitype.StackSummary{newStack("dev", 1)})
+	p.store.StackIds["org/project/dev"] = "dev-record"
+	if _, err := p.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	body := p.output.String()
+
+	consumer := &common.Consumer{
+		Config: &config.Config{PulumiUrl: service.URL, RetryAttempts: 1, OutputCompression: config.NoCompression},
+		Sink:   p.sink,
+		Store:  p.store,
+	}
+	logger := zerolog.Nop()
+	if err := engine.ProcessMessage(context.Background(), &logger, consumer, body); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p.store.DeletedStateFiles, []string{"dev-record"}) {
+		t.Errorf("expected the state file of the stack record to be deleted, got %v", p.store.DeletedStateFiles)
+	}
+
+	// the consumer went through the stack's update, so it is not produced again
+	result, err := p.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *result != (Result{Listed: 1, Unchanged: 1}) {
+		t.Errorf("expected the processed stack to be unchanged, got %+v", *result)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/infralight/pulumi/refresher"
+	"github.com/infralight/pulumi/refresher/config"
+	"github.com/infralight/pulumi/refresher/producer/fanout"
+	"github.com/infralight/pulumi/refresher/queue"
+	"github.com/infralight/pulumi/refresher/storage"
+	"github.com/infralight/pulumi/refresher/utils"
+	"github.com/pulumi/pulumi/pkg/v3/backend/httpstate"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+var (
+	cfg       *config.ProducerConfig
+	logger    zerolog.Logger
+	component = "pulumi-mapper-producer"
+)
+
+func init() {
+	var err error
+
+	cfg, err = config.LoadProducerConfig()
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load configuration from environment variables")
+	}
+
+	if cfg.DebugMode {
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	} else {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+}
+
+// newPublisher returns the SQS queue publisher when a queue is configured, and
+// a JSONL file publisher otherwise.
+func newPublisher() (queue.Publisher, func(), error) {
+	if cfg.QueueUrl != "" {
+		return queue.NewSQSPublisher(cfg.LoadServiceAwsSession(), cfg.QueueUrl), func() {}, nil
+	}
+	var writer io.Writer = os.Stdout
+	closer := func() {}
+	if cfg.OutputFile != "" && cfg.OutputFile != "-" {
+		file, err := os.OpenFile(cfg.OutputFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open output file: %w", err)
+		}
+		writer = file
+		closer = func() { _ = file.Close() }
+	}
+	return queue.NewFilePublisher(writer), closer, nil
+}
+
+func run(ctx context.Context) error {
+	client, err := refresher.NewClient(ctx, cfg.PulumiUrl)
+	if err != nil {
+		return fmt.Errorf("failed to create new pulumi client: %w", err)
+	}
+	var httpBackend httpstate.Backend
+	err = utils.Retry(ctx, cfg.RetryAttempts, func() (err error) {
+		httpBackend, err = client.Login()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to login to pulumi http backend: %w", err)
+	}
+
+	sink, err := storage.NewSink(&cfg.Config)
+	if err != nil {
+		return err
+	}
+	stackFinder, err := storage.NewStackFinder(ctx, &cfg.Config)
+	if err != nil {
+		return err
+	}
+	publisher, closePublisher, err := newPublisher()
+	if err != nil {
+		return err
+	}
+	defer closePublisher()
+
+	producer := fanout.Producer{
+		Config:      cfg,
+		Stacks:      httpBackend.Client(),
+		Publisher:   publisher,
+		StackFinder: stackFinder,
+		Sink:        sink,
+		Logger:      &logger,
+	}
+	result, err := producer.Run(ctx)
+	if result != nil {
+		logger.Info().Int("listed", result.Listed).Int("published", result.Published).Int("unchanged", result.Unchanged).
+			Int("unregistered", result.Unregistered).
+			Msg("Finished producing mapper jobs")
+	}
+	return err
+}
+
+func main() {
+	logger = log.With().
+		Str("component", component).
+		Str("accountId", cfg.AccountId).
+		Str("integrationId", cfg.IntegrationId).
+		Str("organizationName", cfg.OrganizationName).Logger()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	if err := run(ctx); err != nil {
+		logger.Fatal().Err(err).Msg("failed to produce mapper jobs")
+	}
+}
@@ -0,0 +1,80 @@
+package queue
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FileQueue reads one message per line from a reader (a JSONL file or stdin),
+// which makes it possible to run the worker locally and in tests. Messages that
+// fail processing are written as JSON lines to the dead letter writer.
+type FileQueue struct {
+	mutex      sync.Mutex
+	scanner    *bufio.Scanner
+	line       int
+	deadLetter io.Writer
+}
+
+func NewFileQueue(reader io.Reader, deadLetter io.Writer) *FileQueue {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	return &FileQueue{
+		scanner:    scanner,
+		deadLetter: deadLetter,
+	}
+}
+
+func (q *FileQueue) Receive(ctx context.Context) ([]*Message, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if !q.scanner.Scan() {
+			if err := q.scanner.Err(); err != nil {
+				return nil, err
+			}
+			return nil, ErrDrained
+		}
+		q.line++
+		body := strings.TrimSpace(q.scanner.Text())
+		if body == "" {
+			continue
+		}
+		id := strconv.Itoa(q.line)
+		return []*Message{{Id: id, Body: body, handle: id}}, nil
+	}
+}
+
+func (q *FileQueue) Ack(ctx context.Context, message *Message) error {
+	return nil
+}
+
+func (q *FileQueue) DeadLetter(ctx context.Context, message *Message, reason error) error {
+	if q.deadLetter == nil {
+		return nil
+	}
+	record := map[string]string{
+		"id":   message.Id,
+		"body": message.Body,
+	}
+	if reason != nil {
+		record["error"] = reason.Error()
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	_, err = q.deadLetter.Write(append(line, '\n'))
+	return err
+}
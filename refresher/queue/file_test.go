@@ -0,0 +1,93 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFileQueue(t *testing.T) {
+	ctx := context.Background()
+	deadLetter := &bytes.Buffer{}
+	q := NewFileQueue(strings.NewReader("{\"stackId\": \"a\"}\n\n  \n{\"stackId\": \"b\"}\n"), deadLetter)
+
+	// blank lines are skipped, and messages are identified by their line
+	var received []*Message
+	for {
+		messages, err := q.Receive(ctx)
+		if errors.Is(err, ErrDrained) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, messages...)
+	}
+	expected := []*Message{
+		{Id: "1", Body: `{"stackId": "a"}`, handle: "1"},
+		{Id: "4", Body: `{"stackId": "b"}`, handle: "4"},
+	}
+	if !reflect.DeepEqual(received, expected) {
+		t.Fatalf("expected messages %+v, got %+v", expected, received)
+	}
+	if _, err := q.Receive(ctx); !errors.Is(err, ErrDrained) {
+		t.Errorf("expected the queue to stay drained, got %v", err)
+	}
+
+	if err := q.Ack(ctx, received[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.DeadLetter(ctx, received[1], errors.New("failed")); err != nil {
+		t.Fatal(err)
+	}
+	var record map[string]string
+	if err := json.Unmarshal(deadLetter.Bytes(), &record); err != nil {
+		t.Fatalf("failed to parse dead letter %q: %v", deadLetter.String(), err)
+	}
+	if expected := map[string]string{"id": "4", "body": `{"stackId": "b"}`, "error": "failed"}; !reflect.DeepEqual(record, expected) {
+		t.Errorf("expected dead letter %v, got %v", expected, record)
+	}
+}
+
+func TestFileQueueCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	q := NewFileQueue(strings.NewReader("{}\n"), nil)
+	if _, err := q.Receive(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the canceled context's error, got %v", err)
+	}
+	// messages are not dead-lettered anywhere without a writer
+	if err := q.DeadLetter(context.Background(), &Message{Id: "1"}, errors.New("failed")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFilePublisher(t *testing.T) {
+	ctx := context.Background()
+	output := &bytes.Buffer{}
+	bodies := []string{`{"stackId": "a"}`, "  {\"stackId\": \"b\"}\n"}
+	if err := NewFilePublisher(output).Publish(ctx, bodies); err != nil {
+		t.Fatal(err)
+	}
+
+	// published messages are read back by a file queue
+	q := NewFileQueue(output, nil)
+	var received []string
+	for {
+		messages, err := q.Receive(ctx)
+		if errors.Is(err, ErrDrained) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		for _, message := range messages {
+			received = append(received, message.Body)
+		}
+	}
+	if expected := []string{`{"stackId": "a"}`, `{"stackId": "b"}`}; !reflect.DeepEqual(received, expected) {
+		t.Errorf("expected %v, got %v", expected, received)
+	}
+}
@@ -0,0 +1,78 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Publisher is the destination of mapper jobs produced for worker mode.
+type Publisher interface {
+	// Publish sends the message bodies, failing if any of them wasn't sent.
+	Publish(ctx context.Context, bodies []string) error
+}
+
+// SQSPublisher sends messages to an SQS queue.
+type SQSPublisher struct {
+	svc *sqs.SQS
+	url string
+}
+
+func NewSQSPublisher(sess *session.Session, url string) *SQSPublisher {
+	return &SQSPublisher{svc: sqs.New(sess), url: url}
+}
+
+func (p *SQSPublisher) Publish(ctx context.Context, bodies []string) error {
+	for start := 0; start < len(bodies); start += sqsMaxMessages {
+		end := start + sqsMaxMessages
+		if end > len(bodies) {
+			end = len(bodies)
+		}
+		entries := make([]*sqs.SendMessageBatchRequestEntry, 0, end-start)
+		for i, body := range bodies[start:end] {
+			entries = append(entries, &sqs.SendMessageBatchRequestEntry{
+				Id:          aws.String(strconv.Itoa(i)),
+				MessageBody: aws.String(body),
+			})
+		}
+		output, err := p.svc.SendMessageBatchWithContext(ctx, &sqs.SendMessageBatchInput{
+			QueueUrl: aws.String(p.url),
+			Entries:  entries,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to send messages to %s: %w", p.url, err)
+		}
+		if len(output.Failed) > 0 {
+			return fmt.Errorf("failed to send %d messages to %s: %s", len(output.Failed), p.url, aws.StringValue(output.Failed[0].Message))
+		}
+	}
+	return nil
+}
+
+// FilePublisher writes messages as JSON lines, e.g. to a file read later on
+// by a FileQueue.
+type FilePublisher struct {
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+func NewFilePublisher(writer io.Writer) *FilePublisher {
+	return &FilePublisher{writer: writer}
+}
+
+func (p *FilePublisher) Publish(ctx context.Context, bodies []string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, body := range bodies {
+		if _, err := io.WriteString(p.writer, strings.TrimSpace(body)+"\n"); err != nil {
+			return fmt.Errorf("failed to write message: %w", err)
+		}
+	}
+	return nil
+}
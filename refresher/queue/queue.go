@@ -0,0 +1,29 @@
+package queue
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrDrained is returned by Receive when a finite queue has no more messages.
+var ErrDrained = errors.New("queue drained")
+
+// Message is a single PulumiMapperEvent pulled from a queue.
+type Message struct {
+	Id   string
+	Body string
+
+	// handle is the queue specific value needed to ack the message
+	handle string
+}
+
+// Queue is the source of mapper jobs in worker mode.
+type Queue interface {
+	// Receive blocks until at least one message is available, the context is
+	// done, or the queue is drained.
+	Receive(ctx context.Context) ([]*Message, error)
+	// Ack removes a successfully processed message from the queue.
+	Ack(ctx context.Context, message *Message) error
+	// DeadLetter moves a message that failed processing out of the queue.
+	DeadLetter(ctx context.Context, message *Message, reason error) error
+}
@@ -0,0 +1,95 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const (
+	sqsMaxMessages     = 10
+	sqsWaitTimeSeconds = 20
+)
+
+// SQSQueue pulls messages from an SQS queue. Failed messages are sent to the
+// dead letter queue when one is configured, otherwise they are left for the
+// queue's redrive policy to handle once their visibility timeout expires.
+type SQSQueue struct {
+	svc               *sqs.SQS
+	url               string
+	deadLetterUrl     string
+	visibilityTimeout int64
+}
+
+func NewSQSQueue(sess *session.Session, url, deadLetterUrl string, visibilityTimeout int64) *SQSQueue {
+	return &SQSQueue{
+		svc:               sqs.New(sess),
+		url:               url,
+		deadLetterUrl:     deadLetterUrl,
+		visibilityTimeout: visibilityTimeout,
+	}
+}
+
+func (q *SQSQueue) Receive(ctx context.Context) ([]*Message, error) {
+	for {
+		input := &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(q.url),
+			MaxNumberOfMessages: aws.Int64(sqsMaxMessages),
+			WaitTimeSeconds:     aws.Int64(sqsWaitTimeSeconds),
+		}
+		if q.visibilityTimeout > 0 {
+			input.VisibilityTimeout = aws.Int64(q.visibilityTimeout)
+		}
+
+		output, err := q.svc.ReceiveMessageWithContext(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to receive messages from %s: %w", q.url, err)
+		}
+		if len(output.Messages) == 0 {
+			continue
+		}
+
+		messages := make([]*Message, 0, len(output.Messages))
+		for _, message := range output.Messages {
+			messages = append(messages, &Message{
+				Id:     aws.StringValue(message.MessageId),
+				Body:   aws.StringValue(message.Body),
+				handle: aws.StringValue(message.ReceiptHandle),
+			})
+		}
+		return messages, nil
+	}
+}
+
+func (q *SQSQueue) Ack(ctx context.Context, message *Message) error {
+	_, err := q.svc.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(q.url),
+		ReceiptHandle: aws.String(message.handle),
+	})
+	return err
+}
+
+func (q *SQSQueue) DeadLetter(ctx context.Context, message *Message, reason error) error {
+	if q.deadLetterUrl == "" {
+		return nil
+	}
+
+	input := &sqs.SendMessageInput{
+		QueueUrl:    aws.String(q.deadLetterUrl),
+		MessageBody: aws.String(message.Body),
+	}
+	if reason != nil {
+		input.MessageAttributes = map[string]*sqs.MessageAttributeValue{
+			"error": {
+				DataType:    aws.String("String"),
+				StringValue: aws.String(reason.Error()),
+			},
+		}
+	}
+	if _, err := q.svc.SendMessageWithContext(ctx, input); err != nil {
+		return fmt.Errorf("failed to send message %s to dead letter queue: %w", message.Id, err)
+	}
+	return q.Ack(ctx, message)
+}
@@ -0,0 +1,199 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	testQueueUrl      = "https://sqs.us-east-1.amazonaws.com/123456789012/jobs"
+	testDeadLetterUrl = "https://sqs.us-east-1.amazonaws.com/123456789012/jobs-dlq"
+)
+
+// fakeSQS serves the SQS query API. Received messages are served from its
+// batches one call at a time, and every request is recorded.
+type fakeSQS struct {
+	mutex    sync.Mutex
+	batches  [][]*Message
+	requests []url.Values
+	// failed is the id of a batch entry that fails to be sent
+	failed string
+}
+
+func (f *fakeSQS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.requests = append(f.requests, r.PostForm)
+
+	action := r.PostForm.Get("Action")
+	var result strings.Builder
+	switch action {
+	case "ReceiveMessage":
+		var batch []*Message
+		if len(f.batches) > 0 {
+			batch, f.batches = f.batches[0], f.batches[1:]
+		}
+		for _, message := range batch {
+			fmt.Fprintf(&result, "<Message><MessageId>%s</MessageId><ReceiptHandle>%s</ReceiptHandle><Body>%s</Body></Message>",
+				message.Id, message.handle, message.Body)
+		}
+	case "SendMessage":
+		result.WriteString("<MessageId>sent</MessageId>")
+	case "SendMessageBatch":
+		for i := 1; r.PostForm.Get(fmt.Sprintf("SendMessageBatchRequestEntry.%d.Id", i)) != ""; i++ {
+			id := r.PostForm.Get(fmt.Sprintf("SendMessageBatchRequestEntry.%d.Id", i))
+			if id == f.failed {
+				fmt.Fprintf(&result, "<BatchResultErrorEntry><Id>%s</Id><Code>InvalidMessage</Code><Message>too large</Message>"+
+					"<SenderFault>true</SenderFault></BatchResultErrorEntry>", id)
+				continue
+			}
+			fmt.Fprintf(&result, "<SendMessageBatchResultEntry><Id>%s</Id><MessageId>sent-%s</MessageId></SendMessageBatchResultEntry>", id, id)
+		}
+	}
+	fmt.Fprintf(w, "<%[1]sResponse><%[1]sResult>%[2]s</%[1]sResult><ResponseMetadata><RequestId>request</RequestId></ResponseMetadata></%[1]sResponse>",
+		action, result.String())
+}
+
+// actions returns the actions of the recorded requests along with the queue
+// they were sent to.
+func (f *fakeSQS) actions() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var actions []string
+	for _, request := range f.requests {
+		actions = append(actions, request.Get("Action")+" "+request.Get("QueueUrl"))
+	}
+	return actions
+}
+
+func newFakeSQSSession(t *testing.T, fake *fakeSQS) *session.Session {
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		// the fake doesn't compute the checksums of the messages
+		DisableComputeChecksums: aws.Bool(true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sess
+}
+
+func TestSQSQueue(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeSQS{batches: [][]*Message{
+		nil,
+		{{Id: "1", Body: "good", handle: "handle-1"}, {Id: "2", Body: "bad", handle: "handle-2"}},
+	}}
+	q := NewSQSQueue(newFakeSQSSession(t, fake), testQueueUrl, testDeadLetterUrl, 300)
+
+	// empty receives are polled again until messages arrive
+	messages, err := q.Receive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request := fake.requests[0]; request.Get("VisibilityTimeout") != "300" || request.Get("MaxNumberOfMessages") != "10" {
+		t.Errorf("unexpected receive request %v", request)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %+v", messages)
+	}
+	if messages[0].Id != "1" || messages[0].Body != "good" || messages[0].handle != "handle-1" {
+		t.Errorf("unexpected message %+v", messages[0])
+	}
+
+	if err = q.Ack(ctx, messages[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.DeadLetter(ctx, messages[1], errors.New("failed")); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"ReceiveMessage " + testQueueUrl,
+		"ReceiveMessage " + testQueueUrl,
+		"DeleteMessage " + testQueueUrl,
+		"SendMessage " + testDeadLetterUrl,
+		"DeleteMessage " + testQueueUrl,
+	}
+	if actions := fake.actions(); !reflect.DeepEqual(actions, expected) {
+		t.Fatalf("expected requests %v, got %v", expected, actions)
+	}
+	if handle := fake.requests[2].Get("ReceiptHandle"); handle != "handle-1" {
+		t.Errorf("expected the good message to be acked, got handle %s", handle)
+	}
+	deadLetter := fake.requests[3]
+	if deadLetter.Get("MessageBody") != "bad" || deadLetter.Get("MessageAttribute.1.Value.StringValue") != "failed" {
+		t.Errorf("unexpected dead letter %v", deadLetter)
+	}
+	if handle := fake.requests[4].Get("ReceiptHandle"); handle != "handle-2" {
+		t.Errorf("expected the dead-lettered message to be removed, got handle %s", handle)
+	}
+}
+
+func TestSQSQueueWithoutDeadLetterQueue(t *testing.T) {
+	fake := &fakeSQS{}
+	q := NewSQSQueue(newFakeSQSSession(t, fake), testQueueUrl, "", 0)
+
+	// failed messages are left for the redrive policy of the queue
+	if err := q.DeadLetter(context.Background(), &Message{Id: "1", Body: "bad", handle: "handle-1"}, errors.New("failed")); err != nil {
+		t.Fatal(err)
+	}
+	if actions := fake.actions(); len(actions) != 0 {
+		t.Errorf("expected the message to be left in the queue, got requests %v", actions)
+	}
+}
+
+func TestSQSPublisher(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeSQS{}
+	p := NewSQSPublisher(newFakeSQSSession(t, fake), testQueueUrl)
+
+	var bodies []string
+	for i := 0; i < 12; i++ {
+		bodies = append(bodies, fmt.Sprintf("job-%d", i))
+	}
+	if err := p.Publish(ctx, bodies); err != nil {
+		t.Fatal(err)
+	}
+
+	// messages are sent in batches of at most 10
+	var sent []string
+	for _, request := range fake.requests {
+		if request.Get("Action") != "SendMessageBatch" || request.Get("QueueUrl") != testQueueUrl {
+			t.Errorf("unexpected request %v", request)
+		}
+		var batch int
+		for ; request.Get(fmt.Sprintf("SendMessageBatchRequestEntry.%d.Id", batch+1)) != ""; batch++ {
+			sent = append(sent, request.Get(fmt.Sprintf("SendMessageBatchRequestEntry.%d.MessageBody", batch+1)))
+		}
+		if batch > sqsMaxMessages {
+			t.Errorf("expected batches of at most %d messages, got %d", sqsMaxMessages, batch)
+		}
+	}
+	if len(fake.requests) != 2 || !reflect.DeepEqual(sent, bodies) {
+		t.Errorf("expected the messages to be sent in 2 batches, got %d with %v", len(fake.requests), sent)
+	}
+
+	fake.failed = "1"
+	if err := p.Publish(ctx, bodies[:2]); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("expected the failed message to fail the publish, got %v", err)
+	}
+}
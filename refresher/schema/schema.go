@@ -0,0 +1,52 @@
+package schema
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// IacNodeSchemaVersion is the version of the iac node records written by the
+// mapper. It is bumped whenever a change to the records isn't backwards
+// compatible for their consumers.
+const IacNodeSchemaVersion = 1
+
+// IacNodeSchemaID is the $id of the iac node schema.
+const IacNodeSchemaID = "https://github.com/infralight/pulumi/blob/main/refresher/schema/iac-node.json"
+
+//go:embed iac-node.json
+var iacNodeSchema string
+
+var compiledIacNodeSchema *jsonschema.Schema
+
+func init() {
+	compiler := jsonschema.NewCompiler()
+	compiler.LoadURL = func(s string) (io.ReadCloser, error) {
+		if s == IacNodeSchemaID {
+			return ioutil.NopCloser(strings.NewReader(iacNodeSchema)), nil
+		}
+		return jsonschema.LoadURL(s)
+	}
+	compiledIacNodeSchema = compiler.MustCompile(IacNodeSchemaID)
+}
+
+// IacNodeSchema returns the JSON schema of the iac node records.
+func IacNodeSchema() string {
+	return iacNodeSchema
+}
+
+// ValidateIacNode validates a JSON encoded iac node record against the schema.
+func ValidateIacNode(record []byte) error {
+	var raw interface{}
+	if err := json.Unmarshal(record, &raw); err != nil {
+		return err
+	}
+	if err := compiledIacNodeSchema.Validate(raw); err != nil {
+		return fmt.Errorf("invalid iac node: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package refresher
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/pulumi/pulumi/pkg/v3/engine"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+)
+
+// SecretRedactor converts property values to JSON friendly values, redacting
+// the secrets they contain. Secrets are replaced with SecretMask, or with a
+// salted hash of their value when a salt is set, so that a changed secret can
+// still be told apart without revealing it.
+type SecretRedactor struct {
+	Salt string
+}
+
+func NewSecretRedactor(salt string) SecretRedactor {
+	return SecretRedactor{Salt: salt}
+}
+
+// Map converts a property map, e.g. the outputs of a resource.
+func (r SecretRedactor) Map(props resource.PropertyMap) map[string]interface{} {
+	values := make(map[string]interface{}, len(props))
+	for key, val := range props {
+		values[string(key)] = r.Value(val)
+	}
+	return values
+}
+
+// Value converts a single property value.
+func (r SecretRedactor) Value(v resource.PropertyValue) interface{} {
+	switch {
+	case v.IsSecret():
+		return r.redact(v.SecretValue().Element)
+	case v.IsOutput() && v.OutputValue().Secret:
+		return r.redact(v.OutputValue().Element)
+	case v.IsArray():
+		arr := v.ArrayValue()
+		values := make([]interface{}, 0, len(arr))
+		for _, elem := range arr {
+			values = append(values, r.Value(elem))
+		}
+		return values
+	case v.IsObject():
+		return r.Map(v.ObjectValue())
+	default:
+		return v.Mappable()
+	}
+}
+
+func (r SecretRedactor) redact(v resource.PropertyValue) string {
+	if r.Salt == "" {
+		return SecretMask
+	}
+	plain, err := json.Marshal(v.Mappable())
+	if err != nil {
+		return SecretMask
+	}
+	hash := sha256.New()
+	hash.Write([]byte(r.Salt))
+	hash.Write(plain)
+	return SecretHashPrefix + hex.EncodeToString(hash.Sum(nil)) + "]"
+}
+
+// RawStepMetadata returns the metadata of a step with the raw inputs and
+// outputs of its states. The engine filters the inputs and outputs of step
+// events for display, which turns secrets into plain "[secret]" strings, so
+// they could neither be hashed nor told apart from other values. Steps built
+// from a checkpoint already hold the raw values, so both modes serialize the
+// same secret the same way.
+func RawStepMetadata(step engine.StepEventMetadata) engine.StepEventMetadata {
+	step.Old = rawStateMetadata(step.Old)
+	step.New = rawStateMetadata(step.New)
+	step.Res = rawStateMetadata(step.Res)
+	return step
+}
+
+func rawStateMetadata(state *engine.StepEventStateMetadata) *engine.StepEventStateMetadata {
+	if state == nil || state.State == nil {
+		return state
+	}
+	raw := *state
+	raw.Inputs = state.State.Inputs
+	raw.Outputs = state.State.Outputs
+	return &raw
+}
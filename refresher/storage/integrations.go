@@ -0,0 +1,13 @@
+package storage
+
+// GcpIntegration is the integration of a GCP project.
+type GcpIntegration struct {
+	ID        string
+	ProjectId string
+}
+
+// AzureIntegration is the integration of an Azure subscription.
+type AzureIntegration struct {
+	ID             string
+	SubscriptionId string
+}
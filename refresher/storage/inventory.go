@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	goKitDynamo "github.com/infralight/go-kit/db/dynamo"
+	"github.com/infralight/go-kit/db/elasticsearch"
+	"github.com/infralight/go-kit/db/mongo"
+	"github.com/infralight/pulumi/refresher/config"
+	"github.com/infralight/pulumi/refresher/metrics"
+	"github.com/infralight/pulumi/refresher/utils"
+	"github.com/rs/zerolog"
+	"github.com/thoas/go-funk"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	dynamoChunkSize = 25
+)
+
+// InventoryStore holds everything the mapper reads from and writes to besides
+// the output files: integrations, stack records, the IaC assets index and the
+// engine accumulator.
+type InventoryStore interface {
+	ListAWSIntegrations(ctx context.Context, accountId string) ([]mongo.AwsIntegration, error)
+	ListK8SIntegrations(ctx context.Context, accountId string) ([]mongo.K8sIntegration, error)
+	ListGCPIntegrations(ctx context.Context, accountId string) ([]GcpIntegration, error)
+	ListAzureIntegrations(ctx context.Context, accountId string) ([]AzureIntegration, error)
+	GetStack(ctx context.Context, accountId, stackId string) (*mongo.GlobalStack, error)
+	UpdateStack(ctx context.Context, accountId, stackId string, update bson.M) error
+	UpdateStateFileDeleted(ctx context.Context, accountId, stackId string) error
+	UpdateEmptyStateFile(ctx context.Context, accountId, stackId string) error
+	DeleteIacAssets(ctx context.Context, accountId, integrationId, stackId string, assetIds []string) error
+	GetK8sIntegrationIds(ctx context.Context, accountId string, uids, kinds []string) ([]string, error)
+	TriggerAtrs(ctx context.Context, accountId string, atrs []string) error
+}
+
+// NewInventoryStore returns the inventory store selected by the configuration.
+func NewInventoryStore(cfg *config.Config, logger *zerolog.Logger) (InventoryStore, error) {
+	switch cfg.InventoryStoreType {
+	case config.DatabaseInventoryStore:
+		return NewDatabaseInventoryStore(cfg, logger)
+	case config.MemoryInventoryStore:
+		return NewMemoryInventoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unsupported inventory store %s", cfg.InventoryStoreType)
+	}
+}
+
+// DatabaseInventoryStore is the production InventoryStore backed by MongoDB,
+// Elasticsearch and the DynamoDB engine accumulator.
+type DatabaseInventoryStore struct {
+	MongoDb *mongo.Client
+	ES      *elasticsearch.Client
+	Config  *config.Config
+	Logger  *zerolog.Logger
+}
+
+func NewDatabaseInventoryStore(cfg *config.Config, logger *zerolog.Logger) (*DatabaseInventoryStore, error) {
+	var err error
+
+	store := &DatabaseInventoryStore{
+		Config: cfg,
+		Logger: logger,
+	}
+
+	store.MongoDb, err = mongo.NewClient(cfg.MongoURI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to mongoDB: %v", err)
+	}
+
+	store.ES, err = elasticsearch.NewClient(cfg.ElasticsearchUrl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create to ES client: %v", err)
+	}
+
+	return store, nil
+}
+
+func (s *DatabaseInventoryStore) ListAWSIntegrations(ctx context.Context, accountId string) ([]mongo.AwsIntegration, error) {
+	return s.MongoDb.ListAWSIntegrations(ctx, accountId)
+}
+
+func (s *DatabaseInventoryStore) ListK8SIntegrations(ctx context.Context, accountId string) ([]mongo.K8sIntegration, error) {
+	return s.MongoDb.ListK8SIntegrations(ctx, accountId)
+}
+
+func (s *DatabaseInventoryStore) GetStack(ctx context.Context, accountId, stackId string) (*mongo.GlobalStack, error) {
+	return s.MongoDb.GetStack(ctx, accountId, stackId, nil)
+}
+
+func (s *DatabaseInventoryStore) UpdateStack(ctx context.Context, accountId, stackId string, update bson.M) error {
+	_, err := s.MongoDb.UpdateStack(ctx, accountId, stackId, nil, update)
+	return err
+}
+
+func (s *DatabaseInventoryStore) UpdateStateFileDeleted(ctx context.Context, accountId, stackId string) error {
+	return s.MongoDb.UpdateStateFileDeleted(ctx, accountId, stackId)
+}
+
+func (s *DatabaseInventoryStore) UpdateEmptyStateFile(ctx context.Context, accountId, stackId string) error {
+	return s.MongoDb.UpdateEmptyStateFile(ctx, accountId, stackId)
+}
+
+func (s *DatabaseInventoryStore) DeleteIacAssets(ctx context.Context, accountId, integrationId, stackId string, assetIds []string) error {
+	return s.ES.DeleteIacAssets(fmt.Sprintf("iac-%s", accountId), accountId, integrationId, stackId, assetIds)
+}
+
+func (s *DatabaseInventoryStore) GetK8sIntegrationIds(ctx context.Context, accountId string, uids, kinds []string) ([]string, error) {
+	return utils.GetK8sIntegrationIds(accountId, uids, kinds, s.ES, s.Logger)
+}
+
+// TriggerAtrs writes the given ATRs to the engine accumulator, skipping the
+// ones that were already triggered and did not expire yet.
+func (s *DatabaseInventoryStore) TriggerAtrs(ctx context.Context, accountId string, atrs []string) error {
+	if len(atrs) == 0 {
+		return nil
+	}
+	dynamoClient, err := goKitDynamo.NewClient(s.Config.LoadServiceAwsSession())
+	if err != nil {
+		return fmt.Errorf("failed to load aws session: %w", err)
+	}
+
+	atrsChunks := funk.Chunk(atrs, dynamoChunkSize)
+	for _, chunk := range atrsChunks.([][]string) {
+		var items []string
+		err := utils.Retry(ctx, s.Config.RetryAttempts, func() (err error) {
+			items, err = utils.GetAtrsFromDynamo(accountId, s.Config.EngineAccumulatorDynamo, chunk, dynamoClient)
+			return err
+		})
+		if err != nil {
+			s.Logger.Err(err).Msg("failed to get batch items from dynamodb")
+			continue
+		}
+
+		filteredAtrs, err := utils.DiffDynamoItems(items, chunk, accountId)
+		if err != nil {
+			s.Logger.Err(err).Msg("failed to calculate dynamo diff")
+			continue
+		}
+
+		err = utils.Retry(ctx, s.Config.RetryAttempts, func() error {
+			return utils.WriteAtrsToDynamo(accountId, s.Config.EngineAccumulatorDynamo, filteredAtrs, s.Config.EngineAccumulatorTTL, dynamoClient)
+		})
+		if err != nil {
+			s.Logger.Err(err).Msg("failed to write batch items to dynamo db")
+			continue
+		}
+		metrics.AtrsTriggered(len(filteredAtrs))
+		s.Logger.Info().Int("Records", len(filteredAtrs)).Msg("Successfully wrote chunk to dynamo")
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+//go:build gcpazure
+
+package storage
+
+import (
+	"context"
+)
+
+func (s *DatabaseInventoryStore) ListGCPIntegrations(ctx context.Context, accountId string) ([]GcpIntegration, error) {
+	mongoIntegrations, err := s.MongoDb.ListGCPIntegrations(ctx, accountId)
+	if err != nil {
+		return nil, err
+	}
+	integrations := make([]GcpIntegration, 0, len(mongoIntegrations))
+	for _, integration := range mongoIntegrations {
+		integrations = append(integrations, GcpIntegration{ID: integration.ID, ProjectId: integration.ProjectId})
+	}
+	return integrations, nil
+}
+
+func (s *DatabaseInventoryStore) ListAzureIntegrations(ctx context.Context, accountId string) ([]AzureIntegration, error) {
+	mongoIntegrations, err := s.MongoDb.ListAzureIntegrations(ctx, accountId)
+	if err != nil {
+		return nil, err
+	}
+	integrations := make([]AzureIntegration, 0, len(mongoIntegrations))
+	for _, integration := range mongoIntegrations {
+		integrations = append(integrations, AzureIntegration{ID: integration.ID, SubscriptionId: integration.SubscriptionId})
+	}
+	return integrations, nil
+}
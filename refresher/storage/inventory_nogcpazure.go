@@ -0,0 +1,22 @@
+//go:build !gcpazure
+
+package storage
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNoCloudIntegrations is returned when listing GCP or Azure integrations
+// from the database. go-kit v1.155.0 can't list them, so the GCP and Azure
+// node builders are only built with the gcpazure build tag, along with a
+// go-kit release that can.
+var ErrNoCloudIntegrations = errors.New("gcp and azure integrations need the gcpazure build tag")
+
+func (s *DatabaseInventoryStore) ListGCPIntegrations(ctx context.Context, accountId string) ([]GcpIntegration, error) {
+	return nil, ErrNoCloudIntegrations
+}
+
+func (s *DatabaseInventoryStore) ListAzureIntegrations(ctx context.Context, accountId string) ([]AzureIntegration, error) {
+	return nil, ErrNoCloudIntegrations
+}
@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/infralight/go-kit/db/mongo"
+	"github.com/infralight/go-kit/helpers"
+	"go.mongodb.org/mongo-driver/bson"
+	"sync"
+)
+
+// MemoryInventoryStore is an InventoryStore kept entirely in memory. It lets
+// the mapper run without MongoDB, Elasticsearch and DynamoDB and records every
+// write so tests can assert on them.
+type MemoryInventoryStore struct {
+	mutex sync.Mutex
+
+	AwsIntegrations   []mongo.AwsIntegration
+	K8sIntegrations   []mongo.K8sIntegration
+	GcpIntegrations   []GcpIntegration
+	AzureIntegrations []AzureIntegration
+	Stacks            map[string]*mongo.GlobalStack
+	// StackIds holds the record id of each "org/project/stack"; stacks without
+	// one are identified by that name, since local stacks have no record
+	StackIds map[string]string
+	// K8sUidIntegrations holds the k8s integration that found each resource
+	// uid in its cluster
+	K8sUidIntegrations map[string]string
+	// K8sIntegrationLookups counts the GetK8sIntegrationIds calls
+	K8sIntegrationLookups int
+
+	StackUpdates      map[string][]bson.M
+	DeletedStateFiles []string
+	EmptyStateFiles   []string
+	// CurrentIacAssets holds, per stack, the asset ids passed to the last
+	// DeleteIacAssets call; any other asset of the stack is considered deleted
+	CurrentIacAssets map[string][]string
+	TriggeredAtrs    []string
+}
+
+func NewMemoryInventoryStore() *MemoryInventoryStore {
+	return &MemoryInventoryStore{
+		Stacks:             make(map[string]*mongo.GlobalStack),
+		StackIds:           make(map[string]string),
+		K8sUidIntegrations: make(map[string]string),
+		StackUpdates:       make(map[string][]bson.M),
+		CurrentIacAssets:   make(map[string][]string),
+	}
+}
+
+func (s *MemoryInventoryStore) ListAWSIntegrations(ctx context.Context, accountId string) ([]mongo.AwsIntegration, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.AwsIntegrations, nil
+}
+
+func (s *MemoryInventoryStore) ListK8SIntegrations(ctx context.Context, accountId string) ([]mongo.K8sIntegration, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.K8sIntegrations, nil
+}
+
+func (s *MemoryInventoryStore) ListGCPIntegrations(ctx context.Context, accountId string) ([]GcpIntegration, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.GcpIntegrations, nil
+}
+
+func (s *MemoryInventoryStore) ListAzureIntegrations(ctx context.Context, accountId string) ([]AzureIntegration, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.AzureIntegrations, nil
+}
+
+func (s *MemoryInventoryStore) GetStack(ctx context.Context, accountId, stackId string) (*mongo.GlobalStack, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// stacks mapped locally have no record yet, so they start with an empty one
+	stack, ok := s.Stacks[stackId]
+	if !ok {
+		stack = &mongo.GlobalStack{}
+		s.Stacks[stackId] = stack
+	}
+	return stack, nil
+}
+
+func (s *MemoryInventoryStore) FindStackId(ctx context.Context, accountId, integrationId, organization, project, stack string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	name := fmt.Sprintf("%s/%s/%s", organization, project, stack)
+	if stackId, ok := s.StackIds[name]; ok {
+		return stackId, nil
+	}
+	return name, nil
+}
+
+func (s *MemoryInventoryStore) UpdateStack(ctx context.Context, accountId, stackId string, update bson.M) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.StackUpdates[stackId] = append(s.StackUpdates[stackId], update)
+	return nil
+}
+
+func (s *MemoryInventoryStore) UpdateStateFileDeleted(ctx context.Context, accountId, stackId string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.DeletedStateFiles = append(s.DeletedStateFiles, stackId)
+	return nil
+}
+
+func (s *MemoryInventoryStore) UpdateEmptyStateFile(ctx context.Context, accountId, stackId string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.EmptyStateFiles = append(s.EmptyStateFiles, stackId)
+	return nil
+}
+
+func (s *MemoryInventoryStore) DeleteIacAssets(ctx context.Context, accountId, integrationId, stackId string, assetIds []string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.CurrentIacAssets[stackId] = append([]string(nil), assetIds...)
+	return nil
+}
+
+func (s *MemoryInventoryStore) GetK8sIntegrationIds(ctx context.Context, accountId string, uids, kinds []string) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.K8sIntegrationLookups++
+	var integrationIds []string
+	for _, uid := range uids {
+		integrationId, ok := s.K8sUidIntegrations[uid]
+		if ok && !helpers.StringSliceContains(integrationIds, integrationId) {
+			integrationIds = append(integrationIds, integrationId)
+		}
+	}
+	return integrationIds, nil
+}
+
+func (s *MemoryInventoryStore) TriggerAtrs(ctx context.Context, accountId string, atrs []string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.TriggeredAtrs = append(s.TriggeredAtrs, atrs...)
+	return nil
+}
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/infralight/pulumi/refresher/config"
+	"github.com/infralight/pulumi/refresher/metrics"
+	"github.com/infralight/pulumi/refresher/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// ErrNotFound is returned when reading a file that was never written.
+var ErrNotFound = errors.New("file not found")
+
+// Sink persists the files produced by a mapper run (e.g. iac_objects.jsonl),
+// and reads back the ones written by previous runs.
+type Sink interface {
+	Write(ctx context.Context, path string, content []byte, contentType string) error
+	Read(ctx context.Context, path string) ([]byte, error)
+}
+
+func NewSink(cfg *config.Config) (Sink, error) {
+	switch cfg.SinkType {
+	case config.S3Sink:
+		return NewS3Sink(cfg), nil
+	case config.FileSink:
+		return NewFileSink(cfg.OutputDir), nil
+	case config.MemorySink:
+		return NewMemorySink(), nil
+	default:
+		return nil, fmt.Errorf("unsupported sink type %s", cfg.SinkType)
+	}
+}
+
+// S3Sink writes files to the fetched resources bucket.
+type S3Sink struct {
+	cfg *config.Config
+}
+
+func NewS3Sink(cfg *config.Config) *S3Sink {
+	return &S3Sink{cfg: cfg}
+}
+
+func (s *S3Sink) Write(ctx context.Context, path string, content []byte, contentType string) error {
+	err := utils.Retry(ctx, s.cfg.RetryAttempts, func() error {
+		return utils.WriteFile(s.cfg, path, content, contentType)
+	})
+	if err == nil {
+		metrics.S3BytesWritten(len(content))
+	}
+	return err
+}
+
+func (s *S3Sink) Read(ctx context.Context, path string) ([]byte, error) {
+	var content []byte
+	err := utils.Retry(ctx, s.cfg.RetryAttempts, func() (err error) {
+		content, err = utils.ReadFile(s.cfg, path)
+		return err
+	})
+	if errors.Is(err, utils.ErrNoSuchKey) {
+		return nil, ErrNotFound
+	}
+	return content, err
+}
+
+// FileSink writes files under a local directory, keeping the same relative
+// paths that would have been used in S3.
+type FileSink struct {
+	Dir string
+}
+
+func NewFileSink(dir string) *FileSink {
+	return &FileSink{Dir: dir}
+}
+
+func (s *FileSink) Write(ctx context.Context, path string, content []byte, contentType string) error {
+	fullPath := filepath.Join(s.Dir, filepath.FromSlash(path))
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", fullPath, err)
+	}
+	return os.WriteFile(fullPath, content, 0644)
+}
+
+func (s *FileSink) Read(ctx context.Context, path string) ([]byte, error) {
+	content, err := os.ReadFile(filepath.Join(s.Dir, filepath.FromSlash(path)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return content, err
+}
+
+// MemorySink keeps written files in memory, mostly for tests.
+type MemorySink struct {
+	mutex sync.Mutex
+	files map[string][]byte
+}
+
+func NewMemorySink() *MemorySink {
+	return &MemorySink{files: make(map[string][]byte)}
+}
+
+func (s *MemorySink) Write(ctx context.Context, path string, content []byte, contentType string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.files[path] = append([]byte(nil), content...)
+	return nil
+}
+
+func (s *MemorySink) Read(ctx context.Context, path string) ([]byte, error) {
+	content, ok := s.Get(path)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return content, nil
+}
+
+// Get returns the content written to path and whether it exists.
+func (s *MemorySink) Get(path string) ([]byte, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	content, ok := s.files[path]
+	return content, ok
+}
+
+// Paths returns the sorted paths written so far.
+func (s *MemorySink) Paths() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	paths := make([]string, 0, len(s.files))
+	for path := range s.files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
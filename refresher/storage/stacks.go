@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/infralight/pulumi/refresher/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	mongodriver "go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
+)
+
+// stacksCollection is the collection of the Firefly stack records.
+const stacksCollection = "global_stacks"
+
+// ErrStackNotFound is returned when a Pulumi stack has no Firefly stack record.
+var ErrStackNotFound = errors.New("stack not found")
+
+// StackFinder resolves the Firefly stack record of a Pulumi stack, whose id is
+// the stack id of the mapper jobs.
+type StackFinder interface {
+	FindStackId(ctx context.Context, accountId, integrationId, organization, project, stack string) (string, error)
+}
+
+// NewStackFinder returns the stack finder of the inventory store selected by
+// the configuration.
+func NewStackFinder(ctx context.Context, cfg *config.Config) (StackFinder, error) {
+	switch cfg.InventoryStoreType {
+	case config.DatabaseInventoryStore:
+		return NewMongoStackFinder(ctx, cfg.MongoURI)
+	case config.MemoryInventoryStore:
+		return NewMemoryInventoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unsupported inventory store %s", cfg.InventoryStoreType)
+	}
+}
+
+// MongoStackFinder finds the stack records in the database of the MongoDB URI.
+type MongoStackFinder struct {
+	Stacks *mongodriver.Collection
+}
+
+func NewMongoStackFinder(ctx context.Context, uri string) (*MongoStackFinder, error) {
+	cs, err := connstring.ParseAndValidate(uri)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse mongoDB uri: %w", err)
+	}
+	client, err := mongodriver.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to mongoDB: %w", err)
+	}
+	return &MongoStackFinder{Stacks: client.Database(cs.Database).Collection(stacksCollection)}, nil
+}
+
+func (f *MongoStackFinder) FindStackId(ctx context.Context, accountId, integrationId, organization, project, stack string) (string, error) {
+	integrationObjectId, err := primitive.ObjectIDFromHex(integrationId)
+	if err != nil {
+		return "", fmt.Errorf("invalid integration id %s: %w", integrationId, err)
+	}
+	var record struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	err = f.Stacks.FindOne(ctx, bson.M{
+		"accountId":          accountId,
+		"integrationId":      integrationObjectId,
+		"pulumiOrganization": organization,
+		"pulumiProject":      project,
+		"stackName":          stack,
+	}, options.FindOne().SetProjection(bson.M{"_id": 1})).Decode(&record)
+	if errors.Is(err, mongodriver.ErrNoDocuments) {
+		return "", ErrStackNotFound
+	} else if err != nil {
+		return "", fmt.Errorf("failed to find stack: %w", err)
+	}
+	return record.ID.Hex(), nil
+}
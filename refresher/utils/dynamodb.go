@@ -60,6 +60,10 @@ func WriteAtrsToDynamo(accountId, tableName string, atrs []string, dynamoTTL int
 			providerType = "aws"
 		} else if strings.HasPrefix(assetType, "kubernetes") {
 			providerType = "k8s"
+		} else if strings.HasPrefix(assetType, "google") {
+			providerType = "gcp"
+		} else if strings.HasPrefix(assetType, "azurerm") {
+			providerType = "azure"
 		}
 
 		currentTimeStamp := time.Now().Unix()
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"math/rand"
+	"time"
+)
+
+const (
+	retryInitialBackoff = time.Second
+	retryMaxBackoff     = 30 * time.Second
+)
+
+// Retry calls fn until it succeeds, up to the given number of attempts,
+// backing off exponentially (with jitter) between attempts. It gives up early
+// on errors that aren't transient, or once ctx is done.
+func Retry(ctx context.Context, attempts int, fn func() error) error {
+	if attempts < 1 {
+		attempts = 1
+	}
+	backoff := retryInitialBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil || attempt >= attempts || !IsTransient(err) {
+			return err
+		}
+
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		if backoff *= 2; backoff > retryMaxBackoff {
+			backoff = retryMaxBackoff
+		}
+	}
+}
+
+// IsTransient returns whether err may succeed when retried. Errors from the
+// Pulumi Service and AWS are transient when throttled or on server errors,
+// while other errors (e.g. network errors) are assumed to be transient.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, ErrNoSuchKey) {
+		return false
+	}
+
+	var apiErr *apitype.ErrorResponse
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == 429 || apiErr.Code >= 500
+	}
+
+	var awsRequestErr awserr.RequestFailure
+	if errors.As(err, &awsRequestErr) {
+		return request.IsErrorRetryable(awsRequestErr) || request.IsErrorThrottle(awsRequestErr) ||
+			awsRequestErr.StatusCode() == 429 || awsRequestErr.StatusCode() >= 500
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		return request.IsErrorRetryable(awsErr) || request.IsErrorThrottle(awsErr)
+	}
+	return true
+}
+
+// IsNotFound returns whether err tells that what was requested definitely does
+// not exist, as opposed to it failing to be read.
+func IsNotFound(err error) bool {
+	if errors.Is(err, ErrNoSuchKey) {
+		return true
+	}
+	var apiErr *apitype.ErrorResponse
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == 404
+	}
+	var awsRequestErr awserr.RequestFailure
+	if errors.As(err, &awsRequestErr) {
+		return awsRequestErr.StatusCode() == 404
+	}
+	return false
+}
@@ -4,16 +4,16 @@ import (
 	"bytes"
 	"errors"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/infralight/pulumi/refresher/config"
+	"io"
 )
 
+var ErrNoSuchKey = errors.New("no such key")
+
 func WriteFile(cfg *config.Config, path string, content []byte, fileType string) (err error) {
-	awsSession := cfg.LoadAwsSession()
-	if awsSession == nil {
-		return errors.New("failed to create AWS session.")
-	}
-	svc := s3.New(awsSession)
+	svc := s3.New(cfg.LoadServiceAwsSession())
 
 	_, err = svc.PutObject(
 		&s3.PutObjectInput{
@@ -25,3 +25,23 @@ func WriteFile(cfg *config.Config, path string, content []byte, fileType string)
 		})
 	return err
 }
+
+// ReadFile reads a file from the fetched resources bucket.
+func ReadFile(cfg *config.Config, path string) ([]byte, error) {
+	svc := s3.New(cfg.LoadServiceAwsSession())
+
+	output, err := svc.GetObject(
+		&s3.GetObjectInput{
+			Bucket: aws.String(cfg.FetchedResourcesBucket),
+			Key:    aws.String(path),
+		})
+	if err != nil {
+		var awsErr awserr.Error
+		if errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, ErrNoSuchKey
+		}
+		return nil, err
+	}
+	defer output.Body.Close()
+	return io.ReadAll(output.Body)
+}
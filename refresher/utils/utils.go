@@ -1,19 +1,34 @@
 package utils
 
 import (
+	"bytes"
 	"encoding/json"
-	"github.com/thoas/go-funk"
+	"fmt"
 )
 
-
-func ToJsonLines (nodes []map[string]interface{}) (jsonLines []byte,err  error){
-	funk.ForEach(nodes, func(node map[string]interface{}){
-		nodeBytes, err  := json.Marshal(node)
-		if err != nil{
-			return
+// ToJsonLines serializes the nodes as json lines, failing on the first node
+// that can't be marshaled.
+func ToJsonLines(nodes []map[string]interface{}) (jsonLines []byte, err error) {
+	for i, node := range nodes {
+		nodeBytes, err := json.Marshal(node)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal node %d: %w", i, err)
 		}
-		nodeBytes = append(nodeBytes,  []byte{'\n'}...)
 		jsonLines = append(jsonLines, nodeBytes...)
-	})
+		jsonLines = append(jsonLines, '\n')
+	}
 	return jsonLines, nil
 }
+
+// FromJsonLines parses the nodes written by ToJsonLines.
+func FromJsonLines(jsonLines []byte) (nodes []map[string]interface{}, err error) {
+	decoder := json.NewDecoder(bytes.NewReader(jsonLines))
+	for decoder.More() {
+		var node map[string]interface{}
+		if err = decoder.Decode(&node); err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}